@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// AccessLogConfig writes a line for every request of the listeners, apart
+// from the log of the load balancer itself
+type AccessLogConfig struct {
+	// stdout, stderr or the path of a file the lines are appended to. Empty
+	// turns the access log off.
+	Output string `yaml:"output,omitempty"`
+	// common (the default), combined, json, or a text/template over the
+	// fields of accessEntry like "{{.Method}} {{.Path}} {{.Status}}"
+	Format string `yaml:"format,omitempty"`
+	// of the file output, see logfile.go
+	Rotation `yaml:",inline"`
+}
+
+// accessEntry is one request of the access log. The proxy fills in the
+// backend while the request goes through it.
+type accessEntry struct {
+	Time     time.Time     `json:"time"`
+	Client   string        `json:"client"`
+	Method   string        `json:"method"`
+	Host     string        `json:"host"`
+	Path     string        `json:"path"`
+	URI      string        `json:"uri"`
+	Proto    string        `json:"proto"`
+	Status   int           `json:"status"`
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"-"`
+	Referer  string        `json:"referer,omitempty"`
+	Agent    string        `json:"user_agent,omitempty"`
+	Listener string        `json:"listener"`
+	Route    string        `json:"route,omitempty"`
+	Pool     string        `json:"pool,omitempty"`
+	// the backend of the last attempt, empty when none was tried
+	Backend  string `json:"backend,omitempty"`
+	Attempts int    `json:"attempts"`
+	// the id of request_id_header, empty when it is off
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// the duration for templates and the json line
+func (e *accessEntry) Ms() float64 {
+	return float64(e.Duration.Microseconds()) / 1000
+}
+
+func (e *accessEntry) MarshalJSON() ([]byte, error) {
+	type entry accessEntry
+	return json.Marshal(struct {
+		*entry
+		DurationMs float64 `json:"duration_ms"`
+	}{(*entry)(e), e.Ms()})
+}
+
+// the host of the client without the port, "-" when there is none
+func (e *accessEntry) ClientIP() string {
+	if host, _, err := net.SplitHostPort(e.Client); err == nil {
+		return host
+	}
+	if e.Client == "" {
+		return "-"
+	}
+	return e.Client
+}
+
+const (
+	commonLogFormat   = `{{.ClientIP}} - - [{{.Time.Format "02/Jan/2006:15:04:05 -0700"}}] "{{.Method}} {{.URI}} {{.Proto}}" {{.Status}} {{.Bytes}}`
+	combinedLogFormat = commonLogFormat + ` "{{or .Referer "-"}}" "{{or .Agent "-"}}"`
+)
+
+// accessLogger writes the lines of an access log config
+type accessLogger struct {
+	config AccessLogConfig
+	// nil for json
+	tmpl *template.Template
+
+	mu   sync.Mutex
+	out  io.Writer
+	file *rotatingFile
+}
+
+func (a AccessLogConfig) template() (*template.Template, error) {
+	text := a.Format
+	switch a.Format {
+	case "json":
+		return nil, nil
+	case "", "common":
+		text = commonLogFormat
+	case "combined":
+		text = combinedLogFormat
+	}
+	tmpl, err := template.New("access_log").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("access_log: format: %w", err)
+	}
+	// a field that doesnt exist only shows when the template runs
+	if err := tmpl.Execute(io.Discard, &accessEntry{}); err != nil {
+		return nil, fmt.Errorf("access_log: format: %w", err)
+	}
+	return tmpl, nil
+}
+
+func (a AccessLogConfig) Validate() error {
+	if a.Output == "" && a.Format != "" {
+		return fmt.Errorf("access_log: format needs an output")
+	}
+	if (a.Output == "" || a.Output == "stdout" || a.Output == "stderr") && a.Rotation.Enabled() {
+		return fmt.Errorf("access_log: rotation needs a file output")
+	}
+	if err := a.Rotation.Validate("access_log"); err != nil {
+		return err
+	}
+	_, err := a.template()
+	return err
+}
+
+// the logger of the config, the one of the previous pools when the config
+// didnt change so the file stays open. nil without an output.
+func newAccessLogger(a AccessLogConfig, previous *Pools) (*accessLogger, error) {
+	if a.Output == "" {
+		return nil, nil
+	}
+	if previous != nil && previous.accessLog != nil && previous.accessLog.config == a {
+		return previous.accessLog, nil
+	}
+	tmpl, err := a.template()
+	if err != nil {
+		return nil, err
+	}
+	l := &accessLogger{config: a, tmpl: tmpl}
+	switch a.Output {
+	case "stdout":
+		l.out = os.Stdout
+	case "stderr":
+		l.out = os.Stderr
+	default:
+		l.file, err = openRotatingFile(a.Output, a.Rotation)
+		if err != nil {
+			return nil, fmt.Errorf("access_log: %w", err)
+		}
+		l.out = l.file
+	}
+	return l, nil
+}
+
+func (l *accessLogger) Log(e *accessEntry) {
+	var line bytes.Buffer
+	var err error
+	if l.tmpl == nil {
+		err = json.NewEncoder(&line).Encode(e)
+	} else {
+		err = l.tmpl.Execute(&line, e)
+		line.WriteByte('\n')
+	}
+	if err != nil {
+		warnf("Access log: %s\n", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(line.Bytes())
+}
+
+// close the file of a logger that was replaced by a reload
+func (l *accessLogger) Close() {
+	if l == nil || l.file == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.file.Close()
+}
+
+// start the access log entry of a request, nil without an access log
+func startAccessEntry(l *accessLogger, address string, r *http.Request) *accessEntry {
+	if l == nil {
+		return nil
+	}
+	return &accessEntry{
+		Time:     time.Now(),
+		Client:   r.RemoteAddr,
+		Method:   r.Method,
+		Host:     r.Host,
+		Path:     r.URL.Path,
+		URI:      r.RequestURI,
+		Proto:    r.Proto,
+		Referer:  r.Referer(),
+		Agent:    r.UserAgent(),
+		Listener: address,
+
+		RequestID: GetRequestIDFromContext(r),
+	}
+}
+
+// the entry of a request, set by the listener for the proxy to fill in
+func GetAccessEntryFromContext(r *http.Request) *accessEntry {
+	e, _ := r.Context().Value(AccessEntry).(*accessEntry)
+	return e
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AdminConfig turns on the admin api, served under /admin/ on the listeners
+// or on its own address
+type AdminConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// host:port or unix:/path/to.sock to serve the admin api on instead of
+	// the traffic listeners
+	Address string `yaml:"address,omitempty"`
+	// bearer token and/or basic auth credentials every admin request must
+	// carry, the api is open when none are set
+	Token    string `yaml:"token,omitempty"`
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	// applied configs kept to roll back to
+	History int `yaml:"history"`
+	// how often the pools are snapshotted and how long snapshots are kept
+	SnapshotInterval  time.Duration `yaml:"snapshot_interval"`
+	SnapshotRetention time.Duration `yaml:"snapshot_retention"`
+	// serve the go profiler under /admin/debug/pprof/
+	Pprof bool `yaml:"pprof,omitempty"`
+	// where the changes made through the api are recorded
+	AuditLog AuditLogConfig `yaml:"audit_log,omitempty"`
+}
+
+func (a AdminConfig) Validate() error {
+	if a.History < 1 {
+		return fmt.Errorf("admin: history must be at least 1")
+	}
+	if a.Address != "" {
+		if _, _, err := adminNetwork(a.Address); err != nil {
+			return err
+		}
+	}
+	if (a.Username == "") != (a.Password == "") {
+		return fmt.Errorf("admin: username and password go together")
+	}
+	if a.SnapshotInterval <= 0 || a.SnapshotRetention <= 0 {
+		return fmt.Errorf("admin: snapshot_interval and snapshot_retention must be positive")
+	}
+	return a.AuditLog.Validate()
+}
+
+// the admin api endpoints
+func newAdminHandler(r *reloader) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/scheduled", r.handleListScheduled)
+	mux.HandleFunc("DELETE /admin/scheduled/{name}", r.handleCancelScheduled)
+	mux.HandleFunc("GET /admin/backends", handleListBackends)
+	mux.HandleFunc("POST /admin/backends", r.handleAddBackend)
+	mux.HandleFunc("GET /admin/backends/{id}", handleGetBackend)
+	mux.HandleFunc("DELETE /admin/backends/{id}", r.handleRemoveBackend)
+	mux.HandleFunc("POST /admin/backends/{id}/drain", handleDrain)
+	mux.HandleFunc("DELETE /admin/backends/{id}/drain", handleDrain)
+	mux.HandleFunc("GET /admin/listeners", handleListeners)
+	mux.HandleFunc("GET /admin/pools/{name}/strategy", handleGetStrategy)
+	mux.HandleFunc("PUT /admin/pools/{name}/strategy", handleSetStrategy)
+	mux.HandleFunc("DELETE /admin/pools/{name}/strategy", handleSetStrategy)
+	mux.HandleFunc("GET /admin/usage", handleUsage)
+	mux.HandleFunc("GET /admin/maintenance", handleGetMaintenance)
+	mux.HandleFunc("POST /admin/maintenance", handleMaintenance)
+	mux.HandleFunc("DELETE /admin/maintenance", handleMaintenance)
+	mux.HandleFunc("GET /admin/log-level", handleGetLogLevel)
+	mux.HandleFunc("PUT /admin/log-level", handleSetLogLevel)
+	mux.HandleFunc("PATCH /admin/backends/{id}", handlePatchBackend)
+	mux.HandleFunc("POST /admin/backends/{id}/disable", handleDisable)
+	mux.HandleFunc("DELETE /admin/backends/{id}/disable", handleDisable)
+	mux.HandleFunc("GET /admin/ready", handleReady)
+	mux.HandleFunc("GET /admin/watchdog", handleWatchdog)
+	mux.HandleFunc("GET /admin/snapshots", handleSnapshots)
+	mux.HandleFunc("GET /admin/snapshots/diff", handleSnapshotDiff)
+	mux.HandleFunc("GET /admin/status", handleStatus)
+	mux.HandleFunc("GET /admin/events", handleEvents)
+	mux.HandleFunc("GET /admin/dashboard", handleDashboard)
+	mux.HandleFunc("GET /admin/metrics", handleMetrics)
+	mux.HandleFunc("GET /admin/latency", handleLatency)
+	mux.HandleFunc("GET /admin/config", r.handleActiveConfig)
+	mux.HandleFunc("GET /admin/config/versions", r.handleVersions)
+	mux.HandleFunc("POST /admin/config/rollback/{version}", r.handleRollback)
+	mux.HandleFunc("GET /admin/debug/pprof/", r.handlePprof)
+	return r.adminAuth(mux)
+}
+
+// the network and address to listen on for an admin address
+func adminNetwork(address string) (string, string, error) {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		if path == "" {
+			return "", "", fmt.Errorf("admin: address %q has no socket path", address)
+		}
+		return "unix", path, nil
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", "", fmt.Errorf("admin: address %q: %w", address, err)
+	}
+	return "tcp", address, nil
+}
+
+// serve the admin api on its own address, only the /admin/ paths
+func serveAdmin(address string, admin http.Handler) error {
+	if _, _, err := adminNetwork(address); err != nil {
+		return err
+	}
+	ln, err := listenAddress(address, 0)
+	if err != nil {
+		return err
+	}
+	infof("Admin api started at: %s\n", address)
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", admin)
+	return http.Serve(ln, recoverPanics(mux))
+}
+
+// send the admin requests to admin, everything else to next
+func withAdmin(admin, next http.Handler) http.Handler {
+	if admin == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/admin" || strings.HasPrefix(r.URL.Path, "/admin/") {
+			admin.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
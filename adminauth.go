@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// check the credentials of every admin request and log the ones that change
+// something, to the audit log too. The credentials come from the running
+// config, so a reload can rotate them.
+func (r *reloader) adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		admin := r.Current().Admin
+		audit := activePools.Load().auditLog
+		who, ok := admin.authenticate(req)
+		if !ok {
+			warnf("Admin: denied %s %s from %s\n", req.Method, req.URL.Path, req.RemoteAddr)
+			if entry := startAuditEntry(audit, nil, "", req); entry != nil {
+				entry.Status = http.StatusUnauthorized
+				writeAudit(audit, entry)
+			}
+			if admin.Username != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="lb admin"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			next.ServeHTTP(w, req)
+			return
+		}
+		entry := startAuditEntry(audit, next, who, req)
+		sw := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sw, req)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		infof("Admin: %s %s by %s from %s -> %d\n", req.Method, req.URL.Path, who, req.RemoteAddr, sw.status)
+		if entry != nil {
+			entry.Status = sw.status
+			writeAudit(audit, entry)
+		}
+	})
+}
+
+func writeAudit(l *auditLogger, e *auditEntry) {
+	if err := l.Log(e); err != nil {
+		errorf("Admin: audit log: %s\n", err)
+	}
+}
+
+// who made the request, false when credentials are configured and the
+// request doesnt carry them
+func (a AdminConfig) authenticate(req *http.Request) (string, bool) {
+	if a.Token == "" && a.Username == "" {
+		return "anonymous", true
+	}
+	if a.Token != "" {
+		if token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); ok && secretEqual(token, a.Token) {
+			return "token", true
+		}
+	}
+	if a.Username != "" {
+		if user, pass, ok := req.BasicAuth(); ok && secretEqual(user, a.Username) && secretEqual(pass, a.Password) {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+func secretEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+
+	"gopkg.in/yaml.v3"
+)
+
+// runtimeBackends are the backends added and removed through the admin api.
+// They are laid over every config that is applied, file reloads included,
+// until the process restarts.
+type runtimeBackends struct {
+	// pool -> backends added
+	added map[string][]BackendConfig
+	// pool -> urls removed. A removed backend stays out even if the file
+	// lists it, until it is added again.
+	removed map[string]map[string]bool
+}
+
+func (rt runtimeBackends) copy() runtimeBackends {
+	next := runtimeBackends{
+		added:   make(map[string][]BackendConfig),
+		removed: make(map[string]map[string]bool),
+	}
+	for pool, list := range rt.added {
+		next.added[pool] = append([]BackendConfig(nil), list...)
+	}
+	for pool, urls := range rt.removed {
+		next.removed[pool] = make(map[string]bool)
+		for u := range urls {
+			next.removed[pool][u] = true
+		}
+	}
+	return next
+}
+
+// lay the runtime changes over cfg. Doing it twice changes nothing.
+func (rt runtimeBackends) apply(cfg *Config) {
+	for name, pc := range cfg.effectivePools() {
+		if len(rt.added[name]) == 0 && len(rt.removed[name]) == 0 {
+			continue
+		}
+		var backends []BackendConfig
+		present := make(map[string]bool)
+		for _, bc := range pc.Backends {
+			key := backendKey(bc.URL)
+			if !rt.removed[name][key] {
+				backends = append(backends, bc)
+				present[key] = true
+			}
+		}
+		for _, bc := range rt.added[name] {
+			if !present[backendKey(bc.URL)] {
+				backends = append(backends, bc)
+			}
+		}
+		cfg.setPoolBackends(name, backends)
+	}
+}
+
+// the url in the form used to compare backends
+func backendKey(raw string) string {
+	u, err := parseBackendURL(raw)
+	if err != nil {
+		return raw
+	}
+	return u.String()
+}
+
+// the id of a backend in the admin api, stable as long as its pool and url
+// dont change
+func backendID(pool, url string) string {
+	sum := sha256.Sum256([]byte(pool + " " + backendKey(url)))
+	return hex.EncodeToString(sum[:6])
+}
+
+// a copy of the config that can get other backends without touching c
+func (c *Config) clone() *Config {
+	next := *c
+	next.Pools = make(map[string]PoolConfig, len(c.Pools))
+	for name, pc := range c.Pools {
+		next.Pools[name] = pc
+	}
+	return &next
+}
+
+// replace the backends of a pool, the top level ones for the default pool
+// when it comes from there
+func (c *Config) setPoolBackends(name string, backends []BackendConfig) {
+	if name == defaultPoolName && len(c.Backends) > 0 {
+		c.Backends = backends
+		return
+	}
+	pc := c.Pools[name]
+	pc.Backends = backends
+	c.Pools[name] = pc
+}
+
+// change the runtime backends and apply the result to the running config
+func (r *reloader) changeBackends(source string, change func(rt *runtimeBackends) error) error {
+	r.changing.Lock()
+	defer r.changing.Unlock()
+
+	next := r.runtime.copy()
+	if err := change(&next); err != nil {
+		return err
+	}
+	cfg := r.current.Load().clone()
+	next.apply(cfg)
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	changes, ok := applyConfig(r.current.Load(), cfg)
+	if !ok {
+		return fmt.Errorf("the new backends could not be applied, see the log")
+	}
+	r.runtime = next
+	r.current.Store(cfg)
+	r.record(cfg, source, changes)
+	return nil
+}
+
+type backendJSON struct {
+	ID       string `json:"id"`
+	Pool     string `json:"pool"`
+	URL      string `json:"url"`
+	Alive    bool   `json:"alive"`
+	Weight   int    `json:"weight"`
+	InFlight int64  `json:"in_flight"`
+	// websocket connections open to the backend, part of in_flight
+	WebSockets int64 `json:"websockets"`
+	// connections open to the backend, idle ones included
+	Connections int64 `json:"connections"`
+	// active, draining or drained
+	Status string `json:"status"`
+	// closed, open or half-open, left out without a circuit breaker
+	Circuit string `json:"circuit,omitempty"`
+	// kept out by outlier detection
+	Ejected bool `json:"ejected,omitempty"`
+	// kept down after failing requests, see quarantine.go
+	Quarantined bool `json:"quarantined,omitempty"`
+}
+
+func newBackendJSON(pool string, b *Backend) backendJSON {
+	return backendJSON{
+		ID:          backendID(pool, b.URL.String()),
+		Pool:        pool,
+		URL:         b.URL.String(),
+		Alive:       b.IsAlive(),
+		Weight:      b.Weight(),
+		InFlight:    b.inFlight.Load(),
+		WebSockets:  b.websockets.Load(),
+		Connections: b.conns.open.Load(),
+		Status:      b.Status(),
+		Circuit:     b.CircuitState(),
+		Ejected:     b.Ejected(),
+		Quarantined: b.Quarantined(),
+	}
+}
+
+// find a backend of the active pools by its id
+func findBackend(id string) (string, *Backend) {
+	for _, pool := range activePools.Load().All() {
+		for _, b := range pool.backends {
+			if backendID(pool.name, b.URL.String()) == id {
+				return pool.name, b
+			}
+		}
+	}
+	return "", nil
+}
+
+// GET /admin/backends
+func handleListBackends(w http.ResponseWriter, req *http.Request) {
+	list := []backendJSON{}
+	for _, pool := range activePools.Load().All() {
+		for _, b := range pool.backends {
+			list = append(list, newBackendJSON(pool.name, b))
+		}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// POST /admin/backends, the body has the same keys as a backend in the
+// config file plus the pool (the default pool if left out)
+func (r *reloader) handleAddBackend(w http.ResponseWriter, req *http.Request) {
+	// without the UnmarshalYAML of BackendConfig, which would take the
+	// whole body and ignore unknown keys
+	type plain BackendConfig
+	var body struct {
+		Pool  string `yaml:"pool"`
+		plain `yaml:",inline"`
+	}
+	data, err := io.ReadAll(io.LimitReader(req.Body, 1<<20))
+	if err == nil {
+		// json is yaml, so the keys and values are the ones of the config file
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&body)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if body.URL == "" {
+		writeError(w, http.StatusBadRequest, "url is required")
+		return
+	}
+	// decoded again for the keys the body sets, so a 0 or false in it wins
+	// over the defaults block
+	bc := BackendConfig(body.plain)
+	var node yaml.Node
+	if yaml.Unmarshal(data, &node) == nil {
+		bc.markSet(&node)
+	}
+	pool := body.Pool
+	if pool == "" {
+		pool = r.Current().defaultPool()
+	}
+	if activePools.Load().Get(pool) == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown pool %q", pool))
+		return
+	}
+
+	err = r.changeBackends("admin: add backend "+body.URL, func(rt *runtimeBackends) error {
+		key := backendKey(body.URL)
+		for _, b := range activePools.Load().Get(pool).backends {
+			if b.URL.String() == key {
+				return fmt.Errorf("pool %s already has backend %s", pool, key)
+			}
+		}
+		delete(rt.removed[pool], key)
+		rt.added[pool] = append(rt.added[pool], bc)
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	infof("Admin: added backend %s to pool %s\n", body.URL, pool)
+
+	_, b := findBackend(backendID(pool, body.URL))
+	if b == nil {
+		writeError(w, http.StatusInternalServerError, "backend not found after adding it")
+		return
+	}
+	writeJSON(w, http.StatusCreated, newBackendJSON(pool, b))
+}
+
+// DELETE /admin/backends/{id}
+func (r *reloader) handleRemoveBackend(w http.ResponseWriter, req *http.Request) {
+	pool, b := findBackend(req.PathValue("id"))
+	if b == nil {
+		writeError(w, http.StatusNotFound, "no backend with id "+req.PathValue("id"))
+		return
+	}
+	key := b.URL.String()
+
+	err := r.changeBackends("admin: remove backend "+key, func(rt *runtimeBackends) error {
+		var kept []BackendConfig
+		for _, bc := range rt.added[pool] {
+			if backendKey(bc.URL) != key {
+				kept = append(kept, bc)
+			}
+		}
+		rt.added[pool] = kept
+		if rt.removed[pool] == nil {
+			rt.removed[pool] = make(map[string]bool)
+		}
+		rt.removed[pool][key] = true
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	// one added again later starts enabled
+	disabledBackends.Delete(req.PathValue("id"))
+	infof("Admin: removed backend %s from pool %s\n", key, pool)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PATCH /admin/backends/{id} with {"weight": 5} changes the share of the
+// traffic the backend gets right away, 0 goes back to the configured weight.
+// The weight lasts until the config changes the backend or the process
+// restarts.
+func handlePatchBackend(w http.ResponseWriter, req *http.Request) {
+	pool, b := findBackend(req.PathValue("id"))
+	if b == nil {
+		writeError(w, http.StatusNotFound, "no backend with id "+req.PathValue("id"))
+		return
+	}
+	var body struct {
+		Weight *int `yaml:"weight"`
+	}
+	data, err := io.ReadAll(io.LimitReader(req.Body, 1<<20))
+	if err == nil {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&body)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if body.Weight == nil {
+		writeError(w, http.StatusBadRequest, "weight is required")
+		return
+	}
+	if *body.Weight < 0 || *body.Weight > maxWeight {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("weight must be between 0 and %d", maxWeight))
+		return
+	}
+
+	old := b.Weight()
+	b.weight.Store(int64(*body.Weight))
+	if b.Weight() != old {
+		activePools.Load().Get(pool).rebuildRing()
+		infof("Admin: weight of backend %s (pool %s) %d -> %d\n", b.URL, pool, old, b.Weight())
+	}
+	writeJSON(w, http.StatusOK, newBackendJSON(pool, b))
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AuditLogConfig appends every admin request that changes something, and
+// every denied one, to a file of its own as json lines
+type AuditLogConfig struct {
+	// empty turns the audit log off
+	Path string `yaml:"path,omitempty"`
+	// see logfile.go. Rotated files are only removed with max_files or
+	// retention set.
+	Rotation `yaml:",inline"`
+}
+
+func (a AuditLogConfig) Validate() error {
+	if a.Path == "" && a.Rotation.Enabled() {
+		return fmt.Errorf("admin: audit_log: rotation needs a path")
+	}
+	return a.Rotation.Validate("admin: audit_log")
+}
+
+// auditEntry is one line of the audit log
+type auditEntry struct {
+	Time time.Time `json:"time"`
+	// the user of basic auth, "token", "anonymous" without credentials
+	// configured, empty when denied
+	Who    string `json:"who"`
+	Client string `json:"client"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	// the request body, as is when it isnt json
+	Body   json.RawMessage `json:"body,omitempty"`
+	Status int             `json:"status"`
+	// what GET answered for the changed thing before the change, missing
+	// when there was nothing (a new backend) or nothing to ask
+	Previous json.RawMessage `json:"previous,omitempty"`
+}
+
+// auditLogger writes the lines of an audit log config
+type auditLogger struct {
+	config AuditLogConfig
+	mu     sync.Mutex
+	file   *rotatingFile
+}
+
+// the logger of the config, the one of the previous pools when the config
+// didnt change so the file stays open. nil without a path.
+func newAuditLogger(a AuditLogConfig, previous *Pools) (*auditLogger, error) {
+	if a.Path == "" {
+		return nil, nil
+	}
+	if previous != nil && previous.auditLog != nil && previous.auditLog.config == a {
+		return previous.auditLog, nil
+	}
+	f, err := openRotatingFile(a.Path, a.Rotation)
+	if err != nil {
+		return nil, fmt.Errorf("admin: audit_log: %w", err)
+	}
+	return &auditLogger{config: a, file: f}, nil
+}
+
+func (l *auditLogger) Log(e *auditEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.file.Write(append(line, '\n'))
+	return err
+}
+
+// close the file of a logger that was replaced by a reload
+func (l *auditLogger) Close() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.file.Close()
+}
+
+// start the entry of an admin request, reading its body (and putting it
+// back for the handler) and asking the admin api what the request is about
+// to change. nil without an audit log.
+func startAuditEntry(l *auditLogger, api http.Handler, who string, req *http.Request) *auditEntry {
+	if l == nil {
+		return nil
+	}
+	e := &auditEntry{
+		Time:   time.Now(),
+		Who:    who,
+		Client: req.RemoteAddr,
+		Method: req.Method,
+		Path:   req.URL.Path,
+	}
+	if req.Body != nil {
+		// the handlers dont read more than this either
+		body, _ := io.ReadAll(io.LimitReader(req.Body, 1<<20))
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		e.Body = auditBody(body)
+	}
+	if path := auditPreviousPath(req); path != "" && api != nil {
+		get, _ := http.NewRequestWithContext(req.Context(), http.MethodGet, path, nil)
+		get.RemoteAddr = req.RemoteAddr
+		rec := &bodyRecorder{header: make(http.Header)}
+		api.ServeHTTP(rec, get)
+		if rec.status == http.StatusOK {
+			e.Previous = rawJSON(rec.body.Bytes())
+		}
+	}
+	return e
+}
+
+// the GET path that answers what a request changes, empty when there is
+// none
+func auditPreviousPath(req *http.Request) string {
+	path := req.URL.Path
+	switch {
+	case req.Method == http.MethodPost && path == "/admin/backends":
+		return ""
+	case strings.HasPrefix(path, "/admin/backends/"):
+		path = strings.TrimSuffix(strings.TrimSuffix(path, "/drain"), "/disable")
+	case strings.HasPrefix(path, "/admin/scheduled/"):
+		path = "/admin/scheduled"
+	case strings.HasPrefix(path, "/admin/config/rollback/"):
+		path = "/admin/config"
+	}
+	return path
+}
+
+// the body of an admin request as it is logged. A backend in it has its
+// secrets redacted like in -dry-run, the api takes yaml as well as json.
+func auditBody(body []byte) json.RawMessage {
+	var fields map[string]interface{}
+	if yaml.Unmarshal(body, &fields) != nil || !redactBackendFields(fields) {
+		return rawJSON(body)
+	}
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return json.RawMessage(`"` + redacted + `"`)
+	}
+	return b
+}
+
+// b as json, as a json string when it isnt, nil when empty
+func rawJSON(b []byte) json.RawMessage {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return nil
+	}
+	if json.Valid(b) {
+		var compact bytes.Buffer
+		json.Compact(&compact, b)
+		return compact.Bytes()
+	}
+	quoted, _ := json.Marshal(string(b))
+	return quoted
+}
+
+// bodyRecorder keeps the answer of an internal admin request
+type bodyRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *bodyRecorder) Header() http.Header { return r.header }
+
+func (r *bodyRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *bodyRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.body.Write(b)
+}
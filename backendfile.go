@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// read the backends from a plain file, one per line with the same options as
+// the -backend flag. Blank lines and lines starting with # are skipped.
+func readBackendFile(path string) ([]BackendConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var backends []BackendConfig
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		bc, err := parseBackendSpec(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+		if err := bc.resolveSecrets(nil); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+		backends = append(backends, bc)
+	}
+	return backends, nil
+}
+
+// re-read the backend file every backend_file_interval and reload when it
+// changed, so an external system can manage the pool by rewriting the file
+func pollBackendFile(r *reloader) {
+	var last []byte
+	var lastPath string
+	for {
+		cfg := r.Current()
+		if cfg.BackendFile != lastPath {
+			// another file (or none) since a reload, start over
+			last, lastPath = nil, cfg.BackendFile
+		}
+		if cfg.BackendFile == "" {
+			time.Sleep(cfg.BackendFileInterval)
+			continue
+		}
+		data, err := os.ReadFile(cfg.BackendFile)
+		switch {
+		case err != nil:
+			warnf("Cant read backend file: %s\n", err)
+		case last == nil:
+			last = data
+		case !bytes.Equal(data, last):
+			last = data
+			infof("Backend file %s changed\n", cfg.BackendFile)
+			r.Reload("backend file changed")
+		}
+		time.Sleep(cfg.BackendFileInterval)
+	}
+}
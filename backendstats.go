@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// backendStats are the recent latencies and errors of a backend, over the
+// current and the previous window so they dont drop to nothing when a new
+// window starts. Unlike the latency histogram of the backend they forget,
+// so they show how it does now: for the status api and the metrics, and for
+// anything picking backends by how they do.
+type backendStats struct {
+	mu        sync.Mutex
+	started   time.Time
+	cur, prev *statsWindow
+}
+
+type statsWindow struct {
+	latency  latencyHistogram
+	requests uint64
+	// transport errors and 5xx answers
+	errors uint64
+}
+
+// the stats cover the last 30 to 60 seconds
+const backendStatsWindow = 30 * time.Second
+
+// start a new window when the current one is over, called with mu held
+func (s *backendStats) rotate(now time.Time) {
+	switch elapsed := now.Sub(s.started); {
+	case s.cur == nil || elapsed >= 2*backendStatsWindow:
+		s.prev, s.cur, s.started = &statsWindow{}, &statsWindow{}, now
+	case elapsed >= backendStatsWindow:
+		s.prev, s.cur, s.started = s.cur, &statsWindow{}, now
+	}
+}
+
+// an answer of the backend, status 0 for a request that failed without one
+func (s *backendStats) Count(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rotate(time.Now())
+	s.cur.requests++
+	if status == 0 || status >= 500 {
+		s.cur.errors++
+	}
+}
+
+func (s *backendStats) RecordLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rotate(time.Now())
+	s.cur.latency.Record(d)
+}
+
+// recentStats is what backendStats know at one moment
+type recentStats struct {
+	Requests uint64
+	// share of the requests that failed, 0 to 1
+	ErrorRate     float64
+	P50, P95, P99 time.Duration
+}
+
+func (s *backendStats) Recent() recentStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rotate(time.Now())
+	r := recentStats{
+		Requests: s.cur.requests + s.prev.requests,
+		P50:      quantileOf(0.5, &s.cur.latency, &s.prev.latency),
+		P95:      quantileOf(0.95, &s.cur.latency, &s.prev.latency),
+		P99:      quantileOf(0.99, &s.cur.latency, &s.prev.latency),
+	}
+	if r.Requests > 0 {
+		r.ErrorRate = float64(s.cur.errors+s.prev.errors) / float64(r.Requests)
+	}
+	return r
+}
+
+// the latency at quantile q (0 to 1), and how many latencies it is taken
+// from
+func (s *backendStats) Quantile(q float64) (time.Duration, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rotate(time.Now())
+	return quantileOf(q, &s.cur.latency, &s.prev.latency), s.cur.latency.count.Load() + s.prev.latency.count.Load()
+}
+
+type recentStatsJSON struct {
+	Requests  uint64  `json:"requests"`
+	ErrorRate float64 `json:"error_rate"`
+	P50Ms     float64 `json:"p50_ms"`
+	P95Ms     float64 `json:"p95_ms"`
+	P99Ms     float64 `json:"p99_ms"`
+}
+
+func (r recentStats) JSON() recentStatsJSON {
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	return recentStatsJSON{
+		Requests:  r.Requests,
+		ErrorRate: r.ErrorRate,
+		P50Ms:     ms(r.P50),
+		P95Ms:     ms(r.P95),
+		P99Ms:     ms(r.P99),
+	}
+}
+
+func writeRecentMetrics(w io.Writer) {
+	type backendRecent struct {
+		labels string
+		recent recentStats
+	}
+	var all []backendRecent
+	for _, pool := range activePools.Load().All() {
+		for _, b := range pool.backends {
+			all = append(all, backendRecent{fmt.Sprintf("pool=%q,backend=%q", pool.name, b.URL.String()), b.recent.Recent()})
+		}
+	}
+	writeMetricHeader(w, "lb_backend_recent_latency_seconds", "gauge", "Latency percentiles of the backend over the last 30 to 60 seconds.")
+	for _, b := range all {
+		for _, q := range []struct {
+			name string
+			d    time.Duration
+		}{{"0.5", b.recent.P50}, {"0.95", b.recent.P95}, {"0.99", b.recent.P99}} {
+			fmt.Fprintf(w, "lb_backend_recent_latency_seconds{%s,quantile=%q} %g\n", b.labels, q.name, q.d.Seconds())
+		}
+	}
+	writeMetricHeader(w, "lb_backend_recent_error_ratio", "gauge", "Share of the requests to the backend that failed or got a 5xx over the last 30 to 60 seconds.")
+	for _, b := range all {
+		fmt.Fprintf(w, "lb_backend_recent_error_ratio{%s} %g\n", b.labels, b.recent.ErrorRate)
+	}
+}
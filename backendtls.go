@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the tls config for an https backend: the client certificate it gets
+// (mtls), the ca bundle its certificate is verified with and the allowed
+// versions and ciphers. nil when the backend sets none, the transport
+// default then applies.
+func backendTLSConfig(bc BackendConfig) (*tls.Config, error) {
+	if bc.TLSClientCert == "" && bc.TLSClientKey == "" && bc.TLSCA == "" && bc.tlsSettings().empty() {
+		return nil, nil
+	}
+	if (bc.TLSClientCert == "") != (bc.TLSClientKey == "") {
+		return nil, fmt.Errorf("tls_client_cert and tls_client_key must be set together")
+	}
+	cfg := &tls.Config{}
+	if err := bc.tlsSettings().apply(cfg); err != nil {
+		return nil, err
+	}
+	if bc.TLSCA != "" {
+		pem, err := readPEM(bc.TLSCA, new([]string))
+		if err != nil {
+			return nil, fmt.Errorf("tls_ca: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls_ca: no certificate found")
+		}
+	}
+	if bc.TLSClientCert != "" {
+		c := &clientCertificate{certRef: bc.TLSClientCert, keyRef: bc.TLSClientKey}
+		// fail on a bad pair now rather than on the first request
+		if _, err := c.get(nil); err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = c.get
+	}
+	return cfg, nil
+}
+
+// clientCertificate is the client certificate of a backend. It is read
+// again when its files change, so short lived certificates of a mesh are
+// rotated without a reload.
+type clientCertificate struct {
+	certRef, keyRef string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func (c *clientCertificate) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	mod := pemModTime(c.certRef)
+	if t := pemModTime(c.keyRef); t.After(mod) {
+		mod = t
+	}
+	if c.cert != nil && !mod.After(c.modTime) {
+		return c.cert, nil
+	}
+
+	cert, err := c.load()
+	if err != nil {
+		if c.cert != nil {
+			// a half written rotation, the next handshake tries again
+			warnf("Reading client certificate %s failed, using the previous one: %s\n", c.certRef, err)
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	c.cert, c.modTime = cert, mod
+	return cert, nil
+}
+
+func (c *clientCertificate) load() (*tls.Certificate, error) {
+	certPEM, err := readPEM(c.certRef, new([]string))
+	if err != nil {
+		return nil, fmt.Errorf("tls_client_cert: %w", err)
+	}
+	keyPEM, err := readPEM(c.keyRef, new([]string))
+	if err != nil {
+		return nil, fmt.Errorf("tls_client_key: %w", err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("tls_client_cert: %w", err)
+	}
+	return &cert, nil
+}
+
+// when a pem file was last changed, zero for env:// references
+func pemModTime(ref string) time.Time {
+	if strings.HasPrefix(ref, "env://") {
+		return time.Time{}
+	}
+	info, err := os.Stat(strings.TrimPrefix(ref, "file://"))
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
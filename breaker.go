@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// built in circuit breaker settings, used when the backend config leaves
+// them at 0
+const (
+	defaultBreakerMinRequests = 20
+	defaultBreakerOpenFor     = 10 * time.Second
+	defaultBreakerProbes      = 3
+)
+
+// states of a circuit breaker
+const (
+	// requests go through, failures are counted
+	breakerClosed = iota
+	// no requests until open_for is over
+	breakerOpen
+	// a few probe requests go through, they decide between closed and open
+	breakerHalfOpen
+)
+
+var breakerStates = []string{"closed", "open", "half-open"}
+
+// circuitBreaker stops the traffic to a backend that keeps failing, without
+// waiting for its health check. Unlike marking it down, it finds out by
+// itself when the backend is fine again: after open_for a few requests are
+// let through, if they all succeed it closes.
+type circuitBreaker struct {
+	mu    sync.Mutex
+	state int
+	// when the state was entered
+	since time.Time
+	// failures in a row, and the attempts and failures of the current
+	// window, while closed
+	consecutive        int
+	windowStart        time.Time
+	requests, failures int
+	// probes let through and succeeded, while half-open
+	probes, successes int
+
+	// times it opened
+	opened atomic.Uint64
+}
+
+func (b *Backend) breakerEnabled() bool {
+	return b.config.BreakerErrors > 0 || b.config.BreakerErrorRate > 0
+}
+
+func (b *Backend) breakerSettings() (minRequests int, openFor time.Duration, probes int) {
+	minRequests, openFor, probes = b.config.BreakerMinRequests, b.config.BreakerOpenFor, b.config.BreakerProbes
+	if minRequests == 0 {
+		minRequests = defaultBreakerMinRequests
+	}
+	if openFor == 0 {
+		openFor = defaultBreakerOpenFor
+	}
+	if probes == 0 {
+		probes = defaultBreakerProbes
+	}
+	return
+}
+
+// move on from open to half-open once open_for is over, and let new probes
+// through when the last ones never answered. Called with mu held.
+func (b *Backend) breakerTick(now time.Time) {
+	_, openFor, _ := b.breakerSettings()
+	c := &b.breaker
+	if c.state != breakerClosed && now.Sub(c.since) >= openFor {
+		if c.state == breakerOpen {
+			infof("%s: circuit breaker half-open, letting probe requests through\n", b.URL)
+		}
+		c.state, c.since, c.probes, c.successes = breakerHalfOpen, now, 0, 0
+	}
+}
+
+// check if the breaker keeps new requests away from the backend: while it
+// is open, and while half-open once all probes are out
+func (b *Backend) CircuitOpen() bool {
+	if !b.breakerEnabled() {
+		return false
+	}
+	_, _, probes := b.breakerSettings()
+	b.breaker.mu.Lock()
+	defer b.breaker.mu.Unlock()
+	b.breakerTick(time.Now())
+	switch b.breaker.state {
+	case breakerOpen:
+		return true
+	case breakerHalfOpen:
+		return b.breaker.probes >= probes
+	}
+	return false
+}
+
+// a request was sent to the backend, while half-open it is a probe
+func (b *Backend) breakerAdmit() {
+	if !b.breakerEnabled() {
+		return
+	}
+	b.breaker.mu.Lock()
+	if b.breaker.state == breakerHalfOpen {
+		b.breaker.probes++
+	}
+	b.breaker.mu.Unlock()
+}
+
+// the outcome of an attempt on the backend: false for a transport error or
+// a 5xx answer
+func (b *Backend) breakerRecord(ok bool) {
+	if !b.breakerEnabled() {
+		return
+	}
+	minRequests, openFor, probes := b.breakerSettings()
+	now := time.Now()
+	c := &b.breaker
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b.breakerTick(now)
+
+	switch c.state {
+	case breakerHalfOpen:
+		if !ok {
+			c.state, c.since = breakerOpen, now
+			c.opened.Add(1)
+			warnf("%s: circuit breaker probe failed, open again for %s\n", b.URL, openFor)
+			return
+		}
+		if c.successes++; c.successes >= probes {
+			c.state, c.since = breakerClosed, now
+			c.consecutive, c.requests, c.failures, c.windowStart = 0, 0, 0, now
+			infof("%s: circuit breaker closed, %d probe(s) succeeded\n", b.URL, c.successes)
+		}
+	case breakerClosed:
+		if now.Sub(c.windowStart) >= backendStatsWindow {
+			c.requests, c.failures, c.windowStart = 0, 0, now
+		}
+		c.requests++
+		if ok {
+			c.consecutive = 0
+			return
+		}
+		c.failures++
+		c.consecutive++
+		var reason string
+		switch rate := float64(c.failures) / float64(c.requests); {
+		case b.config.BreakerErrors > 0 && c.consecutive >= b.config.BreakerErrors:
+			reason = fmt.Sprintf("%d failures in a row", c.consecutive)
+		case b.config.BreakerErrorRate > 0 && c.requests >= minRequests && rate >= b.config.BreakerErrorRate:
+			reason = fmt.Sprintf("%d of %d requests failed", c.failures, c.requests)
+		default:
+			return
+		}
+		c.state, c.since = breakerOpen, now
+		c.opened.Add(1)
+		warnf("%s: circuit breaker open for %s, %s\n", b.URL, openFor, reason)
+	}
+}
+
+// closed, open or half-open, empty without a breaker
+func (b *Backend) CircuitState() string {
+	if !b.breakerEnabled() {
+		return ""
+	}
+	return breakerStates[b.circuitState()]
+}
+
+func (b *Backend) circuitState() int {
+	b.breaker.mu.Lock()
+	defer b.breaker.mu.Unlock()
+	b.breakerTick(time.Now())
+	return b.breaker.state
+}
+
+func writeBreakerMetrics(w io.Writer) {
+	pools := activePools.Load().All()
+	writeMetricHeader(w, "lb_backend_circuit_state", "gauge", "State of the circuit breaker of the backend: 0 closed, 1 open, 2 half-open.")
+	for _, pool := range pools {
+		for _, b := range pool.backends {
+			if b.breakerEnabled() {
+				fmt.Fprintf(w, "lb_backend_circuit_state{pool=%q,backend=%q} %d\n", pool.name, b.URL.String(), b.circuitState())
+			}
+		}
+	}
+	writeMetricHeader(w, "lb_backend_circuit_opened_total", "counter", "Times the circuit breaker of the backend opened.")
+	for _, pool := range pools {
+		for _, b := range pool.backends {
+			if b.breakerEnabled() {
+				fmt.Fprintf(w, "lb_backend_circuit_opened_total{pool=%q,backend=%q} %d\n", pool.name, b.URL.String(), b.breaker.opened.Load())
+			}
+		}
+	}
+}
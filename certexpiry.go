@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// warn when a backend certificate expires within this many days
+var certWarningDays atomic.Int64
+
+// tcp probe for https backends. The backend is up when the connection opens,
+// the tls handshake after it is only there to read the certificate.
+func (b *Backend) probeTLS() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), b.healthTimeout())
+	defer cancel()
+	conn, err := b.dial(ctx, "tcp", hostPort(b.URL))
+	if err != nil {
+		debugf("Cant connect to the server, error: %s\n", err)
+		return false
+	}
+	defer conn.Close()
+
+	// not verifying is fine, nothing is sent over this connection and an
+	// expired certificate is what we want to see. A backend asking for a
+	// client certificate gets it, or it would end the handshake.
+	config := &tls.Config{ServerName: b.URL.Hostname(), InsecureSkipVerify: true}
+	if b.transport.TLSClientConfig != nil {
+		config.GetClientCertificate = b.transport.TLSClientConfig.GetClientCertificate
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		warnf("%s tls handshake failed: %s\n", b.URL, err)
+		return true
+	}
+	state := tlsConn.ConnectionState()
+	b.recordCertificate(&state)
+	return true
+}
+
+// remember when the certificate of the backend expires, and warn if that is soon
+func (b *Backend) recordCertificate(state *tls.ConnectionState) {
+	if len(state.PeerCertificates) == 0 {
+		return
+	}
+	expiry := state.PeerCertificates[0].NotAfter
+	b.certExpiry.Store(expiry.Unix())
+
+	days := int64(math.Floor(time.Until(expiry).Hours() / 24))
+	if days >= certWarningDays.Load() {
+		b.certWarnedDays.Store(0)
+		return
+	}
+	// once per day left, not on every probe
+	if b.certWarnedDays.Swap(days+1) == days+1 {
+		return
+	}
+	if days < 0 {
+		warnf("certificate of %s expired on %s\n", b.URL, expiry.Format(time.RFC3339))
+		return
+	}
+	warnf("certificate of %s expires in %d day(s) (%s)\n", b.URL, days, expiry.Format(time.RFC3339))
+}
+
+// when the certificate of the backend expires, zero if unknown
+func (b *Backend) CertExpiry() time.Time {
+	if sec := b.certExpiry.Load(); sec != 0 {
+		return time.Unix(sec, 0)
+	}
+	return time.Time{}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// headers with the identity of a verified client certificate for the
+// backends. They are removed from every request first, so a client cant
+// claim an identity it has no certificate for.
+const (
+	clientSubjectHeader     = "X-Client-Cert-Subject"
+	clientSANHeader         = "X-Client-Cert-SAN"
+	clientFingerprintHeader = "X-Client-Cert-Fingerprint"
+)
+
+// client_auth of a listener with client_ca: require a certificate, or
+// only verify one that is sent
+var validClientAuth = map[string]tls.ClientAuthType{
+	"":         tls.RequireAnyClientCert,
+	"require":  tls.RequireAnyClientCert,
+	"optional": tls.RequestClientCert,
+}
+
+func (l ListenerConfig) clientCAs() (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(l.clientCAPEM) {
+		return nil, fmt.Errorf("listener %s: client_ca: no certificate found", l.Address)
+	}
+	return pool, nil
+}
+
+func (l ListenerConfig) validateClientAuth() error {
+	if _, ok := validClientAuth[l.ClientAuth]; !ok {
+		return fmt.Errorf("listener %s: client_auth must be require or optional", l.Address)
+	}
+	if l.ClientCA == "" {
+		if l.ClientAuth != "" {
+			return fmt.Errorf("listener %s: client_auth needs client_ca", l.Address)
+		}
+		return nil
+	}
+	if !l.TLS() {
+		return fmt.Errorf("listener %s: client_ca needs tls_cert and tls_key", l.Address)
+	}
+	_, err := l.clientCAs()
+	return err
+}
+
+// ask for client certificates on a listener with client_ca. They are
+// verified against the ca bundle of the active pools, so a reload rotates it
+// like the certificate.
+func requestClientCerts(l ListenerConfig, config *tls.Config) {
+	if l.ClientCA == "" {
+		return
+	}
+	config.ClientAuth = validClientAuth[l.ClientAuth]
+	address := l.Address
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			// client_auth optional, require fails before this
+			return nil
+		}
+		roots := activePools.Load().clientCAs[address]
+		if roots == nil {
+			return fmt.Errorf("no client ca for listener %s", address)
+		}
+		opts := x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: x509.NewCertPool(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		for _, c := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(c)
+		}
+		_, err := cs.PeerCertificates[0].Verify(opts)
+		return err
+	}
+}
+
+// replace the client identity headers of r with the ones of its client
+// certificate, if it has one. verified is whether the listener verifies
+// client certificates, one it only asked for proves nothing.
+func setClientIdentity(r *http.Request, verified bool) {
+	r.Header.Del(clientSubjectHeader)
+	r.Header.Del(clientSANHeader)
+	r.Header.Del(clientFingerprintHeader)
+
+	state := connectionState(r)
+	if !verified || state == nil || len(state.PeerCertificates) == 0 {
+		return
+	}
+	cert := state.PeerCertificates[0]
+	r.Header.Set(clientSubjectHeader, cert.Subject.String())
+	var sans []string
+	sans = append(sans, cert.DNSNames...)
+	for _, u := range cert.URIs {
+		sans = append(sans, u.String())
+	}
+	sans = append(sans, cert.EmailAddresses...)
+	if len(sans) > 0 {
+		r.Header.Set(clientSANHeader, strings.Join(sans, ","))
+	}
+	sum := sha256.Sum256(cert.Raw)
+	r.Header.Set(clientFingerprintHeader, hex.EncodeToString(sum[:]))
+}
+
+// the tls state of the connection of r, nil for plain http
+func connectionState(r *http.Request) *tls.ConnectionState {
+	if r.TLS != nil {
+		return r.TLS
+	}
+	// strict listeners do tls below the http server, see serveListener
+	if sc, ok := r.Context().Value(StrictConn).(*strictConn); ok {
+		if tc, ok := sc.Conn.(*tls.Conn); ok {
+			state := tc.ConnectionState()
+			return &state
+		}
+	}
+	return nil
+}
@@ -0,0 +1,1214 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the whole load balancer setup, it can come from the yaml file
+// given with -config, LB_* environment variables and the flags
+// (flags win over the environment, which wins over the file)
+type Config struct {
+	Port     int             `yaml:"port"`
+	Strategy string          `yaml:"strategy"`
+	Backends []BackendConfig `yaml:"backends,omitempty"`
+	Health   HealthConfig    `yaml:"health"`
+
+	// file with one backend per line, re-read every backend_file_interval.
+	// Its backends are the top level backends
+	BackendFile         string        `yaml:"backend_file"`
+	BackendFileInterval time.Duration `yaml:"backend_file_interval"`
+
+	// serve https on port with this certificate, like tls_cert and tls_key
+	// of a listener
+	TLSCert string `yaml:"tls_cert,omitempty"`
+	TLSKey  string `yaml:"tls_key,omitempty"`
+	// tls versions, cipher suites and curves of port, like those of a listener
+	TLSMinVersion string `yaml:"tls_min_version,omitempty"`
+	TLSMaxVersion string `yaml:"tls_max_version,omitempty"`
+	TLSCiphers    string `yaml:"tls_ciphers,omitempty"`
+	TLSCurves     string `yaml:"tls_curves,omitempty"`
+	// contents of the cert and key of port, read when the config is loaded
+	certPEM, keyPEM []byte
+	// also serve http/3 on port, like http3 of a listener
+	HTTP3 bool `yaml:"http3,omitempty"`
+	// accept http/2 without tls on port, like h2c of a listener
+	H2C bool `yaml:"h2c,omitempty"`
+	// read a PROXY protocol header on port, like proxy_protocol of a listener
+	ProxyProtocol bool `yaml:"proxy_protocol,omitempty"`
+	// redirect plain http on this address to port, like redirect_http of a listener
+	RedirectHTTP string `yaml:"redirect_http,omitempty"`
+	// listen on this unix socket instead of port, with socket_mode like
+	// that of a listener
+	UnixSocket string `yaml:"unix_socket,omitempty"`
+	SocketMode string `yaml:"socket_mode,omitempty"`
+
+	// several frontends in one process, when set port is not used
+	Listeners []ListenerConfig `yaml:"listeners"`
+	// serve /metrics for prometheus on this host:port or unix:/path, next
+	// to /admin/metrics of the admin api
+	MetricsAddress string `yaml:"metrics_address,omitempty"`
+	// a line for every request, see accesslog.go
+	AccessLog AccessLogConfig `yaml:"access_log,omitempty"`
+	// opentelemetry spans of the requests, see tracing.go
+	Tracing TracingConfig `yaml:"tracing,omitempty"`
+	// log into a file instead of stderr, see logfile.go
+	LogFile LogFileConfig `yaml:"log_file,omitempty"`
+	// log to a syslog daemon instead of stderr, see syslog.go
+	Syslog SyslogConfig `yaml:"syslog,omitempty"`
+	// debug, info (the default), warn or error
+	LogLevel string `yaml:"log_level,omitempty"`
+	// text or json, see loglevel.go
+	LogFormat string `yaml:"log_format,omitempty"`
+	// udp load balancing, next to the http listeners
+	UDP []UDPListenerConfig `yaml:"udp,omitempty"`
+	// tls passthrough listeners, routed by the SNI name without decrypting
+	Passthrough []PassthroughConfig `yaml:"passthrough,omitempty"`
+	// strict request parsing on the plain port listener
+	StrictParsing bool `yaml:"strict_parsing"`
+	// named backend pools, the top level backends are the pool "default"
+	Pools map[string]PoolConfig `yaml:"pools"`
+	// settings for every backend that doesnt set them itself (url is not allowed)
+	Defaults BackendConfig `yaml:"defaults,omitempty"`
+	// dns servers for backend hostnames instead of the system resolver
+	Resolver ResolverConfig `yaml:"resolver"`
+
+	// more files (globs allowed, relative to this file) with backends,
+	// pools, routes and listeners to merge in
+	Include []string `yaml:"include,omitempty"`
+	// every file the config was read from, secret files included
+	files []string
+
+	// default egress proxy for backends that dont set their own
+	EgressProxy string `yaml:"egress_proxy"`
+	// default address family policy for upstream dials
+	IPFamily string `yaml:"ip_family"`
+
+	// reload coordination between the replicas of a fleet
+	Fleet FleetConfig `yaml:"fleet"`
+	// publishing the healthy backends to a service registry
+	Export ExportConfig `yaml:"export"`
+	// push the metrics to statsd or a datadog agent, see statsd.go
+	StatsD StatsDConfig `yaml:"statsd"`
+	// write the counters and backend states to a file, see statsfile.go
+	StatsFile StatsFileConfig `yaml:"stats_file"`
+	// the admin api
+	Admin AdminConfig `yaml:"admin"`
+	// checks on the load balancer itself
+	Watchdog WatchdogConfig `yaml:"watchdog"`
+	// the answer to every request in maintenance mode
+	Maintenance MaintenanceConfig `yaml:"maintenance"`
+	// byte accounting per tenant, api key and route
+	Usage UsageConfig `yaml:"usage"`
+
+	// parts of the config that apply from a point in time on
+	Scheduled []ScheduledChange `yaml:"scheduled,omitempty"`
+	// names of the scheduled changes in effect
+	applied []string
+
+	// percent of healthy backends below which a pool ignores the health
+	// checks and balances over all its backends, 0 disables it
+	PanicThreshold int `yaml:"panic_threshold"`
+
+	// response header a backend sets to "true" to be drained, empty disables it
+	DrainHeader string `yaml:"drain_header"`
+	// how long a removed or disabled backend gets to finish its requests
+	// before its connections are cut
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+
+	// header with the id of every request, see requestid.go. Empty disables
+	// it
+	RequestIDHeader string `yaml:"request_id_header"`
+
+	// retries of all requests together, see retrybudget.go
+	RetryBudget RetryBudgetConfig `yaml:"retry_budget"`
+
+	// requests waiting for a busy pool, see queue.go
+	Queue QueueConfig `yaml:"queue"`
+	// requests in flight through the load balancer at most, see
+	// maxrequests.go. 0 means no limit
+	MaxRequests int `yaml:"max_requests"`
+	// requests turned away by priority while the process is overloaded,
+	// see shed.go
+	LoadShedding LoadSheddingConfig `yaml:"load_shedding"`
+
+	// backends doing much worse than the rest of their pool, see outlier.go
+	OutlierDetection OutlierConfig `yaml:"outlier_detection"`
+
+	// rules tagging requests for the metrics and logs
+	Tags []TagRule `yaml:"tags,omitempty"`
+
+	// global route settings, inherited by every route
+	RouteSettings `yaml:",inline"`
+	Routes        []RouteConfig `yaml:"routes"`
+}
+
+type BackendConfig struct {
+	URL string `yaml:"url"`
+
+	// socks5://host:port or http://host:port (CONNECT) to reach this backend through
+	EgressProxy string `yaml:"egress_proxy"`
+	// any, prefer-ipv4, prefer-ipv6, ipv4 or ipv6
+	IPFamily string `yaml:"ip_family"`
+
+	// share of the traffic relative to the other backends, 0 means 1
+	Weight int `yaml:"weight"`
+	// max requests in flight to this backend, 0 means no limit
+	MaxConns int `yaml:"max_conns"`
+	// probe this path with GET instead of just opening a tcp connection
+	HealthPath string `yaml:"health"`
+	// how long a health probe may take, 0 means 2s
+	HealthTimeout time.Duration `yaml:"health_timeout"`
+	// Authorization header of the health probe, e.g. "Bearer xyz"
+	HealthAuth string `yaml:"health_auth"`
+
+	// pause the backend for reset_cooldown after reset_threshold connection
+	// resets within reset_window. 0 means the built in value, -1 threshold disables
+	ResetThreshold int           `yaml:"reset_threshold"`
+	ResetWindow    time.Duration `yaml:"reset_window"`
+	ResetCooldown  time.Duration `yaml:"reset_cooldown"`
+
+	// pause the backend after it answers 503, for its Retry-After up to
+	// max_retry_after or for unavailable_pause without one. 0 means the
+	// built in value, a negative unavailable_pause disables
+	UnavailablePause time.Duration `yaml:"unavailable_pause"`
+	MaxRetryAfter    time.Duration `yaml:"max_retry_after"`
+
+	// a backend marked down by failed requests stays down for quarantine,
+	// then needs quarantine_checks passing health checks in a row. 0
+	// quarantine disables it, 0 checks means the built in value
+	Quarantine       time.Duration `yaml:"quarantine"`
+	QuarantineChecks int           `yaml:"quarantine_checks"`
+
+	// circuit breaker, see breaker.go: it opens after breaker_errors failed
+	// attempts in a row or when breaker_error_rate of at least
+	// breaker_min_requests attempts failed, stays open for breaker_open_for
+	// and then closes when breaker_probes requests succeed. Both triggers at
+	// 0 disable it, the rest 0 means the built in value
+	BreakerErrors      int           `yaml:"breaker_errors"`
+	BreakerErrorRate   float64       `yaml:"breaker_error_rate"`
+	BreakerMinRequests int           `yaml:"breaker_min_requests"`
+	BreakerOpenFor     time.Duration `yaml:"breaker_open_for"`
+	BreakerProbes      int           `yaml:"breaker_probes"`
+
+	// connections to the backend: source address or interface (linux only)
+	// to send from, nagle, tcp keepalive and TCP_USER_TIMEOUT (linux only).
+	// 0 means the built in value, a negative keepalive_idle disables keepalive
+	SourceIP          string        `yaml:"source_ip"`
+	Interface         string        `yaml:"interface"`
+	Nagle             bool          `yaml:"nagle"`
+	KeepAliveIdle     time.Duration `yaml:"keepalive_idle"`
+	KeepAliveInterval time.Duration `yaml:"keepalive_interval"`
+	KeepAliveCount    int           `yaml:"keepalive_count"`
+	TCPUserTimeout    time.Duration `yaml:"tcp_user_timeout"`
+
+	// how long connecting, the tls handshake, the response headers and the
+	// 100 Continue of a request with Expect may take, see transport.go. 0
+	// means the built in value
+	DialTimeout           time.Duration `yaml:"dial_timeout"`
+	TLSHandshakeTimeout   time.Duration `yaml:"tls_handshake_timeout"`
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout"`
+	ExpectContinueTimeout time.Duration `yaml:"expect_continue_timeout"`
+	// connections kept open for the next request: how many, how long while
+	// idle, or none at all with disable_keepalives. 0 means the built in
+	// value, see transport.go
+	MaxIdleConns        int           `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host"`
+	IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout"`
+	DisableKeepAlives   bool          `yaml:"disable_keepalives"`
+
+	// https backends: the client certificate and key presented to the
+	// backend (mtls) and the ca bundle its certificate is verified with
+	// instead of the system roots. Paths to pem files or env:// references
+	TLSClientCert string `yaml:"tls_client_cert"`
+	TLSClientKey  string `yaml:"tls_client_key"`
+	TLSCA         string `yaml:"tls_ca"`
+	// tls versions, cipher suites and curves allowed to the backend, see
+	// tlsversions.go
+	TLSMinVersion string `yaml:"tls_min_version"`
+	TLSMaxVersion string `yaml:"tls_max_version"`
+	TLSCiphers    string `yaml:"tls_ciphers"`
+	TLSCurves     string `yaml:"tls_curves"`
+	// auto, http1 or h2c, see http2.go
+	Protocol string `yaml:"protocol"`
+	// v1 or v2: start every connection with a PROXY protocol header
+	// carrying the client, see proxyproto.go
+	ProxyProtocol string `yaml:"proxy_protocol"`
+
+	// the options this backend sets itself, even to 0, false or "", so
+	// they win over the defaults block
+	set backendKeys
+}
+
+// backendKeys marks fields of BackendConfig by their index. It is an array
+// and not a map so BackendConfig stays comparable.
+type backendKeys [2]uint64
+
+func (k *backendKeys) add(i int)     { k[i/64] |= 1 << (i % 64) }
+func (k backendKeys) has(i int) bool { return k[i/64]&(1<<(i%64)) != 0 }
+
+// field index of every backend option by its config key
+var backendFields = func() map[string]int {
+	t := reflect.TypeOf(BackendConfig{})
+	if t.NumField() > len(backendKeys{})*64 {
+		panic("backendKeys too small for BackendConfig")
+	}
+	fields := make(map[string]int)
+	for i := 0; i < t.NumField(); i++ {
+		if key, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ","); key != "" {
+			fields[key] = i
+		}
+	}
+	return fields
+}()
+
+// remember the option keys of a backend mapping node as set
+func (b *BackendConfig) markSet(node *yaml.Node) {
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	if node.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if f, ok := backendFields[node.Content[i].Value]; ok {
+			b.set.add(f)
+		}
+	}
+}
+
+func (b BackendConfig) isSet(key string) bool {
+	return b.set.has(backendFields[key])
+}
+
+type HealthConfig struct {
+	Interval    time.Duration `yaml:"interval"`
+	MinInterval time.Duration `yaml:"min_interval"`
+	// warn when the certificate of an https backend expires within this many days
+	CertWarningDays int `yaml:"cert_warning_days"`
+}
+
+// balancing strategies that can be configured
+var validStrategies = map[string]bool{
+	"round-robin": true,
+	"least-conn":  true,
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Port:     3030,
+		Strategy: "round-robin",
+		Health: HealthConfig{
+			Interval:        2 * time.Minute,
+			MinInterval:     10 * time.Second,
+			CertWarningDays: 14,
+		},
+		Fleet:     defaultFleetConfig(),
+		Export:    ExportConfig{Interval: 10 * time.Second},
+		StatsD:    StatsDConfig{Interval: 10 * time.Second},
+		StatsFile: StatsFileConfig{Interval: 10 * time.Second},
+		Resolver:  defaultResolverConfig(),
+		Admin:     AdminConfig{History: 10, SnapshotInterval: 10 * time.Second, SnapshotRetention: 24 * time.Hour},
+		Watchdog:  defaultWatchdogConfig(),
+		Tracing:   defaultTracingConfig(),
+
+		Maintenance: defaultMaintenanceConfig(),
+		Usage:       defaultUsageConfig(),
+
+		DrainHeader:     "X-Backend-Draining",
+		DrainTimeout:    defaultDrainTimeout,
+		RequestIDHeader: "X-Request-ID",
+
+		BackendFileInterval: 10 * time.Second,
+
+		RetryBudget:  RetryBudgetConfig{MinPerSecond: 10},
+		Queue:        QueueConfig{Timeout: time.Second},
+		LoadShedding: defaultLoadSheddingConfig(),
+
+		OutlierDetection: defaultOutlierConfig(),
+	}
+}
+
+// read the yaml config file on top of the defaults
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := defaultConfig()
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	cfg.files = []string{path}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.loadIncludes(path, cfg.Include, map[string]bool{abs: true}); err != nil {
+		return nil, err
+	}
+	if err := cfg.applySchedule(time.Now()); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := cfg.resolveSecrets(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := cfg.Maintenance.loadPage(&cfg.files); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, name := range sortedKeys(cfg.Pools) {
+		if f := cfg.Pools[name].Fallback; f != nil {
+			if err := f.loadPage(&cfg.files); err != nil {
+				return nil, fmt.Errorf("%s: pool %s: %w", path, name, err)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// parse the comma separated -backend flag value. Every backend can carry
+// options after the url separated by semicolons:
+//
+//	http://a:80;weight=3;max_conns=100;health=/ping
+func parseBackendList(list string) ([]BackendConfig, error) {
+	var backends []BackendConfig
+	for _, tok := range strings.Split(list, ",") {
+		tok = strings.TrimSpace(tok)
+		if tok == "" {
+			continue
+		}
+		bc, err := parseBackendSpec(tok)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, bc)
+	}
+	return backends, nil
+}
+
+func parseBackendSpec(spec string) (BackendConfig, error) {
+	parts := strings.Split(spec, ";")
+	bc := BackendConfig{URL: strings.TrimSpace(parts[0])}
+	for _, opt := range parts[1:] {
+		opt = strings.TrimSpace(opt)
+		if opt == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(opt, "=")
+		if !ok {
+			return bc, fmt.Errorf("backend %s: option %q must be key=value", bc.URL, opt)
+		}
+		if f, ok := backendFields[key]; ok {
+			bc.set.add(f)
+		}
+		var err error
+		switch key {
+		case "weight":
+			bc.Weight, err = strconv.Atoi(val)
+		case "max_conns":
+			bc.MaxConns, err = strconv.Atoi(val)
+		case "health":
+			bc.HealthPath = val
+		case "health_timeout":
+			bc.HealthTimeout, err = time.ParseDuration(val)
+		case "health_auth":
+			bc.HealthAuth = val
+		case "reset_threshold":
+			bc.ResetThreshold, err = strconv.Atoi(val)
+		case "reset_window":
+			bc.ResetWindow, err = time.ParseDuration(val)
+		case "reset_cooldown":
+			bc.ResetCooldown, err = time.ParseDuration(val)
+		case "unavailable_pause":
+			bc.UnavailablePause, err = time.ParseDuration(val)
+		case "max_retry_after":
+			bc.MaxRetryAfter, err = time.ParseDuration(val)
+		case "quarantine":
+			bc.Quarantine, err = time.ParseDuration(val)
+		case "quarantine_checks":
+			bc.QuarantineChecks, err = strconv.Atoi(val)
+		case "breaker_errors":
+			bc.BreakerErrors, err = strconv.Atoi(val)
+		case "breaker_error_rate":
+			bc.BreakerErrorRate, err = strconv.ParseFloat(val, 64)
+		case "breaker_min_requests":
+			bc.BreakerMinRequests, err = strconv.Atoi(val)
+		case "breaker_open_for":
+			bc.BreakerOpenFor, err = time.ParseDuration(val)
+		case "breaker_probes":
+			bc.BreakerProbes, err = strconv.Atoi(val)
+		case "egress_proxy":
+			bc.EgressProxy = val
+		case "ip_family":
+			bc.IPFamily = val
+		case "source_ip":
+			bc.SourceIP = val
+		case "interface":
+			bc.Interface = val
+		case "nagle":
+			bc.Nagle, err = strconv.ParseBool(val)
+		case "keepalive_idle":
+			bc.KeepAliveIdle, err = time.ParseDuration(val)
+		case "keepalive_interval":
+			bc.KeepAliveInterval, err = time.ParseDuration(val)
+		case "keepalive_count":
+			bc.KeepAliveCount, err = strconv.Atoi(val)
+		case "tcp_user_timeout":
+			bc.TCPUserTimeout, err = time.ParseDuration(val)
+		case "dial_timeout":
+			bc.DialTimeout, err = time.ParseDuration(val)
+		case "tls_handshake_timeout":
+			bc.TLSHandshakeTimeout, err = time.ParseDuration(val)
+		case "response_header_timeout":
+			bc.ResponseHeaderTimeout, err = time.ParseDuration(val)
+		case "expect_continue_timeout":
+			bc.ExpectContinueTimeout, err = time.ParseDuration(val)
+		case "max_idle_conns":
+			bc.MaxIdleConns, err = strconv.Atoi(val)
+		case "max_idle_conns_per_host":
+			bc.MaxIdleConnsPerHost, err = strconv.Atoi(val)
+		case "idle_conn_timeout":
+			bc.IdleConnTimeout, err = time.ParseDuration(val)
+		case "disable_keepalives":
+			bc.DisableKeepAlives, err = strconv.ParseBool(val)
+		case "tls_client_cert":
+			bc.TLSClientCert = val
+		case "tls_client_key":
+			bc.TLSClientKey = val
+		case "tls_ca":
+			bc.TLSCA = val
+		case "tls_min_version":
+			bc.TLSMinVersion = val
+		case "tls_max_version":
+			bc.TLSMaxVersion = val
+		case "tls_ciphers":
+			bc.TLSCiphers = val
+		case "tls_curves":
+			bc.TLSCurves = val
+		case "protocol":
+			bc.Protocol = val
+		case "proxy_protocol":
+			bc.ProxyProtocol = val
+		default:
+			return bc, fmt.Errorf("backend %s: unknown option %q", bc.URL, key)
+		}
+		if err != nil {
+			return bc, fmt.Errorf("backend %s: option %s: %w", bc.URL, key, err)
+		}
+	}
+	return bc, nil
+}
+
+// check the config before using it, nothing is applied if this fails
+func (c *Config) Validate() error {
+	if err := validatePools(c); err != nil {
+		return err
+	}
+	if c.Port <= 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid port %d", c.Port)
+	}
+	if !validStrategies[c.Strategy] {
+		return fmt.Errorf("unknown strategy %q", c.Strategy)
+	}
+	if c.Health.MinInterval <= 0 || c.Health.Interval <= 0 {
+		return fmt.Errorf("health intervals must be positive")
+	}
+	if c.Health.MinInterval > c.Health.Interval {
+		return fmt.Errorf("health min_interval (%s) must not be greater than interval (%s)", c.Health.MinInterval, c.Health.Interval)
+	}
+	if c.BackendFileInterval <= 0 {
+		return fmt.Errorf("backend_file_interval must be positive")
+	}
+	if c.Health.CertWarningDays < 0 {
+		return fmt.Errorf("health cert_warning_days must not be negative")
+	}
+
+	if _, err := parseEgressProxy(c.EgressProxy); err != nil {
+		return err
+	}
+	if err := parseIPFamily(c.IPFamily); err != nil {
+		return err
+	}
+	if err := validateRoutes(c); err != nil {
+		return err
+	}
+	if err := c.Fleet.Validate(); err != nil {
+		return err
+	}
+	if err := c.Export.Validate(); err != nil {
+		return err
+	}
+	if err := c.StatsD.Validate(); err != nil {
+		return err
+	}
+	if err := c.StatsFile.Validate(); err != nil {
+		return err
+	}
+	if err := c.Maintenance.Validate(); err != nil {
+		return err
+	}
+	if err := c.Usage.Validate(); err != nil {
+		return err
+	}
+	if err := c.AccessLog.Validate(); err != nil {
+		return err
+	}
+	if err := c.LogFile.Validate(); err != nil {
+		return err
+	}
+	if err := c.Syslog.Validate(); err != nil {
+		return err
+	}
+	if c.LogFile.Path != "" && c.Syslog.Address != "" {
+		return fmt.Errorf("log_file and syslog cant be used together")
+	}
+	if err := c.Tracing.Validate(); err != nil {
+		return err
+	}
+	if c.LogLevel != "" {
+		if _, err := parseLogLevel(c.LogLevel); err != nil {
+			return fmt.Errorf("log_level: %w", err)
+		}
+	}
+	if !validLogFormats[c.LogFormat] {
+		return fmt.Errorf("log_format must be text or json")
+	}
+	if c.MetricsAddress != "" {
+		if _, _, err := adminNetwork(c.MetricsAddress); err != nil {
+			return fmt.Errorf("metrics_address %q must be host:port or unix:/path", c.MetricsAddress)
+		}
+	}
+	if err := validateListeners(c); err != nil {
+		return err
+	}
+	if err := validatePassthrough(c); err != nil {
+		return err
+	}
+	if err := validateUDP(c); err != nil {
+		return err
+	}
+	if err := c.Resolver.Validate(); err != nil {
+		return err
+	}
+	if err := c.Admin.Validate(); err != nil {
+		return err
+	}
+	if c.DrainHeader != "" && !validHeaderName(c.DrainHeader) {
+		return fmt.Errorf("drain_header %q is not a valid header name", c.DrainHeader)
+	}
+	if c.DrainTimeout < 0 {
+		return fmt.Errorf("drain_timeout must not be negative")
+	}
+	if c.RequestIDHeader != "" && !validHeaderName(c.RequestIDHeader) {
+		return fmt.Errorf("request_id_header %q is not a valid header name", c.RequestIDHeader)
+	}
+	if c.PanicThreshold < 0 || c.PanicThreshold > 100 {
+		return fmt.Errorf("panic_threshold must be between 0 and 100")
+	}
+	for name, pc := range c.Pools {
+		if pc.PanicThreshold != nil && (*pc.PanicThreshold < 0 || *pc.PanicThreshold > 100) {
+			return fmt.Errorf("pool %s: panic_threshold must be between 0 and 100", name)
+		}
+		if pc.Strategy != "" && !validStrategies[pc.Strategy] {
+			return fmt.Errorf("pool %s: unknown strategy %q", name, pc.Strategy)
+		}
+	}
+	if err := c.RetryBudget.Validate(); err != nil {
+		return err
+	}
+	if err := c.Queue.Validate(); err != nil {
+		return err
+	}
+	if c.MaxRequests < 0 {
+		return fmt.Errorf("max_requests must not be negative")
+	}
+	if err := c.LoadShedding.Validate(); err != nil {
+		return err
+	}
+	if err := c.OutlierDetection.Validate(); err != nil {
+		return err
+	}
+	if err := c.validateWatchdog(); err != nil {
+		return err
+	}
+	if _, err := compileTags(c.Tags); err != nil {
+		return fmt.Errorf("tags: %w", err)
+	}
+
+	if c.Defaults.URL != "" {
+		return fmt.Errorf("defaults: url can not be set")
+	}
+	for name, pc := range c.effectivePools() {
+		if err := validateBackends(c.poolBackends(pc)); err != nil {
+			return fmt.Errorf("pool %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// weights above this would make the round robin ring needlessly big, for
+// the config and PATCH /admin/backends alike
+const maxWeight = 1000
+
+func validateBackends(backends []BackendConfig) error {
+	seen := make(map[string]bool)
+	for _, b := range backends {
+		u, err := parseBackendURL(b.URL)
+		if err != nil {
+			return err
+		}
+		if _, err := parseEgressProxy(b.EgressProxy); err != nil {
+			return fmt.Errorf("backend %s: %w", u, err)
+		}
+		if err := parseIPFamily(b.IPFamily); err != nil {
+			return fmt.Errorf("backend %s: %w", u, err)
+		}
+		if b.Weight < 0 || b.Weight > maxWeight {
+			return fmt.Errorf("backend %s: weight must be between 0 and %d", u, maxWeight)
+		}
+		if b.MaxConns < 0 {
+			return fmt.Errorf("backend %s: max_conns must not be negative", u)
+		}
+		if b.HealthPath != "" && !strings.HasPrefix(b.HealthPath, "/") {
+			return fmt.Errorf("backend %s: health path must start with /", u)
+		}
+		if b.HealthTimeout < 0 {
+			return fmt.Errorf("backend %s: health_timeout must not be negative", u)
+		}
+		if b.ResetThreshold < -1 || b.ResetWindow < 0 || b.ResetCooldown < 0 {
+			return fmt.Errorf("backend %s: invalid reset storm settings", u)
+		}
+		if b.MaxRetryAfter < 0 {
+			return fmt.Errorf("backend %s: max_retry_after must not be negative", u)
+		}
+		if b.Quarantine < 0 || b.QuarantineChecks < 0 {
+			return fmt.Errorf("backend %s: quarantine settings must not be negative", u)
+		}
+		if b.BreakerErrors < 0 || b.BreakerMinRequests < 0 || b.BreakerOpenFor < 0 || b.BreakerProbes < 0 {
+			return fmt.Errorf("backend %s: breaker settings must not be negative", u)
+		}
+		if b.BreakerErrorRate < 0 || b.BreakerErrorRate > 1 {
+			return fmt.Errorf("backend %s: breaker_error_rate must be between 0 and 1", u)
+		}
+		if err := validateDialOptions(b); err != nil {
+			return fmt.Errorf("backend %s: %w", u, err)
+		}
+		if err := validateTransport(b); err != nil {
+			return fmt.Errorf("backend %s: %w", u, err)
+		}
+		if _, err := backendTLSConfig(b); err != nil {
+			return fmt.Errorf("backend %s: %w", u, err)
+		}
+		if err := validateProtocol(b, u.Scheme); err != nil {
+			return fmt.Errorf("backend %s: %w", u, err)
+		}
+		if !validProxyProtocols[b.ProxyProtocol] {
+			return fmt.Errorf("backend %s: proxy_protocol must be v1 or v2", u)
+		}
+		if b.ProxyProtocol != "" && b.Protocol == protocolH2C {
+			return fmt.Errorf("backend %s: proxy_protocol doesnt go with h2c, an http/2 connection carries many clients", u)
+		}
+		if seen[u.String()] {
+			return fmt.Errorf("duplicate backend %s", u)
+		}
+		seen[u.String()] = true
+	}
+	return nil
+}
+
+func parseBackendURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("backend %q: %w", raw, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("backend %q: scheme must be http or https", raw)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("backend %q: missing host", raw)
+	}
+	return u, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// backend configs of a pool with the global defaults filled in
+func (c *Config) poolBackends(pc PoolConfig) []BackendConfig {
+	backends := make([]BackendConfig, 0, len(pc.Backends))
+	for _, b := range pc.Backends {
+		b = mergeBackendDefaults(b, c.Defaults)
+		if !b.isSet("egress_proxy") {
+			b.EgressProxy = c.EgressProxy
+		}
+		if !b.isSet("ip_family") {
+			b.IPFamily = c.IPFamily
+		}
+		if b.Weight == 0 {
+			b.Weight = 1
+		}
+		backends = append(backends, b)
+	}
+	return backends
+}
+
+// fill every option the backend doesnt set itself from the defaults block.
+// An option set to 0, false or "" is kept, that is how a backend turns a
+// default off.
+func mergeBackendDefaults(b, defaults BackendConfig) BackendConfig {
+	bv := reflect.ValueOf(&b).Elem()
+	dv := reflect.ValueOf(defaults)
+	for _, i := range backendFields {
+		if !b.set.has(i) && defaults.set.has(i) {
+			bv.Field(i).Set(dv.Field(i))
+			b.set.add(i)
+		}
+	}
+	return b
+}
+
+// describe what changed between two configs, used when reloading
+func diffConfig(old, new *Config) []string {
+	var changes []string
+
+	oldPools := old.effectivePools()
+	newPools := new.effectivePools()
+	for _, name := range sortedKeys(newPools) {
+		if _, ok := oldPools[name]; !ok {
+			changes = append(changes, "+ pool "+name)
+		} else if !reflect.DeepEqual(oldPools[name].RouteSettings, newPools[name].RouteSettings) {
+			changes = append(changes, "~ pool "+name+" route settings")
+		}
+		if _, ok := oldPools[name]; ok && !reflect.DeepEqual(oldPools[name].PanicThreshold, newPools[name].PanicThreshold) {
+			changes = append(changes, "~ pool "+name+" panic_threshold")
+		}
+		if _, ok := oldPools[name]; ok && oldPools[name].Strategy != newPools[name].Strategy {
+			changes = append(changes, "~ pool "+name+" strategy")
+		}
+		if _, ok := oldPools[name]; ok && !reflect.DeepEqual(oldPools[name].Fallback, newPools[name].Fallback) {
+			changes = append(changes, "~ pool "+name+" fallback")
+		}
+
+		oldBackends := make(map[string]BackendConfig)
+		for _, b := range old.poolBackends(oldPools[name]) {
+			oldBackends[b.URL] = b
+		}
+		newBackends := make(map[string]bool)
+		for _, b := range new.poolBackends(newPools[name]) {
+			newBackends[b.URL] = true
+			prev, ok := oldBackends[b.URL]
+			if !ok {
+				changes = append(changes, "+ backend "+b.URL+" (pool "+name+")")
+			} else if prev != b {
+				changes = append(changes, "~ backend "+b.URL+" (pool "+name+")")
+			}
+		}
+		for _, b := range oldPools[name].Backends {
+			if !newBackends[b.URL] {
+				changes = append(changes, "- backend "+b.URL+" (pool "+name+")")
+			}
+		}
+	}
+	for _, name := range sortedKeys(oldPools) {
+		if _, ok := newPools[name]; !ok {
+			changes = append(changes, "- pool "+name)
+		}
+	}
+
+	if !reflect.DeepEqual(old.Resolver, new.Resolver) {
+		changes = append(changes, "~ resolver")
+	}
+	if old.Defaults != new.Defaults {
+		changes = append(changes, "~ backend defaults")
+	}
+	if old.Port != new.Port {
+		changes = append(changes, fmt.Sprintf("~ port %d -> %d (restart required)", old.Port, new.Port))
+	}
+	if !reflect.DeepEqual(old.RouteSettings, new.RouteSettings) {
+		changes = append(changes, "~ global route settings")
+	}
+	oldRoutes := make(map[string]RouteConfig)
+	for _, r := range old.Routes {
+		oldRoutes[r.hostPath()] = r
+	}
+	newRoutes := make(map[string]bool)
+	for _, r := range new.Routes {
+		newRoutes[r.hostPath()] = true
+		prev, ok := oldRoutes[r.hostPath()]
+		if !ok {
+			changes = append(changes, "+ route "+r.hostPath())
+		} else if !reflect.DeepEqual(prev, r) {
+			changes = append(changes, "~ route "+r.hostPath())
+		}
+	}
+	for _, r := range old.Routes {
+		if !newRoutes[r.hostPath()] {
+			changes = append(changes, "- route "+r.hostPath())
+		}
+	}
+
+	if !reflect.DeepEqual(listenerBindings(old.Listeners), listenerBindings(new.Listeners)) {
+		changes = append(changes, "~ listeners (restart required)")
+	} else {
+		for i, l := range new.Listeners {
+			if l.certificatesChanged(old.Listeners[i]) {
+				changes = append(changes, "~ listener "+l.Address+" certificate")
+			}
+			if !bytes.Equal(l.clientCAPEM, old.Listeners[i].clientCAPEM) {
+				changes = append(changes, "~ listener "+l.Address+" client ca")
+			}
+			o := old.Listeners[i]
+			if l.RateLimit != o.RateLimit || l.RateBurst != o.RateBurst || !reflect.DeepEqual(l.RouteSettings, o.RouteSettings) {
+				changes = append(changes, "~ listener "+l.Address+" overrides")
+			}
+		}
+	}
+	if (old.TLSCert == "") != (new.TLSCert == "") {
+		changes = append(changes, "~ tls_cert (restart required)")
+	} else if !bytes.Equal(old.certPEM, new.certPEM) || !bytes.Equal(old.keyPEM, new.keyPEM) {
+		changes = append(changes, "~ port certificate")
+	}
+	if old.TLSMinVersion != new.TLSMinVersion || old.TLSMaxVersion != new.TLSMaxVersion || old.TLSCiphers != new.TLSCiphers || old.TLSCurves != new.TLSCurves {
+		changes = append(changes, "~ port tls versions and ciphers (restart required)")
+	}
+	if old.HTTP3 != new.HTTP3 {
+		changes = append(changes, "~ http3 (restart required)")
+	}
+	if old.H2C != new.H2C {
+		changes = append(changes, "~ h2c (restart required)")
+	}
+	if old.ProxyProtocol != new.ProxyProtocol {
+		changes = append(changes, "~ proxy_protocol (restart required)")
+	}
+	if old.RedirectHTTP != new.RedirectHTTP {
+		changes = append(changes, "~ redirect_http (restart required)")
+	}
+	if old.AccessLog != new.AccessLog {
+		changes = append(changes, "~ access_log")
+	}
+	if !reflect.DeepEqual(old.Tracing, new.Tracing) {
+		changes = append(changes, "~ tracing (restart required)")
+	}
+	if old.LogLevel != new.LogLevel {
+		changes = append(changes, fmt.Sprintf("~ log_level %s -> %s", levelNames[configLogLevel(old.LogLevel)], levelNames[configLogLevel(new.LogLevel)]))
+	}
+	if old.LogFile != new.LogFile {
+		changes = append(changes, "~ log_file (restart required)")
+	}
+	if old.Syslog != new.Syslog {
+		changes = append(changes, "~ syslog (restart required)")
+	}
+	if old.LogFormat != new.LogFormat {
+		changes = append(changes, "~ log_format (restart required)")
+	}
+	if old.MetricsAddress != new.MetricsAddress {
+		changes = append(changes, "~ metrics_address (restart required)")
+	}
+	if old.UnixSocket != new.UnixSocket || old.SocketMode != new.SocketMode {
+		changes = append(changes, "~ unix_socket (restart required)")
+	}
+	if !reflect.DeepEqual(udpAddresses(old.UDP), udpAddresses(new.UDP)) {
+		changes = append(changes, "~ udp listeners (restart required)")
+	} else {
+		for i, u := range new.UDP {
+			if !reflect.DeepEqual(u, old.UDP[i]) {
+				changes = append(changes, "~ udp "+u.Address)
+			}
+		}
+	}
+	if !reflect.DeepEqual(passthroughAddresses(old.Passthrough), passthroughAddresses(new.Passthrough)) {
+		changes = append(changes, "~ passthrough listeners (restart required)")
+	} else {
+		for i, p := range new.Passthrough {
+			if !reflect.DeepEqual(p, old.Passthrough[i]) {
+				changes = append(changes, "~ passthrough "+p.Address)
+			}
+		}
+	}
+	if old.Strategy != new.Strategy {
+		changes = append(changes, fmt.Sprintf("~ strategy %s -> %s", old.Strategy, new.Strategy))
+	}
+	if !reflect.DeepEqual(scheduleTimes(old), scheduleTimes(new)) {
+		changes = append(changes, "~ schedule")
+	}
+	if !reflect.DeepEqual(old.applied, new.applied) {
+		changes = append(changes, fmt.Sprintf("~ scheduled changes in effect: [%s] -> [%s]", strings.Join(old.applied, ", "), strings.Join(new.applied, ", ")))
+	}
+	if old.DrainHeader != new.DrainHeader {
+		changes = append(changes, fmt.Sprintf("~ drain_header %q -> %q", old.DrainHeader, new.DrainHeader))
+	}
+	if old.DrainTimeout != new.DrainTimeout {
+		changes = append(changes, fmt.Sprintf("~ drain_timeout %s -> %s", old.DrainTimeout, new.DrainTimeout))
+	}
+	if old.RequestIDHeader != new.RequestIDHeader {
+		changes = append(changes, fmt.Sprintf("~ request_id_header %q -> %q", old.RequestIDHeader, new.RequestIDHeader))
+	}
+	if old.PanicThreshold != new.PanicThreshold {
+		changes = append(changes, fmt.Sprintf("~ panic_threshold %d -> %d", old.PanicThreshold, new.PanicThreshold))
+	}
+	if old.RetryBudget != new.RetryBudget {
+		changes = append(changes, fmt.Sprintf("~ retry_budget %g -> %g", old.RetryBudget.Ratio, new.RetryBudget.Ratio))
+	}
+	if old.Queue != new.Queue {
+		changes = append(changes, fmt.Sprintf("~ queue depth %d -> %d, timeout %s -> %s", old.Queue.Depth, new.Queue.Depth, old.Queue.Timeout, new.Queue.Timeout))
+	}
+	if old.MaxRequests != new.MaxRequests {
+		changes = append(changes, fmt.Sprintf("~ max_requests %d -> %d", old.MaxRequests, new.MaxRequests))
+	}
+	if !reflect.DeepEqual(old.LoadShedding, new.LoadShedding) {
+		changes = append(changes, "~ load_shedding")
+	}
+	if old.OutlierDetection != new.OutlierDetection {
+		changes = append(changes, "~ outlier_detection")
+	}
+	if !reflect.DeepEqual(old.Tags, new.Tags) {
+		changes = append(changes, "~ tags")
+	}
+	if old.StrictParsing != new.StrictParsing {
+		changes = append(changes, "~ strict_parsing (restart required)")
+	}
+	if old.BackendFile != new.BackendFile {
+		changes = append(changes, fmt.Sprintf("~ backend_file %q -> %q", old.BackendFile, new.BackendFile))
+	}
+	if old.Admin.Enabled != new.Admin.Enabled {
+		changes = append(changes, "~ admin enabled (restart required)")
+	}
+	if old.Admin.Address != new.Admin.Address {
+		changes = append(changes, fmt.Sprintf("~ admin address %q -> %q (restart required)", old.Admin.Address, new.Admin.Address))
+	}
+	if old.Admin.Token != new.Admin.Token || old.Admin.Username != new.Admin.Username || old.Admin.Password != new.Admin.Password {
+		changes = append(changes, "~ admin credentials")
+	}
+	if old.Admin.History != new.Admin.History {
+		changes = append(changes, fmt.Sprintf("~ admin history %d -> %d", old.Admin.History, new.Admin.History))
+	}
+	if old.Admin.SnapshotInterval != new.Admin.SnapshotInterval || old.Admin.SnapshotRetention != new.Admin.SnapshotRetention {
+		changes = append(changes, fmt.Sprintf("~ admin snapshots every %s for %s", new.Admin.SnapshotInterval, new.Admin.SnapshotRetention))
+	}
+	if old.Admin.AuditLog != new.Admin.AuditLog {
+		changes = append(changes, "~ admin audit_log")
+	}
+	if old.Admin.Pprof != new.Admin.Pprof {
+		changes = append(changes, fmt.Sprintf("~ admin pprof %s", map[bool]string{true: "on", false: "off"}[new.Admin.Pprof]))
+	}
+	if old.Maintenance.Enabled != new.Maintenance.Enabled {
+		changes = append(changes, fmt.Sprintf("~ maintenance mode %s", map[bool]string{true: "on", false: "off"}[new.Maintenance.Enabled]))
+	}
+	if !reflect.DeepEqual(old.Maintenance, new.Maintenance) {
+		changes = append(changes, "~ maintenance response")
+	}
+	if !reflect.DeepEqual(old.Watchdog, new.Watchdog) {
+		changes = append(changes, "~ watchdog")
+	}
+	if old.Fleet != new.Fleet {
+		changes = append(changes, "~ fleet (used from the next reload on)")
+	}
+	if old.Export != new.Export {
+		changes = append(changes, "~ export")
+	}
+	if !reflect.DeepEqual(old.StatsD, new.StatsD) {
+		changes = append(changes, "~ statsd")
+	}
+	if old.StatsFile != new.StatsFile {
+		changes = append(changes, "~ stats_file")
+	}
+	if old.Usage != new.Usage {
+		changes = append(changes, "~ usage")
+	}
+	if old.Health.Interval != new.Health.Interval || old.Health.MinInterval != new.Health.MinInterval {
+		changes = append(changes, fmt.Sprintf("~ health %s/%s -> %s/%s (restart required)",
+			old.Health.Interval, old.Health.MinInterval, new.Health.Interval, new.Health.MinInterval))
+	}
+	if old.Health.CertWarningDays != new.Health.CertWarningDays {
+		changes = append(changes, fmt.Sprintf("~ health cert_warning_days %d -> %d", old.Health.CertWarningDays, new.Health.CertWarningDays))
+	}
+	return changes
+}
+
+// when each scheduled change is due, by name
+func scheduleTimes(c *Config) map[string]time.Time {
+	times := make(map[string]time.Time)
+	for _, sc := range c.Scheduled {
+		times[sc.Name] = sc.At
+	}
+	return times
+}
+
+// the listeners without the loaded certificates and the overrides, to tell
+// what a reload applies (a rotated certificate, other limits) from a changed
+// listener
+func listenerBindings(listeners []ListenerConfig) []ListenerConfig {
+	out := make([]ListenerConfig, len(listeners))
+	for i, l := range listeners {
+		l.certPEM, l.keyPEM, l.clientCAPEM, l.Certificates = nil, nil, nil, nil
+		l.RateLimit, l.RateBurst, l.RouteSettings = 0, 0, RouteSettings{}
+		out[i] = l
+	}
+	return out
+}
+
+// put together the effective config: defaults, then the config file (if any),
+// then every flag that was explicitly set on the command line
+func resolveConfig(configPath string, flags *Config, serverList string) (*Config, error) {
+	cfg := defaultConfig()
+	if configPath != "" {
+		fileCfg, err := LoadConfig(configPath)
+		if err != nil {
+			return nil, err
+		}
+		cfg = fileCfg
+	}
+
+	var err error
+	// the certificate is read once both flags are in
+	tlsFlags := false
+	flag.Visit(func(f *flag.Flag) {
+		if err != nil {
+			// keep the first error, a later flag would overwrite it
+			return
+		}
+		switch f.Name {
+		case "backend":
+			if cfg.Backends, err = parseBackendList(serverList); err != nil {
+				return
+			}
+			for i := range cfg.Backends {
+				if err = cfg.Backends[i].resolveSecrets(nil); err != nil {
+					return
+				}
+			}
+		case "port":
+			cfg.Port = flags.Port
+		case "strategy":
+			cfg.Strategy = flags.Strategy
+		case "health-interval":
+			cfg.Health.Interval = flags.Health.Interval
+		case "health-min-interval":
+			cfg.Health.MinInterval = flags.Health.MinInterval
+		case "egress-proxy":
+			cfg.EgressProxy, err = resolveSecret(flags.EgressProxy, nil)
+		case "ip-family":
+			cfg.IPFamily = flags.IPFamily
+		case "admin":
+			cfg.Admin.Enabled = flags.Admin.Enabled
+		case "access-log":
+			cfg.AccessLog.Output = flags.AccessLog.Output
+		case "access-log-format":
+			cfg.AccessLog.Format = flags.AccessLog.Format
+		case "tracing-endpoint":
+			cfg.Tracing.Endpoint = flags.Tracing.Endpoint
+		case "statsd-address":
+			cfg.StatsD.Address = flags.StatsD.Address
+		case "log-level", "quiet":
+			cfg.LogLevel = flags.LogLevel
+		case "log-file":
+			cfg.LogFile.Path = flags.LogFile.Path
+		case "syslog":
+			cfg.Syslog.Address = flags.Syslog.Address
+		case "syslog-facility":
+			cfg.Syslog.Facility = flags.Syslog.Facility
+		case "log-format":
+			cfg.LogFormat = flags.LogFormat
+		case "stats-file":
+			cfg.StatsFile.Path = flags.StatsFile.Path
+		case "metrics-address":
+			cfg.MetricsAddress = flags.MetricsAddress
+		case "admin-address":
+			cfg.Admin.Address = flags.Admin.Address
+		case "admin-token":
+			cfg.Admin.Token, err = resolveSecret(flags.Admin.Token, nil)
+		case "admin-audit-log":
+			cfg.Admin.AuditLog.Path = flags.Admin.AuditLog.Path
+		case "admin-pprof":
+			cfg.Admin.Pprof = flags.Admin.Pprof
+		case "watchdog":
+			cfg.Watchdog.Enabled = flags.Watchdog.Enabled
+		case "strict-parsing":
+			cfg.StrictParsing = flags.StrictParsing
+		case "retry-delay":
+			cfg.RetryDelay = durationPtr(*flags.RetryDelay)
+		case "retry-backoff":
+			cfg.RetryBackoff = floatPtr(*flags.RetryBackoff)
+		case "retry-max-delay":
+			cfg.RetryMaxDelay = durationPtr(*flags.RetryMaxDelay)
+		case "retry-jitter":
+			cfg.RetryJitter = floatPtr(*flags.RetryJitter)
+		case "slow-threshold":
+			cfg.SlowThreshold = durationPtr(*flags.SlowThreshold)
+		case "request-timeout":
+			cfg.RequestTimeout = durationPtr(*flags.RequestTimeout)
+		case "retry-budget":
+			cfg.RetryBudget.Ratio = flags.RetryBudget.Ratio
+		case "queue-depth":
+			cfg.Queue.Depth = flags.Queue.Depth
+		case "queue-timeout":
+			cfg.Queue.Timeout = flags.Queue.Timeout
+		case "max-requests":
+			cfg.MaxRequests = flags.MaxRequests
+		case "drain-timeout":
+			cfg.DrainTimeout = flags.DrainTimeout
+		case "backend-file":
+			cfg.BackendFile = flags.BackendFile
+		case "backend-file-interval":
+			cfg.BackendFileInterval = flags.BackendFileInterval
+		case "tls-cert":
+			cfg.TLSCert, tlsFlags = flags.TLSCert, true
+		case "tls-key":
+			cfg.TLSKey, tlsFlags = flags.TLSKey, true
+		case "tls-min-version":
+			cfg.TLSMinVersion = flags.TLSMinVersion
+		case "tls-max-version":
+			cfg.TLSMaxVersion = flags.TLSMaxVersion
+		case "tls-ciphers":
+			cfg.TLSCiphers = flags.TLSCiphers
+		case "tls-curves":
+			cfg.TLSCurves = flags.TLSCurves
+		case "http3":
+			cfg.HTTP3 = flags.HTTP3
+		case "h2c":
+			cfg.H2C = flags.H2C
+		case "proxy-protocol":
+			cfg.ProxyProtocol = flags.ProxyProtocol
+		case "redirect-http":
+			cfg.RedirectHTTP = flags.RedirectHTTP
+		case "unix-socket":
+			cfg.UnixSocket = flags.UnixSocket
+		case "socket-mode":
+			cfg.SocketMode = flags.SocketMode
+		}
+	})
+	if err == nil && tlsFlags {
+		err = cfg.loadCertificate()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.BackendFile != "" {
+		if len(cfg.Backends) > 0 {
+			return nil, fmt.Errorf("backends can not be set together with a backend file")
+		}
+		if cfg.Backends, err = readBackendFile(cfg.BackendFile); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestBackendDefaults(t *testing.T) {
+	data := `
+egress_proxy: socks5://proxy:1080
+defaults:
+  health: /healthz
+  dial_timeout: 5s
+  nagle: true
+  disable_keepalives: true
+  max_conns: 10
+backends:
+  - url: http://inherits:80
+  - url: http://overrides:80
+    health: ""
+    dial_timeout: 0s
+    nagle: false
+    disable_keepalives: false
+    max_conns: 0
+    egress_proxy: ""
+  - http://spec:80;nagle=false;max_conns=0
+`
+	cfg := defaultConfig()
+	if err := yaml.Unmarshal([]byte(data), cfg); err != nil {
+		t.Fatal(err)
+	}
+	backends := cfg.poolBackends(cfg.effectivePools()[cfg.defaultPool()])
+	if len(backends) != 3 {
+		t.Fatalf("got %d backends, want 3", len(backends))
+	}
+
+	inherits := backends[0]
+	if inherits.HealthPath != "/healthz" || inherits.DialTimeout != 5*time.Second ||
+		!inherits.Nagle || !inherits.DisableKeepAlives || inherits.MaxConns != 10 ||
+		inherits.EgressProxy != "socks5://proxy:1080" {
+		t.Errorf("backend without options didnt take the defaults: %+v", inherits)
+	}
+
+	overrides := backends[1]
+	if overrides.HealthPath != "" || overrides.DialTimeout != 0 || overrides.Nagle ||
+		overrides.DisableKeepAlives || overrides.MaxConns != 0 || overrides.EgressProxy != "" {
+		t.Errorf("backend setting options to zero got the defaults: %+v", overrides)
+	}
+
+	spec := backends[2]
+	if spec.Nagle || spec.MaxConns != 0 {
+		t.Errorf("backend spec setting options to zero got the defaults: %+v", spec)
+	}
+	if spec.HealthPath != "/healthz" || !spec.DisableKeepAlives {
+		t.Errorf("backend spec didnt take the other defaults: %+v", spec)
+	}
+}
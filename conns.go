@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// connStats counts the connections to a backend that carry traffic, the
+// ones of the transport and of passthrough. Health checks dial on their own
+// and arent counted. Comparing opened with the requests shows how well the
+// connections are reused.
+type connStats struct {
+	open   atomic.Int64
+	opened atomic.Uint64
+
+	// the open connections, so they can be cut when the backend is gone
+	mu    sync.Mutex
+	conns map[*countedConn]struct{}
+}
+
+// dial counts the connections it makes until they are closed
+func (c *connStats) counting(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return c.track(conn), nil
+	}
+}
+
+func (c *connStats) track(conn net.Conn) net.Conn {
+	c.open.Add(1)
+	c.opened.Add(1)
+	counted := &countedConn{Conn: conn, stats: c}
+	c.mu.Lock()
+	if c.conns == nil {
+		c.conns = make(map[*countedConn]struct{})
+	}
+	c.conns[counted] = struct{}{}
+	c.mu.Unlock()
+	return counted
+}
+
+// close every connection still open, busy or not. Returns how many there
+// were.
+func (c *connStats) closeAll() int {
+	c.mu.Lock()
+	conns := make([]*countedConn, 0, len(c.conns))
+	for conn := range c.conns {
+		conns = append(conns, conn)
+	}
+	c.mu.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return len(conns)
+}
+
+type countedConn struct {
+	net.Conn
+	stats  *connStats
+	closed sync.Once
+}
+
+// the transport and passthrough may both close a connection more than once
+func (c *countedConn) Close() error {
+	c.closed.Do(func() {
+		c.stats.open.Add(-1)
+		c.stats.mu.Lock()
+		delete(c.stats.conns, c)
+		c.stats.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// kept for passthrough, which half closes the connection when the client is
+// done sending
+func (c *countedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "time"
+
+// cpu time the process used so far, only measured on linux
+func processCPUTime() (time.Duration, bool) {
+	return 0, false
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// adminClient talks to the admin api of a running load balancer, for the
+// lb status, lb drain and lb add commands
+type adminClient struct {
+	client   *http.Client
+	base     string
+	token    string
+	username string
+	password string
+}
+
+// the flags every command has. The defaults come from LB_ADMIN_ADDRESS and
+// LB_ADMIN_TOKEN, which the load balancer reads too, so on its host they
+// usually just work.
+func adminClientFlags(fs *flag.FlagSet) func() (*adminClient, error) {
+	address := fs.String("address", envOr("LB_ADMIN_ADDRESS", "localhost:3030"), "Admin api of the load balancer, host:port or unix:/path")
+	token := fs.String("token", os.Getenv("LB_ADMIN_TOKEN"), "Bearer token of the admin api (file:// and env:// allowed)")
+	username := fs.String("username", os.Getenv("LB_ADMIN_USERNAME"), "Basic auth user of the admin api")
+	password := fs.String("password", os.Getenv("LB_ADMIN_PASSWORD"), "Basic auth password of the admin api (file:// and env:// allowed)")
+	return func() (*adminClient, error) {
+		network, addr, err := adminNetwork(*address)
+		if err != nil {
+			return nil, err
+		}
+		c := &adminClient{base: "http://" + addr, username: *username}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if network == "unix" {
+			c.base = "http://lb"
+			transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", addr)
+			}
+		}
+		c.client = &http.Client{Transport: transport, Timeout: 30 * time.Second}
+		if c.token, err = resolveSecret(*token, nil); err != nil {
+			return nil, err
+		}
+		if c.password, err = resolveSecret(*password, nil); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// send a request with body (nil for none) as json and decode the answer
+// into out. An answer other than 2xx is returned as the error.
+func (c *adminClient) do(method, path string, body, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.base+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &e) == nil && e.Error != "" {
+			return fmt.Errorf("%s %s: %s", method, path, e.Error)
+		}
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// find a backend by its id or its url, pool narrows it down when the url is
+// in several pools
+func (c *adminClient) findBackend(ref, pool string) (backendJSON, error) {
+	var list []backendJSON
+	if err := c.do(http.MethodGet, "/admin/backends", nil, &list); err != nil {
+		return backendJSON{}, err
+	}
+	var found []backendJSON
+	for _, b := range list {
+		if pool != "" && b.Pool != pool {
+			continue
+		}
+		if b.ID == ref || b.URL == ref || b.URL == backendKey(ref) {
+			found = append(found, b)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return backendJSON{}, fmt.Errorf("no backend %s", ref)
+	case 1:
+		return found[0], nil
+	}
+	return backendJSON{}, fmt.Errorf("backend %s is in several pools, pick one with -pool", ref)
+}
+
+func printBackends(w io.Writer, list []backendJSON) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tPOOL\tURL\tSTATUS\tHEALTH\tWEIGHT\tIN FLIGHT")
+	for _, b := range list {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%d\n", b.ID, b.Pool, b.URL, b.Status, healthWord(b.Alive), b.Weight, b.InFlight)
+	}
+	tw.Flush()
+}
+
+// lb status: the backends of the running load balancer
+func runStatus(args []string) int {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	client := adminClientFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: lb status [-address host:port]")
+		return 2
+	}
+	c, err := client()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var list []backendJSON
+	if err := c.do(http.MethodGet, "/admin/backends", nil, &list); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var maintenance struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := c.do(http.MethodGet, "/admin/maintenance", nil, &maintenance); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if maintenance.Enabled {
+		fmt.Println("Maintenance mode is on, every request gets the maintenance response")
+		fmt.Println()
+	}
+	printBackends(os.Stdout, list)
+	return 0
+}
+
+// lb drain [-undo] <id or url>
+func runDrain(args []string) int {
+	fs := flag.NewFlagSet("drain", flag.ExitOnError)
+	client := adminClientFlags(fs)
+	pool := fs.String("pool", "", "Pool of the backend, when its url is in several pools")
+	undo := fs.Bool("undo", false, "End the drain, the backend takes requests again")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: lb drain [-undo] [-pool name] <backend id or url>")
+		return 2
+	}
+	c, err := client()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	b, err := c.findBackend(fs.Arg(0), *pool)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	method := http.MethodPost
+	if *undo {
+		method = http.MethodDelete
+	}
+	if err := c.do(method, "/admin/backends/"+b.ID+"/drain", nil, &b); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	printBackends(os.Stdout, []backendJSON{b})
+	return 0
+}
+
+// lb add [-pool name] [-weight n] <url>
+func runAdd(args []string) int {
+	fs := flag.NewFlagSet("add", flag.ExitOnError)
+	client := adminClientFlags(fs)
+	pool := fs.String("pool", "", "Pool to add the backend to (the default pool if empty)")
+	weight := fs.Int("weight", 0, "Weight of the backend (the defaults of the config if 0)")
+	health := fs.String("health", "", "Path the health check probes")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: lb add [-pool name] [-weight n] [-health /path] <url>")
+		return 2
+	}
+	c, err := client()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	body := map[string]interface{}{"url": fs.Arg(0)}
+	if *pool != "" {
+		body["pool"] = *pool
+	}
+	if *weight != 0 {
+		body["weight"] = *weight
+	}
+	if *health != "" {
+		body["health"] = *health
+	}
+	var b backendJSON
+	if err := c.do(http.MethodPost, "/admin/backends", body, &b); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	printBackends(os.Stdout, []backendJSON{b})
+	return 0
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// the last errors proxying requests, newest last
+type errorLog struct {
+	mu      sync.Mutex
+	entries []errorEntry
+}
+
+type errorEntry struct {
+	Time    time.Time `json:"time"`
+	Pool    string    `json:"pool,omitempty"`
+	Backend string    `json:"backend,omitempty"`
+	Path    string    `json:"path"`
+	Error   string    `json:"error"`
+}
+
+const recentErrorsKept = 50
+
+var recentErrors errorLog
+
+func (l *errorLog) Add(e errorEntry) {
+	e.Time = time.Now()
+	l.mu.Lock()
+	l.entries = append(l.entries, e)
+	if len(l.entries) > recentErrorsKept {
+		l.entries = append([]errorEntry(nil), l.entries[len(l.entries)-recentErrorsKept:]...)
+	}
+	l.mu.Unlock()
+}
+
+// newest first
+func (l *errorLog) Recent() []errorEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	recent := make([]errorEntry, 0, len(l.entries))
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		recent = append(recent, l.entries[i])
+	}
+	return recent
+}
+
+type backendStatusJSON struct {
+	backendJSON
+	Requests uint64  `json:"requests"`
+	P50Ms    float64 `json:"p50_ms"`
+	P90Ms    float64 `json:"p90_ms"`
+	P99Ms    float64 `json:"p99_ms"`
+	// the last 30 to 60 seconds, the rest is since the start
+	Recent recentStatsJSON `json:"recent"`
+}
+
+// GET /admin/status, everything the dashboard shows in one poll
+func handleStatus(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"time":     time.Now(),
+		"backends": backendStatuses(),
+		"errors":   recentErrors.Recent(),
+	})
+}
+
+// every backend of the active pools with its numbers, for the status and the
+// stats file
+func backendStatuses() []backendStatusJSON {
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	backends := []backendStatusJSON{}
+	for _, pool := range activePools.Load().All() {
+		for _, b := range pool.backends {
+			backends = append(backends, backendStatusJSON{
+				backendJSON: newBackendJSON(pool.name, b),
+				Requests:    b.requests.Load(),
+				P50Ms:       ms(b.latency.Quantile(0.5)),
+				P90Ms:       ms(b.latency.Quantile(0.9)),
+				P99Ms:       ms(b.latency.Quantile(0.99)),
+				Recent:      b.recent.Recent().JSON(),
+			})
+		}
+	}
+	return backends
+}
+
+// GET /admin/dashboard, a page polling /admin/status
+func handleDashboard(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardHTML)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// keepalive the backend connections get when the backend doesnt set its own
+const defaultKeepAliveIdle = 30 * time.Second
+
+// the socket settings of a backend for the connections to it: the source
+// address or interface, nagle and tcp keepalive and user timeout
+func backendNetDialer(bc BackendConfig) *net.Dialer {
+	d := &net.Dialer{Timeout: bc.dialTimeout()}
+	if bc.SourceIP != "" {
+		d.LocalAddr = &net.TCPAddr{IP: net.ParseIP(bc.SourceIP)}
+	}
+	if bc.KeepAliveIdle < 0 {
+		d.KeepAlive = -1
+	} else {
+		d.KeepAliveConfig = net.KeepAliveConfig{
+			Enable: true,
+			Idle:   bc.KeepAliveIdle,
+			// 0 is the go default (15s interval, 9 probes)
+			Interval: bc.KeepAliveInterval,
+			Count:    bc.KeepAliveCount,
+		}
+		if d.KeepAliveConfig.Idle == 0 {
+			d.KeepAliveConfig.Idle = defaultKeepAliveIdle
+		}
+	}
+	if bc.Interface != "" || bc.TCPUserTimeout > 0 {
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = setSocketOptions(fd, bc.Interface, bc.TCPUserTimeout)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+	return d
+}
+
+// go turns nagle off on every tcp connection, it can only be turned on
+// again once the connection is open
+func withNagle(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.SetNoDelay(false)
+		}
+		return conn, nil
+	}
+}
+
+func validateDialOptions(bc BackendConfig) error {
+	if bc.SourceIP != "" && net.ParseIP(bc.SourceIP) == nil {
+		return fmt.Errorf("source_ip %q is not an ip address", bc.SourceIP)
+	}
+	if bc.Interface != "" {
+		if !linuxSocketOptions {
+			return fmt.Errorf("interface is only supported on linux")
+		}
+		if _, err := net.InterfaceByName(bc.Interface); err != nil {
+			return fmt.Errorf("interface %q: %w", bc.Interface, err)
+		}
+	}
+	if bc.KeepAliveInterval < 0 || bc.KeepAliveCount < 0 {
+		return fmt.Errorf("invalid keepalive settings")
+	}
+	if bc.TCPUserTimeout < 0 {
+		return fmt.Errorf("tcp_user_timeout must not be negative")
+	}
+	if bc.TCPUserTimeout > 0 && !linuxSocketOptions {
+		return fmt.Errorf("tcp_user_timeout is only supported on linux")
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+// ids of the backends disabled through the admin api, so a backend that a
+// reload creates again stays disabled
+var disabledBackends sync.Map
+
+// a disabled backend gets no requests, whatever its health checks say, not
+// even in panic mode. It is still probed, so it is known whether it is up
+// when it gets enabled again.
+func (b *Backend) Disabled() bool {
+	return b.disabled.Load()
+}
+
+func (b *Backend) SetDisabled(pool string, disabled bool) {
+	if disabled {
+		disabledBackends.Store(backendID(pool, b.URL.String()), true)
+	} else {
+		disabledBackends.Delete(backendID(pool, b.URL.String()))
+	}
+	b.disabled.Store(disabled)
+}
+
+// for backends created by NewPools
+func isDisabled(pool string, b *Backend) bool {
+	_, ok := disabledBackends.Load(backendID(pool, b.URL.String()))
+	return ok
+}
+
+// POST /admin/backends/{id}/disable takes a backend out for maintenance,
+// DELETE enables it again
+func handleDisable(w http.ResponseWriter, req *http.Request) {
+	pool, b := findBackend(req.PathValue("id"))
+	if b == nil {
+		writeError(w, http.StatusNotFound, "no backend with id "+req.PathValue("id"))
+		return
+	}
+	disabled := req.Method == http.MethodPost
+	if b.Disabled() != disabled {
+		b.SetDisabled(pool, disabled)
+		if disabled {
+			infof("Admin: disabled backend %s (pool %s), %d request(s) in flight\n", b.URL, pool, b.inFlight.Load())
+			// the requests in flight get the drain timeout to finish
+			go b.drainConnections("disabled", activePools.Load().drainTimeout, b.Disabled)
+		} else {
+			infof("Admin: enabled backend %s (pool %s), it is %s\n", b.URL, pool, healthWord(b.IsAlive()))
+		}
+	}
+	writeJSON(w, http.StatusOK, newBackendJSON(pool, b))
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ResolverConfig replaces the system resolver for backend hostnames
+type ResolverConfig struct {
+	// host:port of the dns servers, port defaults to 53. Empty keeps the system resolver
+	Nameservers []string `yaml:"nameservers"`
+	// timeout of one query to one server
+	Timeout time.Duration `yaml:"timeout"`
+	// spread queries over the servers instead of always starting with the first
+	Rotate bool `yaml:"rotate"`
+	// names with fewer dots than this are tried with the search domains first
+	Ndots int `yaml:"ndots"`
+	// domains appended to short names
+	Search []string `yaml:"search"`
+}
+
+func defaultResolverConfig() ResolverConfig {
+	return ResolverConfig{
+		Timeout: 2 * time.Second,
+		Ndots:   1,
+	}
+}
+
+func (r ResolverConfig) Validate() error {
+	for _, ns := range r.Nameservers {
+		if _, _, err := net.SplitHostPort(withDefaultPort(ns, "53")); err != nil {
+			return fmt.Errorf("resolver: nameserver %q: %w", ns, err)
+		}
+	}
+	if r.Timeout <= 0 {
+		return fmt.Errorf("resolver: timeout must be positive")
+	}
+	if r.Ndots < 0 {
+		return fmt.Errorf("resolver: ndots must not be negative")
+	}
+	return nil
+}
+
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+// dnsResolver resolves against the configured nameservers, failing over to
+// the next one when a server doesnt answer
+type dnsResolver struct {
+	config    ResolverConfig
+	resolvers []*net.Resolver
+	next      atomic.Uint64
+}
+
+// the resolver in use, nil means the system one. Swapped on reload, dialers
+// read it on every dial so backends dont have to be rebuilt.
+var activeResolver atomic.Pointer[dnsResolver]
+
+func newDNSResolver(cfg ResolverConfig) *dnsResolver {
+	if len(cfg.Nameservers) == 0 {
+		return nil
+	}
+	r := &dnsResolver{config: cfg}
+	for _, ns := range cfg.Nameservers {
+		server := withDefaultPort(ns, "53")
+		r.resolvers = append(r.resolvers, &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				d := net.Dialer{Timeout: cfg.Timeout}
+				return d.DialContext(ctx, network, server)
+			},
+		})
+	}
+	return r
+}
+
+// names to try for host, following ndots and the search domains
+func (r *dnsResolver) candidates(host string) []string {
+	if strings.HasSuffix(host, ".") || len(r.config.Search) == 0 {
+		return []string{host}
+	}
+	var searched []string
+	for _, domain := range r.config.Search {
+		searched = append(searched, host+"."+strings.Trim(domain, "."))
+	}
+	if strings.Count(host, ".") >= r.config.Ndots {
+		return append([]string{host}, searched...)
+	}
+	return append(searched, host)
+}
+
+func (r *dnsResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+
+	var lastErr error
+	for _, name := range r.candidates(host) {
+		ips, err := r.lookupName(ctx, name)
+		if err == nil {
+			return ips, nil
+		}
+		lastErr = err
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			// the servers failed, other names wont do better
+			return nil, err
+		}
+	}
+	return nil, lastErr
+}
+
+// ask the servers one after the other until one answers
+func (r *dnsResolver) lookupName(ctx context.Context, name string) ([]net.IPAddr, error) {
+	start := 0
+	if r.config.Rotate {
+		start = int(r.next.Add(1) % uint64(len(r.resolvers)))
+	}
+
+	var lastErr error
+	for i := range r.resolvers {
+		res := r.resolvers[(start+i)%len(r.resolvers)]
+		qctx, cancel := context.WithTimeout(ctx, r.config.Timeout)
+		ips, err := res.LookupIPAddr(qctx, name)
+		cancel()
+		if err == nil {
+			return ips, nil
+		}
+		lastErr = err
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			// a real answer, asking another server wont change it
+			return nil, err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// resolve with the configured resolver or the system one
+func lookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if r := activeResolver.Load(); r != nil {
+		return r.LookupIPAddr(ctx, host)
+	}
+	return net.DefaultResolver.LookupIPAddr(ctx, host)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// a draining backend gets no new requests, the ones in flight finish
+func (b *Backend) Draining() bool {
+	return b.draining.Load()
+}
+
+// stop or resume sending new requests to the backend
+func (b *Backend) SetDraining(draining bool) {
+	if b.draining.Swap(draining) == draining {
+		return
+	}
+	if draining {
+		// idle keep-alive connections wont be used again
+		b.closeIdleConnections()
+	}
+}
+
+// a backend sets the drain header to "true" on its responses when it is about
+// to shut down, to get no new requests while it finishes the ones it has.
+// "false" on a response, or a health probe answered without the header, takes
+// it back. The header is not passed on to the client. A drain through the
+// admin api is left alone.
+func (b *Backend) checkDrainHeader(h http.Header, strip bool) {
+	name := activePools.Load().drainHeader
+	if name == "" {
+		return
+	}
+	value := h.Get(name)
+	if strip {
+		h.Del(name)
+	} else if value == "" {
+		// health probe without the header
+		value = "false"
+	}
+	draining, err := strconv.ParseBool(value)
+	if err != nil {
+		return
+	}
+	switch {
+	case draining && !b.Draining():
+		b.drainedByHeader.Store(true)
+		b.SetDraining(true)
+		infof("%s asked to be drained, %d request(s) in flight\n", b.URL, b.inFlight.Load())
+	case !draining && b.drainedByHeader.Swap(false):
+		b.SetDraining(false)
+		infof("%s takes requests again\n", b.URL)
+	}
+}
+
+// active, draining while requests are still in flight, then drained.
+// disabled wins over both.
+func (b *Backend) Status() string {
+	switch {
+	case b.Disabled():
+		return "disabled"
+	case !b.Draining():
+		return "active"
+	case b.inFlight.Load() > 0:
+		return "draining"
+	default:
+		return "drained"
+	}
+}
+
+// GET /admin/backends/{id}
+func handleGetBackend(w http.ResponseWriter, req *http.Request) {
+	pool, b := findBackend(req.PathValue("id"))
+	if b == nil {
+		writeError(w, http.StatusNotFound, "no backend with id "+req.PathValue("id"))
+		return
+	}
+	writeJSON(w, http.StatusOK, newBackendJSON(pool, b))
+}
+
+// POST /admin/backends/{id}/drain starts draining, DELETE stops it. Both
+// answer with the backend, poll GET /admin/backends/{id} until its status is
+// drained.
+func handleDrain(w http.ResponseWriter, req *http.Request) {
+	pool, b := findBackend(req.PathValue("id"))
+	if b == nil {
+		writeError(w, http.StatusNotFound, "no backend with id "+req.PathValue("id"))
+		return
+	}
+	draining := req.Method == http.MethodPost
+	// from now on the drain belongs to the admin api
+	b.drainedByHeader.Store(false)
+	if b.Draining() != draining {
+		b.SetDraining(draining)
+		if draining {
+			infof("Admin: draining backend %s (pool %s), %d request(s) in flight\n", b.URL, pool, b.inFlight.Load())
+		} else {
+			infof("Admin: backend %s (pool %s) takes requests again\n", b.URL, pool)
+		}
+	}
+	writeJSON(w, http.StatusOK, newBackendJSON(pool, b))
+}
+
+// built in drain_timeout, used when the config doesnt set it
+const defaultDrainTimeout = 30 * time.Second
+
+// how often a backend on its way out is checked for open connections
+const drainPollInterval = 200 * time.Millisecond
+
+// drainConnections lets the requests, websockets and passthrough
+// connections of a backend that gets no new traffic anymore finish. The
+// keep-alive connections are closed as they go idle, whatever is still open
+// after timeout is cut. It stops early once keep returns false, for a
+// backend that takes traffic again.
+func (b *Backend) drainConnections(why string, timeout time.Duration, keep func() bool) {
+	deadline := time.Now().Add(timeout)
+	for keep() {
+		b.closeIdleConnections()
+		if b.conns.open.Load() == 0 && b.inFlight.Load() == 0 {
+			infof("%s (%s) drained, no connections left\n", b.URL, why)
+			return
+		}
+		if !time.Now().Before(deadline) {
+			inFlight := b.inFlight.Load()
+			cut := b.conns.closeAll()
+			warnf("%s (%s) not drained after the drain timeout of %s, cut %d connection(s) with %d request(s) in flight\n", b.URL, why, timeout, cut, inFlight)
+			return
+		}
+		time.Sleep(drainPollInterval)
+	}
+}
+
+// the backends of previous that are not in pools anymore get no new
+// requests from now on, drain them in the background
+func drainRemovedBackends(previous, pools *Pools) {
+	if previous == nil {
+		return
+	}
+	kept := make(map[*Backend]bool)
+	urls := make(map[string]bool)
+	for _, pool := range pools.pools {
+		for _, b := range pool.backends {
+			kept[b] = true
+			urls[pool.name+" "+b.URL.String()] = true
+		}
+	}
+	always := func() bool { return true }
+	for _, pool := range previous.pools {
+		for _, b := range pool.backends {
+			if kept[b] {
+				continue
+			}
+			// a backend whose settings changed is replaced by a new one
+			why := "removed"
+			if urls[pool.name+" "+b.URL.String()] {
+				why = "replaced"
+			}
+			b.removed.Store(true)
+			debugf("Draining %s (pool %s, %s), %d request(s) in flight, %d connection(s) open\n", b.URL, pool.name, why, b.inFlight.Load(), b.conns.open.Load())
+			go b.drainConnections(why, pools.drainTimeout, always)
+		}
+	}
+}
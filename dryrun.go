@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "REDACTED"
+
+// the config as the load balancer will run it: defaults filled in, the
+// backend defaults merged into every backend, the top level backends shown
+// as the default pool and the implicit listener spelled out. Secrets are
+// redacted so the output can end up in logs.
+func effectiveConfig(cfg *Config) *Config {
+	out := *cfg
+	out.Backends = nil
+	out.Defaults = BackendConfig{}
+	out.Listeners = cfg.effectiveListeners()
+	out.Pools = make(map[string]PoolConfig)
+	for name, pc := range cfg.effectivePools() {
+		backends := cfg.poolBackends(pc)
+		for i := range backends {
+			redactBackend(&backends[i])
+		}
+		pc.Backends = backends
+		out.Pools[name] = pc
+	}
+
+	// global route settings fall back to the built in ones
+	route := reflect.ValueOf(resolveRoute("", "", "", settingsLayer{"global", cfg.RouteSettings})).Elem()
+	settings := reflect.ValueOf(&out.RouteSettings).Elem()
+	for i := 0; i < settings.NumField(); i++ {
+		v := reflect.New(settings.Field(i).Type().Elem())
+		v.Elem().Set(route.FieldByName(settings.Type().Field(i).Name))
+		settings.Field(i).Set(v)
+	}
+
+	out.EgressProxy = redactURL(out.EgressProxy)
+	if out.Fleet.Token != "" {
+		out.Fleet.Token = redacted
+	}
+	if out.Export.Token != "" {
+		out.Export.Token = redacted
+	}
+	out.Usage.URL = redactURL(out.Usage.URL)
+	if out.Usage.Token != "" {
+		out.Usage.Token = redacted
+	}
+	if out.Admin.Token != "" {
+		out.Admin.Token = redacted
+	}
+	if out.Admin.Password != "" {
+		out.Admin.Password = redacted
+	}
+	if len(out.Tracing.Headers) > 0 {
+		// the names stay, the values are api keys more often than not
+		out.Tracing.Headers = make(map[string]string, len(cfg.Tracing.Headers))
+		for name, v := range cfg.Tracing.Headers {
+			out.Tracing.Headers[name] = redactSecret(v)
+		}
+	}
+	return &out
+}
+
+// the secrets of a backend by their config key, with how they are hidden
+var backendSecrets = []struct {
+	key   string
+	field func(bc *BackendConfig) *string
+	hide  func(s string) string
+}{
+	{"egress_proxy", func(bc *BackendConfig) *string { return &bc.EgressProxy }, redactURL},
+	{"health_auth", func(bc *BackendConfig) *string { return &bc.HealthAuth }, redactSecret},
+	{"tls_client_key", func(bc *BackendConfig) *string { return &bc.TLSClientKey }, redactSecret},
+}
+
+func redactBackend(bc *BackendConfig) {
+	for _, s := range backendSecrets {
+		v := s.field(bc)
+		*v = s.hide(*v)
+	}
+}
+
+// hide the secrets of a backend given by its config keys, like the body of
+// POST /admin/backends. Returns false when there were none.
+func redactBackendFields(fields map[string]interface{}) bool {
+	found := false
+	for _, s := range backendSecrets {
+		if v, ok := fields[s.key]; ok {
+			str, _ := v.(string)
+			fields[s.key] = s.hide(str)
+			found = true
+		}
+	}
+	return found
+}
+
+func redactSecret(s string) string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+// hide the password of a proxy url
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	return u.Redacted()
+}
+
+// the effective config as plain maps and lists, through yaml so the keys and
+// durations look the same in json as in yaml
+func effectiveConfigValue(cfg *Config) (interface{}, error) {
+	data, err := yaml.Marshal(effectiveConfig(cfg))
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	err = yaml.Unmarshal(data, &v)
+	return v, err
+}
+
+// print the effective config as yaml or json
+func printEffectiveConfig(w io.Writer, cfg *Config, format string) error {
+	switch format {
+	case "yaml":
+		data, err := yaml.Marshal(effectiveConfig(cfg))
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	case "json":
+		v, err := effectiveConfigValue(cfg)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	return fmt.Errorf("unknown format %q, use yaml or json", format)
+}
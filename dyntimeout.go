@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// DynamicTimeout derives the upstream timeout of a route from its recent
+// latency: the percentile of the last window times multiplier, kept between
+// floor and ceiling. The timeout covers the wait for the response headers.
+type DynamicTimeout struct {
+	// 0 turns it off
+	Percentile float64       `yaml:"percentile,omitempty"`
+	Multiplier float64       `yaml:"multiplier,omitempty"`
+	Floor      time.Duration `yaml:"floor,omitempty"`
+	// also the timeout while there are fewer than min_samples latencies
+	Ceiling    time.Duration `yaml:"ceiling,omitempty"`
+	Window     time.Duration `yaml:"window,omitempty"`
+	MinSamples int           `yaml:"min_samples,omitempty"`
+}
+
+func (d DynamicTimeout) Enabled() bool {
+	return d.Percentile > 0
+}
+
+func (d DynamicTimeout) Validate() error {
+	if !d.Enabled() {
+		return nil
+	}
+	if d.Percentile >= 100 {
+		return fmt.Errorf("percentile must be between 0 and 100")
+	}
+	if d.Multiplier != 0 && d.Multiplier < 1 {
+		return fmt.Errorf("multiplier must be at least 1")
+	}
+	if d.Ceiling <= 0 {
+		return fmt.Errorf("ceiling is required")
+	}
+	if d.Floor < 0 || d.Floor > d.Ceiling {
+		return fmt.Errorf("floor must be between 0 and the ceiling")
+	}
+	if d.Window < 0 || d.MinSamples < 0 {
+		return fmt.Errorf("window and min_samples must not be negative")
+	}
+	return nil
+}
+
+// with the defaults filled in
+func (d DynamicTimeout) withDefaults() DynamicTimeout {
+	if d.Multiplier == 0 {
+		d.Multiplier = 3
+	}
+	if d.Window == 0 {
+		d.Window = time.Minute
+	}
+	if d.MinSamples == 0 {
+		d.MinSamples = 100
+	}
+	return d
+}
+
+// for lb config explain
+func (d DynamicTimeout) String() string {
+	if !d.Enabled() {
+		return "off"
+	}
+	d = d.withDefaults()
+	return fmt.Sprintf("p%g x%g within [%s, %s] over %s", d.Percentile, d.Multiplier, d.Floor, d.Ceiling, d.Window)
+}
+
+// rollingLatency keeps the latencies of the current and the previous window
+type rollingLatency struct {
+	mu        sync.Mutex
+	started   time.Time
+	cur, prev *latencyHistogram
+}
+
+// latencies per route ("pool host+path" -> *rollingLatency), outside of the
+// routes so they survive a reload
+var routeLatencies sync.Map
+
+func routeLatency(route *Route) *rollingLatency {
+	key := route.Pool + " " + route.Host + route.Path
+	if l, ok := routeLatencies.Load(key); ok {
+		return l.(*rollingLatency)
+	}
+	l, _ := routeLatencies.LoadOrStore(key, &rollingLatency{started: time.Now(), cur: &latencyHistogram{}, prev: &latencyHistogram{}})
+	return l.(*rollingLatency)
+}
+
+// start a new window when the current one is over, called with mu held
+func (l *rollingLatency) rotate(window time.Duration, now time.Time) {
+	switch elapsed := now.Sub(l.started); {
+	case elapsed >= 2*window:
+		l.prev, l.cur, l.started = &latencyHistogram{}, &latencyHistogram{}, now
+	case elapsed >= window:
+		l.prev, l.cur, l.started = l.cur, &latencyHistogram{}, now
+	}
+}
+
+func (l *rollingLatency) Record(d time.Duration, window time.Duration) {
+	l.mu.Lock()
+	l.rotate(window, time.Now())
+	l.cur.Record(d)
+	l.mu.Unlock()
+}
+
+// the timeout for the next request
+func (l *rollingLatency) Timeout(d DynamicTimeout) time.Duration {
+	d = d.withDefaults()
+	l.mu.Lock()
+	l.rotate(d.Window, time.Now())
+	count := l.cur.count.Load() + l.prev.count.Load()
+	q := quantileOf(d.Percentile/100, l.cur, l.prev)
+	l.mu.Unlock()
+
+	if count < uint64(d.MinSamples) {
+		return d.Ceiling
+	}
+	timeout := time.Duration(float64(q) * d.Multiplier)
+	if timeout < d.Floor {
+		return d.Floor
+	}
+	if timeout > d.Ceiling {
+		return d.Ceiling
+	}
+	return timeout
+}
+
+// the current timeout of every route with a dynamic timeout
+func writeDynamicTimeoutMetrics(w io.Writer) {
+	writeMetricHeader(w, "lb_route_dynamic_timeout_seconds", "gauge", "Current upstream timeout of routes with a dynamic timeout.")
+	pools := activePools.Load()
+	seen := make(map[string]bool)
+	for _, address := range sortedKeys(pools.listeners) {
+		for _, route := range pools.listeners[address].routes {
+			key := route.Pool + " " + route.Host + route.Path
+			if !route.DynamicTimeout.Enabled() || seen[key] {
+				continue
+			}
+			seen[key] = true
+			timeout := routeLatency(route).Timeout(route.DynamicTimeout)
+			fmt.Fprintf(w, "lb_route_dynamic_timeout_seconds{pool=%q,route=%q} %g\n", route.Pool, route.Name, timeout.Seconds())
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// dialFunc opens the connection to a backend, either directly or through
+// the configured egress proxy
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func init() {
+	// x/net/proxy only knows socks5, teach it about http CONNECT proxies
+	proxy.RegisterDialerType("http", newConnectDialer)
+}
+
+// parse and check the egress proxy url, empty means no proxy
+func parseEgressProxy(raw string) (*url.URL, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("egress proxy %q: %w", raw, err)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, fmt.Errorf("egress proxy %q: scheme must be socks5, socks5h or http", raw)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("egress proxy %q: missing host", raw)
+	}
+	return u, nil
+}
+
+// build the dial function used for a backend. The address family policy
+// and the socket options of the backend apply to direct dials (or to
+// reaching the egress proxy).
+func newDialer(egress *url.URL, bc BackendConfig) (dialFunc, error) {
+	direct := familyDialer(backendNetDialer(bc), bc.IPFamily)
+	if bc.Nagle {
+		direct = withNagle(direct)
+	}
+	if egress == nil {
+		return direct, nil
+	}
+
+	d, err := proxy.FromURL(egress, forwardDialer(direct))
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var conn net.Conn
+		var err error
+		if cd, ok := d.(proxy.ContextDialer); ok {
+			conn, err = cd.DialContext(ctx, network, addr)
+		} else {
+			conn, err = d.Dial(network, addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &proxiedConn{Conn: conn, family: addrFamily(ctx, addr, bc.IPFamily)}, nil
+	}, nil
+}
+
+// proxiedConn is a connection to a backend through the egress proxy. Its
+// remote address is the proxy, family is the one of the backend.
+type proxiedConn struct {
+	net.Conn
+	family string
+}
+
+// kept for passthrough, see countedConn
+func (c *proxiedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+// adapts a dialFunc to the x/net/proxy dialer interfaces
+type forwardDialer dialFunc
+
+func (f forwardDialer) Dial(network, addr string) (net.Conn, error) {
+	return f(context.Background(), network, addr)
+}
+
+func (f forwardDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// connectDialer tunnels connections through an http proxy with CONNECT,
+// which works for both http and https backends
+type connectDialer struct {
+	proxyURL *url.URL
+	// host:port of the proxy, port 80 when the url has none
+	addr    string
+	forward proxy.Dialer
+}
+
+func newConnectDialer(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "80")
+	}
+	return &connectDialer{proxyURL: u, addr: addr, forward: forward}, nil
+}
+
+func (d *connectDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *connectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if cd, ok := d.forward.(proxy.ContextDialer); ok {
+		conn, err = cd.DialContext(ctx, "tcp", d.addr)
+	} else {
+		conn, err = d.forward.Dial("tcp", d.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := d.proxyURL.User; u != nil {
+		password, _ := u.Password()
+		req.SetBasicAuth(u.Username(), password)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("egress proxy %s: CONNECT %s: %s", d.addr, addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		// the proxy must not send anything before we do
+		conn.Close()
+		return nil, fmt.Errorf("egress proxy %s: unexpected data after CONNECT response", d.addr)
+	}
+	return conn, nil
+}
+
+// host:port of a backend url, with the default port for the scheme
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// every flag can also be given as an environment variable: LB_ followed by
+// the flag name in upper case with dashes replaced, e.g. -health-interval
+// becomes LB_HEALTH_INTERVAL. -backend is LB_BACKENDS since it takes a list.
+// Precedence is defaults < config file < environment < command line flags.
+func envName(flagName string) string {
+	if name, ok := envNames[flagName]; ok {
+		return name
+	}
+	return "LB_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// flags whose variable doesnt follow the naming rule
+var envNames = map[string]string{
+	"backend": "LB_BACKENDS",
+}
+
+// copy the environment into the flag set, must run before fs.Parse so
+// flags given on the command line still win
+func applyEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		val, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if e := fs.Set(f.Name, val); e != nil {
+			err = fmt.Errorf("%s: %w", envName(f.Name), e)
+		}
+	})
+	return err
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// GET /admin/events, a server-sent events stream. It starts with a state
+// event listing every backend, then every second sends a stats event with
+// the requests of that second and a backend event for every change since
+// the second before.
+func handleEvents(w http.ResponseWriter, req *http.Request) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	prev := takeSnapshot(time.Now())
+	state := []snapshotBackend{}
+	for _, b := range prev.backends {
+		state = append(state, b)
+	}
+	sort.Slice(state, func(i, j int) bool {
+		return state[i].Pool+" "+state[i].Backend < state[j].Pool+" "+state[j].Backend
+	})
+	writeEvent(w, "state", map[string]interface{}{"time": prev.Time, "backends": state})
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	counts := requestCounts()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case now := <-ticker.C:
+			snap := takeSnapshot(now)
+			for _, c := range snapshotChanges(prev, snap) {
+				writeEvent(w, "backend", snapshotEvent{now, c})
+			}
+			prev = snap
+
+			next := requestCounts()
+			stats := eventStats{Time: now, Backends: []backendRate{}}
+			for key, n := range next {
+				rate := backendRate{Pool: key.pool, Backend: key.backend, Requests: n - counts[key]}
+				if n < counts[key] {
+					// the backend was replaced by a reload
+					rate.Requests = n
+				}
+				stats.Total += rate.Requests
+				stats.Backends = append(stats.Backends, rate)
+			}
+			counts = next
+			sort.Slice(stats.Backends, func(i, j int) bool {
+				a, b := stats.Backends[i], stats.Backends[j]
+				return a.Pool+" "+a.Backend < b.Pool+" "+b.Backend
+			})
+			writeEvent(w, "stats", stats)
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+type backendKeyPair struct {
+	pool, backend string
+}
+
+type backendRate struct {
+	Pool     string `json:"pool"`
+	Backend  string `json:"backend"`
+	Requests uint64 `json:"requests"`
+}
+
+type eventStats struct {
+	Time     time.Time     `json:"time"`
+	Total    uint64        `json:"total"`
+	Backends []backendRate `json:"backends"`
+}
+
+// requests served by every backend so far
+func requestCounts() map[backendKeyPair]uint64 {
+	counts := make(map[backendKeyPair]uint64)
+	for _, pool := range activePools.Load().All() {
+		for _, b := range pool.backends {
+			counts[backendKeyPair{pool.name, b.URL.String()}] = b.requests.Load()
+		}
+	}
+	return counts
+}
+
+func writeEvent(w io.Writer, event string, v interface{}) {
+	fmt.Fprintf(w, "event: %s\ndata: ", event)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	// Encode ends the data line
+	enc.Encode(v)
+	fmt.Fprint(w, "\n")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+)
+
+// lb config <command>
+func runConfigCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: lb config explain -config lb.yaml <path>")
+		return 2
+	}
+	switch args[0] {
+	case "explain":
+		return runExplain(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "config: unknown command %q\n", args[0])
+	return 2
+}
+
+// lb config explain -config lb.yaml [-pool name | -listener address] [-host name] /api/users
+// print the route a path is matched to and the effective value of every
+// setting, with the level it was inherited from
+func runExplain(args []string) int {
+	fs := flag.NewFlagSet("config explain", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to the yaml config file")
+	listenerPool := fs.String("pool", "", "Pool of the listener the request comes in on (default pool if empty)")
+	listenerAddress := fs.String("listener", "", "Address of the listener the request comes in on, with its overrides")
+	host := fs.String("host", "", "Host name of the request, for routes with a host")
+	fs.Parse(args)
+
+	if *configPath == "" || fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: lb config explain -config lb.yaml <path>")
+		return 2
+	}
+	path := fs.Arg(0)
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", *configPath, err)
+		return 1
+	}
+
+	listener := ListenerConfig{Pool: *listenerPool}
+	if *listenerAddress != "" {
+		found := false
+		for _, l := range cfg.effectiveListeners() {
+			if l.Address == *listenerAddress {
+				listener, found = l, true
+			}
+		}
+		if !found {
+			fmt.Fprintf(os.Stderr, "%s: no listener %s\n", *configPath, *listenerAddress)
+			return 1
+		}
+	}
+	route := matchRoute(buildRoutes(cfg, listener), strings.ToLower(*host), path)
+	fmt.Printf("%s%s -> route %s (path %s%s) -> pool %s\n\n", *host, path, route.Name, route.Host, route.Path, route.Pool)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SETTING\tVALUE\tFROM")
+	rv := reflect.ValueOf(route).Elem()
+	st := reflect.TypeOf(RouteSettings{})
+	for i := 0; i < st.NumField(); i++ {
+		field := st.Field(i)
+		name := yamlName(field)
+		fmt.Fprintf(w, "%s\t%v\t%s\n", name, rv.FieldByName(field.Name).Interface(), route.sources[name])
+	}
+	w.Flush()
+	return 0
+}
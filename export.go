@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExportConfig publishes what the load balancer knows into consul, so other
+// systems can use its health checks as the source of truth: the healthy
+// backends of every pool in the kv store, and the load balancer itself as a
+// service (which consul also serves over dns).
+type ExportConfig struct {
+	// consul http address, empty disables the export
+	Consul string `yaml:"consul"`
+	Token  string `yaml:"token,omitempty"`
+	// <kv_prefix>/<pool> gets a json list of the healthy backends
+	KVPrefix string `yaml:"kv_prefix,omitempty"`
+	// register the load balancer as this service, passing while every pool
+	// has a healthy backend
+	Service string `yaml:"service,omitempty"`
+	// host:port advertised for the service, the hostname and the port of the
+	// first listener by default
+	ServiceAddress string        `yaml:"service_address,omitempty"`
+	Interval       time.Duration `yaml:"interval"`
+}
+
+func (e ExportConfig) Validate() error {
+	// checked without consul too, the export loop waits for it
+	if e.Interval <= 0 {
+		return fmt.Errorf("export: interval must be positive")
+	}
+	if e.Consul == "" {
+		return nil
+	}
+	u, err := url.Parse(e.Consul)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("export: consul must be an http(s) url, got %q", e.Consul)
+	}
+	if e.KVPrefix == "" && e.Service == "" {
+		return fmt.Errorf("export: kv_prefix or service is required")
+	}
+	if e.ServiceAddress != "" {
+		if _, _, err := splitServiceAddress(e.ServiceAddress); err != nil {
+			return fmt.Errorf("export: service_address: %w", err)
+		}
+	}
+	return nil
+}
+
+func splitServiceAddress(address string) (string, int, error) {
+	host, p, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port %q", p)
+	}
+	return host, port, nil
+}
+
+// the healthy backends of every pool, the ones that get traffic
+func healthyBackends() map[string][]string {
+	healthy := make(map[string][]string)
+	for _, pool := range activePools.Load().All() {
+		list := []string{}
+		for _, b := range pool.backends {
+			if b.IsAlive() && !b.Draining() && !b.Disabled() {
+				list = append(list, b.URL.String())
+			}
+		}
+		healthy[pool.name] = list
+	}
+	return healthy
+}
+
+// publish the pool state every export.interval, for the lifetime of the
+// process
+func exportState(r *reloader) {
+	var last ExportConfig
+	// what was written to every kv key, only changes are written again
+	written := make(map[string]string)
+	registered := false
+	for {
+		cfg := r.Current()
+		e := cfg.Export
+		if e != last {
+			written = make(map[string]string)
+			registered = false
+			last = e
+		}
+		if e.Consul == "" {
+			time.Sleep(e.Interval)
+			continue
+		}
+
+		consul := newConsulClient(e.Consul, e.Token, 10*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), e.Interval)
+		healthy := healthyBackends()
+		if e.KVPrefix != "" {
+			for pool, backends := range healthy {
+				key := strings.Trim(e.KVPrefix, "/") + "/" + pool
+				value, _ := json.Marshal(backends)
+				if written[key] == string(value) {
+					continue
+				}
+				var ok bool
+				if err := consul.do(ctx, http.MethodPut, "/v1/kv/"+key, bytes.NewReader(value), &ok); err != nil {
+					warnf("Export to consul failed: %s\n", err)
+					continue
+				}
+				written[key] = string(value)
+			}
+		}
+		if e.Service != "" {
+			if !registered {
+				if err := registerService(ctx, consul, cfg); err != nil {
+					warnf("Registering service %s in consul failed: %s\n", e.Service, err)
+				} else {
+					registered = true
+				}
+			}
+			if registered {
+				if err := updateServiceCheck(ctx, consul, e, healthy); err != nil {
+					warnf("Updating service %s in consul failed: %s\n", e.Service, err)
+					// the agent may have lost it, register again
+					registered = false
+				}
+			}
+		}
+		cancel()
+		time.Sleep(e.Interval)
+	}
+}
+
+func serviceID(e ExportConfig) string {
+	host, _ := os.Hostname()
+	return e.Service + "-" + host
+}
+
+// register the load balancer with the local consul agent, with a ttl check
+// that updateServiceCheck keeps passing
+func registerService(ctx context.Context, consul *consulClient, cfg *Config) error {
+	e := cfg.Export
+	address := e.ServiceAddress
+	if address == "" {
+		host, _ := os.Hostname()
+		_, port, _ := net.SplitHostPort(cfg.effectiveListeners()[0].Address)
+		address = net.JoinHostPort(host, port)
+	}
+	host, port, err := splitServiceAddress(address)
+	if err != nil {
+		return err
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"ID":      serviceID(e),
+		"Name":    e.Service,
+		"Address": host,
+		"Port":    port,
+		"Check": map[string]string{
+			"TTL":                            (3 * e.Interval).String(),
+			"DeregisterCriticalServiceAfter": "10m",
+		},
+	})
+	if err := consul.do(ctx, http.MethodPut, "/v1/agent/service/register", bytes.NewReader(body), nil); err != nil {
+		return err
+	}
+	infof("Registered service %s (%s) in consul\n", e.Service, address)
+	return nil
+}
+
+func updateServiceCheck(ctx context.Context, consul *consulClient, e ExportConfig, healthy map[string][]string) error {
+	status := "passing"
+	var notes []string
+	for _, pool := range sortedKeys(healthy) {
+		notes = append(notes, fmt.Sprintf("pool %s: %d healthy", pool, len(healthy[pool])))
+		if len(healthy[pool]) == 0 {
+			status = "critical"
+		}
+	}
+	body, _ := json.Marshal(map[string]string{"Status": status, "Output": strings.Join(notes, ", ")})
+	return consul.do(ctx, http.MethodPut, "/v1/agent/check/update/service:"+serviceID(e), bytes.NewReader(body), nil)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// FallbackConfig is what a pool does with a request none of its backends
+// can take, because they are all down or busy or every attempt failed:
+// send it to another pool, or answer it with a fixed response
+type FallbackConfig struct {
+	Pool string `yaml:"pool,omitempty"`
+	// the response, status 0 means 503
+	Status int `yaml:"status,omitempty"`
+	// the body, text or the contents of page (a file, html by its
+	// extension)
+	Body string `yaml:"body,omitempty"`
+	Page string `yaml:"page,omitempty"`
+
+	// contents of page, read when the config is loaded
+	page []byte
+}
+
+func (f FallbackConfig) Validate(pool string, pools map[string]PoolConfig) error {
+	response := f.Status != 0 || f.Body != "" || f.Page != ""
+	switch {
+	case f.Pool != "" && response:
+		return fmt.Errorf("either pool or a response, not both")
+	case f.Pool == "" && !response:
+		return fmt.Errorf("needs a pool or a status, body or page")
+	case f.Pool == pool:
+		return fmt.Errorf("pool must be another pool")
+	case f.Status != 0 && (f.Status < 200 || f.Status > 599):
+		return fmt.Errorf("status must be between 200 and 599")
+	}
+	if _, ok := pools[f.Pool]; f.Pool != "" && !ok {
+		return fmt.Errorf("unknown pool %q", f.Pool)
+	}
+	return nil
+}
+
+// read the page, it is added to files so -watch reloads when it changes
+func (f *FallbackConfig) loadPage(files *[]string) error {
+	var err error
+	if f.page, err = readPage(f.Page, files); err != nil {
+		return fmt.Errorf("fallback: page: %w", err)
+	}
+	return nil
+}
+
+// pool -> requests handed to the fallback of the pool
+var poolFallbacks sync.Map
+
+// hand a request no backend of the pool can take to the fallback of the
+// pool, false without one. A request only falls back once, the fallback
+// pool doesnt pass it on to its own fallback.
+func (s *ServerPool) fallBack(w http.ResponseWriter, r *http.Request) bool {
+	f := s.fallback
+	if f == nil || r.Context().Value(Fallback) != nil {
+		return false
+	}
+	if f.Pool == "" {
+		countFallback(s.name)
+		status := f.Status
+		if status == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		debugw(requestFields(r), "%s(%s)%s Answering with the fallback response of pool %s\n", r.RemoteAddr, r.URL.Path, logRequest(r), s.name)
+		writePage(w, status, f.Body, f.Page, f.page)
+		return true
+	}
+	if !bodyReplayable(r) {
+		return false
+	}
+	countFallback(s.name)
+	// the route and its settings stay, only the pool changes
+	route := *GetRouteFromContext(r)
+	route.Pool = f.Pool
+	ctx := context.WithValue(r.Context(), CurrentRoute, &route)
+	ctx = context.WithValue(ctx, Fallback, s.name)
+	ctx = context.WithValue(ctx, Attempts, 1)
+	debugw(requestFields(r), "%s(%s)%s Sending the request to pool %s, the fallback of pool %s\n", r.RemoteAddr, r.URL.Path, logRequest(r), f.Pool, s.name)
+	lb(w, r.WithContext(ctx))
+	return true
+}
+
+func countFallback(pool string) {
+	n, _ := poolFallbacks.LoadOrStore(pool, new(atomic.Uint64))
+	n.(*atomic.Uint64).Add(1)
+}
+
+func writeFallbackMetrics(w io.Writer) {
+	writeMetricHeader(w, "lb_pool_fallbacks_total", "counter", "Requests no backend of the pool could take, handed to its fallback pool or response.")
+	for _, pool := range activePools.Load().All() {
+		if pool.fallback != nil {
+			fmt.Fprintf(w, "lb_pool_fallbacks_total{pool=%q} %d\n", pool.name, loadCount(&poolFallbacks, pool.name))
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// FleetConfig makes the replicas of a fleet reload one at a time. Before
+// applying a new config every replica takes a lock in Consul, applies the
+// config, checks its backends and only then lets the next one go. A replica
+// that ends up with too few healthy backends rolls back to the config it had.
+type FleetConfig struct {
+	// consul http address, e.g. http://127.0.0.1:8500. Empty disables coordination
+	Consul string `yaml:"consul"`
+	Token  string `yaml:"token"`
+	// kv key used as the lock
+	LockKey string `yaml:"lock_key"`
+	// give up on the reload if the lock cant be taken in time
+	LockTimeout time.Duration `yaml:"lock_timeout"`
+	// wait after applying before checking health and releasing the lock
+	Settle time.Duration `yaml:"settle"`
+	// percent of backends that must be healthy for the reload to be kept
+	MinHealthy int `yaml:"min_healthy"`
+}
+
+func defaultFleetConfig() FleetConfig {
+	return FleetConfig{
+		LockKey:     "lb/reload-lock",
+		LockTimeout: 5 * time.Minute,
+		Settle:      5 * time.Second,
+		MinHealthy:  50,
+	}
+}
+
+func (f FleetConfig) Validate() error {
+	if f.Consul == "" {
+		return nil
+	}
+	u, err := url.Parse(f.Consul)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("fleet: consul must be an http(s) url, got %q", f.Consul)
+	}
+	if f.LockKey == "" {
+		return fmt.Errorf("fleet: lock_key is required")
+	}
+	if f.LockTimeout <= 0 {
+		return fmt.Errorf("fleet: lock_timeout must be positive")
+	}
+	if f.Settle < 0 {
+		return fmt.Errorf("fleet: settle must not be negative")
+	}
+	if f.MinHealthy < 0 || f.MinHealthy > 100 {
+		return fmt.Errorf("fleet: min_healthy must be between 0 and 100")
+	}
+	return nil
+}
+
+// consulClient talks to the consul http api
+type consulClient struct {
+	addr   string
+	token  string
+	client *http.Client
+}
+
+func newConsulClient(addr, token string, timeout time.Duration) *consulClient {
+	return &consulClient{
+		addr:   strings.TrimSuffix(addr, "/"),
+		token:  token,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// consulLock is a lock on a consul kv key held through a session
+type consulLock struct {
+	*consulClient
+	key     string
+	session string
+	// stops renewing the session
+	stop chan struct{}
+}
+
+func newConsulLock(f FleetConfig) *consulLock {
+	return &consulLock{
+		consulClient: newConsulClient(f.Consul, f.Token, 70*time.Second),
+		key:          strings.TrimPrefix(f.LockKey, "/"),
+	}
+}
+
+func (l *consulClient) do(ctx context.Context, method, path string, body io.Reader, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, l.addr+path, body)
+	if err != nil {
+		return err
+	}
+	if l.token != "" {
+		req.Header.Set("X-Consul-Token", l.token)
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("consul %s %s: %s %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// block until the lock is ours or ctx is done. ttl bounds how long the lock
+// survives if this process dies while holding it, the session is renewed
+// for as long as it is waited for and held.
+func (l *consulLock) Acquire(ctx context.Context, ttl time.Duration) error {
+	if ttl < 10*time.Second {
+		ttl = 10 * time.Second
+	}
+	host, _ := os.Hostname()
+	sessionReq := fmt.Sprintf(`{"Name":"lb-reload-%s","TTL":"%ds","Behavior":"release","LockDelay":"0s"}`, host, int(ttl.Seconds()))
+
+	var session struct{ ID string }
+	if err := l.do(ctx, http.MethodPut, "/v1/session/create", strings.NewReader(sessionReq), &session); err != nil {
+		return err
+	}
+	l.session = session.ID
+	l.stop = make(chan struct{})
+	go l.renew(l.session, ttl, l.stop)
+
+	index := "0"
+	for {
+		var acquired bool
+		err := l.do(ctx, http.MethodPut, "/v1/kv/"+l.key+"?acquire="+l.session, strings.NewReader(host), &acquired)
+		if err != nil {
+			l.destroy()
+			return err
+		}
+		if acquired {
+			return nil
+		}
+
+		// somebody else is reloading, wait for the key to change
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.addr+"/v1/kv/"+l.key+"?wait=30s&index="+index, nil)
+		if err != nil {
+			l.destroy()
+			return err
+		}
+		if l.token != "" {
+			req.Header.Set("X-Consul-Token", l.token)
+		}
+		resp, err := l.client.Do(req)
+		if err != nil {
+			l.destroy()
+			return err
+		}
+		resp.Body.Close()
+		if idx := resp.Header.Get("X-Consul-Index"); idx != "" {
+			index = idx
+		}
+	}
+}
+
+func (l *consulLock) Release() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var released bool
+	if err := l.do(ctx, http.MethodPut, "/v1/kv/"+l.key+"?release="+l.session, nil, &released); err != nil {
+		warnf("Fleet lock release failed: %s\n", err)
+	}
+	l.destroy()
+}
+
+// renew the session every half ttl until stop is closed
+func (l *consulLock) renew(session string, ttl time.Duration, stop chan struct{}) {
+	t := time.NewTicker(ttl / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := l.do(ctx, http.MethodPut, "/v1/session/renew/"+session, nil, nil); err != nil {
+			warnf("Fleet lock session renewal failed: %s\n", err)
+		}
+		cancel()
+	}
+}
+
+func (l *consulLock) destroy() {
+	if l.session == "" {
+		return
+	}
+	close(l.stop)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := l.do(ctx, http.MethodPut, "/v1/session/destroy/"+l.session, nil, nil); err != nil {
+		warnf("Fleet lock session cleanup failed: %s\n", err)
+	}
+	l.session = ""
+}
+
+// apply new pools while holding the fleet lock. After the settle time every
+// backend is probed, if less than MinHealthy percent are up the previous pools
+// are put back. Returns false when the new pools were not kept.
+func coordinatedSwap(f FleetConfig, pools *Pools) bool {
+	lock := newConsulLock(f)
+	ctx, cancel := context.WithTimeout(context.Background(), f.LockTimeout)
+	defer cancel()
+
+	infof("Waiting for fleet reload lock %s\n", f.LockKey)
+	if err := lock.Acquire(ctx, f.Settle+time.Minute); err != nil {
+		warnf("Could not take fleet reload lock, reload skipped: %s\n", err)
+		return false
+	}
+	defer lock.Release()
+
+	previous := activePools.Swap(pools)
+	time.Sleep(f.Settle)
+
+	healthy, total := 0, 0
+	for _, pool := range pools.All() {
+		for _, b := range pool.backends {
+			alive := b.quarantineProbe(b.probe())
+			b.SetAlive(alive)
+			if alive {
+				healthy++
+			}
+			total++
+		}
+	}
+	percent := 100
+	if total > 0 {
+		percent = healthy * 100 / total
+	}
+	if percent < f.MinHealthy {
+		activePools.Store(previous)
+		warnf("Only %d%% of backends healthy after reload (need %d%%), rolled back\n", percent, f.MinHealthy)
+		return false
+	}
+	infof("Reload verified, %d%% of backends healthy, releasing fleet lock\n", percent)
+	return true
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// health check interval bounds.
+// healthInterval is used for backends that have been stable for a while,
+// healthMinInterval is the floor used right after a backend flapped
+var (
+	healthInterval    = 2 * time.Minute
+	healthMinInterval = 10 * time.Second
+)
+
+// check if the backend should be probed at this tick
+func (b *Backend) dueForCheck(now time.Time) bool {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return !now.Before(b.nextCheck)
+}
+
+// plan the next probe. If the status didnt change since the last probe
+// the interval is doubled until it reaches healthInterval, so stable backends
+// are checked less often and flapping ones stay at the floor.
+func (b *Backend) scheduleNextCheck(now time.Time) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.lastChange.After(now.Add(-b.checkInterval)) {
+		// flipped during this probe, SetAlive already reset the interval
+		b.nextCheck = now.Add(b.checkInterval)
+		return
+	}
+
+	b.checkInterval *= 2
+	if b.checkInterval < healthMinInterval {
+		b.checkInterval = healthMinInterval
+	}
+	if b.checkInterval > healthInterval {
+		b.checkInterval = healthInterval
+	}
+	b.nextCheck = now.Add(b.checkInterval)
+}
+
+func (b *Backend) CheckInterval() time.Duration {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.checkInterval
+}
+
+func (b *Backend) healthTimeout() time.Duration {
+	if b.config.HealthTimeout > 0 {
+		return b.config.HealthTimeout
+	}
+	return 2 * time.Second
+}
+
+// run the health probe for this backend. Without a health path it only
+// checks that a tcp connection can be opened, with one it expects a non 5xx
+// answer to a GET on that path.
+func (b *Backend) probe() bool {
+	if b.config.HealthPath == "" {
+		if b.URL.Scheme == "https" {
+			return b.probeTLS()
+		}
+		return isBackendAlive(b.URL, b.dial, b.healthTimeout())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), b.healthTimeout())
+	defer cancel()
+	u := *b.URL
+	u.Path = b.config.HealthPath
+	u.RawQuery = ""
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		warnw([]any{"backend", b.URL.String(), "error", err.Error()}, "Cant build health request, error: %s\n", err)
+		return false
+	}
+	if b.config.HealthAuth != "" {
+		req.Header.Set("Authorization", b.config.HealthAuth)
+	}
+	resp, err := b.roundTripper.RoundTrip(req)
+	if err != nil {
+		debugw([]any{"backend", b.URL.String(), "error", err.Error()}, "Cant connect to the server, error: %s\n", err)
+		return false
+	}
+	resp.Body.Close()
+	b.checkDrainHeader(resp.Header, false)
+	if resp.TLS != nil {
+		b.recordCertificate(resp.TLS)
+	}
+	if resp.StatusCode >= 500 {
+		debugw([]any{"backend", b.URL.String(), "path", u.Path, "status", resp.StatusCode}, "%s health check returned %s\n", u.String(), resp.Status)
+		return false
+	}
+	return true
+}
+
+// probeStats are the results of the health probes of a backend, for the
+// metrics. A backend going up and down a lot shows in the transitions long
+// before anyone looks at the log.
+type probeStats struct {
+	latency latencyHistogram
+	// by result, failed at 0
+	results [2]atomic.Uint64
+	// failed probes since the last one that passed
+	failures atomic.Int64
+	// up and down changes by the new state (up at 1), whoever found them:
+	// the probes, or the proxy giving up on the backend
+	transitions [2]atomic.Uint64
+}
+
+func boolIndex(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (p *probeStats) record(passed bool, took time.Duration) {
+	p.latency.Record(took)
+	p.results[boolIndex(passed)].Add(1)
+	if passed {
+		p.failures.Store(0)
+	} else {
+		p.failures.Add(1)
+	}
+}
+
+// when the backend last went up or down, zero if it never did
+func (b *Backend) LastChange() time.Time {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.lastChange
+}
+
+func writeHealthMetrics(w io.Writer) {
+	type backendLabels struct {
+		b      *Backend
+		labels string
+	}
+	var all []backendLabels
+	for _, pool := range activePools.Load().All() {
+		for _, b := range pool.backends {
+			all = append(all, backendLabels{b, fmt.Sprintf("pool=%q,backend=%q", pool.name, b.URL.String())})
+		}
+	}
+	writeMetricHeader(w, "lb_health_probe_duration_seconds", "histogram", "Time the health probes of the backend took.")
+	for _, b := range all {
+		writeHistogram(w, "lb_health_probe_duration_seconds", b.labels, &b.b.probes.latency)
+	}
+	writeMetricHeader(w, "lb_health_probes_total", "counter", "Health probes of the backend by result.")
+	for _, b := range all {
+		fmt.Fprintf(w, "lb_health_probes_total{%s,result=\"passed\"} %d\n", b.labels, b.b.probes.results[1].Load())
+		fmt.Fprintf(w, "lb_health_probes_total{%s,result=\"failed\"} %d\n", b.labels, b.b.probes.results[0].Load())
+	}
+	writeMetricHeader(w, "lb_health_probe_consecutive_failures", "gauge", "Failed health probes of the backend since the last one that passed.")
+	for _, b := range all {
+		fmt.Fprintf(w, "lb_health_probe_consecutive_failures{%s} %d\n", b.labels, b.b.probes.failures.Load())
+	}
+	writeMetricHeader(w, "lb_backend_transitions_total", "counter", "Times the backend went up or down.")
+	for _, b := range all {
+		fmt.Fprintf(w, "lb_backend_transitions_total{%s,to=\"up\"} %d\n", b.labels, b.b.probes.transitions[1].Load())
+		fmt.Fprintf(w, "lb_backend_transitions_total{%s,to=\"down\"} %d\n", b.labels, b.b.probes.transitions[0].Load())
+	}
+	writeMetricHeader(w, "lb_backend_last_transition_timestamp_seconds", "gauge", "Unix time the backend last went up or down, 0 if it never did.")
+	for _, b := range all {
+		var ts float64
+		if last := b.b.LastChange(); !last.IsZero() {
+			ts = float64(last.UnixMilli()) / 1000
+		}
+		fmt.Fprintf(w, "lb_backend_last_transition_timestamp_seconds{%s} %.3f\n", b.labels, ts)
+	}
+}
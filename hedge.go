@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HedgeConfig sends a read that takes long to a second backend as well and
+// uses the answer that comes first, to cut the tail of the latency. The
+// wait is delay, or the percentile of the recent latency of the backend when
+// that is longer.
+type HedgeConfig struct {
+	// 0 for no fixed wait
+	Delay time.Duration `yaml:"delay,omitempty"`
+	// like 95 for the p95 latency, 0 turns it off
+	Percentile float64 `yaml:"percentile,omitempty"`
+}
+
+// latencies a backend needs before its percentile is used
+const hedgeMinSamples = 20
+
+func (h HedgeConfig) Enabled() bool {
+	return h.Delay > 0 || h.Percentile > 0
+}
+
+func (h HedgeConfig) Validate() error {
+	if h.Delay < 0 {
+		return fmt.Errorf("delay must not be negative")
+	}
+	if h.Percentile < 0 || h.Percentile >= 100 {
+		return fmt.Errorf("percentile must be between 0 and 100")
+	}
+	return nil
+}
+
+// for lb config explain
+func (h HedgeConfig) String() string {
+	switch {
+	case !h.Enabled():
+		return "off"
+	case h.Percentile == 0:
+		return fmt.Sprintf("after %s", h.Delay)
+	}
+	return fmt.Sprintf("after p%g, at least %s", h.Percentile, h.Delay)
+}
+
+// how long a request to b waits before it is hedged, false when it isnt
+func (h HedgeConfig) wait(b *Backend) (time.Duration, bool) {
+	d := h.Delay
+	if h.Percentile > 0 {
+		if q, n := b.recent.Quantile(h.Percentile / 100); n >= hedgeMinSamples && q > d {
+			d = q
+		}
+	}
+	return d, d > 0
+}
+
+// only reads without a body are sent twice: they change nothing, and there
+// is no body to send again. Upgrades stay on one backend.
+func hedgeable(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0 {
+		return false
+	}
+	return r.Header.Get("Upgrade") == "" && GetAttemptsFromContext(r) == 1
+}
+
+var errHedgeLost = errors.New("hedged request answered by another backend")
+
+// the other attempt of the request answered first, this one was cancelled
+// and has nothing to report
+func hedgeLost(r *http.Request) bool {
+	return context.Cause(r.Context()) == errHedgeLost
+}
+
+// a hedge doesnt retry or move on, the first attempt of the request does
+func isHedge(r *http.Request) bool {
+	_, ok := r.Context().Value(Hedge).(bool)
+	return ok
+}
+
+// hedgeRace is the two attempts of a hedged request. The first to answer
+// wins and writes to the client, the other one is cancelled. An error
+// answer only wins when the other attempt is done too, it may still do
+// better.
+type hedgeRace struct {
+	w        http.ResponseWriter
+	mu       sync.Mutex
+	winner   *hedgeAttempt
+	running  int
+	attempts []*hedgeAttempt
+	wg       sync.WaitGroup
+}
+
+// hedgeAttempt is the response writer of one attempt
+type hedgeAttempt struct {
+	race    *hedgeRace
+	backend *Backend
+	header  http.Header
+	cancel  context.CancelCauseFunc
+	// closed once the attempt has an answer or is done
+	answered     chan struct{}
+	answeredOnce sync.Once
+	// only used by the goroutine of the attempt
+	decided, won bool
+	// what the attempt panicked with, read after it is done
+	panicked any
+}
+
+// run an attempt of the request on b, nil when the race is already decided
+func (race *hedgeRace) start(r *http.Request, b *Backend, hedge bool) *hedgeAttempt {
+	race.mu.Lock()
+	defer race.mu.Unlock()
+	if race.winner != nil {
+		return nil
+	}
+	ctx, cancel := context.WithCancelCause(r.Context())
+	if hedge {
+		ctx = context.WithValue(ctx, Hedge, true)
+	}
+	a := &hedgeAttempt{race: race, backend: b, header: make(http.Header), cancel: cancel, answered: make(chan struct{})}
+	race.running++
+	race.attempts = append(race.attempts, a)
+	race.wg.Add(1)
+	go func() {
+		defer race.wg.Done()
+		defer func() {
+			a.panicked = recover()
+			race.done(a)
+			cancel(nil)
+		}()
+		a.backend.ReverseProxy.ServeHTTP(a, r.WithContext(ctx))
+	}()
+	return a
+}
+
+func (race *hedgeRace) done(a *hedgeAttempt) {
+	a.answeredOnce.Do(func() { close(a.answered) })
+	race.mu.Lock()
+	if !a.decided {
+		race.running--
+	}
+	race.mu.Unlock()
+}
+
+// decide the race with the status of an answer of a, true when a won
+func (race *hedgeRace) claim(a *hedgeAttempt, code int) bool {
+	race.mu.Lock()
+	defer race.mu.Unlock()
+	if race.winner == nil && (code < 500 || race.running == 1) {
+		race.winner = a
+		for k, v := range a.header {
+			race.w.Header()[k] = v
+		}
+		for _, other := range race.attempts {
+			if other != a {
+				other.cancel(errHedgeLost)
+			}
+		}
+	}
+	race.running--
+	return race.winner == a
+}
+
+func (a *hedgeAttempt) Header() http.Header {
+	return a.header
+}
+
+func (a *hedgeAttempt) WriteHeader(code int) {
+	if a.decided {
+		return
+	}
+	if code < 200 {
+		// informational answers dont decide anything
+		return
+	}
+	a.decided = true
+	a.won = a.race.claim(a, code)
+	a.answeredOnce.Do(func() { close(a.answered) })
+	if a.won {
+		a.race.w.WriteHeader(code)
+	}
+}
+
+func (a *hedgeAttempt) Write(p []byte) (int, error) {
+	if !a.decided {
+		a.WriteHeader(http.StatusOK)
+	}
+	if !a.won {
+		return len(p), nil
+	}
+	return a.race.w.Write(p)
+}
+
+func (a *hedgeAttempt) Flush() {
+	if a.won {
+		http.NewResponseController(a.race.w).Flush()
+	}
+}
+
+// the request is on peer. Once it took longer than the hedge wait of the
+// route, it is sent to another backend too.
+func serveHedged(w http.ResponseWriter, r *http.Request, pool *ServerPool, peer *Backend, route *Route) {
+	wait, ok := route.Hedge.wait(peer)
+	if !ok {
+		peer.ReverseProxy.ServeHTTP(w, r)
+		return
+	}
+	race := &hedgeRace{w: w}
+	first := race.start(r, peer, false)
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	var second *hedgeAttempt
+	select {
+	case <-first.answered:
+	case <-r.Context().Done():
+	case <-timer.C:
+		if other := pool.hedgePeer(peer); other != nil {
+			if !globalRetryBudget.Take(activePools.Load().retryBudget) {
+				debugw(requestFields(r), "%s(%s)%s Retry budget used up, not hedging\n", r.RemoteAddr, r.URL.Path, logRequest(r))
+				pool.releasePeer(other)
+				break
+			}
+			other.breakerAdmit()
+			hr := r
+			if other.config.ProxyProtocol != "" {
+				hr = withProxyClient(r)
+			}
+			if second = race.start(hr, other, true); second == nil {
+				pool.releasePeer(other)
+				break
+			}
+			defer pool.releasePeer(other)
+			countHedge(route).sent.Add(1)
+			debugw(requestFields(r, "backend", other.URL.String()), "%s(%s)%s No answer from %s after %s, hedging to %s\n", r.RemoteAddr, r.URL.Path, logRequest(r), peer.URL, wait.Round(time.Millisecond), other.URL)
+		}
+	}
+	race.wg.Wait()
+	if race.winner == nil && r.Context().Err() == nil {
+		// no attempt got to answer
+		http.Error(w, "Bad gateway", http.StatusBadGateway)
+	}
+
+	if second != nil {
+		e := GetAccessEntryFromContext(r)
+		if e != nil {
+			e.Attempts++
+		}
+		if race.winner == second {
+			countHedge(route).won.Add(1)
+			if e != nil {
+				e.Backend = second.backend.URL.String()
+			}
+		}
+	}
+	// a client gone mid response aborts the handler, as without hedging
+	for _, a := range race.attempts {
+		if a.panicked != nil && (a == race.winner || a.panicked != http.ErrAbortHandler) {
+			panic(a.panicked)
+		}
+	}
+}
+
+// another backend than peer with a slot taken on it, nil when there is none.
+// It is the one with the fewest requests for its weight, like least-conn,
+// and doesnt move the round robin on.
+func (s *ServerPool) hedgePeer(peer *Backend) *Backend {
+	panicking := s.Panicking()
+	var best *Backend
+	for _, b := range s.backends {
+		if b == peer || (!b.Available() && !(panicking && b.AvailableIgnoringHealth())) {
+			continue
+		}
+		if best == nil || b.inFlight.Load()*int64(best.Weight()) < best.inFlight.Load()*int64(b.Weight()) {
+			best = b
+		}
+	}
+	if best == nil || !best.acquire() {
+		return nil
+	}
+	return best
+}
+
+type hedgeCounts struct {
+	sent, won atomic.Uint64
+}
+
+// hedges by route ("pool host+path" -> *hedgeCounts)
+var hedges sync.Map
+
+func countHedge(route *Route) *hedgeCounts {
+	c, _ := hedges.LoadOrStore(route.Pool+" "+route.Host+route.Path, new(hedgeCounts))
+	return c.(*hedgeCounts)
+}
+
+func writeHedgeMetrics(w io.Writer) {
+	pools := activePools.Load()
+	var routes []*Route
+	seen := make(map[string]bool)
+	for _, address := range sortedKeys(pools.listeners) {
+		for _, route := range pools.listeners[address].routes {
+			key := route.Pool + " " + route.Host + route.Path
+			if !route.Hedge.Enabled() || seen[key] {
+				continue
+			}
+			seen[key] = true
+			routes = append(routes, route)
+		}
+	}
+	writeMetricHeader(w, "lb_route_hedges_total", "counter", "Requests sent to a second backend because the first was slow to answer.")
+	for _, route := range routes {
+		fmt.Fprintf(w, "lb_route_hedges_total{pool=%q,route=%q} %d\n", route.Pool, route.Name, countHedge(route).sent.Load())
+	}
+	writeMetricHeader(w, "lb_route_hedge_wins_total", "counter", "Hedged requests the second backend answered first.")
+	for _, route := range routes {
+		fmt.Fprintf(w, "lb_route_hedge_wins_total{pool=%q,route=%q} %d\n", route.Pool, route.Name, countHedge(route).won.Load())
+	}
+}
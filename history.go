@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// configVersion is a config that was applied, kept to roll back to it
+type configVersion struct {
+	Version   int       `json:"version"`
+	AppliedAt time.Time `json:"applied_at"`
+	// what applied it: startup, file changed, a scheduled change, a rollback
+	Source  string   `json:"source"`
+	Changes []string `json:"changes,omitempty"`
+	Active  bool     `json:"active"`
+
+	config *Config
+}
+
+// add an applied config to the history, keeping the last admin.history
+func (r *reloader) record(cfg *Config, source string, changes []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastVersion++
+	r.history = append(r.history, configVersion{
+		Version:   r.lastVersion,
+		AppliedAt: time.Now(),
+		Source:    source,
+		Changes:   changes,
+		config:    cfg,
+	})
+	if n := cfg.Admin.History; len(r.history) > n {
+		r.history = append([]configVersion(nil), r.history[len(r.history)-n:]...)
+	}
+}
+
+// the kept versions, newest first
+func (r *reloader) Versions() []configVersion {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	versions := make([]configVersion, 0, len(r.history))
+	for i := len(r.history) - 1; i >= 0; i-- {
+		v := r.history[i]
+		v.Active = v.Version == r.lastVersion
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+// apply an earlier config again. It stays until the next reload, so a
+// watched file that still has the bad config has to be fixed before it is
+// saved again. Backends added or removed through the admin api stay as they
+// are.
+func (r *reloader) Rollback(version int) error {
+	r.changing.Lock()
+	defer r.changing.Unlock()
+
+	target, err := r.version(version)
+	if err != nil {
+		return err
+	}
+	target = target.clone()
+	r.runtime.apply(target)
+	if err := target.Validate(); err != nil {
+		return fmt.Errorf("rollback to version %d: %s", version, err)
+	}
+
+	infof("Rolling back to config version %d\n", version)
+	changes, ok := applyConfig(r.current.Load(), target)
+	if !ok {
+		return fmt.Errorf("rollback to version %d failed, see the log", version)
+	}
+	r.current.Store(target)
+	r.record(target, fmt.Sprintf("rollback to version %d", version), changes)
+	r.scheduleNext()
+	return nil
+}
+
+// the config of a kept version that isnt the active one
+func (r *reloader) version(version int) (*Config, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if version == r.lastVersion {
+		return nil, fmt.Errorf("version %d is already active", version)
+	}
+	for _, v := range r.history {
+		if v.Version == version {
+			return v.config, nil
+		}
+	}
+	return nil, fmt.Errorf("version %d is not in the history", version)
+}
+
+// GET /admin/config/versions
+func (r *reloader) handleVersions(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, r.Versions())
+}
+
+// GET /admin/config, the active version and its effective config
+func (r *reloader) handleActiveConfig(w http.ResponseWriter, req *http.Request) {
+	versions := r.Versions()
+	active := versions[0]
+
+	cfg, err := effectiveConfigValue(active.config)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"version": active,
+		"config":  cfg,
+	})
+}
+
+// POST /admin/config/rollback/{version}
+func (r *reloader) handleRollback(w http.ResponseWriter, req *http.Request) {
+	version, err := strconv.Atoi(req.PathValue("version"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "version must be a number")
+		return
+	}
+	if err := r.Rollback(version); err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, r.Versions()[0])
+}
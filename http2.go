@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// protocols the load balancer speaks to a backend
+const (
+	// https backends: http/2 when the backend offers it in the tls handshake
+	// (alpn), http/1.1 otherwise. http backends: http/1.1
+	protocolAuto = "auto"
+	// http/1.1 only, for backends with a broken http/2
+	protocolHTTP1 = "http1"
+	// http/2 without tls (prior knowledge), for plain http backends that
+	// speak it, like grpc servers
+	protocolH2C = "h2c"
+)
+
+var validProtocols = map[string]bool{"": true, protocolAuto: true, protocolHTTP1: true, protocolH2C: true}
+
+// an h2c connection that was idle this long is pinged, and closed when the
+// ping isnt answered within h2PingTimeout. Every request to the backend
+// shares the connection, so a dead one must not wait for the tcp timeouts.
+const (
+	h2PingInterval = 30 * time.Second
+	h2PingTimeout  = 15 * time.Second
+)
+
+func validateProtocol(bc BackendConfig, scheme string) error {
+	if !validProtocols[bc.Protocol] {
+		return fmt.Errorf("protocol must be auto, http1 or h2c")
+	}
+	if bc.Protocol == protocolH2C && scheme != "http" {
+		return fmt.Errorf("protocol h2c is for http backends, https ones negotiate http/2 with auto")
+	}
+	return nil
+}
+
+// the transports of a backend: the http one (its tls config is the one of
+// the backend) and the round tripper requests and health probes go through,
+// the same transport unless the backend speaks h2c
+func backendTransports(bc BackendConfig, dial dialFunc, tlsConfig *tls.Config) (*http.Transport, http.RoundTripper) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dial
+	transport.TLSClientConfig = tlsConfig
+	tuneTransport(transport, bc)
+
+	if bc.ProxyProtocol != "" {
+		// the PROXY header is for the client of the first request, see
+		// withProxyHeader
+		transport.DisableKeepAlives = true
+	}
+	switch {
+	case bc.Protocol == protocolHTTP1, bc.ProxyProtocol != "":
+		// a non nil empty map turns http/2 off
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	case bc.Protocol == protocolH2C:
+		h2c := &http2.Transport{
+			AllowHTTP: true,
+			// the plain connection stands in for the tls one
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+			ReadIdleTimeout: h2PingInterval,
+			PingTimeout:     h2PingTimeout,
+			IdleConnTimeout: bc.idleConnTimeout(),
+		}
+		return transport, h2c
+	}
+	return transport, transport
+}
+
+// a plain listener with h2c takes http/2 both from clients that know the
+// listener speaks it (prior knowledge, like grpc clients) and from ones that
+// ask with Upgrade: h2c. Http/1 requests are served as before.
+func acceptH2C(next http.Handler) http.Handler {
+	return h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.EqualFold(r.Header.Get("Upgrade"), "h2c") {
+			// the request that asked for the upgrade, served over http/2 now.
+			// The upgrade is done and must not be passed on to the backend.
+			r.Header.Del("Upgrade")
+			r.Header.Del("Connection")
+			r.Header.Del("HTTP2-Settings")
+		}
+		next.ServeHTTP(w, r)
+	}), &http2.Server{})
+}
+
+// close the connections to the backend that carry no request
+func (b *Backend) closeIdleConnections() {
+	b.transport.CloseIdleConnections()
+	if rt, ok := b.roundTripper.(*http2.Transport); ok {
+		rt.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// the http/3 server of a tls listener, on the udp port with the number of
+// its tcp one. It shares the tls config, so certificates and client
+// certificates work the same over quic.
+func newHTTP3Server(server *http.Server) *http3.Server {
+	return &http3.Server{
+		Addr:      server.Addr,
+		Handler:   server.Handler,
+		TLSConfig: server.TLSConfig,
+	}
+}
+
+// clients find the http/3 listener through the Alt-Svc header on the
+// responses over tcp, and switch to it for the next requests
+func advertiseHTTP3(h3 *http3.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			h3.SetQUICHeaders(w.Header())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// give the request an idempotency key if the route asks for one and the
+// client didnt send its own. It is set once before the first attempt so every
+// retry carries the same key.
+func setIdempotencyKey(r *http.Request, route *Route) {
+	if route.IdempotencyHeader == "" || r.Header.Get(route.IdempotencyHeader) != "" {
+		return
+	}
+	r.Header.Set(route.IdempotencyHeader, newUUID())
+}
+
+// random (version 4) uuid
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// header names are http tokens
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	return strings.IndexFunc(name, func(r rune) bool {
+		return r > 0x7e || r <= ' ' || strings.ContainsRune("\"(),/:;<=>?@[\\]{}", r)
+	}) < 0
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configFragment is what an included file may contain, so teams can own
+// their pools and routes without touching the main file
+type configFragment struct {
+	Include   []string              `yaml:"include"`
+	Backends  []BackendConfig       `yaml:"backends"`
+	Pools     map[string]PoolConfig `yaml:"pools"`
+	Routes    []RouteConfig         `yaml:"routes"`
+	Listeners []ListenerConfig      `yaml:"listeners"`
+}
+
+// expand an include pattern relative to the file it is written in
+func expandInclude(from, pattern string) ([]string, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(from), pattern)
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%s: include %q: %w", from, pattern, err)
+	}
+	if len(matches) == 0 && !hasGlobMeta(pattern) {
+		// a plain file name must exist, an empty glob is fine
+		return nil, fmt.Errorf("%s: include %q: no such file", from, pattern)
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+func hasGlobMeta(pattern string) bool {
+	for _, c := range pattern {
+		if c == '*' || c == '?' || c == '[' {
+			return true
+		}
+	}
+	return false
+}
+
+// load the files included by cfg (and the files they include) and merge
+// them into it. Pools must have unique names over all the files, backends,
+// routes and listeners are appended in include order.
+func (cfg *Config) loadIncludes(from string, includes []string, seen map[string]bool) error {
+	for _, pattern := range includes {
+		files, err := expandInclude(from, pattern)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			abs, err := filepath.Abs(file)
+			if err != nil {
+				return err
+			}
+			if seen[abs] {
+				return fmt.Errorf("%s: include cycle with %s", from, file)
+			}
+			seen[abs] = true
+
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			var frag configFragment
+			dec := yaml.NewDecoder(bytes.NewReader(data))
+			dec.KnownFields(true)
+			if err := dec.Decode(&frag); err != nil && !errors.Is(err, io.EOF) {
+				return fmt.Errorf("%s: %w", file, err)
+			}
+			cfg.files = append(cfg.files, file)
+
+			cfg.Backends = append(cfg.Backends, frag.Backends...)
+			cfg.Routes = append(cfg.Routes, frag.Routes...)
+			cfg.Listeners = append(cfg.Listeners, frag.Listeners...)
+			for name, pc := range frag.Pools {
+				if _, ok := cfg.Pools[name]; ok {
+					return fmt.Errorf("%s: pool %s is already defined", file, name)
+				}
+				if cfg.Pools == nil {
+					cfg.Pools = make(map[string]PoolConfig)
+				}
+				cfg.Pools[name] = pc
+			}
+
+			if err := cfg.loadIncludes(file, frag.Include, seen); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+)
+
+// address family policies for upstream dials.
+// "" (or "any") keeps the default Go behaviour (happy eyeballs),
+// prefer-* tries that family first and falls back to the other one,
+// ipv4/ipv6 only ever use that family.
+var validIPFamilies = map[string]bool{
+	"":            true,
+	"any":         true,
+	"prefer-ipv4": true,
+	"prefer-ipv6": true,
+	"ipv4":        true,
+	"ipv6":        true,
+}
+
+func parseIPFamily(family string) error {
+	if !validIPFamilies[family] {
+		return fmt.Errorf("unknown ip_family %q", family)
+	}
+	return nil
+}
+
+// wrap a dialer so it resolves the host itself (with the configured resolver)
+// and dials the addresses in the order asked by the family policy
+func familyDialer(d *net.Dialer, family string) dialFunc {
+	anyFamily := family == "" || family == "any"
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if anyFamily && activeResolver.Load() == nil {
+			return d.DialContext(ctx, network, addr)
+		}
+
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := lookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		var v4, v6 []net.IPAddr
+		for _, ip := range ips {
+			if ip.IP.To4() != nil {
+				v4 = append(v4, ip)
+			} else {
+				v6 = append(v6, ip)
+			}
+		}
+
+		ordered := ips
+		switch family {
+		case "prefer-ipv4":
+			ordered = append(v4, v6...)
+		case "prefer-ipv6":
+			ordered = append(v6, v4...)
+		case "ipv4":
+			ordered = v4
+		case "ipv6":
+			ordered = v6
+		}
+		if len(ordered) == 0 {
+			return nil, fmt.Errorf("dial %s: no %s address for %s", network, family, host)
+		}
+
+		var lastErr error
+		for _, ip := range ordered {
+			conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, lastErr
+	}
+}
+
+func ipFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// the address family of the backend a connection goes to, "" when unknown
+func connFamily(conn net.Conn) string {
+	for {
+		switch c := conn.(type) {
+		case *tls.Conn:
+			conn = c.NetConn()
+		case *countedConn:
+			conn = c.Conn
+		case *proxiedConn:
+			return c.family
+		default:
+			if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+				return ipFamily(addr.IP)
+			}
+			return ""
+		}
+	}
+}
+
+// the family of the address a backend host:port resolves to, the one the
+// family policy would dial first
+func addrFamily(ctx context.Context, addr, family string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ipFamily(ip)
+	}
+	ips, err := lookupIPAddr(ctx, host)
+	if err != nil || len(ips) == 0 {
+		return ""
+	}
+	want := ""
+	switch family {
+	case "ipv4", "prefer-ipv4":
+		want = "ipv4"
+	case "ipv6", "prefer-ipv6":
+		want = "ipv6"
+	}
+	for _, ip := range ips {
+		if ipFamily(ip.IP) == want {
+			return want
+		}
+	}
+	return ipFamily(ips[0].IP)
+}
+
+// familyCounter counts which address family every proxied request went over
+type familyCounter struct {
+	next    http.RoundTripper
+	backend *Backend
+}
+
+func (t *familyCounter) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			switch connFamily(info.Conn) {
+			case "ipv4":
+				t.backend.servedIPv4.Add(1)
+			case "ipv6":
+				t.backend.servedIPv6.Add(1)
+			}
+		},
+	}
+	return t.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+// requests served over ipv4 and ipv6
+func (b *Backend) FamilyCounts() (v4, v6 uint64) {
+	return b.servedIPv4.Load(), b.servedIPv6.Load()
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// latencyHistogram counts backend latencies in log-linear buckets, the same
+// layout as an HDR histogram: every power of two range of microseconds is
+// split into latencySubBuckets linear buckets, so the error stays below
+// 1/latencySubBuckets whatever the latency. From 64µs to about 67s.
+type latencyHistogram struct {
+	buckets [latencyBuckets]atomic.Uint64
+	count   atomic.Uint64
+	sumUs   atomic.Uint64
+}
+
+const (
+	latencySubBits    = 3
+	latencySubBuckets = 1 << latencySubBits
+	// 2^6 µs, everything faster lands in the first bucket
+	latencyMinExp = 6
+	// 2^26 µs, everything slower lands in the last bucket
+	latencyMaxExp  = 26
+	latencyBuckets = 1 + (latencyMaxExp-latencyMinExp)*latencySubBuckets + 1
+)
+
+func (h *latencyHistogram) Record(d time.Duration) {
+	us := uint64(d.Microseconds())
+	if d < 0 {
+		us = 0
+	}
+	h.buckets[latencyBucket(us)].Add(1)
+	h.count.Add(1)
+	h.sumUs.Add(us)
+}
+
+func latencyBucket(us uint64) int {
+	if us < 1<<latencyMinExp {
+		return 0
+	}
+	exp := bits.Len64(us) - 1
+	if exp >= latencyMaxExp {
+		return latencyBuckets - 1
+	}
+	sub := int(us>>(exp-latencySubBits)) & (latencySubBuckets - 1)
+	return 1 + (exp-latencyMinExp)*latencySubBuckets + sub
+}
+
+// upper bound (exclusive) of a bucket in microseconds, 0 for the last one
+// which has none
+func latencyBucketBound(i int) uint64 {
+	if i == 0 {
+		return 1 << latencyMinExp
+	}
+	if i == latencyBuckets-1 {
+		return 0
+	}
+	exp := latencyMinExp + (i-1)/latencySubBuckets
+	sub := uint64((i-1)%latencySubBuckets + 1)
+	return 1<<exp + sub<<(exp-latencySubBits)
+}
+
+// latencyRecorder times every request to a backend until its response
+// headers arrive
+type latencyRecorder struct {
+	next    http.RoundTripper
+	backend *Backend
+}
+
+func (t *latencyRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	recordAttempt(req, t.backend.URL.String(), time.Since(start), resp, err)
+	if err == nil {
+		latency := time.Since(start)
+		t.backend.latency.Record(latency)
+		t.backend.recent.RecordLatency(latency)
+		t.backend.outlier.RecordLatency(latency)
+		debugw(requestFields(req, "backend", t.backend.URL.String(), "status", resp.StatusCode, "latency_ms", float64(latency.Microseconds())/1000),
+			"%s(%s)%s %s answered %d in %s\n", req.RemoteAddr, req.URL.Path, logRequest(req), t.backend.URL, resp.StatusCode, latency.Round(time.Microsecond))
+	}
+	return resp, err
+}
+
+type latencyBucketJSON struct {
+	// upper bound in microseconds, 0 for the overflow bucket
+	LtUs  uint64 `json:"lt_us"`
+	Count uint64 `json:"count"`
+}
+
+type backendLatencyJSON struct {
+	Pool    string              `json:"pool"`
+	Backend string              `json:"backend"`
+	Count   uint64              `json:"count"`
+	SumUs   uint64              `json:"sum_us"`
+	Buckets []latencyBucketJSON `json:"buckets"`
+}
+
+// GET /admin/latency, the latency histogram of every backend. Counts only
+// grow, take the difference of two reads for a heatmap column. Only buckets
+// with a count are listed.
+func handleLatency(w http.ResponseWriter, req *http.Request) {
+	var out []backendLatencyJSON
+	for _, pool := range activePools.Load().All() {
+		for _, b := range pool.backends {
+			bl := backendLatencyJSON{
+				Pool:    pool.name,
+				Backend: b.URL.String(),
+				Count:   b.latency.count.Load(),
+				SumUs:   b.latency.sumUs.Load(),
+				Buckets: []latencyBucketJSON{},
+			}
+			for i := range b.latency.buckets {
+				if n := b.latency.buckets[i].Load(); n > 0 {
+					bl.Buckets = append(bl.Buckets, latencyBucketJSON{LtUs: latencyBucketBound(i), Count: n})
+				}
+			}
+			out = append(out, bl)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"sub_buckets": latencySubBuckets,
+		"backends":    out,
+	})
+}
+
+// the histograms for prometheus, with one bucket per power of two to keep
+// the number of series down
+func writeLatencyMetrics(w io.Writer) {
+	writeMetricHeader(w, "lb_backend_latency_seconds", "histogram", "Time until the response headers of the backend arrived.")
+	for _, pool := range activePools.Load().All() {
+		for _, b := range pool.backends {
+			writeHistogram(w, "lb_backend_latency_seconds", fmt.Sprintf("pool=%q,backend=%q", pool.name, b.URL.String()), &b.latency)
+		}
+	}
+}
+
+// the samples of one histogram in seconds, after its metric header
+func writeHistogram(w io.Writer, name, labels string, h *latencyHistogram) {
+	var cumulative uint64
+	for i := range h.buckets {
+		cumulative += h.buckets[i].Load()
+		if i == latencyBuckets-1 || i%latencySubBuckets != 0 {
+			continue
+		}
+		le := float64(latencyBucketBound(i)) / 1e6
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, le, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, cumulative)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, float64(h.sumUs.Load())/1e6)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count.Load())
+}
+
+// the latency q (0..1) of the requests is below, to the precision of the
+// buckets. 0 when nothing was recorded.
+func (h *latencyHistogram) Quantile(q float64) time.Duration {
+	return quantileOf(q, h)
+}
+
+// the quantile of several histograms together
+func quantileOf(q float64, hs ...*latencyHistogram) time.Duration {
+	var count uint64
+	for _, h := range hs {
+		count += h.count.Load()
+	}
+	if count == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var seen uint64
+	for i := 0; i < latencyBuckets; i++ {
+		for _, h := range hs {
+			seen += h.buckets[i].Load()
+		}
+		if seen >= rank {
+			if i == latencyBuckets-1 {
+				return (1 << latencyMaxExp) * time.Microsecond
+			}
+			return time.Duration(latencyBucketBound(i)) * time.Microsecond
+		}
+	}
+	// counts moved on while reading
+	return (1 << latencyMaxExp) * time.Microsecond
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ListenerConfig is one frontend the load balancer accepts traffic on
+type ListenerConfig struct {
+	// host:port or :port to listen on, or unix:/path/to.sock for a unix
+	// domain socket
+	Address string `yaml:"address"`
+	// permissions of the unix socket, like "0660". The umask decides
+	// without it.
+	SocketMode string `yaml:"socket_mode,omitempty"`
+	// serve https with this certificate, both must be set. Paths to the pem
+	// files, or env:// references holding the pem
+	TLSCert string `yaml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key"`
+	// pool that gets the traffic of this listener, routes can send it elsewhere
+	Pool string `yaml:"pool"`
+	// reject ambiguous http/1 requests, see strict.go
+	Strict bool `yaml:"strict"`
+	// requests per second the listener accepts, 0 means no limit. Bursts of
+	// rate_burst requests (rate_limit rounded up by default) go through.
+	RateLimit float64 `yaml:"rate_limit,omitempty"`
+	RateBurst int     `yaml:"rate_burst,omitempty"`
+	// mutual tls: verify client certificates against this ca bundle (a pem
+	// file or env:// reference) and pass the identity to the backends.
+	// client_auth is require (the default) or optional.
+	ClientCA   string `yaml:"client_ca,omitempty"`
+	ClientAuth string `yaml:"client_auth,omitempty"`
+	// more certificates for other domains, picked by the name the client
+	// asks for (SNI). The main certificate is used when none fits.
+	Certificates []CertConfig `yaml:"certificates,omitempty"`
+	// tls versions ("1.2"), cipher suites and curves the listener allows,
+	// see tlsversions.go
+	TLSMinVersion string `yaml:"tls_min_version,omitempty"`
+	TLSMaxVersion string `yaml:"tls_max_version,omitempty"`
+	TLSCiphers    string `yaml:"tls_ciphers,omitempty"`
+	TLSCurves     string `yaml:"tls_curves,omitempty"`
+	// also serve http/3 (quic) on the udp port of a tls listener, see http3.go
+	HTTP3 bool `yaml:"http3,omitempty"`
+	// accept http/2 without tls on a plain listener, see http2.go
+	H2C bool `yaml:"h2c,omitempty"`
+	// every connection starts with a PROXY protocol header (v1 or v2) of
+	// the l4 balancer in front, with the address of the client
+	ProxyProtocol bool `yaml:"proxy_protocol,omitempty"`
+	// also listen on this address (like :80) for plain http and redirect
+	// it to the tls listener, see redirect.go
+	RedirectHTTP string `yaml:"redirect_http,omitempty"`
+	// route settings for the traffic of this listener, between the routes
+	// and the pools in the inheritance chain
+	RouteSettings `yaml:",inline"`
+
+	// contents of the cert, key and client ca, read when the config is loaded
+	certPEM, keyPEM, clientCAPEM []byte
+}
+
+func (l ListenerConfig) TLS() bool {
+	return l.TLSCert != ""
+}
+
+// listeners to start, a config without any listens on the plain port
+func (c *Config) effectiveListeners() []ListenerConfig {
+	if len(c.Listeners) > 0 {
+		return c.Listeners
+	}
+	address := fmt.Sprintf(":%d", c.Port)
+	if c.UnixSocket != "" {
+		address = "unix:" + c.UnixSocket
+	}
+	return []ListenerConfig{{
+		Address:       address,
+		SocketMode:    c.SocketMode,
+		Strict:        c.StrictParsing,
+		TLSCert:       c.TLSCert,
+		TLSKey:        c.TLSKey,
+		TLSMinVersion: c.TLSMinVersion,
+		TLSMaxVersion: c.TLSMaxVersion,
+		TLSCiphers:    c.TLSCiphers,
+		TLSCurves:     c.TLSCurves,
+		HTTP3:         c.HTTP3,
+		H2C:           c.H2C,
+		ProxyProtocol: c.ProxyProtocol,
+		RedirectHTTP:  c.RedirectHTTP,
+		certPEM:       c.certPEM,
+		keyPEM:        c.keyPEM,
+	}}
+}
+
+func validateListeners(c *Config) error {
+	if len(c.Listeners) > 0 && (c.TLSCert != "" || c.TLSKey != "") {
+		return fmt.Errorf("tls_cert and tls_key are for port, with listeners set them per listener")
+	}
+	if len(c.Listeners) > 0 && (c.TLSMinVersion != "" || c.TLSMaxVersion != "" || c.TLSCiphers != "" || c.TLSCurves != "") {
+		return fmt.Errorf("tls_min_version, tls_max_version, tls_ciphers and tls_curves are for port, with listeners set them per listener")
+	}
+	if len(c.Listeners) > 0 && (c.HTTP3 || c.H2C || c.ProxyProtocol || c.RedirectHTTP != "") {
+		return fmt.Errorf("http3, h2c, proxy_protocol and redirect_http are for port, with listeners set them per listener")
+	}
+	if len(c.Listeners) > 0 && (c.UnixSocket != "" || c.SocketMode != "") {
+		return fmt.Errorf("unix_socket and socket_mode replace port, with listeners use a unix: address")
+	}
+	seen := make(map[string]bool)
+	for _, l := range c.effectiveListeners() {
+		if l.Address == "" {
+			return fmt.Errorf("listener: address is required")
+		}
+		if seen[l.Address] {
+			return fmt.Errorf("duplicate listener %s", l.Address)
+		}
+		seen[l.Address] = true
+		if err := l.validateSocket(); err != nil {
+			return err
+		}
+		if (l.TLSCert == "") != (l.TLSKey == "") {
+			return fmt.Errorf("listener %s: tls_cert and tls_key must be set together", l.Address)
+		}
+		if l.HTTP3 && !l.TLS() {
+			return fmt.Errorf("listener %s: http3 needs tls_cert and tls_key", l.Address)
+		}
+		if !l.tlsSettings().empty() && !l.TLS() {
+			return fmt.Errorf("listener %s: tls versions, ciphers and curves need tls_cert and tls_key", l.Address)
+		}
+		if err := l.tlsSettings().apply(&tls.Config{}); err != nil {
+			return fmt.Errorf("listener %s: %w", l.Address, err)
+		}
+		if l.HTTP3 && !l.tlsSettings().allowsTLS13() {
+			return fmt.Errorf("listener %s: http3 needs tls 1.3, it is above tls_max_version", l.Address)
+		}
+		if l.H2C && (l.TLS() || l.Strict) {
+			return fmt.Errorf("listener %s: h2c is for plain listeners without strict parsing, tls ones get http/2 anyway", l.Address)
+		}
+		if len(l.Certificates) > 0 && !l.TLS() {
+			return fmt.Errorf("listener %s: certificates need tls_cert and tls_key", l.Address)
+		}
+		for _, c := range l.Certificates {
+			if c.Cert == "" || c.Key == "" {
+				return fmt.Errorf("listener %s: certificates: cert and key must be set together", l.Address)
+			}
+		}
+		if l.TLS() {
+			if _, err := l.certificates(); err != nil {
+				return err
+			}
+		}
+		if err := l.validateClientAuth(); err != nil {
+			return err
+		}
+		if l.RateLimit < 0 || l.RateBurst < 0 {
+			return fmt.Errorf("listener %s: rate_limit and rate_burst must not be negative", l.Address)
+		}
+		if err := l.RouteSettings.Validate(); err != nil {
+			return fmt.Errorf("listener %s: %w", l.Address, err)
+		}
+	}
+	return validateRedirects(c.effectiveListeners(), seen)
+}
+
+// handler for a listener, picks the route (and so the pool) for each
+// request then hands it to lb()
+func listenerHandler(address string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		pools := activePools.Load()
+		sw := &statusRecorder{ResponseWriter: w}
+		defer func() { countListener(address, sw.status) }()
+		w = sw
+		routeName, poolName := "-", ""
+		r = setRequestID(w, r, pools.requestIDHeader)
+		r, endSpan := traceRequest(r)
+		defer func() {
+			if s := GetSpanFromContext(r); s != nil {
+				s.set("lb.listener", address)
+				s.set("lb.route", routeName)
+				s.set("lb.pool", poolName)
+				if id := GetRequestIDFromContext(r); id != "" {
+					s.set("lb.request_id", id)
+				}
+			}
+			endSpan(sw.status)
+		}()
+		if entry := startAccessEntry(pools.accessLog, address, r); entry != nil {
+			r = r.WithContext(context.WithValue(r.Context(), AccessEntry, entry))
+			defer func() {
+				entry.Status, entry.Bytes, entry.Duration = sw.status, sw.written, time.Since(entry.Time)
+				if entry.Status == 0 {
+					entry.Status = http.StatusOK
+				}
+				entry.Route, entry.Pool = routeName, poolName
+				pools.accessLog.Log(entry)
+			}()
+		}
+		body := &countingBody{ReadCloser: r.Body}
+		r.Body = body
+		if l := pools.listeners[address]; l != nil {
+			setClientIdentity(r, l.config.ClientCA != "")
+		}
+		tenant, key := pools.usage.identify(r)
+		defer func() {
+			countUsage(pools.usage, usageKey{Tenant: tenant, Key: key, Route: routeName}, body.n, sw.written)
+		}()
+		if tags := tagRequest(pools.tags, r); len(tags) > 0 {
+			r = withTags(r, tags)
+			defer func() { countTagged(tags, sw.status) }()
+		}
+
+		if maintenanceOn.Load() {
+			writeMaintenance(w, pools.maintenance)
+			return
+		}
+		if shedRequest(pools.shedding, r) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Service not available", http.StatusServiceUnavailable)
+			return
+		}
+		if !admitRequest(pools.maxRequests) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Service not available", http.StatusServiceUnavailable)
+			return
+		}
+		defer requestsInFlight.Add(-1)
+		if l := pools.listeners[address]; l != nil && l.limiter != nil && !l.limiter.Allow() {
+			countLimited(address)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		route := matchRoute(pools.Routes(address), requestHost(r), r.URL.Path)
+		routeName, poolName = route.Name, route.Pool
+		setIdempotencyKey(r, route)
+		if err := transformRequest(r, route.requestTransform); err != nil {
+			warnw(requestFields(r, "route", route.Name, "pool", route.Pool, "status", http.StatusBadRequest, "error", err.Error()), "Request body transform failed on route %s%s: %s\n", route.Name, logRequest(r), err)
+			http.Error(w, "Bad request body", http.StatusBadRequest)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), CurrentRoute, route))
+		if route.SlowThreshold > 0 {
+			var history *requestHistory
+			r, history = withHistory(r)
+			defer func() { checkSlow(r, route, history, sw.status, time.Since(start)) }()
+		}
+		// deferred last so the 500 of a panic is what the access log, the
+		// metrics and the span above see
+		defer recoverPanic(sw, r)
+		lb(w, r)
+	})
+}
+
+// start all the listeners, returns the first error any of them stops with.
+// admin (if not nil) serves the /admin/ paths.
+func serveListeners(listeners []ListenerConfig, admin http.Handler) error {
+	errs := make(chan error, 3*len(listeners))
+	for _, l := range listeners {
+		server := &http.Server{
+			Addr:      l.Address,
+			Handler:   recoverPanics(withAdmin(admin, listenerHandler(l.Address))),
+			ConnState: trackConns(l.Address),
+		}
+		if l.TLS() {
+			// the certificate comes from the active pools, so a reload can
+			// rotate it without restarting the listener
+			address := l.Address
+			server.TLSConfig = &tls.Config{
+				GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+					if certs := activePools.Load().certs[address]; len(certs) > 0 {
+						return pickCertificate(certs, hello), nil
+					}
+					return nil, fmt.Errorf("no certificate for listener %s", address)
+				},
+			}
+			// already checked by validateListeners
+			l.tlsSettings().apply(server.TLSConfig)
+			requestClientCerts(l, server.TLSConfig)
+		}
+		if l.HTTP3 {
+			// before the strict checks, they are about http/1 only
+			h3 := newHTTP3Server(server)
+			server.Handler = advertiseHTTP3(h3, server.Handler)
+			go func(address string) {
+				infof("Load Balancer started at: %s (http/3)\n", address)
+				errs <- fmt.Errorf("%s (http/3): %w", address, h3.ListenAndServe())
+			}(l.Address)
+		}
+		if l.H2C {
+			server.Handler = acceptH2C(server.Handler)
+		}
+		if l.Strict {
+			server.Handler = strictHandler(server.Handler)
+			server.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+				return context.WithValue(ctx, StrictConn, c)
+			}
+		}
+		if l.RedirectHTTP != "" {
+			go func(l ListenerConfig) {
+				errs <- fmt.Errorf("%s (redirect): %w", l.RedirectHTTP, serveRedirect(l))
+			}(l)
+		}
+		go func(l ListenerConfig) {
+			errs <- fmt.Errorf("%s: %w", l.Address, serveListener(server, l))
+		}(l)
+	}
+	return <-errs
+}
+
+func serveListener(server *http.Server, l ListenerConfig) error {
+	mode := ""
+	if l.TLS() {
+		mode = " (tls)"
+	}
+	ln, err := listenAddress(l.Address, l.socketMode())
+	if err != nil {
+		return err
+	}
+	if l.ProxyProtocol {
+		// the header comes first, before tls and the strict checks
+		ln = proxyListener{ln}
+		mode += ", proxy protocol"
+	}
+	if !l.Strict {
+		infof("Load Balancer started at: %s%s\n", l.Address, mode)
+		if l.TLS() {
+			return server.ServeTLS(ln, "", "")
+		}
+		return server.Serve(ln)
+	}
+
+	// the strict checks need the plain text, so tls is done below them. The
+	// server doesnt see a *tls.Conn then, which also means no http/2.
+	if l.TLS() {
+		tlsConfig := server.TLSConfig.Clone()
+		tlsConfig.NextProtos = []string{"http/1.1"}
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	infof("Load Balancer started at: %s%s, strict parsing\n", l.Address, mode)
+	return server.Serve(strictListener{ln})
+}
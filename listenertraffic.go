@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// per listener state of the active pools
+type listenerState struct {
+	config ListenerConfig
+	// routing table with the overrides of the listener applied
+	routes []*Route
+	// nil without a rate_limit
+	limiter *tokenBucket
+}
+
+// tokenBucket lets rate requests per second through, with bursts of up to
+// burst requests
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst == 0 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (t *tokenBucket) Allow() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.tokens = math.Min(t.burst, t.tokens+now.Sub(t.last).Seconds()*t.rate)
+	t.last = now
+	if t.tokens < 1 {
+		return false
+	}
+	t.tokens--
+	return true
+}
+
+// the limiter of a listener, the one of the previous pools is kept when the
+// limit didnt change so a reload doesnt refill the bucket
+func listenerLimiter(l ListenerConfig, previous *Pools) *tokenBucket {
+	if l.RateLimit == 0 {
+		return nil
+	}
+	if previous != nil {
+		if old := previous.listeners[l.Address]; old != nil && old.limiter != nil &&
+			old.config.RateLimit == l.RateLimit && old.config.RateBurst == l.RateBurst {
+			return old.limiter
+		}
+	}
+	return newTokenBucket(l.RateLimit, l.RateBurst)
+}
+
+// requests per "listener status class", and the rate limited ones per
+// listener. Outside of the pools so they survive a reload.
+var listenerRequests, listenerLimited sync.Map
+
+// client connections per listener -> *listenerConnStats
+var listenerConns sync.Map
+
+type listenerConnStats struct {
+	open atomic.Int64
+	// connections in the middle of a request, the others are idle
+	active   atomic.Int64
+	accepted atomic.Uint64
+	// the last state of every open connection, a connection can close
+	// while active or idle
+	states sync.Map
+}
+
+func listenerConnsOf(address string) *listenerConnStats {
+	c, _ := listenerConns.LoadOrStore(address, new(listenerConnStats))
+	return c.(*listenerConnStats)
+}
+
+// the ConnState hook of the server of a listener, counting its open
+// connections. A hijacked one (websocket) is counted by its backend then.
+func trackConns(address string) func(net.Conn, http.ConnState) {
+	c := listenerConnsOf(address)
+	return func(conn net.Conn, state http.ConnState) {
+		previous, _ := c.states.Load(conn)
+		if previous == http.StateActive {
+			c.active.Add(-1)
+		}
+		switch state {
+		case http.StateNew:
+			c.open.Add(1)
+			c.accepted.Add(1)
+		case http.StateActive:
+			c.active.Add(1)
+		case http.StateClosed, http.StateHijacked:
+			c.open.Add(-1)
+			c.states.Delete(conn)
+			return
+		}
+		c.states.Store(conn, state)
+	}
+}
+
+func countListener(address string, status int) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	n, _ := listenerRequests.LoadOrStore(fmt.Sprintf("%s %dxx", address, status/100), new(atomic.Uint64))
+	n.(*atomic.Uint64).Add(1)
+}
+
+func countLimited(address string) {
+	n, _ := listenerLimited.LoadOrStore(address, new(atomic.Uint64))
+	n.(*atomic.Uint64).Add(1)
+}
+
+func loadCount(m *sync.Map, key string) uint64 {
+	if n, ok := m.Load(key); ok {
+		return n.(*atomic.Uint64).Load()
+	}
+	return 0
+}
+
+type listenerJSON struct {
+	Address     string            `json:"address"`
+	Pool        string            `json:"pool"`
+	TLS         bool              `json:"tls"`
+	RateLimit   float64           `json:"rate_limit,omitempty"`
+	Requests    uint64            `json:"requests"`
+	ByStatus    map[string]uint64 `json:"by_status"`
+	RateLimited uint64            `json:"rate_limited"`
+	// client connections open and in the middle of a request
+	Connections       int64 `json:"connections"`
+	ActiveConnections int64 `json:"active_connections"`
+	// the settings the listener overrides
+	Overrides []string `json:"overrides"`
+}
+
+// GET /admin/listeners
+func handleListeners(w http.ResponseWriter, req *http.Request) {
+	pools := activePools.Load()
+	list := []listenerJSON{}
+	for _, address := range sortedKeys(pools.listeners) {
+		l := pools.listeners[address].config
+		pool := l.Pool
+		if pool == "" {
+			pool = pools.defaultPool
+		}
+		lj := listenerJSON{
+			Address:     address,
+			Pool:        pool,
+			TLS:         l.TLS(),
+			RateLimit:   l.RateLimit,
+			ByStatus:    make(map[string]uint64),
+			RateLimited: loadCount(&listenerLimited, address),
+			Overrides:   l.RouteSettings.set(),
+		}
+		conns := listenerConnsOf(address)
+		lj.Connections, lj.ActiveConnections = conns.open.Load(), conns.active.Load()
+		for class := 1; class <= 5; class++ {
+			if n := loadCount(&listenerRequests, fmt.Sprintf("%s %dxx", address, class)); n > 0 {
+				lj.ByStatus[fmt.Sprintf("%dxx", class)] = n
+				lj.Requests += n
+			}
+		}
+		list = append(list, lj)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func writeListenerMetrics(w io.Writer) {
+	var keys []string
+	listenerRequests.Range(func(k, _ interface{}) bool {
+		keys = append(keys, k.(string))
+		return true
+	})
+	sort.Strings(keys)
+	writeMetricHeader(w, "lb_listener_requests_total", "counter", "Requests per listener and status class.")
+	for _, key := range keys {
+		address, code, _ := strings.Cut(key, " ")
+		fmt.Fprintf(w, "lb_listener_requests_total{listener=%q,code=%q} %d\n", address, code, loadCount(&listenerRequests, key))
+	}
+
+	keys = keys[:0]
+	listenerLimited.Range(func(k, _ interface{}) bool {
+		keys = append(keys, k.(string))
+		return true
+	})
+	sort.Strings(keys)
+	writeMetricHeader(w, "lb_listener_rate_limited_total", "counter", "Requests rejected by the rate limit of the listener.")
+	for _, address := range keys {
+		fmt.Fprintf(w, "lb_listener_rate_limited_total{listener=%q} %d\n", address, loadCount(&listenerLimited, address))
+	}
+
+	keys = keys[:0]
+	listenerConns.Range(func(k, _ interface{}) bool {
+		keys = append(keys, k.(string))
+		return true
+	})
+	sort.Strings(keys)
+	writeMetricHeader(w, "lb_listener_connections", "gauge", "Client connections open on the listener.")
+	for _, address := range keys {
+		fmt.Fprintf(w, "lb_listener_connections{listener=%q} %d\n", address, listenerConnsOf(address).open.Load())
+	}
+	writeMetricHeader(w, "lb_listener_connections_active", "gauge", "Client connections of the listener in the middle of a request.")
+	for _, address := range keys {
+		fmt.Fprintf(w, "lb_listener_connections_active{listener=%q} %d\n", address, listenerConnsOf(address).active.Load())
+	}
+	writeMetricHeader(w, "lb_listener_connections_accepted_total", "counter", "Client connections accepted by the listener.")
+	for _, address := range keys {
+		fmt.Fprintf(w, "lb_listener_connections_accepted_total{listener=%q} %d\n", address, listenerConnsOf(address).accepted.Load())
+	}
+}
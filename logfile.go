@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogFileConfig writes the log into a file instead of stderr
+type LogFileConfig struct {
+	// empty logs to stderr
+	Path     string `yaml:"path,omitempty"`
+	Rotation `yaml:",inline"`
+}
+
+// Rotation moves a log file aside when it gets too big or too old and
+// starts a new one, so a long running load balancer doesnt fill the disk
+// and needs no logrotate. The old files are <path>.<time>, next to it.
+type Rotation struct {
+	// rotate when the file would grow past this many megabytes, 0 for no
+	// limit
+	MaxSizeMB int `yaml:"max_size_mb,omitempty"`
+	// rotate when the file is this old, like 24h. 0 for no limit
+	MaxAge time.Duration `yaml:"max_age,omitempty"`
+	// rotated files kept, the oldest are removed first. 0 keeps them all
+	MaxFiles int `yaml:"max_files,omitempty"`
+	// rotated files older than this are removed, 0 keeps them
+	Retention time.Duration `yaml:"retention,omitempty"`
+}
+
+func (r Rotation) Enabled() bool {
+	return r != Rotation{}
+}
+
+func (r Rotation) Validate(setting string) error {
+	if r.MaxSizeMB < 0 || r.MaxAge < 0 || r.MaxFiles < 0 || r.Retention < 0 {
+		return fmt.Errorf("%s: max_size_mb, max_age, max_files and retention cant be negative", setting)
+	}
+	return nil
+}
+
+func (l LogFileConfig) Validate() error {
+	if l.Path == "" && l.Rotation.Enabled() {
+		return fmt.Errorf("log_file: rotation needs a path")
+	}
+	return l.Rotation.Validate("log_file")
+}
+
+// where the log goes, stderr or the log file
+var logOutput io.Writer = os.Stderr
+
+// set once at startup, before setLogFormat
+func setLogFile(l LogFileConfig) error {
+	if l.Path == "" {
+		return nil
+	}
+	f, err := openRotatingFile(l.Path, l.Rotation)
+	if err != nil {
+		return fmt.Errorf("log_file: %w", err)
+	}
+	logOutput = f
+	log.SetOutput(f)
+	return nil
+}
+
+// the suffix of rotated files, sorts by time
+const rotatedTimeFormat = "20060102-150405"
+
+// rotatingFile is a log file that rotates itself. It is the output of a
+// logger, so it cant log its own errors, they go to stderr.
+type rotatingFile struct {
+	path     string
+	rotation Rotation
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func openRotatingFile(path string, rotation Rotation) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, rotation: rotation}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	go f.prune()
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.size > 0 && f.due(len(p)) {
+		if err := f.rotate(); err != nil {
+			// keep writing to the file there is
+			fmt.Fprintf(os.Stderr, "Rotating %s failed: %s\n", f.path, err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// whether the file has to rotate before n more bytes
+func (f *rotatingFile) due(n int) bool {
+	r := f.rotation
+	return (r.MaxSizeMB > 0 && f.size+int64(n) > int64(r.MaxSizeMB)<<20) ||
+		(r.MaxAge > 0 && time.Since(f.opened) >= r.MaxAge)
+}
+
+// called with mu held
+func (f *rotatingFile) rotate() error {
+	rotated := f.path + "." + time.Now().Format(rotatedTimeFormat)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(rotated); os.IsNotExist(err) {
+			break
+		}
+		rotated = fmt.Sprintf("%s.%s.%d", f.path, time.Now().Format(rotatedTimeFormat), i)
+	}
+	if err := os.Rename(f.path, rotated); err != nil {
+		return err
+	}
+	old := f.file
+	if err := f.open(); err != nil {
+		// the old file is still open under its new name, better than
+		// nothing
+		return err
+	}
+	old.Close()
+	go f.prune()
+	return nil
+}
+
+// remove the rotated files beyond max_files and retention
+func (f *rotatingFile) prune() {
+	if f.rotation.MaxFiles == 0 && f.rotation.Retention == 0 {
+		return
+	}
+	matches, _ := filepath.Glob(f.path + ".*")
+	var rotated []string
+	for _, m := range matches {
+		suffix := strings.TrimPrefix(m, f.path+".")
+		if len(suffix) >= len(rotatedTimeFormat) {
+			if _, err := time.Parse(rotatedTimeFormat, suffix[:len(rotatedTimeFormat)]); err == nil {
+				rotated = append(rotated, m)
+			}
+		}
+	}
+	// newest first
+	sort.Sort(sort.Reverse(sort.StringSlice(rotated)))
+	for i, m := range rotated {
+		remove := f.rotation.MaxFiles > 0 && i >= f.rotation.MaxFiles
+		if info, err := os.Stat(m); err == nil && f.rotation.Retention > 0 && time.Since(info.ModTime()) > f.rotation.Retention {
+			remove = true
+		}
+		if remove {
+			if err := os.Remove(m); err != nil {
+				fmt.Fprintf(os.Stderr, "Removing %s failed: %s\n", m, err)
+			}
+		}
+	}
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// log levels, messages below the current level are dropped. Info is the zero
+// value so it is the level until something changes it.
+const (
+	levelDebug int32 = iota - 1
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[int32]string{levelDebug: "debug", levelInfo: "info", levelWarn: "warn", levelError: "error"}
+
+var logLevel atomic.Int32
+
+func parseLogLevel(name string) (int32, error) {
+	for level, n := range levelNames {
+		if n == name {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, use debug, info, warn or error", name)
+}
+
+// the level of log_level, info when it is not set
+func configLogLevel(name string) int32 {
+	if name == "" {
+		return levelInfo
+	}
+	level, _ := parseLogLevel(name)
+	return level
+}
+
+// formats of the log output: lines of text, or one json object per line
+// with the fields of the message (see warnw) as keys
+var validLogFormats = map[string]bool{"": true, "text": true, "json": true}
+
+// the logger of the json format, nil for text
+var jsonLogger *slog.Logger
+
+var slogLevels = map[int32]slog.Level{levelDebug: slog.LevelDebug, levelInfo: slog.LevelInfo, levelWarn: slog.LevelWarn, levelError: slog.LevelError}
+
+// set once at startup, before anything else logs
+func setLogFormat(format string) {
+	if format == "json" {
+		jsonLogger = slog.New(slog.NewJSONHandler(logOutput, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+}
+
+// info messages go out as they are, the others with their level in front
+func logf(level int32, format string, args ...interface{}) {
+	logw(level, nil, format, args...)
+}
+
+// a message with fields, key value pairs like "backend", url. The json
+// format has them as keys, the text one leaves them out, the message says
+// what matters already.
+func logw(level int32, fields []any, format string, args ...interface{}) {
+	if level < logLevel.Load() {
+		return
+	}
+	if jsonLogger != nil {
+		msg := strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")
+		jsonLogger.Log(context.Background(), slogLevels[level], msg, fields...)
+		return
+	}
+	switch level {
+	case levelDebug:
+		format = "DEBUG " + format
+	case levelWarn:
+		format = "WARN " + format
+	case levelError:
+		format = "ERROR " + format
+	}
+	log.Printf(format, args...)
+}
+
+func debugf(format string, args ...interface{}) { logf(levelDebug, format, args...) }
+func infof(format string, args ...interface{})  { logf(levelInfo, format, args...) }
+func warnf(format string, args ...interface{})  { logf(levelWarn, format, args...) }
+func errorf(format string, args ...interface{}) { logf(levelError, format, args...) }
+
+// an info message whatever the level
+func logAlways(format string, args ...interface{}) {
+	if jsonLogger != nil {
+		jsonLogger.Info(strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"))
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// log an error that ends the process, in the log format
+func fatal(v any) {
+	logf(levelError, "%v\n", v)
+	os.Exit(1)
+}
+
+func debugw(fields []any, format string, args ...interface{}) {
+	logw(levelDebug, fields, format, args...)
+}
+func infow(fields []any, format string, args ...interface{}) {
+	logw(levelInfo, fields, format, args...)
+}
+func warnw(fields []any, format string, args ...interface{}) {
+	logw(levelWarn, fields, format, args...)
+}
+func errorw(fields []any, format string, args ...interface{}) {
+	logw(levelError, fields, format, args...)
+}
+
+// the fields of a proxied request: path, method, client, route, pool, retry
+// and attempt, its tags, and more given as key value pairs
+func requestFields(r *http.Request, more ...any) []any {
+	retry, _ := r.Context().Value(Retry).(int)
+	fields := []any{"method", r.Method, "path", r.URL.Path, "client", r.RemoteAddr, "retry", retry, "attempt", GetAttemptsFromContext(r)}
+	if id := GetRequestIDFromContext(r); id != "" {
+		fields = append(fields, "request_id", id)
+	}
+	if route, ok := r.Context().Value(CurrentRoute).(*Route); ok {
+		fields = append(fields, "route", route.Name, "pool", route.Pool)
+	}
+	if tags := GetTagsFromContext(r); len(tags) > 0 {
+		fields = append(fields, "tags", tags)
+	}
+	return append(fields, more...)
+}
+
+// a level set for a while through the admin api, and the one to go back to
+var logLevelReset struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	until  time.Time
+	before int32
+}
+
+// change the log level, for duration if not 0. Level changes are always
+// logged, whatever the level.
+func setLogLevel(level int32, duration time.Duration) {
+	r := &logLevelReset
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	base := logLevel.Load()
+	if r.timer != nil {
+		// a temporary level is replaced, the one before it is still the
+		// level to go back to
+		r.timer.Stop()
+		base = r.before
+		r.timer, r.until = nil, time.Time{}
+	}
+	logLevel.Store(level)
+	if duration == 0 {
+		return
+	}
+	r.before, r.until = base, time.Now().Add(duration)
+	var timer *time.Timer
+	timer = time.AfterFunc(duration, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.timer != timer {
+			return
+		}
+		logLevel.Store(r.before)
+		r.timer, r.until = nil, time.Time{}
+		logAlways("Log level back to %s\n", levelNames[r.before])
+	})
+	r.timer = timer
+}
+
+type logLevelJSON struct {
+	Level string `json:"level"`
+	// when a temporary level ends
+	Until *time.Time `json:"until,omitempty"`
+}
+
+func currentLogLevel() logLevelJSON {
+	logLevelReset.mu.Lock()
+	defer logLevelReset.mu.Unlock()
+	out := logLevelJSON{Level: levelNames[logLevel.Load()]}
+	if !logLevelReset.until.IsZero() {
+		until := logLevelReset.until
+		out.Until = &until
+	}
+	return out
+}
+
+// GET /admin/log-level
+func handleGetLogLevel(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, currentLogLevel())
+}
+
+// PUT /admin/log-level with {"level": "debug"}, and "for": "15m" to go back
+// to the level before after a while
+func handleSetLogLevel(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Level string        `yaml:"level"`
+		For   time.Duration `yaml:"for"`
+	}
+	data, err := io.ReadAll(io.LimitReader(req.Body, 1<<20))
+	if err == nil {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&body)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	level, err := parseLogLevel(body.Level)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if body.For < 0 {
+		writeError(w, http.StatusBadRequest, "for must not be negative")
+		return
+	}
+	setLogLevel(level, body.For)
+	if body.For > 0 {
+		logAlways("Admin: log level %s for %s\n", body.Level, body.For)
+	} else {
+		logAlways("Admin: log level %s\n", body.Level)
+	}
+	writeJSON(w, http.StatusOK, currentLogLevel())
+}
@@ -2,24 +2,40 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
-	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"strings"
+	"os"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
-// make increment value with iota, attempts = 0, retry = 1
+// make increment value with iota, attempts = 0, retry = 1, route = 2,
+// strict conn = 3, tags = 4, proxy client = 5, access entry = 6, trace = 7,
+// request id = 8, history = 9, request timer = 10, hedge = 11,
+// retry body = 12, fallback = 13, peer slot = 14
 // keep track of the http request
 const ( 
 	Attempts int = iota
 	Retry
+	CurrentRoute
+	StrictConn
+	Tags
+	ProxyClient
+	AccessEntry
+	Trace
+	RequestID
+	History
+	RequestTimer
+	Hedge
+	RetryBody
+	Fallback
+	PeerSlot
 )
 
 
@@ -28,17 +44,93 @@ type Backend struct {
 	Alive bool
 	mux   sync.RWMutex
 	ReverseProxy *httputil.ReverseProxy
+
+	// config the backend was built from and how to connect to it
+	config    BackendConfig
+	dial      dialFunc
+	transport *http.Transport
+	// what requests go through, transport unless the backend speaks h2c
+	roundTripper http.RoundTripper
+
+	// requests sent to this backend, every attempt counts
+	requests atomic.Uint64
+	// proxied requests per address family
+	servedIPv4 atomic.Uint64
+	servedIPv6 atomic.Uint64
+
+	// requests currently being proxied to this backend, open websockets
+	// included
+	inFlight atomic.Int64
+	// websocket connections open to this backend, and opened in total
+	websockets      atomic.Int64
+	websocketsTotal atomic.Uint64
+	// set through the admin api, no new requests while draining
+	draining atomic.Bool
+	// draining because the backend asked for it with the drain header
+	drainedByHeader atomic.Bool
+	// set through the admin api, no requests at all while disabled
+	disabled atomic.Bool
+	// not in the pools anymore since a reload, see drainRemovedBackends
+	removed atomic.Bool
+	// weight set through the admin api, 0 means the configured one
+	weight atomic.Int64
+	// time to the response headers of every request
+	latency latencyHistogram
+	// latency and errors of the last minute or so
+	recent backendStats
+	// results of the health probes
+	probes probeStats
+	// connections open to the backend for the traffic
+	conns connStats
+	// trips when the backend keeps failing, see breaker.go
+	breaker circuitBreaker
+	// compared with the other backends of the pool, see outlier.go
+	outlier outlierStats
+	// responses by status class (index 2 for 2xx), failed attempts at 0
+	responses [6]atomic.Uint64
+	// attempts that followed a failed one on this backend, here or elsewhere
+	retries atomic.Uint64
+	// 503 answers that paused the backend, see unavailable.go
+	unavailable atomic.Uint64
+
+	// adaptive health check state, guarded by mux
+	checkInterval time.Duration
+	nextCheck     time.Time
+	lastChange    time.Time
+
+	// connection reset storm detection, guarded by mux
+	resetCount       int
+	resetWindowStart time.Time
+	pausedUntil      time.Time
+
+	// quarantine after being marked down by failed requests, guarded by mux
+	quarantinedUntil time.Time
+	quarantinePasses int
+
+	// expiry of the tls certificate seen by the health check (unix seconds,
+	// 0 if unknown) and the days left we last warned about
+	certExpiry     atomic.Int64
+	certWarnedDays atomic.Int64
 }
 
 // keep track of the backend server
 type ServerPool struct {
+	name     string
 	backends []*Backend
+	ring     atomic.Pointer[[]int] // backend indexes in weighted round robin order
 	current uint64 // keep track of the index
+	// balancing strategy of the config, see Strategy()
+	strategy string
+
+	// below this percent of healthy backends the health checks are ignored
+	panicThreshold int
+	panicking      atomic.Bool
+
+	// what happens to requests no backend can take, nil for a 503
+	fallback *FallbackConfig
 }
 
 func GetRetryFromContext(r *http.Request) int {
-	fmt.Println(r.Context().Value(Retry))
-
 	// check if the retry is an type of int => int then return it
 	if retry, ok := r.Context().Value(Retry).(int); ok {
 		return retry
@@ -51,10 +143,39 @@ func (b *Backend) SetAlive(alive bool) {
 	// Lock is used to ensure no one (go routine) can read or write the data
 	// Just one routine at a time
 	b.mux.Lock()
+	if b.Alive != alive {
+		// status flipped, probe this one at the floor interval until it settles
+		now := time.Now()
+		b.probes.transitions[boolIndex(alive)].Add(1)
+		b.lastChange = now
+		b.checkInterval = healthMinInterval
+		b.nextCheck = now.Add(b.checkInterval)
+	}
 	b.Alive = alive
 	b.mux.Unlock()
 }
 
+// share of the traffic this backend gets
+func (b *Backend) Weight() int {
+	if w := b.weight.Load(); w > 0 {
+		return int(w)
+	}
+	if b.config.Weight <= 0 {
+		return 1
+	}
+	return b.config.Weight
+}
+
+// check if the backend already has max_conns requests in flight
+func (b *Backend) Saturated() bool {
+	return b.config.MaxConns > 0 && b.inFlight.Load() >= int64(b.config.MaxConns)
+}
+
+// check if the backend can take a new request right now
+func (b *Backend) Available() bool {
+	return b.IsAlive() && !b.Saturated() && !b.Paused() && !b.CircuitOpen() && !b.Ejected() && !b.Draining() && !b.Disabled()
+}
+
 func (b *Backend) IsAlive() (alive bool) {
 	// RLock is used to ensure that when reading of the data happend,
 	// no one is updating the value.
@@ -64,6 +185,42 @@ func (b *Backend) IsAlive() (alive bool) {
 	return
 }
 
+// add backend to the server pool
+func (s *ServerPool) AddBackend(backend *Backend) {
+	s.backends = append(s.backends, backend)
+	s.rebuildRing()
+}
+
+// spread the backends over a new ring, after a weight changed
+func (s *ServerPool) rebuildRing() {
+	ring := weightedRing(s.backends)
+	s.ring.Store(&ring)
+}
+
+// spread the backends over a ring according to their weight, using smooth
+// weighted round robin so a heavy backend isnt picked many times in a row.
+// With all weights at 1 the ring is just the backends in order.
+func weightedRing(backends []*Backend) []int {
+	total := 0
+	for _, b := range backends {
+		total += b.Weight()
+	}
+	ring := make([]int, 0, total)
+	current := make([]int, len(backends))
+	for len(ring) < total {
+		best := 0
+		for i, b := range backends {
+			current[i] += b.Weight()
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		ring = append(ring, best)
+	}
+	return ring
+}
+
 func (s *ServerPool) MarkBackendStatus(backendUrl *url.URL, alive bool) {
 	for _, b := range s.backends {
 		if b.URL.String() == backendUrl.String() {
@@ -80,24 +237,30 @@ func GetAttemptsFromContext(r *http.Request) int {
 	return 1
 }
 
-func (s *ServerPool) NextIndex() int {
-	return int(atomic.AddUint64(&s.current, uint64(1)) % uint64(len(s.backends)))
+func (s *ServerPool) NextIndex(ring []int) int {
+	return int(atomic.AddUint64(&s.current, uint64(1)) % uint64(len(ring)))
 }
 
 // get the next active peer to connect
 func (s *ServerPool) GetNextPeer() *Backend {
+	if s.Strategy() == "least-conn" {
+		return s.leastConnPeer()
+	}
 	// Find the alive backend in the pool
-	next := s.NextIndex()
+	ring := *s.ring.Load()
+	next := s.NextIndex(ring)
+	panicking := s.Panicking()
 	// start from the next -=> find in the full cycle
-	l := len(s.backends) + next
+	l := len(ring) + next
 	for i := next; i < l; i++ {
-		idx := i % len(s.backends)
+		idx := i % len(ring)
+		b := s.backends[ring[idx]]
 		// if its alive, use it and if its not the original, store it!
-		if s.backends[idx].IsAlive() {
+		if b.Available() || (panicking && b.AvailableIgnoringHealth()) {
 			if i != next { // if not original, then store for new index
 				atomic.StoreUint64(&s.current, uint64(idx))
 			}	
-			return s.backends[idx]
+			return b
 		}
 	}
 	return nil
@@ -105,26 +268,82 @@ func (s *ServerPool) GetNextPeer() *Backend {
 
 // Load balancing
 func lb(w http.ResponseWriter, r *http.Request) {
-	attempts := GetAttemptsFromContext(r)
-	if attempts > 3 {
-		log.Printf("%s(%s) Max attemps reached, terminating\n", r.RemoteAddr, r.URL.Path)
+	pools := activePools.Load()
+
+	// the listener picks the route, retries keep the one of the first attempt
+	route, ok := r.Context().Value(CurrentRoute).(*Route)
+	if !ok {
+		route = matchRoute(pools.Routes(""), requestHost(r), r.URL.Path)
+		r = r.WithContext(context.WithValue(r.Context(), CurrentRoute, route))
+	}
+	pool := pools.Get(route.Pool)
+	if pool == nil {
+		// the pool went away with a reload while this request was retrying
+		warnw(requestFields(r), "%s(%s)%s Pool %s not found\n", r.RemoteAddr, r.URL.Path, logRequest(r), route.Pool)
+		recentErrors.Add(errorEntry{Pool: route.Pool, Path: r.URL.Path, Error: "pool not found"})
 		http.Error(w, "servie not available", http.StatusServiceUnavailable)
 		return
 	}
 
-	peer := serverPool.GetNextPeer()
-	if peer != nil {
-		peer.ReverseProxy.ServeHTTP(w, r)
+	// retries to another backend come back here with their attempt set
+	if _, retry := r.Context().Value(Attempts).(int); !retry {
+		globalRetryBudget.Request()
+		r = withRetryBody(r, route.RetryBodyLimit)
+		var cancel context.CancelCauseFunc
+		r, cancel = withRequestTimeout(r, route)
+		defer cancel(nil)
+	} else {
+		r = rewindBody(r)
+	}
+
+	attempts := GetAttemptsFromContext(r)
+	if attempts > route.MaxAttempts {
+		warnw(requestFields(r), "%s(%s)%s Max attemps reached, terminating\n", r.RemoteAddr, r.URL.Path, logRequest(r))
+		recentErrors.Add(errorEntry{Pool: route.Pool, Path: r.URL.Path, Error: "max attempts reached"})
+		if pool.fallBack(w, r) {
+			return
+		}
+		http.Error(w, "servie not available", http.StatusServiceUnavailable)
+		return
 	}
 
+	peer := pool.acquirePeer()
+	if peer == nil {
+		peer = pool.waitForPeer(r)
+	}
+	if peer == nil {
+		if !requestTimedOut(w, r) {
+			noPeer(w, r, pool)
+		}
+		return
+	}
+	r, release := withPeerSlot(r, pool, peer)
+	defer release()
+	peer.breakerAdmit()
+	if peer.config.ProxyProtocol != "" {
+		r = withProxyClient(r)
+	}
+	if e := GetAccessEntryFromContext(r); e != nil {
+		e.Backend = peer.URL.String()
+		e.Attempts++
+	}
+	if route.Streaming {
+		w = &flushWriter{ResponseWriter: w}
+	}
+	if route.Hedge.Enabled() && hedgeable(r) {
+		serveHedged(w, r, pool, peer, route)
+		return
+	}
+	peer.ReverseProxy.ServeHTTP(w, r)
 }
 
 // Check if backend is alive or not by trying to connect through TCP connection
-func isBackendAlive(u *url.URL) bool {
-	timeout := 2 * time.Second
-	conn, err := net.DialTimeout("tcp", u.Host, timeout)
+func isBackendAlive(u *url.URL, dial dialFunc, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := dial(ctx, "tcp", hostPort(u))
 	if err != nil {
-		log.Println("Cant connect to the server, error: ", err)
+		debugw([]any{"backend", u.String(), "error", err.Error()}, "Cant connect to the server, error: %s\n", err)
 		return false
 	}
 	defer conn.Close()
@@ -133,96 +352,422 @@ func isBackendAlive(u *url.URL) bool {
 
 
 func (s *ServerPool) HealthCheck() {
-	for _, b := range s.backends{
+	now := time.Now()
+	for _, b := range s.backends {
+		if !b.dueForCheck(now) {
+			continue
+		}
 		status := "up"
-		alive := isBackendAlive(b.URL)
+		wasAlive := b.IsAlive()
+		start := time.Now()
+		alive := b.probe()
+		took := time.Since(start)
+		b.probes.record(alive, took)
+		alive = b.quarantineProbe(alive)
 		b.SetAlive(alive)
+		if !alive && b.drainedByHeader.Load() {
+			// it went away as announced, once it is back it gets requests again
+			b.drainedByHeader.Store(false)
+			b.SetDraining(false)
+		}
+		b.scheduleNextCheck(time.Now())
 		if !alive {
 			status = "down"
 		}
-		log.Printf("%s [%s]\n", b.URL, status)
+		if b.Quarantined() {
+			status += ", quarantined"
+		}
+		if b.Disabled() {
+			status += ", disabled"
+		}
+		v4, v6 := b.FamilyCounts()
+		// only a change is news, the rest is for debugging
+		logCheck := debugw
+		if alive != wasAlive {
+			logCheck = infow
+		}
+		fields := []any{"backend", b.URL.String(), "pool", s.name, "alive", alive, "state", status, "latency_ms", float64(took.Microseconds()) / 1000, "next_check_ms", b.CheckInterval().Milliseconds()}
+		logCheck(fields, "%s [%s] pool %s, next check in %s (served ipv4: %d, ipv6: %d)\n", b.URL, status, s.name, b.CheckInterval(), v4, v6)
 	}
 }
 
 // check if there is something wrong on the backend
-// refresh every 2 mins
+// ticks at the floor interval, each backend is only probed when its own interval is due
 func healthCheck() {
-	t := time.NewTicker(time.Minute * 2)
+	t := time.NewTicker(healthMinInterval)
 	for {
 		select {
 			case <- t.C:
-				log.Println("Start Health Checking...")
-				serverPool.HealthCheck()
-				log.Println("Health check complete")
+				for _, pool := range activePools.Load().All() {
+					pool.HealthCheck()
+				}
 		}
 	}
 }
 
 
-var serverPool ServerPool
+// create a backend with its own reverse proxy
+func NewBackend(serverUrl *url.URL, bc BackendConfig) (*Backend, error) {
+	egress, err := parseEgressProxy(bc.EgressProxy)
+	if err != nil {
+		return nil, err
+	}
+	dial, err := newDialer(egress, bc)
+	if err != nil {
+		return nil, err
+	}
+	if bc.ProxyProtocol != "" {
+		dial = withProxyHeader(dial, bc.ProxyProtocol)
+	}
+	tlsConfig, err := backendTLSConfig(bc)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Backend{
+		URL:           serverUrl,
+		Alive:         true,
+		config:        bc,
+		dial:          dial,
+		checkInterval: healthMinInterval,
+	}
+	b.transport, b.roundTripper = backendTransports(bc, b.conns.counting(dial), tlsConfig)
+
+	// all request will be passed to the serverUrl
+	proxy := httputil.NewSingleHostReverseProxy(serverUrl)
+	proxy.FlushInterval = proxyFlushInterval
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		b.requests.Add(1)
+		director(r)
+	}
+	proxy.Transport = &spanRecorder{next: &responseTimeouter{next: &headerTimeouter{next: &latencyRecorder{next: &familyCounter{next: b.roundTripper, backend: b}, backend: b}}, backend: b}, backend: b}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		stopRequestTimeout(resp.Request)
+		b.checkDrainHeader(resp.Header, true)
+		stripRequestID(resp)
+		b.countResponse(resp.StatusCode)
+		b.breakerRecord(resp.StatusCode < 500)
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			if err := b.honorUnavailable(resp); err != nil {
+				return err
+			}
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			b.trackUpgrade(resp)
+			return nil
+		}
+		if err := transformResponse(resp); err != nil {
+			return err
+		}
+		recordStale(resp)
+		return nil
+	}
+	proxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, e error){
+		if hedgeLost(request) {
+			return
+		}
+		if requestTimedOut(writer, request) {
+			return
+		}
+		// already counted as a response, it only moves on
+		if errors.Is(e, errBackendUnavailable) {
+			b.retryUnavailable(writer, request)
+			return
+		}
+		warnw(requestFields(request, "backend", serverUrl.String(), "error", e.Error()), "[%s]%s %s\n", serverUrl.Host, logRequest(request), e.Error())
+		retries := GetRetryFromContext(request)
+		route := GetRouteFromContext(request)
+		recentErrors.Add(errorEntry{Pool: route.Pool, Backend: serverUrl.String(), Path: request.URL.Path, Error: e.Error()})
+		b.countResponse(0)
+		if isConnReset(e) {
+			b.recordReset()
+		}
+		// the client going away says nothing about the backend
+		if !errors.Is(e, context.Canceled) {
+			b.breakerRecord(false)
+		}
+		paused := b.Paused() || b.CircuitOpen() || b.removed.Load() || b.Disabled()
+		if isHedge(request) {
+			// the first attempt of the request is still going, it retries
+			http.Error(writer, "Bad gateway", http.StatusBadGateway)
+			return
+		}
+
+		attempts := GetAttemptsFromContext(request)
+		action := route.RetryMatrix.action(errorClass(e), request.Method, route.idempotent(request))
+		if action != actionFail && action != actionServeStale && !bodyReplayable(request) {
+			// the failed attempt took part of the body with it, another one
+			// would send it cut
+			bodyNotKept.Add(1)
+			warnw(requestFields(request, "backend", serverUrl.String()), "%s(%s)%s Request body longer than retry_body_limit partly sent, not retrying\n", request.RemoteAddr, request.URL.Path, logRequest(request))
+			action = actionFail
+		}
+		switch action {
+		case actionFail:
+			http.Error(writer, "Bad gateway", http.StatusBadGateway)
+			return
+		case actionServeStale:
+			if !serveStale(writer, request, route) {
+				http.Error(writer, "Bad gateway", http.StatusBadGateway)
+			}
+			return
+		case actionRetryOther:
+			if !retryWithinBudget(writer, request, serverUrl.String()) {
+				return
+			}
+			b.retries.Add(1)
+			debugw(requestFields(request, "backend", serverUrl.String()), "%s(%s)%s Attempting retry %d on another backend\n", request.RemoteAddr, request.URL.Path, logRequest(request), attempts)
+			releasePeerSlot(request)
+			lb(writer, request.WithContext(context.WithValue(request.Context(), Attempts, attempts+1)))
+			return
+		}
+
+		// we try a few times (3 by default) for a request to reach server,
+		// unless it is paused because of a reset storm or its breaker opened,
+		// or it was taken out while the request was on it
+		if retries < route.Retries && !paused {
+			if !retryWithinBudget(writer, request, serverUrl.String()) {
+				return
+			}
+			select {
+			case <- request.Context().Done():
+				if !requestTimedOut(writer, request) {
+					http.Error(writer, "Bad gateway", http.StatusBadGateway)
+				}
+			case <- time.After(route.retryWait(retries)):
+				b.retries.Add(1)
+				ctx := context.WithValue(request.Context(), Retry, retries+1)
+				proxy.ServeHTTP(writer, rewindBody(request.WithContext(ctx)))
+			}
+			return
+		}
+
+		// after all the retreis, mark it as backend down. A paused backend
+		// is left alone, it gets traffic again after the cooldown, and with
+		// a circuit breaker that decides instead
+		if !paused && !b.breakerEnabled() {
+			b.SetAlive(false)
+			b.startQuarantine()
+		}
+
+
+		// if the same request routing for few attempts with different backends, increase the count
+		if !retryWithinBudget(writer, request, serverUrl.String()) {
+			return
+		}
+		b.retries.Add(1)
+		debugw(requestFields(request, "backend", serverUrl.String()), "%s(%s)%s Attempting retry %d\n", request.RemoteAddr, request.URL.Path, logRequest(request), attempts)
+		ctx := context.WithValue(request.Context(), Attempts, attempts+1)
+		releasePeerSlot(request)
+		lb(writer, request.WithContext(ctx))
+	}
+
+	b.ReverseProxy = proxy
+	return b, nil
+}
 
 func main() {
+	// subcommands, anything else is the normal flag based startup
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(runValidate(os.Args[2:]))
+		case "config":
+			os.Exit(runConfigCommand(os.Args[2:]))
+		case "status":
+			os.Exit(runStatus(os.Args[2:]))
+		case "drain":
+			os.Exit(runDrain(os.Args[2:]))
+		case "add":
+			os.Exit(runAdd(os.Args[2:]))
+		case "top":
+			os.Exit(runTop(os.Args[2:]))
+		}
+	}
+
 	var serverList string
-	var port int
+	var configPath string
+	var watch bool
+	var dryRun bool
+	var dryRunFormat string
+
+	flags := defaultConfig()
 
 	// cli argument, -backend=server1,server2 .... -port=8080
 	// seperate using comma, dont use space
+	flag.StringVar(&configPath, "config", "", "Path to the yaml config file")
+	flag.BoolVar(&watch, "watch", false, "Reload the config file automatically when it changes")
 	flag.StringVar(&serverList, "backend", "", "Load balancer backend, separate with commas.")
-	flag.IntVar(&port, "port", 3030, "Port to serve")
-
+	flag.IntVar(&flags.Port, "port", flags.Port, "Port to serve")
+	flag.StringVar(&flags.TLSCert, "tls-cert", "", "Serve https on the port with this certificate (pem file or env://)")
+	flag.StringVar(&flags.TLSKey, "tls-key", "", "Key of the -tls-cert certificate (pem file or env://)")
+	flag.StringVar(&flags.TLSMinVersion, "tls-min-version", "", "Oldest tls version the port accepts: 1.0, 1.1, 1.2 or 1.3")
+	flag.StringVar(&flags.TLSMaxVersion, "tls-max-version", "", "Newest tls version the port accepts")
+	flag.StringVar(&flags.TLSCiphers, "tls-ciphers", "", "Cipher suites the port allows for tls 1.2 and older, separated by colons")
+	flag.StringVar(&flags.TLSCurves, "tls-curves", "", "Curves the port allows in order of preference, like X25519:P256")
+	flag.BoolVar(&flags.HTTP3, "http3", false, "Also serve http/3 on the udp port, needs -tls-cert")
+	flag.BoolVar(&flags.H2C, "h2c", false, "Accept http/2 without tls on the port")
+	flag.BoolVar(&flags.ProxyProtocol, "proxy-protocol", false, "Expect a PROXY protocol header on every connection to the port")
+	flag.StringVar(&flags.UnixSocket, "unix-socket", "", "Listen on this unix socket instead of the port")
+	flag.StringVar(&flags.SocketMode, "socket-mode", "", "Permissions of the -unix-socket, like 0660")
+	flag.StringVar(&flags.RedirectHTTP, "redirect-http", "", "Redirect plain http on this address (like :80) to the https port, needs -tls-cert")
+	flag.DurationVar(&flags.Health.Interval, "health-interval", flags.Health.Interval, "Health check interval for stable backends")
+	flag.StringVar(&flags.EgressProxy, "egress-proxy", "", "Reach backends through this proxy (socks5://host:port or http://host:port)")
+	flag.DurationVar(&flags.Health.MinInterval, "health-min-interval", flags.Health.MinInterval, "Health check interval floor for flapping backends")
+	flag.StringVar(&flags.IPFamily, "ip-family", "", "Address family for upstream dials: any, prefer-ipv4, prefer-ipv6, ipv4, ipv6")
+	flag.StringVar(&flags.Strategy, "strategy", flags.Strategy, "Load balancing strategy (round-robin or least-conn)")
+	flag.BoolVar(&flags.StrictParsing, "strict-parsing", false, "Reject ambiguous http/1 requests (see README)")
+	flags.RouteSettings = RouteSettings{
+		RetryDelay:    durationPtr(*defaultRouteSettings.RetryDelay),
+		RetryBackoff:  floatPtr(*defaultRouteSettings.RetryBackoff),
+		RetryMaxDelay: durationPtr(*defaultRouteSettings.RetryMaxDelay),
+		RetryJitter:   floatPtr(*defaultRouteSettings.RetryJitter),
+		SlowThreshold: durationPtr(*defaultRouteSettings.SlowThreshold),
+		RequestTimeout: durationPtr(*defaultRouteSettings.RequestTimeout),
+	}
+	flag.DurationVar(flags.RetryDelay, "retry-delay", *flags.RetryDelay, "Wait before the first retry on the same backend, for every route that doesnt set it")
+	flag.Float64Var(flags.RetryBackoff, "retry-backoff", *flags.RetryBackoff, "Multiplier of the retry wait for every further retry")
+	flag.DurationVar(flags.RetryMaxDelay, "retry-max-delay", *flags.RetryMaxDelay, "Longest wait between two retries, 0 for no limit")
+	flag.Float64Var(flags.RetryJitter, "retry-jitter", *flags.RetryJitter, "Random fraction of the retry wait, 0 to 1")
+	flag.DurationVar(flags.SlowThreshold, "slow-threshold", *flags.SlowThreshold, "Log requests taking longer than this, for every route that doesnt set it, 0 for none")
+	flag.Float64Var(&flags.RetryBudget.Ratio, "retry-budget", 0, "Allow at most this many retries per request over all requests, like 0.2, 0 for no limit")
+	flag.DurationVar(flags.RequestTimeout, "request-timeout", *flags.RequestTimeout, "Answer 504 when no attempt got a response within this, for every route that doesnt set it, 0 for no limit")
+	flag.IntVar(&flags.Queue.Depth, "queue-depth", 0, "Requests per pool that wait for a free backend when all are at max_conns, 0 answers 503 right away")
+	flag.DurationVar(&flags.Queue.Timeout, "queue-timeout", flags.Queue.Timeout, "How long a request waits in the queue at most")
+	flag.IntVar(&flags.MaxRequests, "max-requests", 0, "Requests in flight through the load balancer at most, the rest get 503 right away, 0 for no limit")
+	flag.DurationVar(&flags.DrainTimeout, "drain-timeout", flags.DrainTimeout, "Time a removed or disabled backend gets to finish its requests before its connections are cut")
+	flag.StringVar(&flags.BackendFile, "backend-file", "", "File listing one backend per line, re-read periodically")
+	flag.DurationVar(&flags.BackendFileInterval, "backend-file-interval", flags.BackendFileInterval, "How often the backend file is re-read")
+	flag.BoolVar(&flags.Admin.Enabled, "admin", false, "Serve the admin api under /admin/ on the listeners")
+	flag.StringVar(&flags.AccessLog.Output, "access-log", "", "Write an access log to stdout, stderr or this file")
+	flag.StringVar(&flags.AccessLog.Format, "access-log-format", "", "Access log format: common, combined, json or a text/template")
+	flag.StringVar(&flags.Tracing.Endpoint, "tracing-endpoint", "", "Send a span of every request to this OTLP/HTTP collector, like http://localhost:4318")
+	flag.StringVar(&flags.LogLevel, "log-level", "", "Log level: debug, info (the default), warn or error")
+	flag.BoolFunc("quiet", "Only log errors, the same as -log-level=error", func(value string) error {
+		quiet, err := strconv.ParseBool(value)
+		if quiet {
+			flags.LogLevel = "error"
+		}
+		return err
+	})
+	flag.StringVar(&flags.LogFile.Path, "log-file", "", "Log into this file instead of stderr")
+	flag.StringVar(&flags.Syslog.Address, "syslog", "", "Log to syslog instead of stderr: udp://host:port, tcp://host:port or unixgram:///dev/log")
+	flag.StringVar(&flags.Syslog.Facility, "syslog-facility", "", "Syslog facility, like daemon (the default) or local0")
+	flag.StringVar(&flags.LogFormat, "log-format", "", "Log as text (the default) or json")
+	flag.StringVar(&flags.StatsD.Address, "statsd-address", "", "Push the metrics to this statsd or dogstatsd host:port")
+	flag.StringVar(&flags.StatsFile.Path, "stats-file", "", "Write the counters and backend states to this file every 10s, as json")
+	flag.StringVar(&flags.MetricsAddress, "metrics-address", "", "Serve /metrics for prometheus on this host:port or unix:/path")
+	flag.StringVar(&flags.Admin.Address, "admin-address", "", "Serve the admin api on this host:port or unix:/path instead of the listeners")
+	flag.StringVar(&flags.Admin.Token, "admin-token", "", "Bearer token the admin api requires (file:// and env:// allowed)")
+	flag.StringVar(&flags.Admin.AuditLog.Path, "admin-audit-log", "", "Append the changes made through the admin api to this file")
+	flag.BoolVar(&flags.Admin.Pprof, "admin-pprof", false, "Serve the go profiler under /admin/debug/pprof/")
+	flag.BoolVar(&flags.Watchdog.Enabled, "watchdog", false, "Watch the load balancer itself for stalls, goroutine leaks and dead listeners")
+	flag.BoolVar(&dryRun, "dry-run", false, "Print the effective configuration and exit")
+	flag.StringVar(&dryRunFormat, "dry-run-format", "yaml", "Format of the -dry-run output: yaml or json")
+
+	// LB_* environment variables, overridden by the command line
+	if err := applyEnv(flag.CommandLine); err != nil {
+		log.Fatal(err)
+	}
 	flag.Parse()
 
-	if len(serverList) == 0 {
-		log.Fatal("Please provide one or more backends to load balance")
+	cfg, err := resolveConfig(configPath, flags, serverList)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	// parse servers
-	tokens := strings.Split(serverList, ",")
-	for _, tok := range tokens {
-		serverUrl, err := url.Parse(tok)
-		if err != nil {
+	// show what flags, environment and file add up to, invalid or not
+	if dryRun {
+		if err := printEffectiveConfig(os.Stdout, cfg, dryRunFormat); err != nil {
 			log.Fatal(err)
 		}
-		// log.Printf("Configured server: %s\n", serverUrl)
-		
-		// all request will be passed to the serverUrl 
-		proxy := httputil.NewSingleHostReverseProxy(serverUrl)
-		proxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, e error){
-			log.Printf("[%s] %s\n", serverUrl.Host, e.Error())
-			retries := GetRetryFromContext(request)
-
-			// we try 3 times for a request to reach server
-			if retries < 3 {
-				select {
-				case <- time.After(10 * time.Millisecond):
-					ctx := context.WithValue(request.Context(), Retry, retries+1)
-					proxy.ServeHTTP(writer, request.WithContext(ctx))
-				}
-				return
-			}
+		if err := cfg.Validate(); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
 
-			// after 3 retreis, mark it as backend down
-			serverPool.MarkBackendStatus(serverUrl, false)
+	if len(cfg.effectivePools()) == 0 {
+		log.Fatal("Please provide one or more backends to load balance")
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	if err := setLogFile(cfg.LogFile); err != nil {
+		log.Fatal(err)
+	}
+	if err := setSyslog(cfg.Syslog); err != nil {
+		log.Fatal(err)
+	}
+	setLogFormat(cfg.LogFormat)
+	logLevel.Store(configLogLevel(cfg.LogLevel))
+	startTracing(cfg.Tracing)
 
+	healthInterval = cfg.Health.Interval
+	healthMinInterval = cfg.Health.MinInterval
+	certWarningDays.Store(int64(cfg.Health.CertWarningDays))
+
+	activeResolver.Store(newDNSResolver(cfg.Resolver))
+	pools, err := NewPools(cfg, nil)
+	if err != nil {
+		fatal(err)
+	}
+	activePools.Store(pools)
+	setMaintenance(cfg.Maintenance.Enabled, "config")
 
-			// if the same request routing for few attempts with different backends, increase the count
-			attempts := GetAttemptsFromContext(request)
-			log.Printf("%s(%s) Attempting retry %d\n", request.RemoteAddr, request.URL.Path, attempts)
-			ctx := context.WithValue(request.Context(), Attempts, attempts+1)
-			lb(writer, request.WithContext(ctx))
+	r := newReloader(configPath, cfg, flags, serverList)
+	if watch {
+		if configPath == "" {
+			fatal("-watch requires -config")
+		}
+		go watchConfig(r)
+	}
+	go pollBackendFile(r)
+	go watchProcess(r)
+	go snapshotPools(r)
+	go exportState(r)
+	go exportUsage(r)
+	go exportStatsD(r)
+	go exportStatsFile(r)
+	go detectOutliers(r)
+	go watchLoad(r)
+
+	var admin http.Handler
+	if cfg.Admin.Enabled {
+		admin = newAdminHandler(r)
+		if cfg.Admin.Token == "" && cfg.Admin.Username == "" && cfg.Admin.Address == "" {
+			warnf("Admin api enabled without credentials, anyone reaching the listeners can use it\n")
 		}
-		
-		// create server
-		server := http.Server{
-			Addr: fmt.Sprintf(":%d", port),
-			Handler: http.HandlerFunc(lb),
+		// on its own address the listeners dont serve it at all
+		if cfg.Admin.Address != "" {
+			go func(handler http.Handler) {
+				fatal(serveAdmin(cfg.Admin.Address, handler))
+			}(admin)
+			admin = nil
 		}
+	}
+	if cfg.MetricsAddress != "" {
+		go func() {
+			fatal(serveMetrics(cfg.MetricsAddress))
+		}()
+	}
 
-		go healthCheck()
+	go healthCheck()
 
-		log.Printf("Load Balancer started at: %d\n", port)
-		if err := server.ListenAndServe(); err != nil {
-			log.Fatal(err)
-		}
+	for _, u := range cfg.UDP {
+		go func(address string) {
+			fatal(serveUDP(address))
+		}(u.Address)
+	}
+	for _, p := range cfg.Passthrough {
+		go func(address string) {
+			fatal(servePassthrough(address))
+		}(p.Address)
 	}
-}
\ No newline at end of file
+
+	// create servers, one per listener
+	if err := serveListeners(cfg.effectiveListeners(), admin); err != nil {
+		fatal(err)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// MaintenanceConfig is the answer to every request while the load balancer
+// is in maintenance mode. The admin api keeps working.
+type MaintenanceConfig struct {
+	// start in maintenance mode, the admin api can switch it either way
+	Enabled bool `yaml:"enabled"`
+	Status  int  `yaml:"status"`
+	// the body, text or the contents of page (a file, html by its
+	// extension)
+	Body string `yaml:"body,omitempty"`
+	Page string `yaml:"page,omitempty"`
+	// Retry-After header, 0 leaves it out
+	RetryAfter time.Duration `yaml:"retry_after,omitempty"`
+
+	// contents of page, read when the config is loaded
+	page []byte
+}
+
+func defaultMaintenanceConfig() MaintenanceConfig {
+	return MaintenanceConfig{Status: http.StatusServiceUnavailable, Body: "Down for maintenance"}
+}
+
+func (m MaintenanceConfig) Validate() error {
+	if m.Status < 200 || m.Status > 599 {
+		return fmt.Errorf("maintenance: status must be between 200 and 599")
+	}
+	if m.RetryAfter < 0 {
+		return fmt.Errorf("maintenance: retry_after must not be negative")
+	}
+	return nil
+}
+
+// read the page, it is added to files so -watch reloads when it changes
+func (m *MaintenanceConfig) loadPage(files *[]string) error {
+	var err error
+	if m.page, err = readPage(m.Page, files); err != nil {
+		return fmt.Errorf("maintenance: page: %w", err)
+	}
+	return nil
+}
+
+// the contents of a page file, nil without one
+func readPage(path string, files *[]string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	*files = append(*files, path)
+	return os.ReadFile(path)
+}
+
+// whether the load balancer is in maintenance mode right now
+var maintenanceOn atomic.Bool
+
+func setMaintenance(on bool, by string) {
+	if maintenanceOn.Swap(on) == on {
+		return
+	}
+	if on {
+		warnf("Maintenance mode on (%s), every request gets the maintenance response\n", by)
+	} else {
+		infof("Maintenance mode off (%s)\n", by)
+	}
+}
+
+func writeMaintenance(w http.ResponseWriter, m MaintenanceConfig) {
+	if m.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(m.RetryAfter.Round(time.Second).Seconds())))
+	}
+	writePage(w, m.Status, m.Body, m.Page, m.page)
+}
+
+// answer with body, or with the contents of the page file at path when
+// there is one, html by its extension
+func writePage(w http.ResponseWriter, status int, body, path string, page []byte) {
+	data, contentType := []byte(body), "text/plain; charset=utf-8"
+	if page != nil {
+		data = page
+		if strings.HasSuffix(path, ".html") || strings.HasSuffix(path, ".htm") {
+			contentType = "text/html; charset=utf-8"
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// GET /admin/maintenance
+func handleGetMaintenance(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]bool{"enabled": maintenanceOn.Load()})
+}
+
+// POST /admin/maintenance turns maintenance mode on, DELETE turns it off.
+// It stays that way until the next call, or a reload that changes
+// maintenance.enabled.
+func handleMaintenance(w http.ResponseWriter, req *http.Request) {
+	setMaintenance(req.Method == http.MethodPost, "admin api")
+	writeJSON(w, http.StatusOK, map[string]bool{"enabled": maintenanceOn.Load()})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// take a slot for a request on the backend, false when it already has
+// max_conns requests in flight. Picking a backend and counting the request
+// on it are two steps, two requests picking the last free slot at once
+// would both get it without this.
+func (b *Backend) acquire() bool {
+	if b.config.MaxConns <= 0 {
+		b.inFlight.Add(1)
+		return true
+	}
+	for {
+		n := b.inFlight.Load()
+		if n >= int64(b.config.MaxConns) {
+			return false
+		}
+		if b.inFlight.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+func (b *Backend) release() {
+	b.inFlight.Add(-1)
+}
+
+// the next peer with a slot taken on it, release it when the request is
+// done. nil when no backend can take the request.
+func (s *ServerPool) acquirePeer() *Backend {
+	// the backend picked can fill up before the slot is taken, then the
+	// next one is tried
+	for range s.backends {
+		peer := s.GetNextPeer()
+		if peer == nil {
+			return nil
+		}
+		if peer.acquire() {
+			return peer
+		}
+	}
+	return nil
+}
+
+// put the slot taken on peer on the request. release gives it back, once:
+// the ErrorHandler does that before the request moves on to another
+// backend, so a retry chain doesnt hold the slot of every backend it tried.
+func withPeerSlot(r *http.Request, s *ServerPool, peer *Backend) (*http.Request, func()) {
+	var once sync.Once
+	release := func() {
+		once.Do(func() { s.releasePeer(peer) })
+	}
+	return r.WithContext(context.WithValue(r.Context(), PeerSlot, release)), release
+}
+
+// give back the slot of the backend the request is leaving
+func releasePeerSlot(r *http.Request) {
+	if release, ok := r.Context().Value(PeerSlot).(func()); ok {
+		release()
+	}
+}
+
+// check if a backend of the pool is at max_conns, then the pool is busy
+// rather than down
+func (s *ServerPool) Saturated() bool {
+	for _, b := range s.backends {
+		if b.Saturated() {
+			return true
+		}
+	}
+	return false
+}
+
+// pool -> requests answered 503 because all its backends were at max_conns
+var poolSaturated sync.Map
+
+// no backend of the pool can take the request: the fallback of the pool,
+// or 503 with a hint to come back soon when they are just busy
+func noPeer(w http.ResponseWriter, r *http.Request, pool *ServerPool) {
+	saturated := pool.Saturated()
+	if saturated {
+		n, _ := poolSaturated.LoadOrStore(pool.name, new(atomic.Uint64))
+		n.(*atomic.Uint64).Add(1)
+		warnw(requestFields(r), "%s(%s)%s All backends of pool %s busy or down\n", r.RemoteAddr, r.URL.Path, logRequest(r), pool.name)
+		recentErrors.Add(errorEntry{Pool: pool.name, Path: r.URL.Path, Error: "all backends busy"})
+	} else {
+		warnw(requestFields(r), "%s(%s)%s No backend available in pool %s\n", r.RemoteAddr, r.URL.Path, logRequest(r), pool.name)
+		recentErrors.Add(errorEntry{Pool: pool.name, Path: r.URL.Path, Error: "no backend available"})
+	}
+	if pool.fallBack(w, r) {
+		return
+	}
+	if saturated {
+		w.Header().Set("Retry-After", "1")
+	}
+	http.Error(w, "Service not available", http.StatusServiceUnavailable)
+}
+
+func writeSaturationMetrics(w io.Writer) {
+	writeMetricHeader(w, "lb_backend_max_conns", "gauge", "Requests in flight the backend takes at most, for backends with max_conns.")
+	for _, pool := range activePools.Load().All() {
+		for _, b := range pool.backends {
+			if b.config.MaxConns > 0 {
+				fmt.Fprintf(w, "lb_backend_max_conns{pool=%q,backend=%q} %d\n", pool.name, b.URL.String(), b.config.MaxConns)
+			}
+		}
+	}
+	writeMetricHeader(w, "lb_pool_saturated_total", "counter", "Requests answered 503 because every backend of the pool had max_conns requests in flight.")
+	for _, pool := range activePools.Load().All() {
+		fmt.Fprintf(w, "lb_pool_saturated_total{pool=%q} %d\n", pool.name, loadCount(&poolSaturated, pool.name))
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// requests in the listeners right now, and the ones turned away because
+// there were max_requests already
+var (
+	requestsInFlight  atomic.Int64
+	requestsOverLimit atomic.Uint64
+)
+
+// count a request coming in, false when max_requests are already in flight.
+// Each request holds memory until it is done, a traffic storm without a
+// limit can take the whole process down instead of just the requests over
+// it.
+func admitRequest(limit int) bool {
+	if limit <= 0 {
+		requestsInFlight.Add(1)
+		return true
+	}
+	for {
+		n := requestsInFlight.Load()
+		if n >= int64(limit) {
+			requestsOverLimit.Add(1)
+			return false
+		}
+		if requestsInFlight.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+func writeMaxRequestsMetrics(w io.Writer) {
+	writeMetricHeader(w, "lb_requests_in_flight", "gauge", "Requests in the listeners of the load balancer.")
+	fmt.Fprintf(w, "lb_requests_in_flight %d\n", requestsInFlight.Load())
+	if limit := activePools.Load().maxRequests; limit > 0 {
+		writeMetricHeader(w, "lb_max_requests", "gauge", "Requests in flight the load balancer takes at most.")
+		fmt.Fprintf(w, "lb_max_requests %d\n", limit)
+	}
+	writeMetricHeader(w, "lb_requests_over_limit_total", "counter", "Requests answered 503 because max_requests were already in flight.")
+	fmt.Fprintf(w, "lb_requests_over_limit_total %d\n", requestsOverLimit.Load())
+}
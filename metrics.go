@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// GET /admin/metrics, in the prometheus text format
+func handleMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w)
+}
+
+// every metric in the prometheus text format, for /metrics and the statsd
+// export
+func writeMetrics(w io.Writer) {
+	writeMetricHeader(w, "lb_backend_cert_expiry_days", "gauge", "Days until the tls certificate of the backend expires.")
+	for _, pool := range activePools.Load().All() {
+		for _, b := range pool.backends {
+			expiry := b.CertExpiry()
+			if expiry.IsZero() {
+				continue
+			}
+			fmt.Fprintf(w, "lb_backend_cert_expiry_days{pool=%q,backend=%q} %.2f\n", pool.name, b.URL.String(), time.Until(expiry).Hours()/24)
+		}
+	}
+
+	writeMetricHeader(w, "lb_pool_panic", "gauge", "1 while the pool is below its panic threshold and ignores the health checks.")
+	for _, pool := range activePools.Load().All() {
+		panicking := 0
+		if pool.panicking.Load() {
+			panicking = 1
+		}
+		fmt.Fprintf(w, "lb_pool_panic{pool=%q} %d\n", pool.name, panicking)
+	}
+
+	writeBackendMetrics(w)
+	writeLatencyMetrics(w)
+	writeRecentMetrics(w)
+	writeSlowMetrics(w)
+	writeHealthMetrics(w)
+	writeBreakerMetrics(w)
+	writeUnavailableMetrics(w)
+	writeOutlierMetrics(w)
+	writeQuarantineMetrics(w)
+	writeRetryBudgetMetrics(w)
+	writeRetryBodyMetrics(w)
+	writePanicMetrics(w)
+	writeSaturationMetrics(w)
+	writeMaxRequestsMetrics(w)
+	writeSheddingMetrics(w)
+	writeQueueMetrics(w)
+	writeFallbackMetrics(w)
+	writeHedgeMetrics(w)
+	writeDynamicTimeoutMetrics(w)
+	writeTagMetrics(w)
+	writeListenerMetrics(w)
+	writeUDPMetrics(w)
+	writePassthroughMetrics(w)
+	writeWebSocketMetrics(w)
+	writeTracingMetrics(w)
+}
+
+// GET /metrics on the metrics address, the same as /admin/metrics without
+// the admin api and its credentials, for a prometheus scraping every
+// instance
+func serveMetrics(address string) error {
+	if _, _, err := adminNetwork(address); err != nil {
+		return err
+	}
+	ln, err := listenAddress(address, 0)
+	if err != nil {
+		return err
+	}
+	infof("Metrics started at: %s/metrics\n", address)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", handleMetrics)
+	return http.Serve(ln, mux)
+}
+
+func (b *Backend) countResponse(status int) {
+	if class := status / 100; class < len(b.responses) {
+		b.responses[class].Add(1)
+	}
+	b.recent.Count(status)
+	b.outlier.Count(status)
+}
+
+func writeBackendMetrics(w io.Writer) {
+	pools := activePools.Load().All()
+	writeMetricHeader(w, "lb_backend_up", "gauge", "1 while the backend passes its health checks.")
+	for _, pool := range pools {
+		for _, b := range pool.backends {
+			up := 0
+			if b.IsAlive() {
+				up = 1
+			}
+			fmt.Fprintf(w, "lb_backend_up{pool=%q,backend=%q} %d\n", pool.name, b.URL.String(), up)
+		}
+	}
+	writeMetricHeader(w, "lb_backend_in_flight", "gauge", "Requests being proxied to the backend, open websockets included.")
+	for _, pool := range pools {
+		for _, b := range pool.backends {
+			fmt.Fprintf(w, "lb_backend_in_flight{pool=%q,backend=%q} %d\n", pool.name, b.URL.String(), b.inFlight.Load())
+		}
+	}
+	writeMetricHeader(w, "lb_backend_connections", "gauge", "Connections open to the backend for the traffic, idle ones included.")
+	for _, pool := range pools {
+		for _, b := range pool.backends {
+			fmt.Fprintf(w, "lb_backend_connections{pool=%q,backend=%q} %d\n", pool.name, b.URL.String(), b.conns.open.Load())
+		}
+	}
+	writeMetricHeader(w, "lb_backend_connections_opened_total", "counter", "Connections opened to the backend for the traffic.")
+	for _, pool := range pools {
+		for _, b := range pool.backends {
+			fmt.Fprintf(w, "lb_backend_connections_opened_total{pool=%q,backend=%q} %d\n", pool.name, b.URL.String(), b.conns.opened.Load())
+		}
+	}
+	writeMetricHeader(w, "lb_backend_requests_total", "counter", "Requests sent to the backend by the address family of the backend.")
+	for _, pool := range pools {
+		for _, b := range pool.backends {
+			v4, v6 := b.FamilyCounts()
+			fmt.Fprintf(w, "lb_backend_requests_total{pool=%q,backend=%q,family=\"ipv4\"} %d\n", pool.name, b.URL.String(), v4)
+			fmt.Fprintf(w, "lb_backend_requests_total{pool=%q,backend=%q,family=\"ipv6\"} %d\n", pool.name, b.URL.String(), v6)
+		}
+	}
+	writeMetricHeader(w, "lb_backend_responses_total", "counter", "Responses of the backend by status class, error for attempts that got none.")
+	for _, pool := range pools {
+		for _, b := range pool.backends {
+			for class := range b.responses {
+				code := fmt.Sprintf("%dxx", class)
+				if class == 0 {
+					code = "error"
+				}
+				if n := b.responses[class].Load(); n > 0 || class == 0 || class == 2 {
+					fmt.Fprintf(w, "lb_backend_responses_total{pool=%q,backend=%q,code=%q} %d\n", pool.name, b.URL.String(), code, n)
+				}
+			}
+		}
+	}
+	writeMetricHeader(w, "lb_backend_retries_total", "counter", "Attempts that followed a failed attempt on the backend.")
+	for _, pool := range pools {
+		for _, b := range pool.backends {
+			fmt.Fprintf(w, "lb_backend_retries_total{pool=%q,backend=%q} %d\n", pool.name, b.URL.String(), b.retries.Load())
+		}
+	}
+}
+
+func writeMetricHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
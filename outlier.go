@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OutlierConfig ejects the backends that do much worse than the rest of
+// their pool, by their errors or their latency, for a while. Unlike the
+// circuit breaker it compares a backend to the others, so a slow backend
+// is found even if it never fails, and a pool failing as a whole is left
+// alone.
+type OutlierConfig struct {
+	// how often the backends are compared, over the requests since the last
+	// time
+	Interval time.Duration `yaml:"interval"`
+	// eject a backend with this many times the error rate of the others,
+	// 0 disables it
+	ErrorRateFactor float64 `yaml:"error_rate_factor"`
+	// and at least this error rate, so a few errors next to none dont count
+	MinErrorRate float64 `yaml:"min_error_rate"`
+	// eject a backend with this many times the mean latency of the others,
+	// 0 disables it
+	LatencyFactor float64 `yaml:"latency_factor"`
+	// requests a backend needs in the interval to be judged
+	MinRequests int `yaml:"min_requests"`
+	// share of the backends of a pool that can be ejected at once, in percent
+	MaxEjectionPercent int `yaml:"max_ejection_percent"`
+	// how long an ejected backend gets no requests
+	EjectFor time.Duration `yaml:"eject_for"`
+}
+
+func defaultOutlierConfig() OutlierConfig {
+	return OutlierConfig{
+		Interval:           10 * time.Second,
+		MinErrorRate:       0.1,
+		MinRequests:        20,
+		MaxEjectionPercent: 50,
+		EjectFor:           30 * time.Second,
+	}
+}
+
+func (o OutlierConfig) Enabled() bool {
+	return o.ErrorRateFactor > 0 || o.LatencyFactor > 0
+}
+
+func (o OutlierConfig) Validate() error {
+	switch {
+	case o.Interval < time.Second:
+		return fmt.Errorf("outlier_detection: interval must be at least 1s")
+	case o.ErrorRateFactor < 0 || o.LatencyFactor < 0:
+		return fmt.Errorf("outlier_detection: factors must not be negative")
+	case o.ErrorRateFactor > 0 && o.ErrorRateFactor <= 1, o.LatencyFactor > 0 && o.LatencyFactor <= 1:
+		return fmt.Errorf("outlier_detection: factors must be above 1")
+	case o.MinErrorRate < 0 || o.MinErrorRate > 1:
+		return fmt.Errorf("outlier_detection: min_error_rate must be between 0 and 1")
+	case o.MinRequests < 1:
+		return fmt.Errorf("outlier_detection: min_requests must be at least 1")
+	case o.MaxEjectionPercent < 0 || o.MaxEjectionPercent > 100:
+		return fmt.Errorf("outlier_detection: max_ejection_percent must be between 0 and 100")
+	case o.EjectFor <= 0:
+		return fmt.Errorf("outlier_detection: eject_for must be positive")
+	}
+	return nil
+}
+
+// outlierStats counts the requests of a backend between two comparisons
+type outlierStats struct {
+	mu       sync.Mutex
+	requests uint64
+	errors   uint64
+	// latency of the requests that got an answer
+	timed   uint64
+	latency time.Duration
+
+	// unix nanoseconds the ejection ends at, 0 when not ejected
+	ejectedUntil atomic.Int64
+	ejections    atomic.Uint64
+}
+
+// an answer of the backend, status 0 for a request that failed without one
+func (s *outlierStats) Count(status int) {
+	s.mu.Lock()
+	s.requests++
+	if status == 0 || status >= 500 {
+		s.errors++
+	}
+	s.mu.Unlock()
+}
+
+func (s *outlierStats) RecordLatency(d time.Duration) {
+	s.mu.Lock()
+	s.timed++
+	s.latency += d
+	s.mu.Unlock()
+}
+
+// the requests, the errors and the mean latency since the last call
+func (s *outlierStats) take() (requests, errors uint64, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requests, errors = s.requests, s.errors
+	if s.timed > 0 {
+		latency = s.latency / time.Duration(s.timed)
+	}
+	s.requests, s.errors, s.timed, s.latency = 0, 0, 0, 0
+	return
+}
+
+// check if outlier detection keeps the backend out for now
+func (b *Backend) Ejected() bool {
+	until := b.outlier.ejectedUntil.Load()
+	return until != 0 && time.Now().UnixNano() < until
+}
+
+// compare the backends of every pool each interval
+func detectOutliers(r *reloader) {
+	for {
+		time.Sleep(r.Current().OutlierDetection.Interval)
+		cfg := r.Current().OutlierDetection
+		if !cfg.Enabled() {
+			continue
+		}
+		for _, pool := range activePools.Load().All() {
+			pool.ejectOutliers(cfg)
+		}
+	}
+}
+
+type outlierSample struct {
+	backend   *Backend
+	errorRate float64
+	latency   time.Duration
+}
+
+func (s *ServerPool) ejectOutliers(cfg OutlierConfig) {
+	now := time.Now()
+	ejected := 0
+	var samples []outlierSample
+	for _, b := range s.backends {
+		requests, errors, latency := b.outlier.take()
+		if until := b.outlier.ejectedUntil.Load(); until != 0 {
+			if now.UnixNano() < until {
+				ejected++
+				continue
+			}
+			b.outlier.ejectedUntil.Store(0)
+			infof("%s (pool %s) back from outlier ejection\n", b.URL, s.name)
+		}
+		if requests < uint64(cfg.MinRequests) {
+			continue
+		}
+		samples = append(samples, outlierSample{
+			backend:   b,
+			errorRate: float64(errors) / float64(requests),
+			latency:   latency,
+		})
+	}
+	// nothing to compare with
+	if len(samples) < 2 {
+		return
+	}
+
+	var totalRate float64
+	var totalLatency time.Duration
+	for _, sample := range samples {
+		totalRate += sample.errorRate
+		totalLatency += sample.latency
+	}
+	maxEjected := len(s.backends) * cfg.MaxEjectionPercent / 100
+	for _, sample := range samples {
+		if ejected >= maxEjected {
+			return
+		}
+		// the mean of the others, so the outlier doesnt pull it up itself
+		others := float64(len(samples) - 1)
+		otherRate := (totalRate - sample.errorRate) / others
+		otherLatency := time.Duration(float64(totalLatency-sample.latency) / others)
+		var reason string
+		switch {
+		case cfg.ErrorRateFactor > 0 && sample.errorRate >= cfg.MinErrorRate && sample.errorRate > cfg.ErrorRateFactor*otherRate:
+			reason = fmt.Sprintf("error rate %.0f%%, the others %.0f%%", 100*sample.errorRate, 100*otherRate)
+		case cfg.LatencyFactor > 0 && otherLatency > 0 && float64(sample.latency) > cfg.LatencyFactor*float64(otherLatency):
+			reason = fmt.Sprintf("mean latency %s, the others %s", sample.latency.Round(time.Millisecond), otherLatency.Round(time.Millisecond))
+		default:
+			continue
+		}
+		sample.backend.outlier.ejectedUntil.Store(now.Add(cfg.EjectFor).UnixNano())
+		sample.backend.outlier.ejections.Add(1)
+		ejected++
+		warnf("%s (pool %s) ejected as an outlier for %s: %s\n", sample.backend.URL, s.name, cfg.EjectFor, reason)
+	}
+}
+
+func writeOutlierMetrics(w io.Writer) {
+	pools := activePools.Load().All()
+	writeMetricHeader(w, "lb_backend_ejected", "gauge", "1 while outlier detection keeps the backend out.")
+	for _, pool := range pools {
+		for _, b := range pool.backends {
+			ejected := 0
+			if b.Ejected() {
+				ejected = 1
+			}
+			fmt.Fprintf(w, "lb_backend_ejected{pool=%q,backend=%q} %d\n", pool.name, b.URL.String(), ejected)
+		}
+	}
+	writeMetricHeader(w, "lb_backend_ejections_total", "counter", "Times outlier detection ejected the backend.")
+	for _, pool := range pools {
+		for _, b := range pool.backends {
+			fmt.Fprintf(w, "lb_backend_ejections_total{pool=%q,backend=%q} %d\n", pool.name, b.URL.String(), b.outlier.ejections.Load())
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+// check if the pool is below its panic threshold, then the health checks
+// are probably wrong (or the failure is on the network side) and every
+// backend gets traffic, healthy or not
+func (s *ServerPool) Panicking() bool {
+	if s.panicThreshold <= 0 || len(s.backends) == 0 {
+		return false
+	}
+	healthy := 0
+	for _, b := range s.backends {
+		if b.IsAlive() {
+			healthy++
+		}
+	}
+	panicking := healthy*100 < s.panicThreshold*len(s.backends)
+	if s.panicking.Swap(panicking) != panicking {
+		if panicking {
+			warnf("Pool %s in panic mode: %d of %d backends healthy (threshold %d%%), ignoring health checks\n", s.name, healthy, len(s.backends), s.panicThreshold)
+		} else {
+			infof("Pool %s out of panic mode: %d of %d backends healthy\n", s.name, healthy, len(s.backends))
+		}
+	}
+	return panicking
+}
+
+// Available without the health check, for panic mode. Drained, saturated,
+// paused and ejected backends and open circuit breakers are still left out.
+func (b *Backend) AvailableIgnoringHealth() bool {
+	return !b.Saturated() && !b.Paused() && !b.CircuitOpen() && !b.Ejected() && !b.Draining() && !b.Disabled()
+}
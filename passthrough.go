@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how long a client may take to send its ClientHello
+const passthroughHelloTimeout = 5 * time.Second
+
+// PassthroughConfig is a listener that doesnt terminate tls. It reads the
+// server name (SNI) of the ClientHello, picks a pool by it and hands the
+// encrypted connection to a backend of that pool untouched, for backends
+// that must hold their certificates themselves.
+type PassthroughConfig struct {
+	Address string `yaml:"address"`
+	// pools by server name, exact names before wildcards like *.example.com
+	Routes []PassthroughRoute `yaml:"routes,omitempty"`
+	// pool for clients without a server name or one no route matches,
+	// their connections are closed without one
+	Pool string `yaml:"pool,omitempty"`
+}
+
+type PassthroughRoute struct {
+	Host string `yaml:"host"`
+	Pool string `yaml:"pool"`
+}
+
+// the pool for a server name, empty when there is none
+func (p PassthroughConfig) pool(serverName string) string {
+	if serverName != "" {
+		routes := append([]PassthroughRoute(nil), p.Routes...)
+		sort.SliceStable(routes, func(i, j int) bool { return hostRank(routes[i].Host) < hostRank(routes[j].Host) })
+		for _, r := range routes {
+			if hostMatches(r.Host, serverName) {
+				return r.Pool
+			}
+		}
+	}
+	return p.Pool
+}
+
+func validatePassthrough(c *Config) error {
+	pools := c.effectivePools()
+	// the backends get tls they didnt see terminated, plain ones cant take it
+	checkPool := func(address, name string) error {
+		pc, ok := pools[name]
+		if !ok {
+			return fmt.Errorf("passthrough %s: unknown pool %q", address, name)
+		}
+		for _, b := range pc.Backends {
+			if u, err := parseBackendURL(b.URL); err == nil && u.Scheme != "https" {
+				return fmt.Errorf("passthrough %s: pool %s: backend %s is not https", address, name, u)
+			}
+		}
+		return nil
+	}
+
+	taken := make(map[string]bool)
+	for _, l := range c.effectiveListeners() {
+		taken[l.Address] = true
+		if l.RedirectHTTP != "" {
+			taken[l.RedirectHTTP] = true
+		}
+	}
+	for _, p := range c.Passthrough {
+		if p.Address == "" {
+			return fmt.Errorf("passthrough: address is required")
+		}
+		if taken[p.Address] {
+			return fmt.Errorf("passthrough %s: the address is taken by another listener", p.Address)
+		}
+		taken[p.Address] = true
+		if p.Pool == "" && len(p.Routes) == 0 {
+			return fmt.Errorf("passthrough %s: needs routes or a pool", p.Address)
+		}
+		if p.Pool != "" {
+			if err := checkPool(p.Address, p.Pool); err != nil {
+				return err
+			}
+		}
+		seen := make(map[string]bool)
+		for _, r := range p.Routes {
+			if err := validateRouteHost(r.Host); err != nil {
+				return fmt.Errorf("passthrough %s: %w", p.Address, err)
+			}
+			if seen[r.Host] {
+				return fmt.Errorf("passthrough %s: duplicate host %s", p.Address, r.Host)
+			}
+			seen[r.Host] = true
+			if err := checkPool(p.Address, r.Pool); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// the addresses of the passthrough listeners, changing them needs a restart
+func passthroughAddresses(listeners []PassthroughConfig) []string {
+	addresses := []string{}
+	for _, p := range listeners {
+		addresses = append(addresses, p.Address)
+	}
+	return addresses
+}
+
+// connections of the passthrough listeners: "listener pool" -> *atomic.Uint64,
+// the pool is "-" for the ones closed without a pool
+var passthroughConns sync.Map
+
+func countPassthrough(address, pool string) {
+	if pool == "" {
+		pool = "-"
+	}
+	v, _ := passthroughConns.LoadOrStore(address+" "+pool, new(atomic.Uint64))
+	v.(*atomic.Uint64).Add(1)
+}
+
+// accept connections on a passthrough listener until it fails
+func servePassthrough(address string) error {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("passthrough %s: %w", address, err)
+	}
+	infof("Load Balancer started at: %s (tls passthrough)\n", address)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return fmt.Errorf("passthrough %s: %w", address, err)
+		}
+		go passThrough(address, conn)
+	}
+}
+
+func passThrough(address string, conn net.Conn) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(passthroughHelloTimeout))
+	serverName, hello, err := peekServerName(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		debugw([]any{"listener", address, "client", conn.RemoteAddr().String(), "error", err.Error()}, "passthrough %s: no ClientHello from %s: %s\n", address, conn.RemoteAddr(), err)
+		countPassthrough(address, "")
+		return
+	}
+
+	pools := activePools.Load()
+	cfg, ok := pools.passthrough[address]
+	if !ok {
+		return
+	}
+	poolName := cfg.pool(serverName)
+	countPassthrough(address, poolName)
+	fields := []any{"listener", address, "client", conn.RemoteAddr().String(), "server_name", serverName, "pool", poolName}
+	pool := pools.Get(poolName)
+	if pool == nil {
+		debugw(fields, "passthrough %s: no pool for %q from %s\n", address, serverName, conn.RemoteAddr())
+		return
+	}
+	peer := pool.acquirePeer()
+	if peer == nil {
+		warnw(fields, "passthrough %s: no backend available in pool %s for %q\n", address, poolName, serverName)
+		return
+	}
+	defer pool.releasePeer(peer)
+	fields = append(fields, "backend", peer.URL.String())
+
+	// a backend with proxy_protocol gets the client, see withProxyHeader
+	ctx := context.WithValue(context.Background(), ProxyClient, conn.RemoteAddr())
+	ctx = context.WithValue(ctx, http.LocalAddrContextKey, conn.LocalAddr())
+	dialCtx, cancel := context.WithTimeout(ctx, peer.healthTimeout())
+	backend, err := peer.dial(dialCtx, "tcp", hostPort(peer.URL))
+	cancel()
+	if err != nil {
+		warnw(append(fields, "error", err.Error()), "passthrough %s: cant connect to %s: %s\n", address, peer.URL, err)
+		recentErrors.Add(errorEntry{Pool: poolName, Backend: peer.URL.String(), Path: serverName, Error: err.Error()})
+		return
+	}
+	backend = peer.conns.track(backend)
+	defer backend.Close()
+	if _, err := backend.Write(hello); err != nil {
+		return
+	}
+	debugw(fields, "passthrough %s: %s (%q) -> %s\n", address, conn.RemoteAddr(), serverName, peer.URL)
+
+	// copy both ways until both sides are done, a side that finished
+	// sending gets its half closed so the other one learns about it
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+	go pipe(backend, conn)
+	go pipe(conn, backend)
+	<-done
+	<-done
+}
+
+// the server name of the ClientHello a tls client starts with, and the
+// bytes read for it, which the backend still has to get
+func peekServerName(conn net.Conn) (string, []byte, error) {
+	var read bytes.Buffer
+	var serverName string
+	found := false
+	// a handshake that can only read, it ends with the ClientHello
+	err := tls.Server(readOnlyConn{Conn: conn, r: io.TeeReader(conn, &read)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName, found = hello.ServerName, true
+			return nil, errPeeked
+		},
+	}).Handshake()
+	if !found {
+		return "", nil, err
+	}
+	return serverName, read.Bytes(), nil
+}
+
+var errPeeked = fmt.Errorf("ClientHello read")
+
+// readOnlyConn lets the tls package read the ClientHello without sending
+// anything back
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                { return nil }
+
+func writePassthroughMetrics(w io.Writer) {
+	counts := make(map[string]uint64)
+	passthroughConns.Range(func(k, v any) bool {
+		counts[k.(string)] = v.(*atomic.Uint64).Load()
+		return true
+	})
+	writeMetricHeader(w, "lb_passthrough_connections_total", "counter", "Connections of the tls passthrough listener by the pool they went to, - for none.")
+	for _, key := range sortedKeys(counts) {
+		var address, pool string
+		fmt.Sscan(key, &address, &pool)
+		fmt.Fprintf(w, "lb_passthrough_connections_total{listener=%q,pool=%q} %d\n", address, pool, counts[key])
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// pool used for the top level backends and for listeners/routes that dont
+// name one
+const defaultPoolName = "default"
+
+// PoolConfig is a named group of backends. Besides the backends it can carry
+// route settings, routes sending traffic to the pool inherit them.
+type PoolConfig struct {
+	Backends []BackendConfig `yaml:"backends"`
+	// overrides the global panic_threshold for this pool
+	PanicThreshold *int `yaml:"panic_threshold,omitempty"`
+	// overrides the global strategy for this pool
+	Strategy string `yaml:"strategy,omitempty"`
+	// what happens to requests no backend can take, see fallback.go
+	Fallback      *FallbackConfig `yaml:"fallback,omitempty"`
+	RouteSettings `yaml:",inline"`
+}
+
+// a pool can be written as just its list of backends:
+//
+//	pools:
+//	  api: [http://a:80, http://b:80]
+func (p *PoolConfig) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.SequenceNode {
+		return node.Decode(&p.Backends)
+	}
+	type plain PoolConfig
+	return node.Decode((*plain)(p))
+}
+
+// a backend can be written as just its url, with the same options as the
+// -backend flag: "http://a:80;weight=3"
+func (b *BackendConfig) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		bc, err := parseBackendSpec(node.Value)
+		if err != nil {
+			return err
+		}
+		*b = bc
+		return nil
+	}
+	type plain BackendConfig
+	if err := node.Decode((*plain)(b)); err != nil {
+		return err
+	}
+	b.markSet(node)
+	return nil
+}
+
+// Pools is everything the request path needs: the backend pools and the
+// routing tables. It is swapped as a whole when the config is reloaded.
+type Pools struct {
+	pools map[string]*ServerPool
+	// the listeners by address, with their routing tables
+	listeners map[string]*listenerState
+	// routing table for traffic that didnt come through a listener
+	routes []*Route
+	// pool used by listeners that dont name one
+	defaultPool string
+	// certificates of the tls listeners by address, the main one first
+	certs map[string][]*tls.Certificate
+	// listener address -> ca bundle client certificates are verified with
+	clientCAs map[string]*x509.CertPool
+	// rules tagging the requests
+	tags []*tagRule
+	// response header of backends asking to be drained
+	drainHeader string
+	// time removed backends get to finish their requests
+	drainTimeout time.Duration
+	// header with the request id, empty for none
+	requestIDHeader string
+	// the answer in maintenance mode
+	maintenance MaintenanceConfig
+	// what usage is counted by
+	usage UsageConfig
+	// share of the requests that may be retried
+	retryBudget RetryBudgetConfig
+	// requests waiting for a busy pool
+	queue QueueConfig
+	// requests in flight at most, 0 for no limit
+	maxRequests int
+	// priorities of the requests for load shedding
+	shedding *sheddingRules
+	// udp listeners by address
+	udp map[string]UDPListenerConfig
+	// tls passthrough listeners by address
+	passthrough map[string]PassthroughConfig
+	// nil without an access log
+	accessLog *accessLogger
+	// nil without an audit log
+	auditLog *auditLogger
+}
+
+// the active pools
+var activePools atomic.Pointer[Pools]
+
+func (p *Pools) Get(name string) *ServerPool {
+	return p.pools[name]
+}
+
+// all the pools, sorted by name
+func (p *Pools) All() []*ServerPool {
+	all := make([]*ServerPool, 0, len(p.pools))
+	for _, pool := range p.pools {
+		all = append(all, pool)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].name < all[j].name })
+	return all
+}
+
+// the routing table for traffic coming from the listener on address, the one
+// of the default pool for an unknown address
+func (p *Pools) Routes(address string) []*Route {
+	if l := p.listeners[address]; l != nil {
+		return l.routes
+	}
+	return p.routes
+}
+
+// build the pools from the config, backends that already exist in the
+// previous pools are reused so they keep their health state
+func NewPools(cfg *Config, previous *Pools) (*Pools, error) {
+	existing := make(map[string]*Backend)
+	if previous != nil {
+		for _, pool := range previous.pools {
+			for _, b := range pool.backends {
+				existing[pool.name+" "+b.URL.String()] = b
+			}
+		}
+	}
+
+	set := &Pools{
+		pools:       make(map[string]*ServerPool),
+		listeners:   make(map[string]*listenerState),
+		defaultPool: cfg.defaultPool(),
+		certs:       make(map[string][]*tls.Certificate),
+		clientCAs:   make(map[string]*x509.CertPool),
+		udp:         make(map[string]UDPListenerConfig),
+		passthrough: make(map[string]PassthroughConfig),
+	}
+	for _, u := range cfg.UDP {
+		set.udp[u.Address] = u
+	}
+	for _, p := range cfg.Passthrough {
+		set.passthrough[p.Address] = p
+	}
+	tags, err := compileTags(cfg.Tags)
+	if err != nil {
+		return nil, err
+	}
+	set.tags = tags
+	if set.shedding, err = cfg.LoadShedding.compile(); err != nil {
+		return nil, err
+	}
+	if set.accessLog, err = newAccessLogger(cfg.AccessLog, previous); err != nil {
+		return nil, err
+	}
+	if set.auditLog, err = newAuditLogger(cfg.Admin.AuditLog, previous); err != nil {
+		return nil, err
+	}
+	set.drainHeader = cfg.DrainHeader
+	set.drainTimeout = cfg.DrainTimeout
+	set.requestIDHeader = cfg.RequestIDHeader
+	set.maintenance = cfg.Maintenance
+	set.usage = cfg.Usage
+	set.retryBudget = cfg.RetryBudget
+	set.queue = cfg.Queue
+	set.maxRequests = cfg.MaxRequests
+	for name, pc := range cfg.effectivePools() {
+		pool := &ServerPool{name: name, panicThreshold: cfg.PanicThreshold, strategy: cfg.Strategy}
+		if pc.PanicThreshold != nil {
+			pool.panicThreshold = *pc.PanicThreshold
+		}
+		if pc.Strategy != "" {
+			pool.strategy = pc.Strategy
+		}
+		pool.fallback = pc.Fallback
+		for _, bc := range cfg.poolBackends(pc) {
+			serverUrl, err := parseBackendURL(bc.URL)
+			if err != nil {
+				return nil, err
+			}
+			if b, ok := existing[name+" "+serverUrl.String()]; ok && b.config == bc {
+				pool.AddBackend(b)
+				continue
+			}
+			b, err := NewBackend(serverUrl, bc)
+			if err != nil {
+				return nil, fmt.Errorf("pool %s: backend %s: %w", name, serverUrl, err)
+			}
+			b.disabled.Store(isDisabled(name, b))
+			pool.AddBackend(b)
+			infof("Configured server: %s (pool %s)\n", serverUrl, name)
+		}
+		set.pools[name] = pool
+	}
+
+	set.routes = buildRoutes(cfg, ListenerConfig{})
+	for _, l := range cfg.effectiveListeners() {
+		set.listeners[l.Address] = &listenerState{
+			config:  l,
+			routes:  buildRoutes(cfg, l),
+			limiter: listenerLimiter(l, previous),
+		}
+		if l.TLS() {
+			certs, err := l.certificates()
+			if err != nil {
+				return nil, err
+			}
+			set.certs[l.Address] = certs
+		}
+		if l.ClientCA != "" {
+			cas, err := l.clientCAs()
+			if err != nil {
+				return nil, err
+			}
+			set.clientCAs[l.Address] = cas
+		}
+	}
+	return set, nil
+}
+
+// all the pools in the config, the top level backends are the default pool
+func (c *Config) effectivePools() map[string]PoolConfig {
+	pools := make(map[string]PoolConfig, len(c.Pools)+1)
+	for name, pc := range c.Pools {
+		pools[name] = pc
+	}
+	if len(c.Backends) > 0 {
+		pools[defaultPoolName] = PoolConfig{Backends: c.Backends, Fallback: pools[defaultPoolName].Fallback, RouteSettings: pools[defaultPoolName].RouteSettings}
+	}
+	return pools
+}
+
+// the pool used when nothing names one: "default" if it exists, otherwise the
+// only pool if there is just one
+func (c *Config) defaultPool() string {
+	pools := c.effectivePools()
+	if _, ok := pools[defaultPoolName]; ok {
+		return defaultPoolName
+	}
+	if len(pools) == 1 {
+		for name := range pools {
+			return name
+		}
+	}
+	return ""
+}
+
+func validatePools(c *Config) error {
+	pools := c.effectivePools()
+	if len(pools) == 0 {
+		return fmt.Errorf("no backends configured")
+	}
+	if len(c.Backends) > 0 && len(c.Pools[defaultPoolName].Backends) > 0 {
+		return fmt.Errorf("pool %s: backends are set both at the top level and in pools", defaultPoolName)
+	}
+	for name, pc := range pools {
+		if name == "" {
+			return fmt.Errorf("pool name must not be empty")
+		}
+		if len(pc.Backends) == 0 {
+			return fmt.Errorf("pool %s: no backends configured", name)
+		}
+		if err := pc.RouteSettings.Validate(); err != nil {
+			return fmt.Errorf("pool %s: %w", name, err)
+		}
+		if pc.Fallback != nil {
+			if err := pc.Fallback.Validate(name, pools); err != nil {
+				return fmt.Errorf("pool %s: fallback: %w", name, err)
+			}
+		}
+	}
+
+	exists := func(pool string) bool {
+		if pool == "" {
+			pool = c.defaultPool()
+		}
+		_, ok := pools[pool]
+		return ok
+	}
+	for _, l := range c.effectiveListeners() {
+		if !exists(l.Pool) {
+			if l.Pool == "" {
+				return fmt.Errorf("listener %s: no pool set and there is no default pool", l.Address)
+			}
+			return fmt.Errorf("listener %s: unknown pool %q", l.Address, l.Pool)
+		}
+	}
+	for _, r := range c.Routes {
+		if r.Pool != "" && !exists(r.Pool) {
+			return fmt.Errorf("route %s: unknown pool %q", r.hostPath(), r.Pool)
+		}
+	}
+	return nil
+}
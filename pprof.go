@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// the profiles of net/http/pprof under /admin/debug/pprof/. The package
+// also registers them on http.DefaultServeMux, which nothing here serves.
+var pprofHandler = func() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	// pprof.Index finds the named profiles (heap, goroutine) by the path
+	// without the prefix
+	return http.StripPrefix("/admin", mux)
+}()
+
+// GET /admin/debug/pprof/..., only with admin.pprof on. A reload turns it on
+// and off.
+func (r *reloader) handlePprof(w http.ResponseWriter, req *http.Request) {
+	if !r.Current().Admin.Pprof {
+		http.NotFound(w, req)
+		return
+	}
+	pprofHandler.ServeHTTP(w, req)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the PROXY protocol (haproxy.org/download/2.9/doc/proxy-protocol.txt): an
+// l4 balancer in front of a listener puts the address of the client before
+// the bytes of the connection, so the load balancer sees the client and not
+// the balancer. Backends that want the same get it from us.
+
+// v2 headers start with this, v1 ones with "PROXY "
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// how long the header of a new connection may take
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyListener reads the PROXY header of every connection it accepts
+type proxyListener struct {
+	net.Listener
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// proxyConn is a connection with a PROXY header. The header is read with the
+// first Read or RemoteAddr, in the goroutine of the connection and not in the
+// accept loop, so a slow client holds up no other.
+type proxyConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once          sync.Once
+	err           error
+	remote, local net.Addr
+}
+
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.local, c.err = parseProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			warnf("PROXY header from %s: %s\n", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// the client and the address it connected to from a v1 or v2 header. Both
+// are nil for connections of the balancer itself (v1 UNKNOWN, v2 LOCAL),
+// like its health checks.
+func parseProxyHeader(r *bufio.Reader) (remote, local net.Addr, err error) {
+	start, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, nil, fmt.Errorf("no header: %w", err)
+	}
+	if bytes.Equal(start, proxyV2Signature) {
+		return parseProxyV2(r)
+	}
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return parseProxyV1(r)
+	}
+	return nil, nil, fmt.Errorf("no header")
+}
+
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", 107 bytes at most
+func parseProxyV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	text, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, nil, fmt.Errorf("v1 header too long")
+	}
+	fields := strings.Split(text, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("bad v1 header %q", text)
+	}
+	src, err := proxyAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := proxyAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func proxyAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("bad address %s:%s", host, port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func parseProxyV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var head [16]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, nil, err
+	}
+	if head[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unknown v2 version %d", head[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	if head[12]&0xf == 0 {
+		// LOCAL
+		return nil, nil, nil
+	}
+	// the addresses, tlvs after them are skipped
+	switch head[13] {
+	case 0x11: // tcp over ipv4
+		if len(body) < 12 {
+			return nil, nil, fmt.Errorf("short v2 ipv4 addresses")
+		}
+		src := &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}
+		dst := &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:]))}
+		return src, dst, nil
+	case 0x21: // tcp over ipv6
+		if len(body) < 36 {
+			return nil, nil, fmt.Errorf("short v2 ipv6 addresses")
+		}
+		src := &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}
+		dst := &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:]))}
+		return src, dst, nil
+	}
+	// udp, unix sockets: keep the address of the balancer
+	return nil, nil, nil
+}
+
+// PROXY versions a backend can get
+var validProxyProtocols = map[string]bool{"": true, "v1": true, "v2": true}
+
+// send a PROXY header with the client of the request the connection is
+// dialed for, see withProxyClient. Connections without one (health checks) say
+// they are our own. Backends with proxy_protocol dont reuse connections,
+// as the next request on one could come from another client.
+func withProxyHeader(dial dialFunc, version string) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		src, _ := ctx.Value(ProxyClient).(net.Addr)
+		dst, _ := ctx.Value(http.LocalAddrContextKey).(net.Addr)
+		if _, err := conn.Write(proxyHeader(version, src, dst)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// the client of r for the PROXY header, in the context the transport dials with
+func withProxyClient(r *http.Request) *http.Request {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r
+	}
+	addr, err := proxyAddr(host, port)
+	if err != nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), ProxyClient, net.Addr(addr)))
+}
+
+func proxyHeader(version string, src, dst net.Addr) []byte {
+	s, _ := src.(*net.TCPAddr)
+	d, _ := dst.(*net.TCPAddr)
+	if s == nil || d == nil || (s.IP.To4() == nil) != (d.IP.To4() == nil) {
+		// our own connection, or addresses of two families the header cant
+		// carry together
+		if version == "v1" {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		// LOCAL, no addresses
+		return append(append([]byte{}, proxyV2Signature...), 0x20, 0x00, 0x00, 0x00)
+	}
+
+	family, srcIP, dstIP := "TCP4", s.IP.To4(), d.IP.To4()
+	var v2 []byte
+	if srcIP != nil {
+		v2 = append(append([]byte{}, proxyV2Signature...), 0x21, 0x11, 0x00, 12)
+	} else {
+		family, srcIP, dstIP = "TCP6", s.IP.To16(), d.IP.To16()
+		v2 = append(append([]byte{}, proxyV2Signature...), 0x21, 0x21, 0x00, 36)
+	}
+	if version == "v1" {
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, s.Port, d.Port))
+	}
+	v2 = append(append(v2, srcIP...), dstIP...)
+	return binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(v2, uint16(s.Port)), uint16(d.Port))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// built in quarantine_checks, used when the backend config leaves it at 0
+const defaultQuarantineChecks = 2
+
+func (b *Backend) quarantineChecks() int {
+	if b.config.QuarantineChecks > 0 {
+		return b.config.QuarantineChecks
+	}
+	return defaultQuarantineChecks
+}
+
+// the requests failed until the backend was marked down. For quarantine it
+// stays down whatever the health checks say, and after that it needs
+// quarantine_checks passing checks in a row, so a backend that is still
+// flaky isnt back on the next check.
+func (b *Backend) startQuarantine() {
+	if b.config.Quarantine <= 0 {
+		return
+	}
+	b.mux.Lock()
+	b.quarantinedUntil = time.Now().Add(b.config.Quarantine)
+	b.quarantinePasses = 0
+	b.mux.Unlock()
+	infof("%s quarantined for %s, then %d passing checks bring it back\n", b.URL, b.config.Quarantine, b.quarantineChecks())
+}
+
+// the result of a health probe as the quarantine sees it: down while it
+// lasts and until enough checks passed in a row after it
+func (b *Backend) quarantineProbe(alive bool) bool {
+	checks := b.quarantineChecks()
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.quarantinedUntil.IsZero() {
+		return alive
+	}
+	if !alive {
+		b.quarantinePasses = 0
+		return false
+	}
+	if time.Now().Before(b.quarantinedUntil) {
+		return false
+	}
+	b.quarantinePasses++
+	if b.quarantinePasses < checks {
+		debugf("%s passed %d of %d checks after its quarantine\n", b.URL, b.quarantinePasses, checks)
+		return false
+	}
+	b.quarantinedUntil = time.Time{}
+	b.quarantinePasses = 0
+	return true
+}
+
+// check if the backend is kept down after failing requests
+func (b *Backend) Quarantined() bool {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return !b.quarantinedUntil.IsZero()
+}
+
+func writeQuarantineMetrics(w io.Writer) {
+	writeMetricHeader(w, "lb_backend_quarantined", "gauge", "1 while the backend is kept down after failing requests, until its quarantine and the checks after it passed.")
+	for _, pool := range activePools.Load().All() {
+		for _, b := range pool.backends {
+			if b.config.Quarantine <= 0 {
+				continue
+			}
+			quarantined := 0
+			if b.Quarantined() {
+				quarantined = 1
+			}
+			fmt.Fprintf(w, "lb_backend_quarantined{pool=%q,backend=%q} %d\n", pool.name, b.URL.String(), quarantined)
+		}
+	}
+}
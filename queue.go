@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// QueueConfig lets requests wait for a free slot when every backend of their
+// pool is at max_conns, instead of answering 503 right away, so a short
+// spike is smoothed out rather than failed
+type QueueConfig struct {
+	// requests waiting per pool at most, 0 disables the queue
+	Depth int `yaml:"depth"`
+	// how long a request waits at most
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (q QueueConfig) Validate() error {
+	if q.Depth < 0 {
+		return fmt.Errorf("queue: depth must not be negative")
+	}
+	if q.Depth > 0 && q.Timeout <= 0 {
+		return fmt.Errorf("queue: timeout must be positive")
+	}
+	return nil
+}
+
+// requestQueue holds the requests waiting for a pool, first come first
+// served. It is kept by pool name so a reload doesnt drop the waiting
+// requests.
+type requestQueue struct {
+	mu      sync.Mutex
+	waiters []chan struct{}
+
+	waiting  atomic.Int64
+	queued   atomic.Uint64
+	full     atomic.Uint64
+	timedOut atomic.Uint64
+}
+
+// pool -> *requestQueue
+var poolQueues sync.Map
+
+func queueOf(pool string) *requestQueue {
+	q, _ := poolQueues.LoadOrStore(pool, new(requestQueue))
+	return q.(*requestQueue)
+}
+
+// get in line, at the front for a request that was woken but lost the slot
+// to a request that just came in
+func (q *requestQueue) join(front bool) chan struct{} {
+	ch := make(chan struct{}, 1)
+	q.mu.Lock()
+	if front {
+		q.waiters = append([]chan struct{}{ch}, q.waiters...)
+	} else {
+		q.waiters = append(q.waiters, ch)
+	}
+	q.mu.Unlock()
+	return ch
+}
+
+// get out of line. A wake that came in the meantime goes to the next one.
+func (q *requestQueue) leave(ch chan struct{}) {
+	q.mu.Lock()
+	for i, w := range q.waiters {
+		if w == ch {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			break
+		}
+	}
+	q.mu.Unlock()
+	select {
+	case <-ch:
+		q.wake()
+	default:
+	}
+}
+
+// a slot came free, the first request in line gets to try for it
+func (q *requestQueue) wake() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.waiters) == 0 {
+		return
+	}
+	q.waiters[0] <- struct{}{}
+	q.waiters = q.waiters[1:]
+}
+
+// the request is done with the backend, its slot goes to the queue of the
+// pool
+func (s *ServerPool) releasePeer(peer *Backend) {
+	peer.release()
+	if activePools.Load().queue.Depth > 0 {
+		queueOf(s.name).wake()
+	}
+}
+
+// wait in the queue of the pool for a backend to come free. nil when the
+// queue is full, the wait is over or the request ended.
+func (s *ServerPool) waitForPeer(r *http.Request) *Backend {
+	cfg := activePools.Load().queue
+	if cfg.Depth <= 0 || !s.Saturated() {
+		return nil
+	}
+	q := queueOf(s.name)
+	if q.waiting.Add(1) > int64(cfg.Depth) {
+		q.waiting.Add(-1)
+		q.full.Add(1)
+		debugw(requestFields(r), "%s(%s)%s Queue of pool %s full\n", r.RemoteAddr, r.URL.Path, logRequest(r), s.name)
+		return nil
+	}
+	defer q.waiting.Add(-1)
+	q.queued.Add(1)
+
+	start := time.Now()
+	timer := time.NewTimer(cfg.Timeout)
+	defer timer.Stop()
+	front := false
+	for {
+		ch := q.join(front)
+		// a slot may have come free before the request got in line
+		if peer := s.acquirePeer(); peer != nil {
+			q.leave(ch)
+			return peer
+		}
+		select {
+		case <-ch:
+			if peer := s.acquirePeer(); peer != nil {
+				debugw(requestFields(r), "%s(%s)%s Waited %s in the queue of pool %s\n", r.RemoteAddr, r.URL.Path, logRequest(r), time.Since(start).Round(time.Millisecond), s.name)
+				return peer
+			}
+			front = true
+		case <-timer.C:
+			q.leave(ch)
+			q.timedOut.Add(1)
+			return nil
+		case <-r.Context().Done():
+			q.leave(ch)
+			return nil
+		}
+	}
+}
+
+func writeQueueMetrics(w io.Writer) {
+	pools := activePools.Load().All()
+	writeMetricHeader(w, "lb_pool_queued", "gauge", "Requests waiting for a backend of the pool to come free.")
+	for _, pool := range pools {
+		fmt.Fprintf(w, "lb_pool_queued{pool=%q} %d\n", pool.name, queueOf(pool.name).waiting.Load())
+	}
+	writeMetricHeader(w, "lb_pool_queued_total", "counter", "Requests that waited for a backend of the pool to come free.")
+	for _, pool := range pools {
+		fmt.Fprintf(w, "lb_pool_queued_total{pool=%q} %d\n", pool.name, queueOf(pool.name).queued.Load())
+	}
+	writeMetricHeader(w, "lb_pool_queue_rejected_total", "counter", "Requests answered 503 because the queue of the pool was full or the wait was too long.")
+	for _, pool := range pools {
+		q := queueOf(pool.name)
+		fmt.Fprintf(w, "lb_pool_queue_rejected_total{pool=%q,reason=\"full\"} %d\n", pool.name, q.full.Load())
+		fmt.Fprintf(w, "lb_pool_queue_rejected_total{pool=%q,reason=\"timeout\"} %d\n", pool.name, q.timedOut.Load())
+	}
+}
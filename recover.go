@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// panics recovered while serving a request
+var panicsRecovered atomic.Uint64
+
+// recoverPanics answers a request whose handler panicked with 500 and logs
+// the stack, instead of net/http just dropping the connection
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusRecorder{ResponseWriter: w}
+		defer recoverPanic(sw, r)
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// deferred by a handler: a panic answers 500. When the response already
+// started there is nothing left to answer, the handler is aborted so the
+// client sees it broke off. http.ErrAbortHandler, a client gone mid
+// response, goes on as it is.
+func recoverPanic(w *statusRecorder, r *http.Request) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if v == http.ErrAbortHandler {
+		panic(v)
+	}
+	panicsRecovered.Add(1)
+	pool := ""
+	if route, ok := r.Context().Value(CurrentRoute).(*Route); ok {
+		pool = route.Pool
+	}
+	errorw(requestFields(r, "panic", fmt.Sprint(v)), "%s(%s)%s Panic serving the request: %v\n%s", r.RemoteAddr, r.URL.Path, logRequest(r), v, debug.Stack())
+	recentErrors.Add(errorEntry{Pool: pool, Path: r.URL.Path, Error: fmt.Sprintf("panic: %v", v)})
+	if w.status != 0 {
+		panic(http.ErrAbortHandler)
+	}
+	http.Error(w, "Internal server error", http.StatusInternalServerError)
+}
+
+func writePanicMetrics(w io.Writer) {
+	writeMetricHeader(w, "lb_panics_total", "counter", "Requests answered 500 or cut off because their handler panicked.")
+	fmt.Fprintf(w, "lb_panics_total %d\n", panicsRecovered.Load())
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// certificate authorities check a domain with a request to this path over
+// plain http (the acme http-01 challenge), it cant be redirected
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// the plain listener of redirect_http, it sends clients to the tls listener
+// on address with a 301. Acme challenges go to the routes of the tls
+// listener instead, so the backend running certbot (or the like) answers.
+func serveRedirect(l ListenerConfig) error {
+	server := &http.Server{Addr: l.RedirectHTTP, Handler: redirectToHTTPS(l.Address)}
+	ln, err := net.Listen("tcp", l.RedirectHTTP)
+	if err != nil {
+		return err
+	}
+	if l.ProxyProtocol {
+		// the l4 balancer in front sends it to both ports
+		ln = proxyListener{ln}
+	}
+	infof("Load Balancer started at: %s (redirect to %s)\n", l.RedirectHTTP, l.Address)
+	return server.Serve(ln)
+}
+
+func redirectToHTTPS(address string) http.Handler {
+	routes := listenerHandler(address)
+	_, port, _ := net.SplitHostPort(address)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+			routes.ServeHTTP(w, r)
+			return
+		}
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" {
+			http.Error(w, "Host header required", http.StatusBadRequest)
+			return
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// the addresses of the redirect listeners may not be taken by others
+func validateRedirects(listeners []ListenerConfig, taken map[string]bool) error {
+	for _, l := range listeners {
+		if l.RedirectHTTP == "" {
+			continue
+		}
+		if !l.TLS() {
+			return fmt.Errorf("listener %s: redirect_http needs tls_cert and tls_key", l.Address)
+		}
+		if _, _, err := net.SplitHostPort(l.RedirectHTTP); err != nil {
+			return fmt.Errorf("listener %s: redirect_http must be host:port or :port", l.Address)
+		}
+		if taken[l.RedirectHTTP] {
+			return fmt.Errorf("listener %s: redirect_http %s is taken by another listener", l.Address, l.RedirectHTTP)
+		}
+		taken[l.RedirectHTTP] = true
+	}
+	return nil
+}
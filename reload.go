@@ -0,0 +1,217 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloader owns the running config. Reloads come from the file watcher and
+// from scheduled changes coming due, they are applied one at a time.
+type reloader struct {
+	configPath string
+	flags      *Config
+	serverList string
+
+	// held for the whole of a config change, with the wait for the fleet
+	// lock and the settle time, so changes are applied one at a time
+	changing sync.Mutex
+	// swapped with changing held, read without it so a reload waiting on
+	// the fleet lock doesnt hold up everything that needs the config
+	current atomic.Pointer[Config]
+	// backends added and removed through the admin api, only used with
+	// changing held
+	runtime runtimeBackends
+
+	// guards the rest, only held for a moment
+	mu sync.Mutex
+	// fires when the next scheduled change is due
+	timer *time.Timer
+	// the last applied configs, oldest first
+	history     []configVersion
+	lastVersion int
+}
+
+func newReloader(configPath string, current *Config, flags *Config, serverList string) *reloader {
+	r := &reloader{configPath: configPath, flags: flags, serverList: serverList}
+	r.current.Store(current)
+	r.runtime = r.runtime.copy()
+	r.record(current, "startup", nil)
+	r.scheduleNext()
+	return r
+}
+
+func (r *reloader) Current() *Config {
+	return r.current.Load()
+}
+
+// reload the config, returns the applied config or nil when it was rejected.
+// source says what triggered it, for the version history.
+func (r *reloader) Reload(source string) *Config {
+	r.changing.Lock()
+	next, changes := r.reload()
+	if next != nil {
+		r.current.Store(next)
+		if len(changes) > 0 {
+			r.record(next, source, changes)
+		}
+	}
+	r.changing.Unlock()
+	r.scheduleNext()
+	return next
+}
+
+// load, validate and apply the config. Returns the applied config and what
+// changed, or nil when the reload was rejected. Called with r.changing held.
+func (r *reloader) reload() (*Config, []string) {
+	cfg, err := resolveConfig(r.configPath, r.flags, r.serverList)
+	if err == nil {
+		r.runtime.apply(cfg)
+		err = cfg.Validate()
+	}
+	if err != nil {
+		errorf("Config reload rejected, keeping the current config: %s\n", err)
+		return nil, nil
+	}
+	changes, ok := applyConfig(r.current.Load(), cfg)
+	if !ok {
+		return nil, nil
+	}
+	return cfg, changes
+}
+
+// set the timer for the next pending scheduled change
+func (r *reloader) scheduleNext() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	at, name := r.current.Load().nextScheduled(time.Now())
+	if at.IsZero() {
+		return
+	}
+	infof("Scheduled change %s will be applied at %s\n", name, at.Format(time.RFC3339))
+	r.timer = time.AfterFunc(time.Until(at), func() {
+		infof("Applying scheduled change %s\n", name)
+		r.Reload("scheduled change " + name)
+	})
+}
+
+// watch the config file (and the files it includes) and reload it when it
+// changes. The directories are watched instead of the files themselves because
+// most editors (and k8s configmaps) replace the file instead of writing into it.
+func watchConfig(r *reloader) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		warnf("Config watcher disabled: %s\n", err)
+		return
+	}
+	defer watcher.Close()
+
+	targets := make(map[string]bool)
+	watch := func(files []string) {
+		for _, f := range files {
+			f = filepath.Clean(f)
+			if targets[f] {
+				continue
+			}
+			if err := watcher.Add(filepath.Dir(f)); err != nil {
+				warnf("Cant watch %s: %s\n", f, err)
+				continue
+			}
+			targets[f] = true
+			infof("Watching %s for changes\n", f)
+		}
+	}
+	watch(append([]string{r.configPath}, r.Current().files...))
+
+	// editors usually fire a few events for one save, wait until it settles
+	var debounce <-chan time.Time
+	for {
+		select {
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if !targets[filepath.Clean(ev.Name)] || ev.Op == fsnotify.Chmod {
+				continue
+			}
+			debounce = time.After(200 * time.Millisecond)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			warnf("Config watcher error: %s\n", err)
+		case <-debounce:
+			debounce = nil
+			if next := r.Reload("file changed"); next != nil {
+				watch(next.files)
+			}
+		}
+	}
+}
+
+// put a validated config in place of current. The pools are swapped in one go
+// so requests either see the old backends or the new ones, never a mix.
+// Returns what changed, false when the config was not applied.
+func applyConfig(current, cfg *Config) ([]string, bool) {
+	changes := diffConfig(current, cfg)
+	if len(changes) == 0 {
+		infof("Config reloaded, nothing changed\n")
+		return nil, true
+	}
+
+	previous := activePools.Load()
+	pools, err := NewPools(cfg, previous)
+	if err != nil {
+		errorf("Config reload rejected, keeping the current config: %s\n", err)
+		return nil, false
+	}
+	// the resolver goes first so new backends already use it
+	previousResolver := activeResolver.Swap(newDNSResolver(cfg.Resolver))
+	if current.Fleet.Consul != "" {
+		// one replica at a time, with the fleet settings we are running with
+		if !coordinatedSwap(current.Fleet, pools) {
+			activeResolver.Store(previousResolver)
+			// the previous pools are back, let go of what only the new
+			// ones opened
+			drainRemovedBackends(pools, previous)
+			if pools.accessLog != previous.accessLog {
+				pools.accessLog.Close()
+			}
+			if pools.auditLog != previous.auditLog {
+				pools.auditLog.Close()
+			}
+			return nil, false
+		}
+	} else {
+		activePools.Store(pools)
+	}
+	drainRemovedBackends(previous, pools)
+	if previous.accessLog != pools.accessLog {
+		// requests still on the old pools lose their lines
+		previous.accessLog.Close()
+	}
+	if previous.auditLog != pools.auditLog {
+		previous.auditLog.Close()
+	}
+	certWarningDays.Store(int64(cfg.Health.CertWarningDays))
+	if cfg.LogLevel != current.LogLevel {
+		// also ends a level set for a while through the admin api
+		setLogLevel(configLogLevel(cfg.LogLevel), 0)
+	}
+	if cfg.Maintenance.Enabled != current.Maintenance.Enabled {
+		setMaintenance(cfg.Maintenance.Enabled, "config")
+	}
+
+	infof("Config reloaded with %d change(s):\n", len(changes))
+	for _, c := range changes {
+		infof("  %s\n", c)
+	}
+	return changes, true
+}
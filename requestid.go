@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+// requestID is the id of a request for correlating it across the client,
+// the logs, the traces and the backend. It goes to the backend and back to
+// the client in header.
+type requestID struct {
+	header string
+	id     string
+}
+
+// an incoming id is kept when it looks like one, a client cant put
+// anything it likes into the logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// a random (version 4) uuid
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// give the request its id, the incoming one or a new one, on the request
+// for the backend and on the response for the client. Nothing happens when
+// header is empty.
+func setRequestID(w http.ResponseWriter, r *http.Request, header string) *http.Request {
+	if header == "" {
+		return r
+	}
+	id := r.Header.Get(header)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	r.Header.Set(header, id)
+	w.Header().Set(header, id)
+	return r.WithContext(context.WithValue(r.Context(), RequestID, &requestID{header, id}))
+}
+
+// the id of a request, empty without one
+func GetRequestIDFromContext(r *http.Request) string {
+	if id, ok := r.Context().Value(RequestID).(*requestID); ok {
+		return id.id
+	}
+	return ""
+}
+
+// the response already has the id, one the backend sends back would be
+// there twice
+func stripRequestID(resp *http.Response) {
+	if id, ok := resp.Request.Context().Value(RequestID).(*requestID); ok {
+		resp.Header.Del(id.header)
+	}
+}
+
+// the request id and tags of a request for the text log
+func logRequest(r *http.Request) string {
+	s := logTags(r)
+	if id := GetRequestIDFromContext(r); id != "" {
+		s = " [id " + id + "]" + s
+	}
+	return s
+}
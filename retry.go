@@ -0,0 +1,20 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// wait before retry number retry (from 0) on the same backend: retry_delay,
+// times retry_backoff for every retry before, at most retry_max_delay. With
+// retry_jitter a random part of it (up to that fraction) is left out, so
+// clients failing together dont retry together.
+func (r *Route) retryWait(retry int) time.Duration {
+	wait := float64(r.RetryDelay) * math.Pow(r.RetryBackoff, float64(retry))
+	if r.RetryMaxDelay > 0 && wait > float64(r.RetryMaxDelay) {
+		wait = float64(r.RetryMaxDelay)
+	}
+	wait -= wait * r.RetryJitter * rand.Float64()
+	return time.Duration(wait)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// retryBody is the request body as the attempts of a request see it. A body
+// up to retry_body_limit is read in first and kept, so every attempt sends
+// it whole. A longer one is streamed, and can only be sent again as long as
+// no attempt read any of it.
+type retryBody struct {
+	body io.ReadCloser
+	// the whole body is in kept
+	whole bool
+	kept  []byte
+	// an attempt read some of the streamed body
+	read atomic.Bool
+}
+
+// requests not retried because part of their body was gone
+var bodyNotKept atomic.Uint64
+
+// keep the body of the request for its retries, see retryBody
+func withRetryBody(r *http.Request, limit int) *http.Request {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return r
+	}
+	rb := &retryBody{body: r.Body}
+	if limit > 0 && r.ContentLength <= int64(limit) {
+		data, err := io.ReadAll(io.LimitReader(r.Body, int64(limit)+1))
+		if err == nil && len(data) <= limit {
+			rb.whole, rb.kept = true, data
+		} else {
+			rb.body = prependBody(data, r.Body)
+		}
+	}
+	r = r.WithContext(context.WithValue(r.Context(), RetryBody, rb))
+	if rb.whole {
+		r.Body = io.NopCloser(bytes.NewReader(rb.kept))
+	} else {
+		r.Body = rb
+	}
+	return r
+}
+
+func (b *retryBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if n > 0 {
+		b.read.Store(true)
+	}
+	return n, err
+}
+
+// the transport closes the body after a failed attempt too, the next one
+// may still send it. The server closes the body of the client.
+func (b *retryBody) Close() error {
+	return nil
+}
+
+// check if another attempt can send the body of the request whole
+func bodyReplayable(r *http.Request) bool {
+	rb, ok := r.Context().Value(RetryBody).(*retryBody)
+	return !ok || rb.whole || !rb.read.Load()
+}
+
+// the request with its kept body from the start, for the next attempt
+func rewindBody(r *http.Request) *http.Request {
+	rb, ok := r.Context().Value(RetryBody).(*retryBody)
+	if !ok || !rb.whole {
+		return r
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Body = io.NopCloser(bytes.NewReader(rb.kept))
+	return r2
+}
+
+func writeRetryBodyMetrics(w io.Writer) {
+	writeMetricHeader(w, "lb_retry_body_not_kept_total", "counter", "Failed requests not retried because their body was longer than retry_body_limit and partly sent.")
+	fmt.Fprintf(w, "lb_retry_body_not_kept_total %d\n", bodyNotKept.Load())
+}
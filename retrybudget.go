@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RetryBudgetConfig caps the retries of all requests together at a share
+// of the requests, so a backend failing half of its requests cant make the
+// load balancer send twice the traffic by retrying them
+type RetryBudgetConfig struct {
+	// retries allowed for every request, 0.2 for at most one retry per five
+	// requests. 0 disables the budget
+	Ratio float64 `yaml:"ratio"`
+	// retries per second allowed on top, so little traffic can still retry
+	MinPerSecond float64 `yaml:"min_per_second"`
+}
+
+func (b RetryBudgetConfig) Validate() error {
+	if b.Ratio < 0 {
+		return fmt.Errorf("retry_budget: ratio must not be negative")
+	}
+	if b.MinPerSecond < 0 {
+		return fmt.Errorf("retry_budget: min_per_second must not be negative")
+	}
+	return nil
+}
+
+// the budget is over the last 10 to 20 seconds
+const retryBudgetWindow = 10 * time.Second
+
+// requests and retries over the current and the previous window, outside of
+// the pools so a reload doesnt refill the budget
+type retryBudget struct {
+	mu        sync.Mutex
+	started   time.Time
+	cur, prev retryBudgetWindowCounts
+
+	// retries the budget didnt allow
+	exhausted atomic.Uint64
+}
+
+type retryBudgetWindowCounts struct {
+	requests, retries float64
+}
+
+var globalRetryBudget retryBudget
+
+// start a new window when the current one is over, called with mu held
+func (b *retryBudget) rotate(now time.Time) {
+	switch elapsed := now.Sub(b.started); {
+	case elapsed >= 2*retryBudgetWindow:
+		b.prev, b.cur, b.started = retryBudgetWindowCounts{}, retryBudgetWindowCounts{}, now
+	case elapsed >= retryBudgetWindow:
+		b.prev, b.cur, b.started = b.cur, retryBudgetWindowCounts{}, now
+	}
+}
+
+// a new request from a client, retries not included
+func (b *retryBudget) Request() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rotate(time.Now())
+	b.cur.requests++
+}
+
+// take a retry from the budget, false when there is none left
+func (b *retryBudget) Take(cfg RetryBudgetConfig) bool {
+	if cfg.Ratio <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.rotate(now)
+	// the previous window counts in full, the current one for as long as
+	// it has been going
+	seconds := (retryBudgetWindow + now.Sub(b.started)).Seconds()
+	allowed := cfg.Ratio*(b.cur.requests+b.prev.requests) + cfg.MinPerSecond*seconds
+	if b.cur.retries+b.prev.retries >= allowed {
+		b.exhausted.Add(1)
+		return false
+	}
+	b.cur.retries++
+	return true
+}
+
+// check the budget before retrying a failed request, and answer 502 when
+// it is used up
+func retryWithinBudget(w http.ResponseWriter, r *http.Request, backend string) bool {
+	if globalRetryBudget.Take(activePools.Load().retryBudget) {
+		return true
+	}
+	route := GetRouteFromContext(r)
+	warnw(requestFields(r, "backend", backend), "%s(%s)%s Retry budget used up, not retrying\n", r.RemoteAddr, r.URL.Path, logRequest(r))
+	recentErrors.Add(errorEntry{Pool: route.Pool, Backend: backend, Path: r.URL.Path, Error: "retry budget used up"})
+	http.Error(w, "Bad gateway", http.StatusBadGateway)
+	return false
+}
+
+func writeRetryBudgetMetrics(w io.Writer) {
+	writeMetricHeader(w, "lb_retry_budget_exhausted_total", "counter", "Retries of failed requests left out because the retry budget was used up.")
+	fmt.Fprintf(w, "lb_retry_budget_exhausted_total %d\n", globalRetryBudget.exhausted.Load())
+}
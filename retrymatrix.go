@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+)
+
+// what happens to a request when proxying it to a backend fails
+const (
+	// retry the same backend up to retries times, then mark it down and
+	// move on to another one. What happens when no rule matches, for
+	// requests that can be sent twice.
+	actionRetrySame = "retry-same"
+	// move on to another backend right away, its health stays as it is
+	actionRetryOther = "retry-other"
+	// answer 502 without trying again. What happens when no rule matches,
+	// for other requests that may have reached the backend.
+	actionFail = "fail"
+	// answer with the last good response of the route for the url, or 502
+	// without one
+	actionServeStale = "serve-stale"
+)
+
+var validRetryActions = map[string]bool{actionRetrySame: true, actionRetryOther: true, actionFail: true, actionServeStale: true}
+
+// classes of upstream errors the rules match on
+var validErrorClasses = map[string]bool{"connect": true, "reset": true, "timeout": true, "tls": true, "other": true}
+
+// RetryRule picks the action for the errors and methods it matches, an
+// empty list matches everything
+type RetryRule struct {
+	Errors  []string `yaml:"errors,omitempty"`
+	Methods []string `yaml:"methods,omitempty"`
+	Action  string   `yaml:"action"`
+}
+
+// RetryMatrix is a list of rules, the first that matches a failed request
+// decides what happens to it
+type RetryMatrix []RetryRule
+
+func (m RetryMatrix) Validate() error {
+	for i, rule := range m {
+		if !validRetryActions[rule.Action] {
+			return fmt.Errorf("rule %d: action must be retry-same, retry-other, fail or serve-stale", i+1)
+		}
+		for _, class := range rule.Errors {
+			if !validErrorClasses[class] {
+				return fmt.Errorf("rule %d: unknown error class %q, use connect, reset, timeout, tls or other", i+1, class)
+			}
+		}
+		for _, method := range rule.Methods {
+			if method == "" || strings.ToUpper(method) != method {
+				return fmt.Errorf("rule %d: method %q must be upper case", i+1, method)
+			}
+		}
+	}
+	return nil
+}
+
+// for lb config explain: "timeout GET -> serve-stale, * POST -> fail"
+func (m RetryMatrix) String() string {
+	if len(m) == 0 {
+		return actionRetrySame + " for retry_methods"
+	}
+	rules := make([]string, len(m))
+	for i, rule := range m {
+		classes, methods := "*", "*"
+		if len(rule.Errors) > 0 {
+			classes = strings.Join(rule.Errors, ",")
+		}
+		if len(rule.Methods) > 0 {
+			methods = strings.Join(rule.Methods, ",")
+		}
+		rules[i] = classes + " " + methods + " -> " + rule.Action
+	}
+	return strings.Join(rules, ", ")
+}
+
+func (m RetryMatrix) action(class, method string, idempotent bool) string {
+	for _, rule := range m {
+		if matchesAny(rule.Errors, class) && matchesAny(rule.Methods, method) {
+			return rule.Action
+		}
+	}
+	// a request that never got to the backend can be sent again whatever
+	// it does
+	if idempotent || class == "connect" || class == "tls" {
+		return actionRetrySame
+	}
+	return actionFail
+}
+
+// check if the request can be sent again without a rule saying so: its
+// method is one of retry_methods, or it carries the idempotency header of
+// the route, so the backend can tell it already has it
+func (route *Route) idempotent(r *http.Request) bool {
+	for _, method := range route.RetryMethods {
+		if method == r.Method {
+			return true
+		}
+	}
+	return route.IdempotencyHeader != "" && r.Header.Get(route.IdempotencyHeader) != ""
+}
+
+// whether any rule serves stale responses, only then are they kept
+func (m RetryMatrix) servesStale() bool {
+	for _, rule := range m {
+		if rule.Action == actionServeStale {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAny(list []string, v string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+// the class of an error of the reverse proxy
+func errorClass(err error) string {
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &opErr) && opErr.Op == "dial", errors.As(err, &dnsErr), errors.Is(err, syscall.ECONNREFUSED):
+		return "connect"
+	case isTLSError(err):
+		return "tls"
+	case errors.Is(err, errHeaderTimeout), errors.Is(err, errResponseTimeout), errors.Is(err, context.DeadlineExceeded), isTimeout(err):
+		return "timeout"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "reset"
+	}
+	return "other"
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func isTLSError(err error) bool {
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	return errors.As(err, &recordErr) || errors.As(err, &alertErr) || errors.As(err, &verifyErr) ||
+		errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr)
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RouteSettings are the per request tunables. They can be set globally (top
+// level of the config), per pool, per listener and per route. A nil field
+// means "not set here, inherit from the next level": route -> listener ->
+// pool -> global -> default.
+//
+// Every field needs a field with the same name (without the pointer) in Route.
+type RouteSettings struct {
+	// times the same backend is retried before it is marked down
+	Retries *int `yaml:"retries,omitempty"`
+	// wait before the first retry on the same backend
+	RetryDelay *time.Duration `yaml:"retry_delay,omitempty"`
+	// the wait is multiplied by this for every retry after the first
+	RetryBackoff *float64 `yaml:"retry_backoff,omitempty"`
+	// longest wait between two retries, 0 means no limit
+	RetryMaxDelay *time.Duration `yaml:"retry_max_delay,omitempty"`
+	// fraction of the wait that is random, 0 to 1
+	RetryJitter *float64 `yaml:"retry_jitter,omitempty"`
+	// backends tried for one request before giving up with 503
+	MaxAttempts *int `yaml:"max_attempts,omitempty"`
+	// what a failed request does by error class and method, see
+	// retrymatrix.go. Without a matching rule it is retry-same.
+	RetryMatrix *RetryMatrix `yaml:"retry_matrix,omitempty"`
+	// methods retried when no rule of the matrix matches, the others fail
+	// unless they never got to the backend
+	RetryMethods *[]string `yaml:"retry_methods,omitempty"`
+	// header carrying a per request idempotency key, sent with every attempt
+	// so backends can deduplicate retries. Empty disables it
+	IdempotencyHeader *string `yaml:"idempotency_header,omitempty"`
+	// request bodies up to this many bytes are kept so a retry can send
+	// them again, see retrybody.go. 0 keeps none
+	RetryBodyLimit *int `yaml:"retry_body_limit,omitempty"`
+	// upstream timeout following the recent latency of the route
+	DynamicTimeout *DynamicTimeout `yaml:"dynamic_timeout,omitempty"`
+	// wait for the response headers of a backend, 0 means no limit
+	HeaderTimeout *time.Duration `yaml:"header_timeout,omitempty"`
+	// limit on the whole response, body included, 0 means no limit
+	ResponseTimeout *time.Duration `yaml:"response_timeout,omitempty"`
+	// limit on all attempts of a request together until the response
+	// headers, 0 means no limit
+	RequestTimeout *time.Duration `yaml:"request_timeout,omitempty"`
+	// flush every write of the response to the client and leave the body
+	// alone, see streaming.go
+	Streaming *bool `yaml:"streaming,omitempty"`
+	// requests taking longer are logged with their attempts, see slow.go. 0
+	// disables it
+	SlowThreshold *time.Duration `yaml:"slow_threshold,omitempty"`
+	// send slow reads to a second backend too, see hedge.go
+	Hedge *HedgeConfig `yaml:"hedge,omitempty"`
+}
+
+// RouteConfig matches requests by path prefix, and by host name if it has
+// one
+type RouteConfig struct {
+	Name string `yaml:"name,omitempty"`
+	// api.example.com, or *.example.com for any name directly below it. Empty
+	// matches every host.
+	Host string `yaml:"host,omitempty"`
+	Path string `yaml:"path"`
+	// pool to send the traffic to, defaults to the pool of the listener
+	Pool string `yaml:"pool,omitempty"`
+	// rewrite request/response bodies, only for this route (not inherited)
+	Transform     *TransformConfig `yaml:"transform,omitempty"`
+	RouteSettings `yaml:",inline"`
+}
+
+// Route is a route with all settings resolved
+type Route struct {
+	Name string
+	Host string
+	Path string
+	Pool string
+
+	Retries           int
+	RetryDelay        time.Duration
+	RetryBackoff      float64
+	RetryMaxDelay     time.Duration
+	RetryJitter       float64
+	MaxAttempts       int
+	RetryMatrix       RetryMatrix
+	RetryMethods      []string
+	IdempotencyHeader string
+	RetryBodyLimit    int
+	DynamicTimeout    DynamicTimeout
+	HeaderTimeout     time.Duration
+	ResponseTimeout   time.Duration
+	RequestTimeout    time.Duration
+	Streaming         bool
+	SlowThreshold     time.Duration
+	Hedge             HedgeConfig
+
+	requestTransform  *bodyTransformer
+	responseTransform *bodyTransformer
+
+	// where every setting came from, for lb config explain
+	sources map[string]string
+}
+
+func intPtr(v int) *int                          { return &v }
+func durationPtr(v time.Duration) *time.Duration { return &v }
+func stringPtr(v string) *string                 { return &v }
+func floatPtr(v float64) *float64                { return &v }
+func boolPtr(v bool) *bool                       { return &v }
+
+// built in values, the last level of the inheritance chain
+var defaultRouteSettings = RouteSettings{
+	Retries:           intPtr(3),
+	RetryDelay:        durationPtr(10 * time.Millisecond),
+	RetryBackoff:      floatPtr(1),
+	RetryMaxDelay:     durationPtr(0),
+	RetryJitter:       floatPtr(0),
+	MaxAttempts:       intPtr(3),
+	RetryMatrix:       &RetryMatrix{},
+	RetryMethods:      &[]string{http.MethodGet, http.MethodHead, http.MethodOptions},
+	IdempotencyHeader: stringPtr(""),
+	RetryBodyLimit:    intPtr(64 << 10),
+	DynamicTimeout:    &DynamicTimeout{},
+	HeaderTimeout:     durationPtr(0),
+	ResponseTimeout:   durationPtr(0),
+	RequestTimeout:    durationPtr(0),
+	Streaming:         boolPtr(false),
+	SlowThreshold:     durationPtr(0),
+	Hedge:             &HedgeConfig{},
+}
+
+// one level of the inheritance chain
+type settingsLayer struct {
+	name     string
+	settings RouteSettings
+}
+
+// resolve the route settings, the first layer that sets a field wins
+func resolveRoute(name, path, pool string, layers ...settingsLayer) *Route {
+	layers = append(layers, settingsLayer{"default", defaultRouteSettings})
+
+	route := &Route{Name: name, Path: path, Pool: pool, sources: make(map[string]string)}
+	rv := reflect.ValueOf(route).Elem()
+	st := reflect.TypeOf(RouteSettings{})
+	for i := 0; i < st.NumField(); i++ {
+		field := st.Field(i)
+		for _, l := range layers {
+			v := reflect.ValueOf(l.settings).Field(i)
+			if v.IsNil() {
+				continue
+			}
+			rv.FieldByName(field.Name).Set(v.Elem())
+			route.sources[yamlName(field)] = l.name
+			break
+		}
+	}
+	return route
+}
+
+// the yaml names of the settings set on this level
+func (s RouteSettings) set() []string {
+	names := []string{}
+	v := reflect.ValueOf(s)
+	for i := 0; i < v.NumField(); i++ {
+		if !v.Field(i).IsNil() {
+			names = append(names, yamlName(v.Type().Field(i)))
+		}
+	}
+	return names
+}
+
+func yamlName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
+
+// check the values of one settings level
+func (s RouteSettings) Validate() error {
+	if s.Retries != nil && *s.Retries < 0 {
+		return fmt.Errorf("retries must not be negative")
+	}
+	if s.RetryDelay != nil && *s.RetryDelay < 0 {
+		return fmt.Errorf("retry_delay must not be negative")
+	}
+	if s.RetryBackoff != nil && *s.RetryBackoff < 1 {
+		return fmt.Errorf("retry_backoff must be at least 1")
+	}
+	if s.RetryMaxDelay != nil && *s.RetryMaxDelay < 0 {
+		return fmt.Errorf("retry_max_delay must not be negative")
+	}
+	if s.RetryJitter != nil && (*s.RetryJitter < 0 || *s.RetryJitter > 1) {
+		return fmt.Errorf("retry_jitter must be between 0 and 1")
+	}
+	if s.MaxAttempts != nil && *s.MaxAttempts < 1 {
+		return fmt.Errorf("max_attempts must be at least 1")
+	}
+	if s.RetryMatrix != nil {
+		if err := s.RetryMatrix.Validate(); err != nil {
+			return fmt.Errorf("retry_matrix: %w", err)
+		}
+	}
+	if s.RetryMethods != nil {
+		for _, method := range *s.RetryMethods {
+			if method == "" || strings.ToUpper(method) != method {
+				return fmt.Errorf("retry_methods: method %q must be upper case", method)
+			}
+		}
+	}
+	if s.IdempotencyHeader != nil && *s.IdempotencyHeader != "" && !validHeaderName(*s.IdempotencyHeader) {
+		return fmt.Errorf("idempotency_header %q is not a valid header name", *s.IdempotencyHeader)
+	}
+	if s.RetryBodyLimit != nil && *s.RetryBodyLimit < 0 {
+		return fmt.Errorf("retry_body_limit must not be negative")
+	}
+	if s.HeaderTimeout != nil && *s.HeaderTimeout < 0 {
+		return fmt.Errorf("header_timeout must not be negative")
+	}
+	if s.ResponseTimeout != nil && *s.ResponseTimeout < 0 {
+		return fmt.Errorf("response_timeout must not be negative")
+	}
+	if s.RequestTimeout != nil && *s.RequestTimeout < 0 {
+		return fmt.Errorf("request_timeout must not be negative")
+	}
+	if s.SlowThreshold != nil && *s.SlowThreshold < 0 {
+		return fmt.Errorf("slow_threshold must not be negative")
+	}
+	if s.DynamicTimeout != nil {
+		if err := s.DynamicTimeout.Validate(); err != nil {
+			return fmt.Errorf("dynamic_timeout: %w", err)
+		}
+	}
+	if s.Hedge != nil {
+		if err := s.Hedge.Validate(); err != nil {
+			return fmt.Errorf("hedge: %w", err)
+		}
+	}
+	return nil
+}
+
+// how a route is told apart from the others in messages and diffs
+func (rc RouteConfig) hostPath() string {
+	return rc.Host + rc.Path
+}
+
+// build the routing table for traffic of a listener, the result is sorted
+// routes for a host first, then longest path first, so the most specific
+// route matches. There is always a "/" route for any host sending everything
+// else to the pool of the listener.
+func buildRoutes(cfg *Config, l ListenerConfig) []*Route {
+	pools := cfg.effectivePools()
+	listenerPool := l.Pool
+	if listenerPool == "" {
+		listenerPool = cfg.defaultPool()
+	}
+	listener := settingsLayer{"listener " + l.Address, l.RouteSettings}
+	global := settingsLayer{"global", cfg.RouteSettings}
+	poolLayer := func(name string) settingsLayer {
+		return settingsLayer{"pool " + name, pools[name].RouteSettings}
+	}
+
+	var routes []*Route
+	hasRoot := false
+	for _, rc := range cfg.Routes {
+		name := rc.Name
+		if name == "" {
+			name = rc.hostPath()
+		}
+		pool := rc.Pool
+		if pool == "" {
+			pool = listenerPool
+		}
+		route := resolveRoute(name, rc.Path, pool, settingsLayer{"route " + name, rc.RouteSettings}, listener, poolLayer(pool), global)
+		// already checked by validateRoutes
+		route.Host = rc.Host
+		route.requestTransform, route.responseTransform, _ = rc.Transform.compile()
+		routes = append(routes, route)
+		if rc.Path == "/" && rc.Host == "" {
+			hasRoot = true
+		}
+	}
+	if !hasRoot {
+		routes = append(routes, resolveRoute("/", "/", listenerPool, listener, poolLayer(listenerPool), global))
+	}
+
+	sort.SliceStable(routes, func(i, j int) bool {
+		if hi, hj := hostRank(routes[i].Host), hostRank(routes[j].Host); hi != hj {
+			return hi < hj
+		}
+		return len(routes[i].Path) > len(routes[j].Path)
+	})
+	return routes
+}
+
+// find the route for a request host (see requestHost) and path
+func matchRoute(routes []*Route, host, path string) *Route {
+	for _, r := range routes {
+		if hostMatches(r.Host, host) && routeMatches(r.Path, path) {
+			return r
+		}
+	}
+	return nil
+}
+
+// "/api" matches "/api" and "/api/users" but not "/apiary"
+func routeMatches(prefix, path string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// get the route the request was matched to, falls back to the built in
+// defaults if the request didnt go through lb()
+func GetRouteFromContext(r *http.Request) *Route {
+	if route, ok := r.Context().Value(CurrentRoute).(*Route); ok {
+		return route
+	}
+	return resolveRoute("/", "/", "")
+}
+
+func validateRoutes(cfg *Config) error {
+	if err := cfg.RouteSettings.Validate(); err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for _, rc := range cfg.Routes {
+		if !strings.HasPrefix(rc.Path, "/") {
+			return fmt.Errorf("route %q: path must start with /", rc.Path)
+		}
+		if rc.Host != "" {
+			if err := validateRouteHost(rc.Host); err != nil {
+				return fmt.Errorf("route %s: %w", rc.hostPath(), err)
+			}
+		}
+		if seen[rc.hostPath()] {
+			return fmt.Errorf("duplicate route %s", rc.hostPath())
+		}
+		seen[rc.hostPath()] = true
+		if err := rc.RouteSettings.Validate(); err != nil {
+			return fmt.Errorf("route %s: %w", rc.hostPath(), err)
+		}
+		if _, _, err := rc.Transform.compile(); err != nil {
+			return fmt.Errorf("route %s: transform: %w", rc.hostPath(), err)
+		}
+	}
+	return nil
+}
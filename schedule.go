@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ScheduledChange is a part of the config that only applies from a point in
+// time on, e.g. moving half of the traffic to the canary at 02:00 UTC. Its
+// config is laid over the rest of the file like an included file would be,
+// lists (like the backends of a pool) are replaced as a whole.
+type ScheduledChange struct {
+	Name   string    `yaml:"name"`
+	At     time.Time `yaml:"at"`
+	Config yaml.Node `yaml:"config"`
+}
+
+// changes canceled through the admin api, by name. They are skipped on every
+// load until the process restarts.
+var canceledChanges sync.Map
+
+// lay the due scheduled changes over the config, oldest first. Changes that
+// are not due yet are only decoded, so a broken one fails now and not at 2am.
+func (c *Config) applySchedule(now time.Time) error {
+	changes := append([]ScheduledChange(nil), c.Scheduled...)
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].At.Before(changes[j].At) })
+
+	seen := make(map[string]bool)
+	for _, sc := range changes {
+		if sc.Name == "" {
+			return fmt.Errorf("scheduled: name is required")
+		}
+		if seen[sc.Name] {
+			return fmt.Errorf("scheduled: duplicate change %s", sc.Name)
+		}
+		seen[sc.Name] = true
+		if sc.At.IsZero() {
+			return fmt.Errorf("scheduled %s: at is required", sc.Name)
+		}
+
+		target := &Config{}
+		due := !sc.At.After(now)
+		if _, canceled := canceledChanges.Load(sc.Name); due && !canceled {
+			target = c
+		}
+		if err := sc.decodeInto(target); err != nil {
+			return fmt.Errorf("scheduled %s: %w", sc.Name, err)
+		}
+		if target == c {
+			c.applied = append(c.applied, sc.Name)
+		}
+	}
+	return nil
+}
+
+func (sc ScheduledChange) decodeInto(cfg *Config) error {
+	var overlay struct {
+		Scheduled []yaml.Node `yaml:"scheduled"`
+		Include   []yaml.Node `yaml:"include"`
+	}
+	if err := sc.Config.Decode(&overlay); err != nil {
+		return err
+	}
+	if len(overlay.Scheduled) > 0 || len(overlay.Include) > 0 {
+		return fmt.Errorf("scheduled and include can not be changed by a schedule")
+	}
+
+	// through the text so unknown keys are caught like everywhere else
+	data, err := yaml.Marshal(&sc.Config)
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	return dec.Decode(cfg)
+}
+
+// when the next pending change is due, zero if there is none
+func (c *Config) nextScheduled(now time.Time) (time.Time, string) {
+	var next time.Time
+	var name string
+	for _, sc := range c.Scheduled {
+		if _, canceled := canceledChanges.Load(sc.Name); canceled || !sc.At.After(now) {
+			continue
+		}
+		if next.IsZero() || sc.At.Before(next) {
+			next, name = sc.At, sc.Name
+		}
+	}
+	return next, name
+}
+
+type scheduledStatus struct {
+	Name string    `json:"name"`
+	At   time.Time `json:"at"`
+	// pending, applied, canceled, or rejected when it was due but the reload
+	// with it failed
+	Status string `json:"status"`
+}
+
+// the scheduled changes of cfg and where they stand
+func scheduleStatus(cfg *Config, now time.Time) []scheduledStatus {
+	applied := make(map[string]bool)
+	for _, name := range cfg.applied {
+		applied[name] = true
+	}
+	var list []scheduledStatus
+	for _, sc := range cfg.Scheduled {
+		st := scheduledStatus{Name: sc.Name, At: sc.At}
+		_, canceled := canceledChanges.Load(sc.Name)
+		switch {
+		case applied[sc.Name]:
+			st.Status = "applied"
+		case canceled:
+			st.Status = "canceled"
+		case sc.At.After(now):
+			st.Status = "pending"
+		default:
+			st.Status = "rejected"
+		}
+		list = append(list, st)
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].At.Before(list[j].At) })
+	return list
+}
+
+// GET /admin/scheduled
+func (r *reloader) handleListScheduled(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, scheduleStatus(r.Current(), time.Now()))
+}
+
+// DELETE /admin/scheduled/{name}, only a change that is still pending can
+// be canceled
+func (r *reloader) handleCancelScheduled(w http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+	for _, st := range scheduleStatus(r.Current(), time.Now()) {
+		if st.Name != name {
+			continue
+		}
+		if st.Status != "pending" {
+			writeError(w, http.StatusConflict, fmt.Sprintf("scheduled change %s is %s", name, st.Status))
+			return
+		}
+		canceledChanges.Store(name, true)
+		r.scheduleNext()
+		infof("Scheduled change %s (at %s) canceled\n", name, st.At.Format(time.RFC3339))
+		st.Status = "canceled"
+		writeJSON(w, http.StatusOK, st)
+		return
+	}
+	writeError(w, http.StatusNotFound, fmt.Sprintf("no scheduled change %s", name))
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// a credential in the config can point at where the secret lives instead of
+// holding it, so the orchestrator can mount it:
+//
+//	file:///run/secrets/consul-token   contents of the file
+//	env://CONSUL_TOKEN                 value of the environment variable
+//
+// anything else is the value itself. Secrets are read when the config is
+// loaded, so a reload picks up rotated ones. Secret files are added to files
+// (if not nil) so -watch reloads when they change.
+func resolveSecret(v string, files *[]string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, "file://"):
+		if files != nil {
+			*files = append(*files, strings.TrimPrefix(v, "file://"))
+		}
+		data, err := os.ReadFile(strings.TrimPrefix(v, "file://"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case strings.HasPrefix(v, "env://"):
+		name := strings.TrimPrefix(v, "env://")
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return val, nil
+	}
+	return v, nil
+}
+
+// tls_cert and tls_key are file paths, with file:// being the same thing.
+// env:// holds the pem itself.
+func readPEM(v string, files *[]string) ([]byte, error) {
+	if strings.HasPrefix(v, "env://") {
+		pem, err := resolveSecret(v, nil)
+		return []byte(pem), err
+	}
+	path := strings.TrimPrefix(v, "file://")
+	*files = append(*files, path)
+	return os.ReadFile(path)
+}
+
+// replace the secret references of the config with their values
+func (c *Config) resolveSecrets() error {
+	var err error
+	if c.Fleet.Token, err = resolveSecret(c.Fleet.Token, &c.files); err != nil {
+		return fmt.Errorf("fleet: token: %w", err)
+	}
+	if c.Export.Token, err = resolveSecret(c.Export.Token, &c.files); err != nil {
+		return fmt.Errorf("export: token: %w", err)
+	}
+	if c.Admin.Token, err = resolveSecret(c.Admin.Token, &c.files); err != nil {
+		return fmt.Errorf("admin: token: %w", err)
+	}
+	if c.Admin.Password, err = resolveSecret(c.Admin.Password, &c.files); err != nil {
+		return fmt.Errorf("admin: password: %w", err)
+	}
+	if c.Usage.Token, err = resolveSecret(c.Usage.Token, &c.files); err != nil {
+		return fmt.Errorf("usage: token: %w", err)
+	}
+	if c.EgressProxy, err = resolveSecret(c.EgressProxy, &c.files); err != nil {
+		return fmt.Errorf("egress_proxy: %w", err)
+	}
+	if len(c.Tracing.Headers) > 0 {
+		// a new map, the one loaded may be shared with another config
+		headers := make(map[string]string, len(c.Tracing.Headers))
+		for name, v := range c.Tracing.Headers {
+			if headers[name], err = resolveSecret(v, &c.files); err != nil {
+				return fmt.Errorf("tracing: headers: %s: %w", name, err)
+			}
+		}
+		c.Tracing.Headers = headers
+	}
+	if err := c.Defaults.resolveSecrets(&c.files); err != nil {
+		return fmt.Errorf("defaults: %w", err)
+	}
+	for i := range c.Backends {
+		if err := c.Backends[i].resolveSecrets(&c.files); err != nil {
+			return err
+		}
+	}
+	for _, pc := range c.Pools {
+		// the slice is shared with the map entry, no need to store pc back
+		for i := range pc.Backends {
+			if err := pc.Backends[i].resolveSecrets(&c.files); err != nil {
+				return err
+			}
+		}
+	}
+	for i := range c.Listeners {
+		if err := c.Listeners[i].loadCertificate(&c.files); err != nil {
+			return err
+		}
+	}
+	return c.loadCertificate()
+}
+
+// read the certificate and key of port
+func (c *Config) loadCertificate() error {
+	l := ListenerConfig{Address: fmt.Sprintf(":%d", c.Port), TLSCert: c.TLSCert, TLSKey: c.TLSKey}
+	if err := l.loadCertificate(&c.files); err != nil {
+		return err
+	}
+	c.certPEM, c.keyPEM = l.certPEM, l.keyPEM
+	return nil
+}
+
+func (bc *BackendConfig) resolveSecrets(files *[]string) error {
+	var err error
+	if bc.EgressProxy, err = resolveSecret(bc.EgressProxy, files); err != nil {
+		return fmt.Errorf("backend %s: egress_proxy: %w", bc.URL, err)
+	}
+	if bc.HealthAuth, err = resolveSecret(bc.HealthAuth, files); err != nil {
+		return fmt.Errorf("backend %s: health_auth: %w", bc.URL, err)
+	}
+	return nil
+}
+
+// read the certificate and key of a tls listener
+func (l *ListenerConfig) loadCertificate(files *[]string) error {
+	if !l.TLS() || l.TLSKey == "" {
+		// validateListeners complains about half set pairs
+		return nil
+	}
+	var err error
+	if l.certPEM, err = readPEM(l.TLSCert, files); err != nil {
+		return fmt.Errorf("listener %s: tls_cert: %w", l.Address, err)
+	}
+	if l.keyPEM, err = readPEM(l.TLSKey, files); err != nil {
+		return fmt.Errorf("listener %s: tls_key: %w", l.Address, err)
+	}
+	for i := range l.Certificates {
+		c := &l.Certificates[i]
+		if c.Cert == "" || c.Key == "" {
+			continue
+		}
+		if c.certPEM, err = readPEM(c.Cert, files); err != nil {
+			return fmt.Errorf("listener %s: certificates: %w", l.Address, err)
+		}
+		if c.keyPEM, err = readPEM(c.Key, files); err != nil {
+			return fmt.Errorf("listener %s: certificates: %w", l.Address, err)
+		}
+	}
+	if l.ClientCA != "" {
+		if l.clientCAPEM, err = readPEM(l.ClientCA, files); err != nil {
+			return fmt.Errorf("listener %s: client_ca: %w", l.Address, err)
+		}
+	}
+	return nil
+}
+
+func (l ListenerConfig) certificate() (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(l.certPEM, l.keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("listener %s: %w", l.Address, err)
+	}
+	return &cert, nil
+}
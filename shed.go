@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"runtime/metrics"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LoadSheddingConfig turns requests away by their priority while the load
+// balancer itself is overloaded, the least important first, so the rest is
+// still served instead of everything getting slow together
+type LoadSheddingConfig struct {
+	// how often the process is sampled
+	Interval time.Duration `yaml:"interval"`
+	// share of the cpus (GOMAXPROCS) the process may use, 0 to 1. Only
+	// measured on linux
+	MaxCPU float64 `yaml:"max_cpu,omitempty"`
+	// memory the go runtime may hold, in MiB
+	MaxMemoryMB   int `yaml:"max_memory_mb,omitempty"`
+	MaxGoroutines int `yaml:"max_goroutines,omitempty"`
+	// the first rule a request matches gives its priority, higher is more
+	// important. The highest priority is never turned away.
+	Priorities []PriorityRule `yaml:"priorities,omitempty"`
+	// priority of the requests no rule matches
+	DefaultPriority int `yaml:"default_priority"`
+}
+
+// PriorityRule gives the requests it matches a priority, matched like a
+// tag rule
+type PriorityRule struct {
+	Priority   int    `yaml:"priority"`
+	Header     string `yaml:"header,omitempty"`
+	Match      string `yaml:"match,omitempty"`
+	PathPrefix string `yaml:"path_prefix,omitempty"`
+	Method     string `yaml:"method,omitempty"`
+}
+
+// shedding is eased off once every signal is below this share of its max
+const shedRelax = 0.8
+
+func defaultLoadSheddingConfig() LoadSheddingConfig {
+	return LoadSheddingConfig{Interval: time.Second, DefaultPriority: 1}
+}
+
+func (c LoadSheddingConfig) Enabled() bool {
+	return c.MaxCPU > 0 || c.MaxMemoryMB > 0 || c.MaxGoroutines > 0
+}
+
+func (c LoadSheddingConfig) Validate() error {
+	switch {
+	case c.Interval <= 0:
+		return fmt.Errorf("load_shedding: interval must be positive")
+	case c.MaxCPU < 0 || c.MaxCPU > 1:
+		return fmt.Errorf("load_shedding: max_cpu must be between 0 and 1")
+	case c.MaxMemoryMB < 0 || c.MaxGoroutines < 0:
+		return fmt.Errorf("load_shedding: max_memory_mb and max_goroutines must not be negative")
+	case c.DefaultPriority < 0:
+		return fmt.Errorf("load_shedding: default_priority must not be negative")
+	}
+	if _, err := c.compile(); err != nil {
+		return fmt.Errorf("load_shedding: %w", err)
+	}
+	return nil
+}
+
+// sheddingRules are the priority rules as the listeners use them
+type sheddingRules struct {
+	rules      []*tagRule
+	priorities []int
+	// priority of the requests no rule matches
+	fallback int
+	// the highest priority, never turned away
+	top int
+	// the configured priorities, lowest first and each once
+	classes []int
+}
+
+func (c LoadSheddingConfig) compile() (*sheddingRules, error) {
+	s := &sheddingRules{fallback: c.DefaultPriority, top: c.DefaultPriority}
+	for _, p := range c.Priorities {
+		name := "priority " + strconv.Itoa(p.Priority)
+		if p.Priority < 0 {
+			return nil, fmt.Errorf("%s: must not be negative", name)
+		}
+		rule, err := compileMatch(name, "", p.Header, p.Match, p.PathPrefix, p.Method)
+		if err != nil {
+			return nil, err
+		}
+		s.rules = append(s.rules, rule)
+		s.priorities = append(s.priorities, p.Priority)
+		s.top = max(s.top, p.Priority)
+	}
+	s.classes = slices.Compact(slices.Sorted(slices.Values(append([]int{s.fallback}, s.priorities...))))
+	return s, nil
+}
+
+// the shed level that turns away the next priority, level while every
+// priority but the top is turned away already
+func (s *sheddingRules) raise(level int64) int64 {
+	for _, p := range s.classes[1:] {
+		if int64(p) > level {
+			return int64(p)
+		}
+	}
+	return level
+}
+
+// the shed level that lets the last priority turned away through again
+func (s *sheddingRules) lower(level int64) int64 {
+	next := int64(0)
+	for _, p := range s.classes[1:] {
+		if int64(p) < level {
+			next = int64(p)
+		}
+	}
+	return next
+}
+
+func (s *sheddingRules) priority(r *http.Request) int {
+	for i, rule := range s.rules {
+		if rule.matches(r) {
+			return s.priorities[i]
+		}
+	}
+	return s.fallback
+}
+
+var (
+	// requests below this priority are turned away, 0 while the load is
+	// normal
+	shedLevel atomic.Int64
+	// share of the cpus the process used in the last interval, float64 bits
+	processCPU atomic.Uint64
+	// priority -> requests turned away
+	requestsShed sync.Map
+)
+
+// check if the request is turned away to take load off the process
+func shedRequest(s *sheddingRules, r *http.Request) bool {
+	level := shedLevel.Load()
+	if level == 0 {
+		return false
+	}
+	p := s.priority(r)
+	if int64(p) >= level {
+		return false
+	}
+	n, _ := requestsShed.LoadOrStore(strconv.Itoa(p), new(atomic.Uint64))
+	n.(*atomic.Uint64).Add(1)
+	return true
+}
+
+// sample the process every interval and move the shed level: up to the next
+// configured priority for every interval the process is overloaded, back to
+// the one before once it is well below every max. Runs for the lifetime of
+// the process.
+func watchLoad(r *reloader) {
+	lastCPU, _ := processCPUTime()
+	last := time.Now()
+	for {
+		time.Sleep(r.Current().LoadShedding.Interval)
+		cfg := r.Current().LoadShedding
+		now := time.Now()
+		if cpu, ok := processCPUTime(); ok {
+			ratio := float64(cpu-lastCPU) / (float64(now.Sub(last)) * float64(runtime.GOMAXPROCS(0)))
+			processCPU.Store(math.Float64bits(ratio))
+			lastCPU = cpu
+		}
+		last = now
+		if !cfg.Enabled() {
+			shedLevel.Store(0)
+			continue
+		}
+
+		load, why := cfg.load()
+		level := shedLevel.Load()
+		shedding := activePools.Load().shedding
+		top := int64(shedding.top)
+		switch {
+		case load > 1 && level < top:
+			level = shedding.raise(level)
+			warnf("Load shedding: %s, turning away requests below priority %d\n", why, level)
+		case load < shedRelax && level > 0:
+			level = shedding.lower(level)
+			if level == 0 {
+				infof("Load shedding: load back to normal, no requests turned away\n")
+			} else {
+				infof("Load shedding: %s, turning away requests below priority %d\n", why, level)
+			}
+		case level > top:
+			// a reload took the higher priorities away
+			level = top
+		}
+		shedLevel.Store(level)
+	}
+}
+
+var memorySamples = []metrics.Sample{
+	{Name: "/memory/classes/total:bytes"},
+	{Name: "/memory/classes/heap/released:bytes"},
+}
+
+// the memory the go runtime holds, without what it gave back to the os
+func processMemory() uint64 {
+	samples := make([]metrics.Sample, len(memorySamples))
+	copy(samples, memorySamples)
+	metrics.Read(samples)
+	return samples[0].Value.Uint64() - samples[1].Value.Uint64()
+}
+
+// the highest share of its max a signal is at, with what it is
+func (c LoadSheddingConfig) load() (float64, string) {
+	var load float64
+	why := ""
+	check := func(ratio float64, detail string) {
+		if ratio > load {
+			load, why = ratio, detail
+		}
+	}
+	if c.MaxCPU > 0 {
+		cpu := math.Float64frombits(processCPU.Load())
+		check(cpu/c.MaxCPU, fmt.Sprintf("cpu %.0f%% (max %.0f%%)", 100*cpu, 100*c.MaxCPU))
+	}
+	if c.MaxMemoryMB > 0 {
+		mb := processMemory() >> 20
+		check(float64(mb)/float64(c.MaxMemoryMB), fmt.Sprintf("memory %d MiB (max %d MiB)", mb, c.MaxMemoryMB))
+	}
+	if c.MaxGoroutines > 0 {
+		n := runtime.NumGoroutine()
+		check(float64(n)/float64(c.MaxGoroutines), fmt.Sprintf("%d goroutines (max %d)", n, c.MaxGoroutines))
+	}
+	return load, why
+}
+
+func writeSheddingMetrics(w io.Writer) {
+	writeMetricHeader(w, "lb_process_cpu_ratio", "gauge", "Share of the cpus the load balancer used over the last load shedding interval, linux only.")
+	fmt.Fprintf(w, "lb_process_cpu_ratio %g\n", math.Float64frombits(processCPU.Load()))
+	writeMetricHeader(w, "lb_load_shedding_level", "gauge", "Requests below this priority are turned away, 0 while the load is normal.")
+	fmt.Fprintf(w, "lb_load_shedding_level %d\n", shedLevel.Load())
+	writeMetricHeader(w, "lb_requests_shed_total", "counter", "Requests answered 503 by load shedding, by their priority.")
+	shedding := activePools.Load().shedding
+	for _, p := range shedding.classes {
+		if p < shedding.top {
+			fmt.Fprintf(w, "lb_requests_shed_total{priority=\"%d\"} %d\n", p, loadCount(&requestsShed, strconv.Itoa(p)))
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// requestHistory is what happened to a request on its way through the
+// backends, kept for the requests of routes with a slow_threshold so a slow
+// one can say where its time went
+type requestHistory struct {
+	mu       sync.Mutex
+	attempts []attemptRecord
+}
+
+type attemptRecord struct {
+	Backend string
+	// 0 when the attempt got no response
+	Status   int
+	Error    string
+	Duration time.Duration
+}
+
+func (a attemptRecord) String() string {
+	outcome := fmt.Sprint(a.Status)
+	if a.Status == 0 {
+		outcome = a.Error
+	}
+	return fmt.Sprintf("%s %s in %s", a.Backend, outcome, a.Duration.Round(time.Microsecond))
+}
+
+func withHistory(r *http.Request) (*http.Request, *requestHistory) {
+	h := &requestHistory{}
+	return r.WithContext(context.WithValue(r.Context(), History, h)), h
+}
+
+// note an attempt on a backend, if the request keeps a history
+func recordAttempt(req *http.Request, backend string, d time.Duration, resp *http.Response, err error) {
+	h, ok := req.Context().Value(History).(*requestHistory)
+	if !ok {
+		return
+	}
+	a := attemptRecord{Backend: backend, Duration: d}
+	if err != nil {
+		a.Error = err.Error()
+	} else {
+		a.Status = resp.StatusCode
+	}
+	h.mu.Lock()
+	h.attempts = append(h.attempts, a)
+	h.mu.Unlock()
+}
+
+// slow requests by route ("pool route" -> *atomic.Uint64)
+var slowRequests sync.Map
+
+// log and count the request if it took longer than the threshold of its
+// route
+func checkSlow(r *http.Request, route *Route, h *requestHistory, status int, took time.Duration) {
+	if took < route.SlowThreshold {
+		return
+	}
+	if status == 0 {
+		status = http.StatusOK
+	}
+	n, _ := slowRequests.LoadOrStore(route.Pool+" "+route.Name, new(atomic.Uint64))
+	n.(*atomic.Uint64).Add(1)
+
+	h.mu.Lock()
+	attempts := make([]string, len(h.attempts))
+	for i, a := range h.attempts {
+		attempts[i] = a.String()
+	}
+	h.mu.Unlock()
+	history := strings.Join(attempts, ", ")
+	if history == "" {
+		history = "none"
+	}
+	warnw(requestFields(r, "status", status, "duration_ms", float64(took.Microseconds())/1000, "attempts", attempts),
+		"%s(%s)%s Slow request: %d after %s (over %s), attempts: %s\n",
+		r.RemoteAddr, r.URL.Path, logRequest(r), status, took.Round(time.Millisecond), route.SlowThreshold, history)
+}
+
+func writeSlowMetrics(w io.Writer) {
+	counts := make(map[string]uint64)
+	slowRequests.Range(func(k, v any) bool {
+		counts[k.(string)] = v.(*atomic.Uint64).Load()
+		return true
+	})
+	writeMetricHeader(w, "lb_slow_requests_total", "counter", "Requests that took longer than the slow_threshold of their route.")
+	for _, key := range sortedKeys(counts) {
+		pool, route, _ := strings.Cut(key, " ")
+		fmt.Fprintf(w, "lb_slow_requests_total{pool=%q,route=%q} %d\n", pool, route, counts[key])
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// poolSnapshot is the composition and health of every pool at one time
+type poolSnapshot struct {
+	Time     time.Time
+	backends map[string]snapshotBackend
+}
+
+type snapshotBackend struct {
+	Pool    string `json:"pool"`
+	Backend string `json:"backend"`
+	Alive   bool   `json:"alive"`
+	Status  string `json:"status"`
+	Weight  int    `json:"weight"`
+}
+
+// the snapshots taken, oldest first. Only snapshots that differ from the one
+// before are kept, so the one at a time is the last one taken before it.
+type snapshotLog struct {
+	mu        sync.Mutex
+	snapshots []poolSnapshot
+}
+
+var poolSnapshots snapshotLog
+
+func takeSnapshot(now time.Time) poolSnapshot {
+	snap := poolSnapshot{Time: now, backends: make(map[string]snapshotBackend)}
+	for _, pool := range activePools.Load().All() {
+		for _, b := range pool.backends {
+			snap.backends[pool.name+" "+b.URL.String()] = snapshotBackend{
+				Pool:    pool.name,
+				Backend: b.URL.String(),
+				Alive:   b.IsAlive(),
+				Status:  b.Status(),
+				Weight:  b.Weight(),
+			}
+		}
+	}
+	return snap
+}
+
+func (l *snapshotLog) Add(snap poolSnapshot, retention time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n := len(l.snapshots); n > 0 && len(snapshotChanges(l.snapshots[n-1], snap)) == 0 {
+		return
+	}
+	l.snapshots = append(l.snapshots, snap)
+
+	// keep the last snapshot before the cutoff, it is the state at the cutoff
+	cutoff := snap.Time.Add(-retention)
+	drop := 0
+	for drop+1 < len(l.snapshots) && !l.snapshots[drop+1].Time.After(cutoff) {
+		drop++
+	}
+	if drop > 0 {
+		l.snapshots = append([]poolSnapshot(nil), l.snapshots[drop:]...)
+	}
+}
+
+// the snapshot in effect at t and the index of the next one. Before the
+// first snapshot that is the first one, false when there are none.
+func (l *snapshotLog) at(t time.Time) (poolSnapshot, int, bool) {
+	if len(l.snapshots) == 0 {
+		return poolSnapshot{}, 0, false
+	}
+	i := sort.Search(len(l.snapshots), func(i int) bool { return l.snapshots[i].Time.After(t) })
+	if i == 0 {
+		return l.snapshots[0], 1, true
+	}
+	return l.snapshots[i-1], i, true
+}
+
+// take a snapshot every admin.snapshot_interval, for the lifetime of the
+// process
+func snapshotPools(r *reloader) {
+	for {
+		cfg := r.Current()
+		if cfg.Admin.Enabled {
+			poolSnapshots.Add(takeSnapshot(time.Now()), cfg.Admin.SnapshotRetention)
+		}
+		time.Sleep(cfg.Admin.SnapshotInterval)
+	}
+}
+
+type snapshotChange struct {
+	Pool    string `json:"pool"`
+	Backend string `json:"backend"`
+	Change  string `json:"change"`
+}
+
+// a change and the snapshot it was seen in
+type snapshotEvent struct {
+	Time time.Time `json:"time"`
+	snapshotChange
+}
+
+// what is different in to compared to from
+func snapshotChanges(from, to poolSnapshot) []snapshotChange {
+	var changes []snapshotChange
+	add := func(b snapshotBackend, format string, args ...interface{}) {
+		changes = append(changes, snapshotChange{Pool: b.Pool, Backend: b.Backend, Change: fmt.Sprintf(format, args...)})
+	}
+	for key, b := range to.backends {
+		prev, ok := from.backends[key]
+		if !ok {
+			add(b, "added")
+			continue
+		}
+		if prev.Alive != b.Alive {
+			add(b, "%s -> %s", healthWord(prev.Alive), healthWord(b.Alive))
+		}
+		if prev.Status != b.Status {
+			add(b, "%s -> %s", prev.Status, b.Status)
+		}
+		if prev.Weight != b.Weight {
+			add(b, "weight %d -> %d", prev.Weight, b.Weight)
+		}
+	}
+	for key, b := range from.backends {
+		if _, ok := to.backends[key]; !ok {
+			add(b, "removed")
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Pool != changes[j].Pool {
+			return changes[i].Pool < changes[j].Pool
+		}
+		return changes[i].Backend < changes[j].Backend
+	})
+	return changes
+}
+
+func healthWord(alive bool) string {
+	if alive {
+		return "up"
+	}
+	return "down"
+}
+
+// a time for the snapshot api: RFC 3339, or 15:04 / 15:04:05 for today in
+// local time, or now
+func parseSnapshotTime(s string, now time.Time) (time.Time, error) {
+	if s == "" || s == "now" {
+		return now, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"15:04", "15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, now.Location()); err == nil {
+			y, m, d := now.Date()
+			return time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), 0, now.Location()), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, use RFC 3339, 15:04 or 15:04:05", s)
+}
+
+// GET /admin/snapshots, when the pools changed
+func handleSnapshots(w http.ResponseWriter, req *http.Request) {
+	type snapshotJSON struct {
+		Time     time.Time `json:"time"`
+		Backends int       `json:"backends"`
+		Alive    int       `json:"alive"`
+	}
+	poolSnapshots.mu.Lock()
+	list := make([]snapshotJSON, 0, len(poolSnapshots.snapshots))
+	for _, snap := range poolSnapshots.snapshots {
+		alive := 0
+		for _, b := range snap.backends {
+			if b.Alive {
+				alive++
+			}
+		}
+		list = append(list, snapshotJSON{snap.Time, len(snap.backends), alive})
+	}
+	poolSnapshots.mu.Unlock()
+	writeJSON(w, http.StatusOK, list)
+}
+
+// GET /admin/snapshots/diff?from=14:00&to=14:10, the pools at both times,
+// what is different between them and every change seen in between
+func handleSnapshotDiff(w http.ResponseWriter, req *http.Request) {
+	now := time.Now()
+	from, err := parseSnapshotTime(req.URL.Query().Get("from"), now)
+	if err == nil && req.URL.Query().Get("from") == "" {
+		err = fmt.Errorf("from is required")
+	}
+	var to time.Time
+	if err == nil {
+		to, err = parseSnapshotTime(req.URL.Query().Get("to"), now)
+	}
+	if err == nil && to.Before(from) {
+		err = fmt.Errorf("to is before from")
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	poolSnapshots.mu.Lock()
+	defer poolSnapshots.mu.Unlock()
+	start, next, ok := poolSnapshots.at(from)
+	if !ok {
+		writeError(w, http.StatusNotFound, "no snapshots yet")
+		return
+	}
+	end, _, _ := poolSnapshots.at(to)
+
+	events := []snapshotEvent{}
+	prev := start
+	for _, snap := range poolSnapshots.snapshots[next:] {
+		if snap.Time.After(to) {
+			break
+		}
+		for _, c := range snapshotChanges(prev, snap) {
+			events = append(events, snapshotEvent{snap.Time, c})
+		}
+		prev = snap
+	}
+	changes := snapshotChanges(start, end)
+	if changes == nil {
+		changes = []snapshotChange{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"from":    snapshotSummary(from, start),
+		"to":      snapshotSummary(to, end),
+		"changes": changes,
+		"events":  events,
+	})
+}
+
+func snapshotSummary(t time.Time, snap poolSnapshot) map[string]interface{} {
+	keys := make([]string, 0, len(snap.backends))
+	for key := range snap.backends {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	backends := make([]string, 0, len(keys))
+	for _, key := range keys {
+		b := snap.backends[key]
+		state := healthWord(b.Alive)
+		if b.Status != "active" {
+			state += ", " + b.Status
+		}
+		backends = append(backends, fmt.Sprintf("%s %s (%s)", b.Pool, b.Backend, state))
+	}
+	return map[string]interface{}{
+		"time":          t,
+		"snapshot_time": snap.Time,
+		"backends":      backends,
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// CertConfig is one more certificate of a tls listener, for the domains its
+// main certificate doesnt cover. The client picks one by the name it sends
+// in the handshake (SNI).
+type CertConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+
+	// contents of the cert and key, read when the config is loaded
+	certPEM, keyPEM []byte
+}
+
+// the certificates of a tls listener, the main one first
+func (l ListenerConfig) certificates() ([]*tls.Certificate, error) {
+	main, err := l.certificate()
+	if err != nil {
+		return nil, err
+	}
+	certs := []*tls.Certificate{main}
+	for _, c := range l.Certificates {
+		cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: certificate %s: %w", l.Address, c.Cert, err)
+		}
+		certs = append(certs, &cert)
+	}
+	return certs, nil
+}
+
+// whether the certificates of two versions of a listener differ
+func (l ListenerConfig) certificatesChanged(o ListenerConfig) bool {
+	if !bytes.Equal(l.certPEM, o.certPEM) || !bytes.Equal(l.keyPEM, o.keyPEM) || len(l.Certificates) != len(o.Certificates) {
+		return true
+	}
+	for i, c := range l.Certificates {
+		if !bytes.Equal(c.certPEM, o.Certificates[i].certPEM) || !bytes.Equal(c.keyPEM, o.Certificates[i].keyPEM) {
+			return true
+		}
+	}
+	return false
+}
+
+// the certificate for a handshake: the first one valid for the name the
+// client asks for, or the main one when none is (or no name is sent)
+func pickCertificate(certs []*tls.Certificate, hello *tls.ClientHelloInfo) *tls.Certificate {
+	if hello.ServerName != "" {
+		for _, cert := range certs {
+			if hello.SupportsCertificate(cert) == nil {
+				return cert
+			}
+		}
+	}
+	return certs[0]
+}
+
+// the host name a request is routed by: the Host header without the port,
+// or the SNI name when there is no Host. Browsers send the same name in both,
+// and a http/2 connection reused for another domain of the certificate keeps
+// its first SNI, so the header is the one to trust.
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "" {
+		if state := connectionState(r); state != nil {
+			host = state.ServerName
+		}
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// whether a route host matches a request host. "*.example.com" matches
+// "api.example.com" but not "example.com" or "a.b.example.com", like a
+// wildcard certificate.
+func hostMatches(pattern, host string) bool {
+	if pattern == "" || pattern == host {
+		return true
+	}
+	suffix, ok := strings.CutPrefix(pattern, "*")
+	if !ok || !strings.HasSuffix(host, suffix) {
+		return false
+	}
+	label := strings.TrimSuffix(host, suffix)
+	return label != "" && !strings.Contains(label, ".")
+}
+
+func validateRouteHost(host string) error {
+	if host != strings.ToLower(host) {
+		return fmt.Errorf("host %q must be lower case", host)
+	}
+	name := strings.TrimPrefix(host, "*.")
+	if name == "" || strings.ContainsAny(name, "*:/ ") || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".") {
+		return fmt.Errorf("host %q must be a name like example.com or *.example.com", host)
+	}
+	return nil
+}
+
+// exact hosts before wildcards before routes for any host
+func hostRank(host string) int {
+	switch {
+	case host == "":
+		return 2
+	case strings.HasPrefix(host, "*."):
+		return 1
+	}
+	return 0
+}
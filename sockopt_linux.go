@@ -0,0 +1,23 @@
+package main
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// interface and tcp_user_timeout only work on linux
+const linuxSocketOptions = true
+
+func setSocketOptions(fd uintptr, iface string, userTimeout time.Duration) error {
+	if iface != "" {
+		// needs CAP_NET_RAW
+		if err := unix.BindToDevice(int(fd), iface); err != nil {
+			return err
+		}
+	}
+	if userTimeout > 0 {
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(userTimeout.Milliseconds()))
+	}
+	return nil
+}
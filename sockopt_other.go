@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import "time"
+
+// interface and tcp_user_timeout only work on linux
+const linuxSocketOptions = false
+
+func setSocketOptions(fd uintptr, iface string, userTimeout time.Duration) error {
+	return nil
+}
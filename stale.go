@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// limits of the responses kept for serve-stale
+const (
+	maxStaleBody      = 1 << 20
+	maxStaleResponses = 1000
+)
+
+// the last good response of a url, for the serve-stale action
+type staleResponse struct {
+	status int
+	header http.Header
+	body   []byte
+	stored time.Time
+}
+
+// route name + host + request uri -> *staleResponse. Once it is full only
+// the urls already in it are updated.
+var (
+	staleResponses sync.Map
+	staleCount     atomic.Int64
+)
+
+func staleKey(route *Route, r *http.Request) string {
+	return route.Name + " " + r.Host + r.URL.RequestURI()
+}
+
+// keep the response to resp.Request once its body is read, if the route can
+// serve it stale and it is fit for that: a 200 to a GET, not private
+func recordStale(resp *http.Response) {
+	route := GetRouteFromContext(resp.Request)
+	if !route.RetryMatrix.servesStale() || isStreaming(resp) || resp.Request.Method != http.MethodGet || resp.StatusCode != http.StatusOK ||
+		resp.ContentLength > maxStaleBody || resp.Header.Get("Set-Cookie") != "" {
+		return
+	}
+	cc := strings.ToLower(resp.Header.Get("Cache-Control"))
+	if strings.Contains(cc, "no-store") || strings.Contains(cc, "private") {
+		return
+	}
+	key := staleKey(route, resp.Request)
+	if _, ok := staleResponses.Load(key); !ok && staleCount.Load() >= maxStaleResponses {
+		return
+	}
+	resp.Body = &staleRecorder{ReadCloser: resp.Body, key: key, status: resp.StatusCode, header: resp.Header.Clone()}
+}
+
+// staleRecorder copies the body while the proxy reads it, and stores the
+// response when the body was read to the end
+type staleRecorder struct {
+	io.ReadCloser
+	key    string
+	status int
+	header http.Header
+	buf    bytes.Buffer
+	// body too large
+	skip bool
+}
+
+func (s *staleRecorder) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	if !s.skip {
+		if s.buf.Len()+n > maxStaleBody {
+			s.skip = true
+			s.buf = bytes.Buffer{}
+		} else {
+			s.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !s.skip {
+		stale := &staleResponse{status: s.status, header: s.header, body: s.buf.Bytes(), stored: time.Now()}
+		if _, loaded := staleResponses.Swap(s.key, stale); !loaded {
+			staleCount.Add(1)
+		}
+		s.skip = true
+	}
+	return n, err
+}
+
+// answer with the stale response of the request, false if there is none
+func serveStale(w http.ResponseWriter, r *http.Request, route *Route) bool {
+	v, ok := staleResponses.Load(staleKey(route, r))
+	if !ok {
+		return false
+	}
+	stale := v.(*staleResponse)
+	for k, values := range stale.header {
+		w.Header()[k] = append([]string(nil), values...)
+	}
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(stale.stored).Seconds())))
+	w.Header().Add("Warning", `110 - "Response is Stale"`)
+	w.Header().Set("Content-Length", strconv.Itoa(len(stale.body)))
+	w.WriteHeader(stale.status)
+	w.Write(stale.body)
+	return true
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatsDConfig pushes the metrics to a statsd server or a datadog agent, for
+// setups that cant scrape /metrics. It sends the same metrics as the
+// prometheus endpoint.
+type StatsDConfig struct {
+	// host:port of the statsd server or the agent, empty disables it
+	Address string `yaml:"address,omitempty"`
+	// dogstatsd (the default) sends the labels as tags, statsd has no tags
+	// and puts the label values into the metric name
+	Format string `yaml:"format,omitempty"`
+	// put before every metric name, like "edge."
+	Prefix string `yaml:"prefix,omitempty"`
+	// tags of every metric, like env:prod. Only dogstatsd has tags.
+	Tags     []string      `yaml:"tags,omitempty"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+func (s StatsDConfig) Validate() error {
+	if s.Format != "" && s.Format != "statsd" && s.Format != "dogstatsd" {
+		return fmt.Errorf("statsd: format must be statsd or dogstatsd")
+	}
+	// checked without an address too, the push loop waits for it
+	if s.Interval <= 0 {
+		return fmt.Errorf("statsd: interval must be positive")
+	}
+	if s.Address == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(s.Address); err != nil {
+		return fmt.Errorf("statsd: address: %w", err)
+	}
+	if s.Format == "statsd" && len(s.Tags) > 0 {
+		return fmt.Errorf("statsd: tags need the dogstatsd format")
+	}
+	return nil
+}
+
+// the largest udp packet, below the usual mtu so nothing is fragmented
+const statsdPacketSize = 1432
+
+// push the metrics every statsd.interval, for the lifetime of the process
+func exportStatsD(r *reloader) {
+	var last StatsDConfig
+	var conn net.Conn
+	// counter values at the last push, statsd wants the increments. Kept
+	// over reloads, the counters dont start over either.
+	sent := make(map[string]float64)
+	for {
+		s := r.Current().StatsD
+		if !reflect.DeepEqual(s, last) {
+			if conn != nil {
+				conn.Close()
+				conn = nil
+			}
+			last = s
+		}
+		if s.Address == "" {
+			time.Sleep(s.Interval)
+			continue
+		}
+		if conn == nil {
+			var err error
+			if conn, err = net.Dial("udp", s.Address); err != nil {
+				warnf("Statsd: %s\n", err)
+				time.Sleep(s.Interval)
+				continue
+			}
+		}
+
+		var metrics bytes.Buffer
+		writeMetrics(&metrics)
+		var packet bytes.Buffer
+		for _, line := range statsdLines(s, metrics.String(), sent) {
+			if packet.Len() > 0 && packet.Len()+1+len(line) > statsdPacketSize {
+				if _, err := conn.Write(packet.Bytes()); err != nil {
+					debugf("Statsd: %s\n", err)
+				}
+				packet.Reset()
+			}
+			if packet.Len() > 0 {
+				packet.WriteByte('\n')
+			}
+			packet.WriteString(line)
+		}
+		if packet.Len() > 0 {
+			if _, err := conn.Write(packet.Bytes()); err != nil {
+				debugf("Statsd: %s\n", err)
+			}
+		}
+		time.Sleep(s.Interval)
+	}
+}
+
+// the statsd lines of metrics in the prometheus text format. Gauges are
+// sent as they are, counters as the increment since sent (updated), and of
+// a histogram the sum and the count, as counters.
+func statsdLines(s StatsDConfig, metrics string, sent map[string]float64) []string {
+	types := make(map[string]string)
+	var lines []string
+	for _, line := range strings.Split(metrics, "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			if f := strings.Fields(line); len(f) == 4 {
+				types[f[2]] = f[3]
+			}
+			continue
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		name, labels, value, ok := parseMetricLine(line)
+		if !ok {
+			continue
+		}
+
+		typ, isType := types[name]
+		if !isType {
+			base := strings.TrimSuffix(strings.TrimSuffix(name, "_sum"), "_count")
+			if types[base] != "histogram" {
+				continue
+			}
+			typ = "counter"
+		}
+		kind := "g"
+		switch typ {
+		case "histogram":
+			// the buckets, statsd has no use for them
+			continue
+		case "counter":
+			kind = "c"
+			key := name + "{" + fmt.Sprint(labels) + "}"
+			increment := value - sent[key]
+			if increment < 0 {
+				increment = value
+			}
+			sent[key] = value
+			if increment == 0 {
+				continue
+			}
+			value = increment
+		}
+		lines = append(lines, s.line(name, labels, value, kind))
+	}
+	return lines
+}
+
+func (s StatsDConfig) line(name string, labels [][2]string, value float64, kind string) string {
+	var b strings.Builder
+	b.WriteString(s.Prefix)
+	b.WriteString(name)
+	if s.Format == "statsd" {
+		for _, l := range labels {
+			b.WriteByte('.')
+			b.WriteString(statsdSafe(l[1], ":|@#,./ \n"))
+		}
+	}
+	b.WriteByte(':')
+	b.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+	b.WriteByte('|')
+	b.WriteString(kind)
+	if s.Format != "statsd" && len(labels)+len(s.Tags) > 0 {
+		b.WriteString("|#")
+		tags := append([]string(nil), s.Tags...)
+		for _, l := range labels {
+			tags = append(tags, l[0]+":"+statsdSafe(l[1], "|#,\n"))
+		}
+		b.WriteString(strings.Join(tags, ","))
+	}
+	return b.String()
+}
+
+// replace the characters that would break the line
+func statsdSafe(v, bad string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(bad, r) {
+			return '_'
+		}
+		return r
+	}, v)
+}
+
+// name, labels and value of a sample line like name{a="x",b="y"} 1.5
+func parseMetricLine(line string) (name string, labels [][2]string, value float64, ok bool) {
+	i := strings.IndexAny(line, "{ ")
+	if i < 0 {
+		return
+	}
+	name, rest := line[:i], line[i:]
+	if strings.HasPrefix(rest, "{") {
+		rest = rest[1:]
+		for !strings.HasPrefix(rest, "}") {
+			eq := strings.Index(rest, "=")
+			if eq < 0 {
+				return
+			}
+			key := rest[:eq]
+			quoted, err := strconv.QuotedPrefix(rest[eq+1:])
+			if err != nil {
+				return
+			}
+			v, _ := strconv.Unquote(quoted)
+			labels = append(labels, [2]string{key, v})
+			rest = strings.TrimPrefix(rest[eq+1+len(quoted):], ",")
+		}
+		rest = rest[1:]
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(rest), 64)
+	return name, labels, value, err == nil
+}
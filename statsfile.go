@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// StatsFileConfig writes the counters and the state of the backends to a
+// file every interval, so a crashed instance leaves some numbers behind
+// even where no metrics are collected
+type StatsFileConfig struct {
+	// empty disables it
+	Path     string        `yaml:"path,omitempty"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+func (s StatsFileConfig) Validate() error {
+	if s.Interval < time.Second {
+		return fmt.Errorf("stats_file: interval must be at least 1s")
+	}
+	return nil
+}
+
+// when the process started, for the uptime in the stats file
+var processStarted = time.Now()
+
+type statsFileJSON struct {
+	Time     time.Time           `json:"time"`
+	PID      int                 `json:"pid"`
+	Uptime   string              `json:"uptime"`
+	Backends []backendStatusJSON `json:"backends"`
+	Errors   []errorEntry        `json:"errors"`
+	// every counter and gauge of /admin/metrics, without the histogram
+	// buckets
+	Metrics []statsFileMetric `json:"metrics"`
+}
+
+type statsFileMetric struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+}
+
+func takeStats(now time.Time) statsFileJSON {
+	stats := statsFileJSON{
+		Time:     now,
+		PID:      os.Getpid(),
+		Uptime:   now.Sub(processStarted).Round(time.Second).String(),
+		Backends: backendStatuses(),
+		Errors:   recentErrors.Recent(),
+		Metrics:  []statsFileMetric{},
+	}
+
+	var metrics bytes.Buffer
+	writeMetrics(&metrics)
+	for _, line := range strings.Split(metrics.String(), "\n") {
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		name, labels, value, ok := parseMetricLine(line)
+		if !ok || strings.HasSuffix(name, "_bucket") {
+			continue
+		}
+		m := statsFileMetric{Name: name, Value: value}
+		for _, l := range labels {
+			if m.Labels == nil {
+				m.Labels = make(map[string]string)
+			}
+			m.Labels[l[0]] = l[1]
+		}
+		stats.Metrics = append(stats.Metrics, m)
+	}
+	return stats
+}
+
+// replace the file with the stats, through a temporary file next to it so
+// a crash while writing leaves the previous stats in place
+func writeStatsFile(path string, stats statsFileJSON) error {
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// write the stats every stats_file.interval, for the lifetime of the process
+func exportStatsFile(r *reloader) {
+	for {
+		s := r.Current().StatsFile
+		time.Sleep(s.Interval)
+		s = r.Current().StatsFile
+		if s.Path == "" {
+			continue
+		}
+		if err := writeStatsFile(s.Path, takeStats(time.Now())); err != nil {
+			warnf("Writing the stats to %s failed: %s\n", s.Path, err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"syscall"
+	"time"
+)
+
+// built in reset storm settings, used when the backend config leaves them at 0
+const (
+	defaultResetThreshold = 20
+	defaultResetWindow    = time.Second
+	defaultResetCooldown  = 5 * time.Second
+)
+
+// errors a backend gives while it restarts: the listener is gone (refused)
+// or open connections are dropped (reset / eof)
+func isConnReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func (b *Backend) resetSettings() (threshold int, window, cooldown time.Duration) {
+	threshold, window, cooldown = b.config.ResetThreshold, b.config.ResetWindow, b.config.ResetCooldown
+	if threshold == 0 {
+		threshold = defaultResetThreshold
+	}
+	if window == 0 {
+		window = defaultResetWindow
+	}
+	if cooldown == 0 {
+		cooldown = defaultResetCooldown
+	}
+	return
+}
+
+// count a connection reset. When too many pile up within the window the
+// backend is paused for the cooldown, it is probably restarting and
+// retrying against it would only make thousands of doomed attempts.
+func (b *Backend) recordReset() {
+	threshold, window, cooldown := b.resetSettings()
+	if threshold < 0 {
+		// disabled
+		return
+	}
+
+	now := time.Now()
+	b.mux.Lock()
+	if now.Sub(b.resetWindowStart) > window {
+		b.resetWindowStart = now
+		b.resetCount = 0
+	}
+	b.resetCount++
+	paused := b.resetCount >= threshold && now.After(b.pausedUntil)
+	if paused {
+		b.pausedUntil = now.Add(cooldown)
+		b.resetCount = 0
+	}
+	b.mux.Unlock()
+
+	if paused {
+		warnf("%s: %d connection resets within %s, pausing traffic for %s\n", b.URL, threshold, window, cooldown)
+	}
+}
+
+// check if the backend is in a reset storm cooldown
+func (b *Backend) Paused() bool {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return time.Now().Before(b.pausedUntil)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"gopkg.in/yaml.v3"
+)
+
+// strategies set per pool through the admin api. They win over the config
+// until they are cleared or the process restarts, reloads keep them.
+var poolStrategies sync.Map
+
+// the strategy a pool balances with, the one set through the admin api or
+// else the one of the config
+func (s *ServerPool) Strategy() string {
+	if v, ok := poolStrategies.Load(s.name); ok {
+		return v.(string)
+	}
+	return s.strategy
+}
+
+// the next active peer by least-conn: the available backend with the fewest
+// requests in flight for its weight. Ties go round robin, so an idle pool
+// still spreads its requests.
+func (s *ServerPool) leastConnPeer() *Backend {
+	panicking := s.Panicking()
+	start := int(atomic.AddUint64(&s.current, 1) % uint64(len(s.backends)))
+	var best *Backend
+	for i := range s.backends {
+		b := s.backends[(start+i)%len(s.backends)]
+		if !b.Available() && !(panicking && b.AvailableIgnoringHealth()) {
+			continue
+		}
+		// a/wa < b/wb without dividing
+		if best == nil || b.inFlight.Load()*int64(best.Weight()) < best.inFlight.Load()*int64(b.Weight()) {
+			best = b
+		}
+	}
+	return best
+}
+
+type strategyJSON struct {
+	Pool     string `json:"pool"`
+	Strategy string `json:"strategy"`
+	// the strategy of the config, used again once the one set through the
+	// admin api is cleared
+	Configured string `json:"configured"`
+}
+
+func newStrategyJSON(pool *ServerPool) strategyJSON {
+	return strategyJSON{Pool: pool.name, Strategy: pool.Strategy(), Configured: pool.strategy}
+}
+
+// GET /admin/pools/{name}/strategy
+func handleGetStrategy(w http.ResponseWriter, req *http.Request) {
+	pool := activePools.Load().Get(req.PathValue("name"))
+	if pool == nil {
+		writeError(w, http.StatusNotFound, "no pool "+req.PathValue("name"))
+		return
+	}
+	writeJSON(w, http.StatusOK, newStrategyJSON(pool))
+}
+
+// PUT /admin/pools/{name}/strategy with {"strategy": "least-conn"} switches
+// the strategy of a pool from the next request on, DELETE goes back to the
+// one of the config
+func handleSetStrategy(w http.ResponseWriter, req *http.Request) {
+	pool := activePools.Load().Get(req.PathValue("name"))
+	if pool == nil {
+		writeError(w, http.StatusNotFound, "no pool "+req.PathValue("name"))
+		return
+	}
+	if req.Method == http.MethodDelete {
+		if _, ok := poolStrategies.LoadAndDelete(pool.name); ok {
+			infof("Admin: pool %s back to the strategy of the config, %s\n", pool.name, pool.strategy)
+		}
+		writeJSON(w, http.StatusOK, newStrategyJSON(pool))
+		return
+	}
+
+	var body struct {
+		Strategy string `yaml:"strategy"`
+	}
+	data, err := io.ReadAll(io.LimitReader(req.Body, 1<<20))
+	if err == nil {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&body)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !validStrategies[body.Strategy] {
+		writeError(w, http.StatusBadRequest, "unknown strategy "+body.Strategy)
+		return
+	}
+	if old := pool.Strategy(); old != body.Strategy {
+		infof("Admin: pool %s strategy %s -> %s\n", pool.name, old, body.Strategy)
+	}
+	poolStrategies.Store(pool.name, body.Strategy)
+	writeJSON(w, http.StatusOK, newStrategyJSON(pool))
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// the proxy sends what it has of a response body to the client at least this
+// often, so a backend writing slowly isnt held up in the buffers. Server-Sent
+// Events and responses without a length (chunked) are flushed after every
+// write anyway, the reverse proxy knows them as streams.
+const proxyFlushInterval = 100 * time.Millisecond
+
+// whether a response is a stream: one of a route with streaming, or
+// Server-Sent Events. Streams are passed on as they come, never read whole
+// for a body transform or the stale copy.
+func isStreaming(resp *http.Response) bool {
+	return GetRouteFromContext(resp.Request).Streaming || mediaType(resp.Header) == "text/event-stream"
+}
+
+// flushWriter sends every write to the client right away, for the
+// responses of a streaming route whatever their content type
+type flushWriter struct {
+	http.ResponseWriter
+}
+
+func (w *flushWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	if err == nil {
+		err = http.NewResponseController(w.ResponseWriter).Flush()
+	}
+	return n, err
+}
+
+// for http.ResponseController, so upgrades still work
+func (w *flushWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
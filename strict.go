@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Strict parsing checks the raw bytes of every http/1 request on a listener
+// and rejects the ones that different servers could read differently, the
+// building blocks of request smuggling:
+//
+//   - line endings other than CRLF (bare LF or CR)
+//   - obs-fold, header lines continued on the next line
+//   - whitespace before the colon, invalid header names or values
+//   - Content-Length together with Transfer-Encoding, several or invalid
+//     Content-Length values, any Transfer-Encoding but "chunked"
+//   - invalid chunk sizes and chunk extensions
+//
+// The net/http parser is lenient about some of these, so the connection is
+// wrapped and the bytes are checked as the server reads them. A request with
+// a problem gets 400 and the connection is closed.
+
+// longest request head or chunk line checked
+const maxStrictLine = 1 << 20
+
+type strictListener struct {
+	net.Listener
+}
+
+func (l strictListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &strictConn{Conn: c}, nil
+}
+
+// strictConn checks the requests read from it. There is one verdict per
+// request head, in order, and the handler takes them one by one.
+type strictConn struct {
+	net.Conn
+
+	mu       sync.Mutex
+	parser   requestFramer
+	verdicts []error
+	// first problem seen, every request after it is rejected too
+	err error
+}
+
+func (c *strictConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.mu.Lock()
+		if c.err == nil {
+			c.parser.feed(p[:n], c.verdict)
+		}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// called by the parser (with mu held) for every request head and problem
+func (c *strictConn) verdict(err error, head bool) {
+	if c.err == nil && err != nil {
+		c.err = err
+	}
+	if head {
+		c.verdicts = append(c.verdicts, c.err)
+	}
+}
+
+// the verdict for the next request the server hands to the handler
+func (c *strictConn) next() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.verdicts) == 0 {
+		return c.err
+	}
+	err := c.verdicts[0]
+	c.verdicts = c.verdicts[1:]
+	return err
+}
+
+// problems seen so far, including the body of the current request
+func (c *strictConn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// the server only fills r.TLS for a *tls.Conn, so it is done by hand
+func (c *strictConn) tlsState() *tls.ConnectionState {
+	if tc, ok := c.Conn.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		return &state
+	}
+	return nil
+}
+
+// reject requests the strict parser found a problem with. Chunked bodies are
+// read in full first, so a bad chunk is caught before anything reaches a
+// backend.
+func strictHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sc, _ := r.Context().Value(StrictConn).(*strictConn)
+		if sc == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.TLS == nil {
+			r.TLS = sc.tlsState()
+		}
+		if err := sc.next(); err != nil {
+			rejectStrict(w, r, err)
+			return
+		}
+		if len(r.TransferEncoding) > 0 {
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxTransformBody+1))
+			if err == nil && len(body) > maxTransformBody {
+				w.Header().Set("Connection", "close")
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err == nil {
+				err = sc.Err()
+			}
+			if err != nil {
+				rejectStrict(w, r, err)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+			r.TransferEncoding = nil
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func rejectStrict(w http.ResponseWriter, r *http.Request, err error) {
+	infow(requestFields(r, "status", http.StatusBadRequest, "error", err.Error()), "%s: request rejected by strict parsing: %s\n", r.RemoteAddr, err)
+	w.Header().Set("Connection", "close")
+	http.Error(w, "Bad Request", http.StatusBadRequest)
+}
+
+type framerState int
+
+const (
+	inHead framerState = iota
+	inBody
+	inChunkSize
+	inChunkData
+	inChunkEnd
+	inTrailer
+)
+
+// requestFramer follows the http/1 framing of a request stream: heads,
+// Content-Length bodies and chunked bodies
+type requestFramer struct {
+	state framerState
+	line  []byte
+	// lines of the head being read
+	head [][]byte
+	// body bytes left to skip
+	remaining int64
+}
+
+var (
+	errBareLF  = errors.New("line not ending in CRLF")
+	errBareCR  = errors.New("CR not followed by LF")
+	errObsFold = errors.New("obs-fold header continuation")
+)
+
+// feed bytes read from the connection. report gets every problem, and
+// (head true) a verdict for every complete request head.
+func (f *requestFramer) feed(p []byte, report func(err error, head bool)) {
+	for len(p) > 0 {
+		switch f.state {
+		case inBody, inChunkData:
+			n := int64(len(p))
+			if n > f.remaining {
+				n = f.remaining
+			}
+			p = p[n:]
+			f.remaining -= n
+			if f.remaining == 0 {
+				if f.state == inBody {
+					f.state = inHead
+				} else {
+					f.state = inChunkEnd
+				}
+			}
+			continue
+		}
+
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			f.line = append(f.line, p...)
+			if len(f.line) > maxStrictLine {
+				report(errors.New("line too long"), f.state == inHead)
+			}
+			return
+		}
+		f.line = append(f.line, p[:i+1]...)
+		p = p[i+1:]
+		line := f.line
+		f.line = nil
+
+		if err := checkLineEnding(line); err != nil {
+			report(err, f.state == inHead)
+			return
+		}
+		line = line[:len(line)-2]
+		if err := f.handleLine(line, report); err != nil {
+			report(err, f.state == inHead)
+			return
+		}
+	}
+}
+
+// every line ends with CRLF and has no other CR
+func checkLineEnding(line []byte) error {
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return errBareLF
+	}
+	if bytes.IndexByte(line[:len(line)-2], '\r') >= 0 {
+		return errBareCR
+	}
+	return nil
+}
+
+// handle one complete line (without its CRLF)
+func (f *requestFramer) handleLine(line []byte, report func(err error, head bool)) error {
+	switch f.state {
+	case inHead:
+		if len(line) == 0 {
+			if len(f.head) == 0 {
+				// empty lines before a request are allowed
+				return nil
+			}
+			return f.endHead(report)
+		}
+		if len(f.head) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			return errObsFold
+		}
+		f.head = append(f.head, line)
+		return nil
+
+	case inChunkSize:
+		size, err := parseChunkLine(line)
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			f.state = inTrailer
+			return nil
+		}
+		f.state, f.remaining = inChunkData, size
+		return nil
+
+	case inChunkEnd:
+		if len(line) != 0 {
+			return errors.New("chunk data longer than its size")
+		}
+		f.state = inChunkSize
+		return nil
+
+	case inTrailer:
+		if len(line) == 0 {
+			f.state = inHead
+			return nil
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			return errObsFold
+		}
+		_, _, err := parseHeaderLine(line)
+		return err
+	}
+	return nil
+}
+
+// a complete head: check it, report its verdict and set up the body
+func (f *requestFramer) endHead(report func(err error, head bool)) error {
+	head := f.head
+	f.head = nil
+
+	if parts := strings.Split(string(head[0]), " "); len(parts) != 3 || parts[0] == "" || parts[1] == "" || !strings.HasPrefix(parts[2], "HTTP/1.") {
+		return fmt.Errorf("malformed request line %q", head[0])
+	}
+	http10 := strings.HasSuffix(string(head[0]), "HTTP/1.0")
+
+	var lengths, encodings []string
+	for _, line := range head[1:] {
+		name, value, err := parseHeaderLine(line)
+		if err != nil {
+			return err
+		}
+		switch http.CanonicalHeaderKey(name) {
+		case "Content-Length":
+			lengths = append(lengths, value)
+		case "Transfer-Encoding":
+			encodings = append(encodings, value)
+		}
+	}
+
+	switch {
+	case len(encodings) > 0:
+		if len(lengths) > 0 {
+			return errors.New("both Content-Length and Transfer-Encoding")
+		}
+		if http10 {
+			return errors.New("Transfer-Encoding on HTTP/1.0")
+		}
+		if len(encodings) > 1 || !strings.EqualFold(encodings[0], "chunked") {
+			return fmt.Errorf("unsupported Transfer-Encoding %q", strings.Join(encodings, ", "))
+		}
+		f.state = inChunkSize
+	case len(lengths) > 1:
+		return errors.New("more than one Content-Length")
+	case len(lengths) == 1:
+		n, err := strconv.ParseInt(lengths[0], 10, 64)
+		if err != nil || n < 0 || strings.TrimLeft(lengths[0], "0123456789") != "" {
+			return fmt.Errorf("invalid Content-Length %q", lengths[0])
+		}
+		if n > 0 {
+			f.state, f.remaining = inBody, n
+		}
+	}
+	report(nil, true)
+	return nil
+}
+
+// name: value, with a token name directly followed by the colon and no
+// control characters in the value
+func parseHeaderLine(line []byte) (string, string, error) {
+	name, value, ok := bytes.Cut(line, []byte(":"))
+	if !ok {
+		return "", "", fmt.Errorf("header line without colon %q", line)
+	}
+	if !isToken(name) {
+		return "", "", fmt.Errorf("invalid header name %q", name)
+	}
+	for _, c := range value {
+		if (c < ' ' && c != '\t') || c == 0x7f {
+			return "", "", fmt.Errorf("invalid character in header %s", name)
+		}
+	}
+	return string(name), strings.Trim(string(value), " \t"), nil
+}
+
+// chunk-size [ chunk-ext ], RFC 9112 section 7.1.1:
+//
+//	chunk-ext = *( BWS ";" BWS chunk-ext-name [ BWS "=" BWS chunk-ext-val ] )
+func parseChunkLine(line []byte) (int64, error) {
+	end := 0
+	for end < len(line) && isHex(line[end]) {
+		end++
+	}
+	if end == 0 || end > 16 {
+		return 0, fmt.Errorf("invalid chunk size %q", line)
+	}
+	size, err := strconv.ParseInt(string(line[:end]), 16, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid chunk size %q", line)
+	}
+
+	ext := line[end:]
+	for {
+		ext = skipBWS(ext)
+		if len(ext) == 0 {
+			return size, nil
+		}
+		if ext[0] != ';' {
+			return 0, fmt.Errorf("invalid chunk extension %q", line[end:])
+		}
+		ext = skipBWS(ext[1:])
+		n := tokenLen(ext)
+		if n == 0 {
+			return 0, fmt.Errorf("invalid chunk extension %q", line[end:])
+		}
+		ext = skipBWS(ext[n:])
+		if len(ext) == 0 || ext[0] != '=' {
+			continue
+		}
+		ext = skipBWS(ext[1:])
+		if n := tokenLen(ext); n > 0 {
+			ext = ext[n:]
+			continue
+		}
+		n, ok := quotedStringLen(ext)
+		if !ok {
+			return 0, fmt.Errorf("invalid chunk extension %q", line[end:])
+		}
+		ext = ext[n:]
+	}
+}
+
+func skipBWS(b []byte) []byte {
+	return bytes.TrimLeft(b, " \t")
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+// tchar from RFC 9110
+func isTchar(c byte) bool {
+	if ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') {
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+func isToken(b []byte) bool {
+	return len(b) > 0 && tokenLen(b) == len(b)
+}
+
+func tokenLen(b []byte) int {
+	n := 0
+	for n < len(b) && isTchar(b[n]) {
+		n++
+	}
+	return n
+}
+
+// length of the quoted-string at the start of b
+func quotedStringLen(b []byte) (int, bool) {
+	if len(b) == 0 || b[0] != '"' {
+		return 0, false
+	}
+	for i := 1; i < len(b); i++ {
+		switch c := b[i]; {
+		case c == '"':
+			return i + 1, true
+		case c == '\\':
+			i++
+			if i >= len(b) || (b[i] < ' ' && b[i] != '\t') || b[i] == 0x7f {
+				return 0, false
+			}
+		case (c < ' ' && c != '\t') || c == 0x7f:
+			return 0, false
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// feed raw request bytes through a strict conn, whole or a byte at a time,
+// and take the verdicts for n requests like the handler does, in order
+func strictVerdicts(raw string, bytewise bool, n int) ([]error, int) {
+	c := &strictConn{}
+	if bytewise {
+		for i := 0; i < len(raw) && c.err == nil; i++ {
+			c.parser.feed([]byte{raw[i]}, c.verdict)
+		}
+	} else {
+		c.parser.feed([]byte(raw), c.verdict)
+	}
+	verdicts := make([]error, n)
+	for i := range verdicts {
+		verdicts[i] = c.next()
+	}
+	return verdicts, len(c.verdicts)
+}
+
+func TestStrictFramer(t *testing.T) {
+	// ok is the expected verdict of every request, true for accepted. Once
+	// there was a problem every request after it is rejected.
+	tests := []struct {
+		name string
+		raw  string
+		ok   []bool
+	}{
+		{
+			name: "plain get",
+			raw:  "GET / HTTP/1.1\r\nHost: a\r\n\r\n",
+			ok:   []bool{true},
+		},
+		{
+			name: "leading empty lines",
+			raw:  "\r\n\r\nGET / HTTP/1.1\r\nHost: a\r\n\r\n",
+			ok:   []bool{true},
+		},
+		{
+			name: "bare lf after the request line",
+			raw:  "GET / HTTP/1.1\nHost: a\r\n\r\n",
+			ok:   []bool{false},
+		},
+		{
+			name: "bare lf ending the head",
+			raw:  "GET / HTTP/1.1\r\nHost: a\r\n\n",
+			ok:   []bool{false},
+		},
+		{
+			name: "bare cr in a header",
+			raw:  "GET / HTTP/1.1\r\nHost: a\rX-Smuggle: 1\r\n\r\n",
+			ok:   []bool{false},
+		},
+		{
+			name: "obs-fold with a space",
+			raw:  "GET / HTTP/1.1\r\nHost: a\r\nX-Long: one\r\n two\r\n\r\n",
+			ok:   []bool{false},
+		},
+		{
+			name: "obs-fold with a tab",
+			raw:  "GET / HTTP/1.1\r\nHost: a\r\nX-Long: one\r\n\ttwo\r\n\r\n",
+			ok:   []bool{false},
+		},
+		{
+			name: "obs-fold of transfer-encoding",
+			raw:  "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding:\r\n chunked\r\n\r\n",
+			ok:   []bool{false},
+		},
+		{
+			name: "space before the colon",
+			raw:  "GET / HTTP/1.1\r\nHost : a\r\n\r\n",
+			ok:   []bool{false},
+		},
+		{
+			name: "content-length and transfer-encoding",
+			raw:  "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+			ok:   []bool{false},
+		},
+		{
+			name: "transfer-encoding and content-length",
+			raw:  "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nContent-Length: 4\r\n\r\n0\r\n\r\n",
+			ok:   []bool{false},
+		},
+		{
+			name: "transfer-encoding other than chunked",
+			raw:  "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n",
+			ok:   []bool{false},
+		},
+		{
+			name: "transfer-encoding on http/1.0",
+			raw:  "POST / HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+			ok:   []bool{false},
+		},
+		{
+			name: "duplicate content-length",
+			raw:  "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 4\r\nContent-Length: 4\r\n\r\nabcd",
+			ok:   []bool{false},
+		},
+		{
+			name: "conflicting content-length",
+			raw:  "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 4\r\ncontent-length: 5\r\n\r\nabcde",
+			ok:   []bool{false},
+		},
+		{
+			name: "content-length list",
+			raw:  "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 4, 4\r\n\r\nabcd",
+			ok:   []bool{false},
+		},
+		{
+			name: "signed content-length",
+			raw:  "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: +4\r\n\r\nabcd",
+			ok:   []bool{false},
+		},
+		{
+			name: "chunked body",
+			raw:  "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nabcd\r\n0\r\n\r\n",
+			ok:   []bool{true},
+		},
+		{
+			name: "chunk longer than its size",
+			raw:  "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nabcd\r\n0\r\n\r\nGET / HTTP/1.1\r\nHost: a\r\n\r\n",
+			ok:   []bool{true, false},
+		},
+		{
+			name: "pipelined with content-length bodies",
+			raw: "POST /1 HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhello" +
+				"GET /2 HTTP/1.1\r\nHost: a\r\n\r\n" +
+				"POST /3 HTTP/1.1\r\nHost: a\r\nContent-Length: 2\r\n\r\nhi",
+			ok: []bool{true, true, true},
+		},
+		{
+			name: "pipelined with a chunked body",
+			raw: "POST /1 HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3;a=b\r\nabc\r\n0\r\nX-Trailer: 1\r\n\r\n" +
+				"GET /2 HTTP/1.1\r\nHost: a\r\n\r\n",
+			ok: []bool{true, true},
+		},
+		{
+			name: "pipelined, every request after a bad one is rejected",
+			raw: "GET /1 HTTP/1.1\r\nHost: a\r\n\r\n" +
+				"GET /2 HTTP/1.1\r\nHost: a\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\n" +
+				"GET /3 HTTP/1.1\r\nHost: a\r\n\r\n",
+			ok: []bool{true, false, false},
+		},
+		{
+			name: "smuggled request hidden in a chunk extension",
+			raw: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n" +
+				"2;\nxx\r\n0\r\n\r\nGET /admin HTTP/1.1\r\nHost: a\r\n\r\n",
+			ok: []bool{true, false},
+		},
+	}
+
+	for _, tt := range tests {
+		for _, bytewise := range []bool{false, true} {
+			verdicts, left := strictVerdicts(tt.raw, bytewise, len(tt.ok))
+			if left != 0 {
+				t.Errorf("%s (bytewise %v): %d verdicts left over", tt.name, bytewise, left)
+			}
+			for i, err := range verdicts {
+				if (err == nil) != tt.ok[i] {
+					t.Errorf("%s (bytewise %v): request %d: got %v, want ok %v", tt.name, bytewise, i+1, err, tt.ok[i])
+				}
+			}
+		}
+	}
+}
+
+func TestStrictFramerBodyProblem(t *testing.T) {
+	// a bad chunk comes after the verdict of its head, the handler finds it
+	// with Err once it read the body
+	tests := []string{
+		"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n",
+		"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n4 ;\r\nabcd\r\n0\r\n\r\n",
+		"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nabcd\r\n0\r\nX-Folded: a\r\n b\r\n\r\n",
+	}
+	for _, raw := range tests {
+		c := &strictConn{}
+		c.parser.feed([]byte(raw), c.verdict)
+		if err := c.next(); err != nil {
+			t.Errorf("%q: head rejected: %v", raw, err)
+		}
+		if c.Err() == nil {
+			t.Errorf("%q: body problem not reported", raw)
+		}
+	}
+}
+
+func TestParseChunkLine(t *testing.T) {
+	tests := []struct {
+		line string
+		size int64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"a", 10, true},
+		{"FF", 255, true},
+		{"00000000000000010", 0, false},
+		{"7fffffffffffffff", 1<<63 - 1, true},
+		{"8000000000000000", 0, false},
+		{"", 0, false},
+		{"x", 0, false},
+		{"-1", 0, false},
+		{"0x10", 0, false},
+		{"1 0", 0, false},
+		{"10;name", 16, true},
+		{"10 ; name = value", 16, true},
+		{"10;a=b;c;d=\"quoted; \\\"value\\\"\"", 16, true},
+		{"10;", 0, false},
+		{"10;=value", 0, false},
+		{"10;name=", 0, false},
+		{"10;name=\"open", 0, false},
+		{"10;na me", 0, false},
+		{"10,name", 0, false},
+		{"10;name=\"a\x01b\"", 0, false},
+		{"10;name=" + strings.Repeat("v", 100), 16, true},
+	}
+	for _, tt := range tests {
+		size, err := parseChunkLine([]byte(tt.line))
+		if (err == nil) != tt.ok {
+			t.Errorf("parseChunkLine(%q): got error %v, want ok %v", tt.line, err, tt.ok)
+			continue
+		}
+		if tt.ok && size != tt.size {
+			t.Errorf("parseChunkLine(%q) = %d, want %d", tt.line, size, tt.size)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyslogConfig sends the log to a syslog daemon instead of stderr, local or
+// over the network
+type SyslogConfig struct {
+	// udp://host:port, tcp://host:port or unixgram:///dev/log, empty
+	// disables it
+	Address string `yaml:"address,omitempty"`
+	// kern, user, mail, daemon (the default), auth, syslog, lpr, news, uucp,
+	// cron, authpriv, ftp or local0 to local7
+	Facility string `yaml:"facility,omitempty"`
+	// the program name in every message, lb by default
+	Tag string `yaml:"tag,omitempty"`
+}
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslog severities of the log levels
+var syslogSeverities = map[int32]int{levelDebug: 7, levelInfo: 6, levelWarn: 4, levelError: 3}
+
+func (s SyslogConfig) Validate() error {
+	if s.Address == "" {
+		return nil
+	}
+	if _, _, err := syslogNetwork(s.Address); err != nil {
+		return err
+	}
+	if _, ok := syslogFacilities[s.facility()]; !ok {
+		return fmt.Errorf("syslog: unknown facility %q", s.Facility)
+	}
+	if strings.ContainsAny(s.Tag, " :[]") {
+		return fmt.Errorf("syslog: tag %q must not have spaces, colons or brackets", s.Tag)
+	}
+	return nil
+}
+
+func (s SyslogConfig) facility() string {
+	if s.Facility == "" {
+		return "daemon"
+	}
+	return s.Facility
+}
+
+func (s SyslogConfig) tag() string {
+	if s.Tag == "" {
+		return "lb"
+	}
+	return s.Tag
+}
+
+// the network and address to dial for a syslog address
+func syslogNetwork(address string) (string, string, error) {
+	network, addr, ok := strings.Cut(address, "://")
+	if !ok || addr == "" {
+		return "", "", fmt.Errorf("syslog: address %q must be udp://host:port, tcp://host:port or unixgram:///path", address)
+	}
+	switch network {
+	case "udp", "tcp":
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return "", "", fmt.Errorf("syslog: address %q: %w", address, err)
+		}
+	case "unixgram":
+	default:
+		return "", "", fmt.Errorf("syslog: address %q must be udp, tcp or unixgram", address)
+	}
+	return network, addr, nil
+}
+
+// set once at startup, before setLogFormat. The timestamps are the ones of
+// syslog.
+func setSyslog(s SyslogConfig) error {
+	if s.Address == "" {
+		return nil
+	}
+	network, addr, err := syslogNetwork(s.Address)
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	w := &syslogWriter{
+		network:  network,
+		address:  addr,
+		facility: syslogFacilities[s.facility()],
+		tag:      s.tag(),
+		hostname: hostname,
+	}
+	// the first connection is tried now, so a wrong address shows at startup
+	w.mu.Lock()
+	err = w.connect()
+	w.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("syslog: %w", err)
+	}
+	logOutput = w
+	log.SetOutput(w)
+	log.SetFlags(0)
+	return nil
+}
+
+// syslogWriter sends every log line as a syslog message, with the
+// severity of the level of the line. It is the output of the logger, so it
+// cant log its own errors, they go to stderr.
+type syslogWriter struct {
+	network, address string
+	facility         int
+	tag, hostname    string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// called with mu held
+func (w *syslogWriter) connect() error {
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+	conn, err := net.DialTimeout(w.network, w.address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+	return nil
+}
+
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	msg := w.format(lineSeverity(p), bytes.TrimRight(p, "\n"))
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var err error
+	// once more on a fresh connection, the daemon may have restarted
+	for try := 0; try < 2; try++ {
+		if w.conn == nil {
+			if err = w.connect(); err != nil {
+				continue
+			}
+		}
+		if _, err = w.conn.Write(msg); err == nil {
+			return len(p), nil
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	fmt.Fprintf(os.Stderr, "Syslog: %s\n", err)
+	return 0, err
+}
+
+// the message in the format the daemons expect: the short one without a
+// hostname to the local socket, with the hostname and a full timestamp over
+// the network. Over tcp every message ends with a newline.
+func (w *syslogWriter) format(severity int, line []byte) []byte {
+	pri := w.facility*8 + severity
+	var b bytes.Buffer
+	if w.network == "unixgram" {
+		fmt.Fprintf(&b, "<%d>%s %s[%d]: %s", pri, time.Now().Format(time.Stamp), w.tag, os.Getpid(), line)
+	} else {
+		fmt.Fprintf(&b, "<%d>%s %s %s[%d]: %s", pri, time.Now().Format(time.RFC3339), w.hostname, w.tag, os.Getpid(), line)
+	}
+	if w.network == "tcp" {
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// the severity of a log line, from the level in front of a text line or
+// the level key of a json one
+func lineSeverity(p []byte) int {
+	level := levelInfo
+	if i := bytes.Index(p, []byte(`"level":"`)); i >= 0 && p[0] == '{' {
+		rest := p[i+len(`"level":"`):]
+		switch {
+		case bytes.HasPrefix(rest, []byte("DEBUG")):
+			level = levelDebug
+		case bytes.HasPrefix(rest, []byte("WARN")):
+			level = levelWarn
+		case bytes.HasPrefix(rest, []byte("ERROR")):
+			level = levelError
+		}
+		return syslogSeverities[level]
+	}
+	switch {
+	case bytes.HasPrefix(p, []byte("DEBUG ")):
+		level = levelDebug
+	case bytes.HasPrefix(p, []byte("WARN ")):
+		level = levelWarn
+	case bytes.HasPrefix(p, []byte("ERROR ")):
+		level = levelError
+	}
+	return syslogSeverities[level]
+}
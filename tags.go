@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// TagRule puts a tag on the requests it matches, for slicing the metrics and
+// logs by something the business cares about. Every condition that is set
+// has to match.
+type TagRule struct {
+	Tag string `yaml:"tag"`
+	// header to match against match, the path when empty
+	Header string `yaml:"header,omitempty"`
+	// regular expression, it matches anywhere in the value unless anchored
+	Match      string `yaml:"match,omitempty"`
+	PathPrefix string `yaml:"path_prefix,omitempty"`
+	Method     string `yaml:"method,omitempty"`
+}
+
+type tagRule struct {
+	tag        string
+	header     string
+	match      *regexp.Regexp
+	pathPrefix string
+	method     string
+}
+
+func (t TagRule) compile() (*tagRule, error) {
+	if t.Tag == "" {
+		return nil, fmt.Errorf("tag is required")
+	}
+	return compileMatch("tag "+t.Tag, t.Tag, t.Header, t.Match, t.PathPrefix, t.Method)
+}
+
+// a rule matching requests by a header or the path, the path prefix and the
+// method, name starts its errors
+func compileMatch(name, tag, header, match, pathPrefix, method string) (*tagRule, error) {
+	if match == "" && pathPrefix == "" && method == "" {
+		return nil, fmt.Errorf("%s: one of match, path_prefix or method is required", name)
+	}
+	if header != "" && match == "" {
+		return nil, fmt.Errorf("%s: header needs match", name)
+	}
+	rule := &tagRule{
+		tag:        tag,
+		header:     header,
+		pathPrefix: pathPrefix,
+		method:     strings.ToUpper(method),
+	}
+	if match != "" {
+		re, err := regexp.Compile(match)
+		if err != nil {
+			return nil, fmt.Errorf("%s: match: %w", name, err)
+		}
+		rule.match = re
+	}
+	return rule, nil
+}
+
+func compileTags(rules []TagRule) ([]*tagRule, error) {
+	var compiled []*tagRule
+	for _, t := range rules {
+		rule, err := t.compile()
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, rule)
+	}
+	return compiled, nil
+}
+
+func (t *tagRule) matches(r *http.Request) bool {
+	if t.method != "" && r.Method != t.method {
+		return false
+	}
+	if t.pathPrefix != "" && !strings.HasPrefix(r.URL.Path, t.pathPrefix) {
+		return false
+	}
+	if t.match != nil {
+		value := r.URL.Path
+		if t.header != "" {
+			value = r.Header.Get(t.header)
+		}
+		if !t.match.MatchString(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// the tags of the rules r matches, each once and in rule order
+func tagRequest(rules []*tagRule, r *http.Request) []string {
+	var tags []string
+	for _, t := range rules {
+		if t.matches(r) && !containsString(tags, t.tag) {
+			tags = append(tags, t.tag)
+		}
+	}
+	return tags
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func withTags(r *http.Request, tags []string) *http.Request {
+	if len(tags) == 0 {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), Tags, tags))
+}
+
+func GetTagsFromContext(r *http.Request) []string {
+	tags, _ := r.Context().Value(Tags).([]string)
+	return tags
+}
+
+// the tags for a log line, empty when the request has none
+func logTags(r *http.Request) string {
+	tags := GetTagsFromContext(r)
+	if len(tags) == 0 {
+		return ""
+	}
+	return " [tags " + strings.Join(tags, ",") + "]"
+}
+
+// requests per tag and status class ("tag 2xx" -> count)
+var taggedRequests sync.Map
+
+func countTagged(tags []string, status int) {
+	if status == 0 {
+		// nothing was written, the client gets an empty 200
+		status = http.StatusOK
+	}
+	for _, tag := range tags {
+		key := fmt.Sprintf("%s %dxx", tag, status/100)
+		n, _ := taggedRequests.LoadOrStore(key, new(atomic.Uint64))
+		n.(*atomic.Uint64).Add(1)
+	}
+}
+
+// statusRecorder remembers the status code written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	// bytes of the response body
+	written int64
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// for http.ResponseController, so flushing and upgrades still work
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func writeTagMetrics(w io.Writer) {
+	var keys []string
+	taggedRequests.Range(func(k, _ interface{}) bool {
+		keys = append(keys, k.(string))
+		return true
+	})
+	sort.Strings(keys)
+
+	writeMetricHeader(w, "lb_tagged_requests_total", "counter", "Requests per tag rule and status class.")
+	for _, key := range keys {
+		n, _ := taggedRequests.Load(key)
+		tag, code, _ := strings.Cut(key, " ")
+		fmt.Fprintf(w, "lb_tagged_requests_total{tag=%q,code=%q} %d\n", tag, code, n.(*atomic.Uint64).Load())
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+var errHeaderTimeout = errors.New("header timeout")
+
+// headerTimeouter gives up on a backend that doesnt send the response
+// headers within the header timeout of the route: header_timeout, or the
+// dynamic timeout when that is shorter. The body can take as long as it
+// needs, so a slow download isnt cut by a short timeout meant to find hung
+// backends.
+type headerTimeouter struct {
+	next http.RoundTripper
+}
+
+func (t *headerTimeouter) RoundTrip(req *http.Request) (*http.Response, error) {
+	route := GetRouteFromContext(req)
+	timeout := route.HeaderTimeout
+	var latency *rollingLatency
+	if route.DynamicTimeout.Enabled() {
+		latency = routeLatency(route)
+		if d := latency.Timeout(route.DynamicTimeout); timeout == 0 || d < timeout {
+			timeout = d
+		}
+	}
+	if timeout == 0 {
+		return t.next.RoundTrip(req)
+	}
+	window := route.DynamicTimeout.withDefaults().Window
+
+	// the context ends with the request at the latest, the timer only has
+	// to cut the wait for the headers short
+	ctx, cancel := context.WithCancelCause(req.Context())
+	timer := time.AfterFunc(timeout, func() { cancel(errHeaderTimeout) })
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() {
+		if latency != nil {
+			// count it at the timeout, so a slow backend pushes the timeout up
+			latency.Record(timeout, window)
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+		return nil, fmt.Errorf("%w: no response headers within %s", errHeaderTimeout, timeout)
+	}
+	if err == nil && latency != nil {
+		latency.Record(time.Since(start), window)
+	}
+	return resp, err
+}
+
+var errResponseTimeout = errors.New("response timeout")
+
+// responseTimeouter limits the whole response, headers and body, to the
+// response_timeout of the route
+type responseTimeouter struct {
+	next    http.RoundTripper
+	backend *Backend
+}
+
+func (t *responseTimeouter) RoundTrip(req *http.Request) (*http.Response, error) {
+	timeout := GetRouteFromContext(req).ResponseTimeout
+	if timeout == 0 {
+		return t.next.RoundTrip(req)
+	}
+	ctx, cancel := context.WithCancelCause(req.Context())
+	timer := time.AfterFunc(timeout, func() { cancel(errResponseTimeout) })
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		timer.Stop()
+		if context.Cause(ctx) == errResponseTimeout {
+			return nil, fmt.Errorf("%w: no response within %s", errResponseTimeout, timeout)
+		}
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// the timeout is for the answer to the upgrade, the websocket after
+		// it stays open as long as both sides want
+		timer.Stop()
+		return resp, nil
+	}
+	// the timer keeps running while the proxy copies the body
+	resp.Body = &timeoutBody{ReadCloser: resp.Body, ctx: ctx, timer: timer, timeout: timeout, req: req, backend: t.backend.URL.String()}
+	return resp, nil
+}
+
+// timeoutBody stops the response timer once the body is done with
+type timeoutBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	timer   *time.Timer
+	timeout time.Duration
+	req     *http.Request
+	backend string
+	logged  bool
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && !b.logged && context.Cause(b.ctx) == errResponseTimeout {
+		b.logged = true
+		warnw(requestFields(b.req, "backend", b.backend, "timeout_ms", b.timeout.Milliseconds()), "%s: response cut after the response timeout of %s\n", b.req.URL, b.timeout)
+	}
+	return n, err
+}
+
+func (b *timeoutBody) Close() error {
+	b.timer.Stop()
+	return b.ReadCloser.Close()
+}
+
+var errRequestTimeout = errors.New("request timeout")
+
+// the request_timeout of the route covers every attempt of a request until
+// the response headers of one arrive, so a client doesnt wait while the
+// load balancer goes through backends that dont answer. It ends the
+// context of the request, attempts still running fail and the client gets
+// 504. The body is left to response_timeout.
+func withRequestTimeout(r *http.Request, route *Route) (*http.Request, context.CancelCauseFunc) {
+	ctx, cancel := context.WithCancelCause(r.Context())
+	if route.RequestTimeout > 0 {
+		timer := time.AfterFunc(route.RequestTimeout, func() { cancel(errRequestTimeout) })
+		ctx = context.WithValue(ctx, RequestTimer, timer)
+	}
+	return r.WithContext(ctx), cancel
+}
+
+// the response headers arrived, the request timeout is over
+func stopRequestTimeout(req *http.Request) {
+	if timer, ok := req.Context().Value(RequestTimer).(*time.Timer); ok {
+		timer.Stop()
+	}
+}
+
+// check if the request timeout of the request ran out, then answer 504
+func requestTimedOut(w http.ResponseWriter, r *http.Request) bool {
+	if context.Cause(r.Context()) != errRequestTimeout {
+		return false
+	}
+	route := GetRouteFromContext(r)
+	warnw(requestFields(r), "%s(%s)%s No response within the request timeout of %s\n", r.RemoteAddr, r.URL.Path, logRequest(r), route.RequestTimeout)
+	recentErrors.Add(errorEntry{Pool: route.Pool, Path: r.URL.Path, Error: "request timeout"})
+	http.Error(w, "Gateway timeout", http.StatusGatewayTimeout)
+	return true
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// tlsSettings are the protocol versions, cipher suites and curves a tls
+// listener or https backend allows, for policies that forbid the old ones.
+// Empty means the go defaults, tls 1.2 to 1.3 and the go choice of ciphers
+// and curves. Tls 1.3 has its own fixed ciphers, the list is for 1.2 and
+// older.
+type tlsSettings struct {
+	minVersion, maxVersion string
+	// names separated by ":" (like openssl), "," or spaces
+	ciphers, curves string
+}
+
+func (l ListenerConfig) tlsSettings() tlsSettings {
+	return tlsSettings{l.TLSMinVersion, l.TLSMaxVersion, l.TLSCiphers, l.TLSCurves}
+}
+
+func (bc BackendConfig) tlsSettings() tlsSettings {
+	return tlsSettings{bc.TLSMinVersion, bc.TLSMaxVersion, bc.TLSCiphers, bc.TLSCurves}
+}
+
+func (s tlsSettings) empty() bool {
+	return s == tlsSettings{}
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+func tlsVersion(setting, name string) (uint16, error) {
+	if name == "" {
+		return 0, nil
+	}
+	v, ok := tlsVersions[name]
+	if !ok {
+		return 0, fmt.Errorf("%s must be 1.0, 1.1, 1.2 or 1.3", setting)
+	}
+	return v, nil
+}
+
+func splitTLSNames(list string) []string {
+	return strings.FieldsFunc(list, func(r rune) bool { return r == ':' || r == ',' || r == ' ' })
+}
+
+// put the settings into cfg
+func (s tlsSettings) apply(cfg *tls.Config) error {
+	var err error
+	if cfg.MinVersion, err = tlsVersion("tls_min_version", s.minVersion); err != nil {
+		return err
+	}
+	if cfg.MaxVersion, err = tlsVersion("tls_max_version", s.maxVersion); err != nil {
+		return err
+	}
+	if cfg.MinVersion != 0 && cfg.MaxVersion != 0 && cfg.MinVersion > cfg.MaxVersion {
+		return fmt.Errorf("tls_min_version is above tls_max_version")
+	}
+
+	if s.ciphers != "" {
+		// insecure ones too, a policy may need one for an old peer
+		known := make(map[string]uint16)
+		for _, c := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			known[c.Name] = c.ID
+		}
+		cfg.CipherSuites = nil
+		for _, name := range splitTLSNames(s.ciphers) {
+			id, ok := known[name]
+			if !ok {
+				return fmt.Errorf("tls_ciphers: unknown cipher suite %s", name)
+			}
+			cfg.CipherSuites = append(cfg.CipherSuites, id)
+		}
+	}
+	if s.curves != "" {
+		cfg.CurvePreferences = nil
+		for _, name := range splitTLSNames(s.curves) {
+			id, ok := tlsCurves[name]
+			if !ok {
+				return fmt.Errorf("tls_curves: unknown curve %s, one of X25519, P256, P384 and P521", name)
+			}
+			cfg.CurvePreferences = append(cfg.CurvePreferences, id)
+		}
+	}
+	return nil
+}
+
+// whether connections with these settings can use tls 1.3, which quic needs
+func (s tlsSettings) allowsTLS13() bool {
+	return s.maxVersion == "" || s.maxVersion == "1.3"
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// lb top: the backends of the running load balancer with their traffic,
+// errors and latency, refreshed every interval like top
+func runTop(args []string) int {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	client := adminClientFlags(fs)
+	interval := fs.Duration("interval", 2*time.Second, "Time between two refreshes")
+	count := fs.Int("n", 0, "Stop after this many refreshes, 0 to go on until interrupted")
+	fs.Parse(args)
+	if fs.NArg() != 0 || *interval <= 0 {
+		fmt.Fprintln(os.Stderr, "usage: lb top [-address host:port] [-interval 2s] [-n count]")
+		return 2
+	}
+	c, err := client()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	// requests of every backend at the last refresh, for the rates
+	last := make(map[string]uint64)
+	var lastTime time.Time
+	for i := 0; *count == 0 || i < *count; i++ {
+		if i > 0 {
+			time.Sleep(*interval)
+		}
+		var status struct {
+			Time     time.Time           `json:"time"`
+			Backends []backendStatusJSON `json:"backends"`
+			Errors   []errorEntry        `json:"errors"`
+		}
+		if err := c.do(http.MethodGet, "/admin/status", nil, &status); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		secs := status.Time.Sub(lastTime).Seconds()
+		rates := make(map[string]float64)
+		var total float64
+		for _, b := range status.Backends {
+			if prev, ok := last[b.ID]; ok && secs > 0 && b.Requests >= prev {
+				rates[b.ID] = float64(b.Requests-prev) / secs
+			}
+			total += rates[b.ID]
+			last[b.ID] = b.Requests
+		}
+		lastTime = status.Time
+
+		// the whole screen at once, so it doesnt flicker
+		var screen bytes.Buffer
+		if *count != 1 {
+			screen.WriteString("\033[H\033[2J")
+		}
+		fmt.Fprintf(&screen, "lb top - %s  %s  %.1f req/s\n\n", c.base, status.Time.Local().Format("15:04:05"), total)
+		tw := tabwriter.NewWriter(&screen, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "POOL\tBACKEND\tHEALTH\tSTATUS\tWEIGHT\tIN FLIGHT\tREQ/S\tERRORS\tP50 MS\tP95 MS\tP99 MS")
+		for _, b := range status.Backends {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%.1f\t%.1f%%\t%.1f\t%.1f\t%.1f\n",
+				b.Pool, b.URL, healthWord(b.Alive), b.Status, b.Weight, b.InFlight, rates[b.ID],
+				b.Recent.ErrorRate*100, b.Recent.P50Ms, b.Recent.P95Ms, b.Recent.P99Ms)
+		}
+		tw.Flush()
+		if len(status.Errors) > 0 {
+			screen.WriteString("\nRecent errors\n")
+			for j, e := range status.Errors {
+				if j == 5 {
+					break
+				}
+				fmt.Fprintf(&screen, "  %s  %s  %s  %s\n", e.Time.Local().Format("15:04:05"), e.Backend, e.Path, e.Error)
+			}
+		}
+		os.Stdout.Write(screen.Bytes())
+	}
+	return 0
+}
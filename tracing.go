@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TracingConfig sends a span for every request to an opentelemetry
+// collector, over OTLP/HTTP with json. The W3C traceparent header carries the
+// trace on to the backends, so a trace goes through the load balancer
+// instead of ending there.
+type TracingConfig struct {
+	// base url of the collector, like http://otel-collector:4318. Empty
+	// turns tracing off.
+	Endpoint string `yaml:"endpoint,omitempty"`
+	// headers of the export requests, like the api key of a hosted backend
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// service.name of the spans
+	ServiceName string `yaml:"service_name"`
+	// share of the traces started here that are sampled, 0 to 1. Requests
+	// coming with a traceparent follow its sampled flag.
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+func defaultTracingConfig() TracingConfig {
+	return TracingConfig{ServiceName: "load-balancer", SampleRatio: 1}
+}
+
+func (t TracingConfig) Validate() error {
+	if t.Endpoint != "" {
+		u, err := url.Parse(t.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("tracing: endpoint must be an http or https url")
+		}
+	}
+	if t.SampleRatio < 0 || t.SampleRatio > 1 {
+		return fmt.Errorf("tracing: sample_ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+// span kinds and status codes of OTLP
+const (
+	spanKindServer = 2
+	spanKindClient = 3
+
+	spanStatusError = 2
+)
+
+// span is one operation of a trace: the request through the load balancer
+// (server) or one attempt on a backend (client)
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+	name     string
+	kind     int
+	start    time.Time
+
+	mu    sync.Mutex
+	end   time.Time
+	attrs map[string]any
+	err   string
+	// client spans started under this one
+	attempts int
+}
+
+func (s *span) set(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs[key] = value
+}
+
+func (s *span) fail(err string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// the traceparent header naming this span as the parent
+func (s *span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-" + flags
+}
+
+// trace id, parent span id and sampled flag of a traceparent header. ok is
+// false for a missing or malformed one, a new trace is started then.
+func parseTraceparent(h string) (traceID [16]byte, parentID [8]byte, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil || parentID == [8]byte{} {
+		return
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return
+	}
+	return traceID, parentID, flags&1 == 1, true
+}
+
+// tracer builds the spans and exports the sampled ones in batches
+type tracer struct {
+	config TracingConfig
+	spans  chan *span
+	// spans lost because the exporter fell behind or the collector failed
+	dropped atomic.Uint64
+}
+
+// nil while tracing is off
+var activeTracer atomic.Pointer[tracer]
+
+// spans waiting for the exporter, more are dropped
+const (
+	traceQueue      = 4096
+	traceBatch      = 512
+	traceFlushEvery = 5 * time.Second
+)
+
+func startTracing(cfg TracingConfig) {
+	if cfg.Endpoint == "" {
+		return
+	}
+	t := &tracer{config: cfg, spans: make(chan *span, traceQueue)}
+	activeTracer.Store(t)
+	go t.export()
+	infof("Tracing to %s\n", cfg.Endpoint)
+}
+
+func randomID(b []byte) {
+	rand.Read(b)
+}
+
+// the server span of a request, continuing the trace of its traceparent
+func (t *tracer) startServer(r *http.Request) *span {
+	s := &span{name: r.Method, kind: spanKindServer, start: time.Now(), attrs: make(map[string]any)}
+	if traceID, parentID, sampled, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		s.traceID, s.parentID, s.sampled = traceID, parentID, sampled
+	} else {
+		randomID(s.traceID[:])
+		s.sampled = t.sample(s.traceID)
+	}
+	randomID(s.spanID[:])
+	s.attrs["http.request.method"] = r.Method
+	s.attrs["url.path"] = r.URL.Path
+	s.attrs["server.address"] = r.Host
+	s.attrs["client.address"] = r.RemoteAddr
+	s.attrs["user_agent.original"] = r.UserAgent()
+	return s
+}
+
+// sampled by the trace id, so every load balancer of a fleet decides the
+// same for a trace
+func (t *tracer) sample(traceID [16]byte) bool {
+	var n uint64
+	for _, b := range traceID[8:] {
+		n = n<<8 | uint64(b)
+	}
+	return float64(n>>11)/(1<<53) < t.config.SampleRatio
+}
+
+// a client span for an attempt on a backend, under the server span
+func (t *tracer) startClient(parent *span, backend string) *span {
+	parent.mu.Lock()
+	parent.attempts++
+	parent.mu.Unlock()
+	s := &span{traceID: parent.traceID, parentID: parent.spanID, sampled: parent.sampled, name: "backend", kind: spanKindClient, start: time.Now(), attrs: make(map[string]any)}
+	randomID(s.spanID[:])
+	s.attrs["lb.backend"] = backend
+	return s
+}
+
+func (t *tracer) finish(s *span) {
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+	if !s.sampled {
+		return
+	}
+	select {
+	case t.spans <- s:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+func (t *tracer) export() {
+	ticker := time.NewTicker(traceFlushEvery)
+	var batch []*span
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) < traceBatch {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.send(batch); err != nil {
+			t.dropped.Add(uint64(len(batch)))
+			warnf("Tracing: exporting %d spans failed: %s\n", len(batch), err)
+		}
+		batch = nil
+	}
+}
+
+// OTLP/HTTP json, https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+func (t *tracer) send(batch []*span) error {
+	spans := make([]map[string]any, 0, len(batch))
+	for _, s := range batch {
+		spans = append(spans, s.otlp())
+	}
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": otlpAttributes(map[string]any{"service.name": t.config.ServiceName})},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "load_balancer"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(t.config.Endpoint, "/")+"/v1/traces", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.config.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *span) otlp() map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := map[string]any{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attrs),
+	}
+	if s.parentID != [8]byte{} {
+		out["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+	}
+	if s.err != "" {
+		out["status"] = map[string]any{"code": spanStatusError, "message": s.err}
+	}
+	return out
+}
+
+func otlpAttributes(attrs map[string]any) []any {
+	out := make([]any, 0, len(attrs))
+	for _, k := range sortedKeys(attrs) {
+		var value map[string]any
+		switch v := attrs[k].(type) {
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case float64:
+			if math.IsNaN(v) {
+				continue
+			}
+			value = map[string]any{"doubleValue": v}
+		case bool:
+			value = map[string]any{"boolValue": v}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		out = append(out, map[string]any{"key": k, "value": value})
+	}
+	return out
+}
+
+// the server span of a request, nil without tracing
+func GetSpanFromContext(r *http.Request) *span {
+	s, _ := r.Context().Value(Trace).(*span)
+	return s
+}
+
+// traceRequest wraps the handling of a request of a listener in its server
+// span
+func traceRequest(r *http.Request) (*http.Request, func(status int)) {
+	t := activeTracer.Load()
+	if t == nil {
+		return r, func(int) {}
+	}
+	s := t.startServer(r)
+	r = r.WithContext(context.WithValue(r.Context(), Trace, s))
+	return r, func(status int) {
+		if status == 0 {
+			status = http.StatusOK
+		}
+		s.set("http.response.status_code", status)
+		s.mu.Lock()
+		s.attrs["lb.attempts"] = s.attempts
+		s.attrs["lb.retries"] = max(s.attempts-1, 0)
+		s.mu.Unlock()
+		if status >= 500 {
+			s.fail(http.StatusText(status))
+		}
+		t.finish(s)
+	}
+}
+
+// spanRecorder makes a client span of every attempt on the backend and
+// sends its traceparent along
+type spanRecorder struct {
+	next    http.RoundTripper
+	backend *Backend
+}
+
+func (t *spanRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	tr := activeTracer.Load()
+	parent := GetSpanFromContext(req)
+	if tr == nil || parent == nil {
+		return t.next.RoundTrip(req)
+	}
+	s := tr.startClient(parent, t.backend.URL.String())
+	s.set("server.address", t.backend.URL.Host)
+	if retry, ok := req.Context().Value(Retry).(int); ok {
+		s.set("lb.retry", retry)
+	}
+	parent.set("lb.backend", t.backend.URL.String())
+
+	// the proxy owns the headers of its outgoing request, a copy gets the
+	// traceparent
+	out := req.WithContext(req.Context())
+	out.Header = req.Header.Clone()
+	out.Header.Set("traceparent", s.traceparent())
+	resp, err := t.next.RoundTrip(out)
+	if err != nil {
+		s.fail(err.Error())
+	} else {
+		s.set("http.response.status_code", resp.StatusCode)
+		if resp.StatusCode >= 500 {
+			s.fail(resp.Status)
+		}
+	}
+	tr.finish(s)
+	return resp, err
+}
+
+func writeTracingMetrics(w io.Writer) {
+	t := activeTracer.Load()
+	if t == nil {
+		return
+	}
+	writeMetricHeader(w, "lb_tracing_spans_dropped_total", "counter", "Spans not exported because the queue was full or the collector failed.")
+	fmt.Fprintf(w, "lb_tracing_spans_dropped_total %d\n", t.dropped.Load())
+}
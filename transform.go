@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// bodies bigger than this are passed through untouched
+const maxTransformBody = 10 << 20
+
+// TransformConfig rewrites request and/or response bodies of a route, to put
+// a legacy backend behind a modern api without a separate adapter service
+type TransformConfig struct {
+	Request  *BodyTransform `yaml:"request,omitempty"`
+	Response *BodyTransform `yaml:"response,omitempty"`
+}
+
+type BodyTransform struct {
+	// rename json object keys (at any depth), old name -> new name
+	RenameFields map[string]string `yaml:"rename_fields,omitempty"`
+	// turn an xml body into json with a text/template. The template gets the
+	// parsed document as nested maps: elements by name, attributes as "@name",
+	// text as "#text". A "json" function encodes a value as json.
+	XMLToJSON string `yaml:"xml_to_json,omitempty"`
+}
+
+// bodyTransformer is a compiled BodyTransform
+type bodyTransformer struct {
+	rename map[string]string
+	tmpl   *template.Template
+}
+
+func (t *TransformConfig) compile() (request, response *bodyTransformer, err error) {
+	if t == nil {
+		return nil, nil, nil
+	}
+	if request, err = compileTransform(t.Request); err != nil {
+		return nil, nil, fmt.Errorf("request: %w", err)
+	}
+	if response, err = compileTransform(t.Response); err != nil {
+		return nil, nil, fmt.Errorf("response: %w", err)
+	}
+	return request, response, nil
+}
+
+func compileTransform(bt *BodyTransform) (*bodyTransformer, error) {
+	if bt == nil {
+		return nil, nil
+	}
+	t := &bodyTransformer{rename: bt.RenameFields}
+	if bt.XMLToJSON != "" {
+		tmpl, err := template.New("xml_to_json").Funcs(template.FuncMap{
+			"json": func(v interface{}) (string, error) {
+				b, err := json.Marshal(v)
+				return string(b), err
+			},
+		}).Option("missingkey=zero").Parse(bt.XMLToJSON)
+		if err != nil {
+			return nil, err
+		}
+		t.tmpl = tmpl
+	}
+	return t, nil
+}
+
+func mediaType(h http.Header) string {
+	mt, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return mt
+}
+
+func isJSON(mt string) bool {
+	return mt == "application/json" || strings.HasSuffix(mt, "+json")
+}
+
+func isXML(mt string) bool {
+	return mt == "application/xml" || mt == "text/xml" || strings.HasSuffix(mt, "+xml")
+}
+
+// does the transformer do anything for a body of this media type
+func (t *bodyTransformer) applies(contentType string) bool {
+	return (t.tmpl != nil && isXML(contentType)) || (len(t.rename) > 0 && isJSON(contentType))
+}
+
+// transform a body, returns the new body and its content type. Only call it
+// when applies() says so.
+func (t *bodyTransformer) apply(contentType string, body []byte) ([]byte, string, error) {
+	switch {
+	case t.tmpl != nil && isXML(contentType):
+		doc, err := parseXMLDocument(body)
+		if err != nil {
+			return nil, "", err
+		}
+		var buf bytes.Buffer
+		if err := t.tmpl.Execute(&buf, doc); err != nil {
+			return nil, "", err
+		}
+		if !json.Valid(buf.Bytes()) {
+			return nil, "", fmt.Errorf("xml_to_json template did not produce valid json")
+		}
+		body = buf.Bytes()
+		contentType = "application/json"
+		if len(t.rename) == 0 {
+			return body, contentType, nil
+		}
+		fallthrough
+	case len(t.rename) > 0 && isJSON(contentType):
+		var v interface{}
+		if err := json.Unmarshal(body, &v); err != nil {
+			return nil, "", err
+		}
+		out, err := json.Marshal(renameFields(v, t.rename))
+		return out, contentType, err
+	}
+	return nil, "", nil
+}
+
+func renameFields(v interface{}, rename map[string]string) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			if to, ok := rename[k]; ok {
+				k = to
+			}
+			out[k] = renameFields(val, rename)
+		}
+		return out
+	case []interface{}:
+		for i := range v {
+			v[i] = renameFields(v[i], rename)
+		}
+		return v
+	}
+	return v
+}
+
+// parse xml into nested maps, an element that appears more than once under
+// the same parent becomes a list
+func parseXMLDocument(data []byte) (map[string]interface{}, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	root := map[string]interface{}{}
+	stack := []map[string]interface{}{root}
+	var names []string
+	var text []strings.Builder
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			el := map[string]interface{}{}
+			for _, a := range tok.Attr {
+				el["@"+a.Name.Local] = a.Value
+			}
+			stack = append(stack, el)
+			names = append(names, tok.Name.Local)
+			text = append(text, strings.Builder{})
+		case xml.CharData:
+			if len(text) > 0 {
+				text[len(text)-1].Write(tok)
+			}
+		case xml.EndElement:
+			el := stack[len(stack)-1]
+			name := names[len(names)-1]
+			content := strings.TrimSpace(text[len(text)-1].String())
+			stack, names, text = stack[:len(stack)-1], names[:len(names)-1], text[:len(text)-1]
+
+			var value interface{} = el
+			if len(el) == 0 {
+				// leaf element, just its text
+				value = content
+			} else if content != "" {
+				el["#text"] = content
+			}
+
+			parent := stack[len(stack)-1]
+			switch existing := parent[name].(type) {
+			case nil:
+				parent[name] = value
+			case []interface{}:
+				parent[name] = append(existing, value)
+			default:
+				parent[name] = []interface{}{existing, value}
+			}
+		}
+	}
+	return root, nil
+}
+
+// rewrite the request body of r in place if the route asks for it
+func transformRequest(r *http.Request, t *bodyTransformer) error {
+	if t == nil || r.Body == nil || r.ContentLength > maxTransformBody || !t.applies(mediaType(r.Header)) {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxTransformBody+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxTransformBody {
+		r.Body = prependBody(body, r.Body)
+		return nil
+	}
+	r.Body.Close()
+
+	out, ct, err := t.apply(mediaType(r.Header), body)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", ct)
+	r.Body = io.NopCloser(bytes.NewReader(out))
+	r.ContentLength = int64(len(out))
+	r.Header.Set("Content-Length", strconv.Itoa(len(out)))
+	return nil
+}
+
+// put the part of a body that was already read back in front of the rest
+func prependBody(read []byte, rest io.ReadCloser) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(read), rest), rest}
+}
+
+// rewrite a backend response if the route of its request asks for it,
+// used as the reverse proxy ModifyResponse hook. It never returns an error,
+// that would make the proxy retry and mark a healthy backend down; a body that
+// cant be transformed is answered with 502 instead.
+func transformResponse(resp *http.Response) error {
+	route := GetRouteFromContext(resp.Request)
+	t := route.responseTransform
+	if t == nil || isStreaming(resp) || resp.ContentLength > maxTransformBody || resp.Header.Get("Content-Encoding") != "" || !t.applies(mediaType(resp.Header)) {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTransformBody+1))
+	if err == nil && len(body) > maxTransformBody {
+		resp.Body = prependBody(body, resp.Body)
+		return nil
+	}
+	resp.Body.Close()
+
+	var out []byte
+	var ct string
+	if err == nil {
+		out, ct, err = t.apply(mediaType(resp.Header), body)
+	}
+	if err != nil {
+		warnw(requestFields(resp.Request, "status", http.StatusBadGateway, "error", err.Error()), "Response body transform failed on route %s: %s\n", route.Name, err)
+		out, ct = []byte("Bad Gateway\n"), "text/plain; charset=utf-8"
+		resp.StatusCode, resp.Status = http.StatusBadGateway, "502 Bad Gateway"
+	}
+	resp.Header.Set("Content-Type", ct)
+	resp.Body = io.NopCloser(bytes.NewReader(out))
+	resp.ContentLength = int64(len(out))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(out)))
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// built in transport timeouts, used when the backend config leaves them at
+// 0. They are the ones of the go default transport.
+const (
+	defaultDialTimeout           = 30 * time.Second
+	defaultTLSHandshakeTimeout   = 10 * time.Second
+	defaultExpectContinueTimeout = time.Second
+)
+
+// built in idle connection settings. Unlike the go default of 2 idle
+// connections per host, every idle connection may be to the backend: a
+// transport only has the one host, and a busy backend throttled to 2
+// reused connections opens a new one for most requests.
+const (
+	defaultMaxIdleConns    = 100
+	defaultIdleConnTimeout = 90 * time.Second
+)
+
+func (bc BackendConfig) dialTimeout() time.Duration {
+	if bc.DialTimeout == 0 {
+		return defaultDialTimeout
+	}
+	return bc.DialTimeout
+}
+
+// set the timeouts of the backend on its transport. The response header
+// timeout has no built in value, without one the route settings decide.
+func tuneTransport(transport *http.Transport, bc BackendConfig) {
+	transport.TLSHandshakeTimeout = defaultTLSHandshakeTimeout
+	if bc.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = bc.TLSHandshakeTimeout
+	}
+	transport.ResponseHeaderTimeout = bc.ResponseHeaderTimeout
+	transport.ExpectContinueTimeout = defaultExpectContinueTimeout
+	if bc.ExpectContinueTimeout > 0 {
+		transport.ExpectContinueTimeout = bc.ExpectContinueTimeout
+	}
+
+	transport.MaxIdleConns = defaultMaxIdleConns
+	if bc.MaxIdleConns > 0 {
+		transport.MaxIdleConns = bc.MaxIdleConns
+	}
+	transport.MaxIdleConnsPerHost = transport.MaxIdleConns
+	if bc.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = bc.MaxIdleConnsPerHost
+	}
+	transport.IdleConnTimeout = bc.idleConnTimeout()
+	if bc.DisableKeepAlives {
+		transport.DisableKeepAlives = true
+	}
+}
+
+func (bc BackendConfig) idleConnTimeout() time.Duration {
+	if bc.IdleConnTimeout == 0 {
+		return defaultIdleConnTimeout
+	}
+	return bc.IdleConnTimeout
+}
+
+func validateTransport(bc BackendConfig) error {
+	if bc.DialTimeout < 0 || bc.TLSHandshakeTimeout < 0 || bc.ResponseHeaderTimeout < 0 || bc.ExpectContinueTimeout < 0 {
+		return fmt.Errorf("dial_timeout, tls_handshake_timeout, response_header_timeout and expect_continue_timeout must not be negative")
+	}
+	if bc.MaxIdleConns < 0 || bc.MaxIdleConnsPerHost < 0 || bc.IdleConnTimeout < 0 {
+		return fmt.Errorf("max_idle_conns, max_idle_conns_per_host and idle_conn_timeout must not be negative")
+	}
+	if bc.DisableKeepAlives && bc.Protocol == protocolH2C {
+		return fmt.Errorf("disable_keepalives doesnt go with h2c, every request shares one connection")
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// built in values of a udp listener
+const (
+	udpIdleTimeout = 30 * time.Second
+	udpMaxSessions = 10000
+	// a backend that refused a datagram gets no new sessions for this long
+	udpBackendCooldown = 5 * time.Second
+	// largest datagram, anything longer is cut by the kernel
+	udpMaxDatagram = 64 * 1024
+)
+
+// UDPListenerConfig balances the datagrams arriving on address over
+// backends, for dns, syslog and the like. Every client address gets a session
+// that sticks to one backend and ends when it is idle for idle_timeout.
+type UDPListenerConfig struct {
+	Address string `yaml:"address"`
+	// host:port of the backends
+	Backends []string `yaml:"backends"`
+	// 0 means the built in values, 30s and 10000 sessions. Datagrams of
+	// new clients are dropped while max_sessions are open.
+	IdleTimeout time.Duration `yaml:"idle_timeout,omitempty"`
+	MaxSessions int           `yaml:"max_sessions,omitempty"`
+}
+
+func (u UDPListenerConfig) idleTimeout() time.Duration {
+	if u.IdleTimeout > 0 {
+		return u.IdleTimeout
+	}
+	return udpIdleTimeout
+}
+
+func (u UDPListenerConfig) maxSessions() int {
+	if u.MaxSessions > 0 {
+		return u.MaxSessions
+	}
+	return udpMaxSessions
+}
+
+// the addresses of the udp listeners, changing them needs a restart
+func udpAddresses(listeners []UDPListenerConfig) []string {
+	addresses := []string{}
+	for _, u := range listeners {
+		addresses = append(addresses, u.Address)
+	}
+	return addresses
+}
+
+func validateUDP(c *Config) error {
+	http3 := make(map[string]bool)
+	for _, l := range c.effectiveListeners() {
+		if l.HTTP3 {
+			http3[l.Address] = true
+		}
+	}
+	seen := make(map[string]bool)
+	for _, u := range c.UDP {
+		if u.Address == "" {
+			return fmt.Errorf("udp: address is required")
+		}
+		if seen[u.Address] {
+			return fmt.Errorf("duplicate udp listener %s", u.Address)
+		}
+		seen[u.Address] = true
+		if http3[u.Address] {
+			return fmt.Errorf("udp %s: the port is taken by http3", u.Address)
+		}
+		if len(u.Backends) == 0 {
+			return fmt.Errorf("udp %s: no backends configured", u.Address)
+		}
+		for _, b := range u.Backends {
+			if _, port, err := net.SplitHostPort(b); err != nil || port == "" {
+				return fmt.Errorf("udp %s: backend %q must be host:port", u.Address, b)
+			}
+		}
+		if u.IdleTimeout < 0 || u.MaxSessions < 0 {
+			return fmt.Errorf("udp %s: idle_timeout and max_sessions must not be negative", u.Address)
+		}
+	}
+	return nil
+}
+
+// udpService is a running udp listener. Its config comes from the active
+// pools, so a reload changes the backends of new sessions.
+type udpService struct {
+	address string
+	conn    *net.UDPConn
+
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+
+	next atomic.Uint64
+	// backend -> time.Time until which it gets no new sessions
+	cooldown sync.Map
+
+	in, out, dropped atomic.Uint64
+}
+
+// the datagrams of one client, relayed over a socket connected to its backend
+type udpSession struct {
+	client   *net.UDPAddr
+	backend  string
+	conn     net.Conn
+	lastSeen atomic.Int64
+}
+
+// udp listener address -> *udpService, for the metrics
+var udpServices sync.Map
+
+// listen on a udp listener until it fails
+func serveUDP(address string) error {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return fmt.Errorf("udp %s: %w", address, err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return fmt.Errorf("udp %s: %w", address, err)
+	}
+	s := &udpService{address: address, conn: conn, sessions: make(map[string]*udpSession)}
+	udpServices.Store(address, s)
+	infof("Load Balancer started at: %s (udp)\n", address)
+
+	buf := make([]byte, udpMaxDatagram)
+	for {
+		n, client, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return fmt.Errorf("udp %s: %w", address, err)
+		}
+		s.in.Add(1)
+		session := s.session(client)
+		if session == nil {
+			s.dropped.Add(1)
+			continue
+		}
+		session.lastSeen.Store(time.Now().UnixNano())
+		if _, err := session.conn.Write(buf[:n]); err != nil {
+			debugf("udp %s: sending to %s failed: %s\n", address, session.backend, err)
+			s.dropped.Add(1)
+			s.closeSession(session, err)
+		}
+	}
+}
+
+// the session of a client, a new one if it has none. nil when there is no
+// room for it or its backend cant be reached.
+func (s *udpService) session(client *net.UDPAddr) *udpSession {
+	key := client.String()
+	s.mu.Lock()
+	session, ok := s.sessions[key]
+	full := len(s.sessions)
+	s.mu.Unlock()
+	if ok {
+		return session
+	}
+
+	cfg, ok := activePools.Load().udp[s.address]
+	if !ok || full >= cfg.maxSessions() {
+		return nil
+	}
+	// dialed without the lock, resolving the backend can take a while
+	backend := s.pickBackend(cfg.Backends)
+	conn, err := familyDialer(&net.Dialer{}, "")(context.Background(), "udp", backend)
+	if err != nil {
+		warnf("udp %s: cant reach %s: %s\n", s.address, backend, err)
+		s.cooldown.Store(backend, time.Now().Add(udpBackendCooldown))
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session, ok := s.sessions[key]; ok {
+		// made by someone else in the meantime
+		conn.Close()
+		return session
+	}
+	if len(s.sessions) >= cfg.maxSessions() {
+		conn.Close()
+		return nil
+	}
+	session = &udpSession{client: client, backend: backend, conn: conn}
+	session.lastSeen.Store(time.Now().UnixNano())
+	s.sessions[key] = session
+	debugf("udp %s: session %s -> %s\n", s.address, key, backend)
+	go s.relay(session, cfg.idleTimeout())
+	return session
+}
+
+// round robin over the backends that arent cooling down, or over all of
+// them when every one is
+func (s *udpService) pickBackend(backends []string) string {
+	start := s.next.Add(1)
+	for i := range backends {
+		b := backends[(start+uint64(i))%uint64(len(backends))]
+		if until, ok := s.cooldown.Load(b); !ok || time.Now().After(until.(time.Time)) {
+			return b
+		}
+	}
+	return backends[start%uint64(len(backends))]
+}
+
+// send the answers of the backend to the client until the session is idle
+// for idle or the backend refuses the datagrams
+func (s *udpService) relay(session *udpSession, idle time.Duration) {
+	buf := make([]byte, udpMaxDatagram)
+	for {
+		last := time.Unix(0, session.lastSeen.Load())
+		session.conn.SetReadDeadline(last.Add(idle))
+		n, err := session.conn.Read(buf)
+		if err != nil {
+			if isTimeout(err) && time.Since(time.Unix(0, session.lastSeen.Load())) < idle {
+				// the client sent something since the deadline was set
+				continue
+			}
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				warnf("udp %s: %s refused a datagram, no new sessions for %s\n", s.address, session.backend, udpBackendCooldown)
+				s.cooldown.Store(session.backend, time.Now().Add(udpBackendCooldown))
+			}
+			s.closeSession(session, err)
+			return
+		}
+		session.lastSeen.Store(time.Now().UnixNano())
+		if _, err := s.conn.WriteToUDP(buf[:n], session.client); err != nil {
+			debugf("udp %s: sending to %s failed: %s\n", s.address, session.client, err)
+			continue
+		}
+		s.out.Add(1)
+	}
+}
+
+func (s *udpService) closeSession(session *udpSession, reason error) {
+	s.mu.Lock()
+	key := session.client.String()
+	if s.sessions[key] == session {
+		delete(s.sessions, key)
+	}
+	s.mu.Unlock()
+	session.conn.Close()
+	if !isTimeout(reason) {
+		debugf("udp %s: session %s ended: %s\n", s.address, key, reason)
+	}
+}
+
+func writeUDPMetrics(w io.Writer) {
+	type counts struct {
+		sessions         int
+		in, out, dropped uint64
+	}
+	all := make(map[string]counts)
+	udpServices.Range(func(k, v any) bool {
+		s := v.(*udpService)
+		s.mu.Lock()
+		all[k.(string)] = counts{len(s.sessions), s.in.Load(), s.out.Load(), s.dropped.Load()}
+		s.mu.Unlock()
+		return true
+	})
+
+	writeMetricHeader(w, "lb_udp_sessions", "gauge", "Clients with an open session on the udp listener.")
+	for _, address := range sortedKeys(all) {
+		fmt.Fprintf(w, "lb_udp_sessions{listener=%q} %d\n", address, all[address].sessions)
+	}
+	writeMetricHeader(w, "lb_udp_datagrams_total", "counter", "Datagrams from clients (in) and to clients (out) on the udp listener.")
+	for _, address := range sortedKeys(all) {
+		fmt.Fprintf(w, "lb_udp_datagrams_total{listener=%q,direction=\"in\"} %d\n", address, all[address].in)
+		fmt.Fprintf(w, "lb_udp_datagrams_total{listener=%q,direction=\"out\"} %d\n", address, all[address].out)
+	}
+	writeMetricHeader(w, "lb_udp_dropped_total", "counter", "Datagrams from clients that were not delivered, no free session or backend.")
+	for _, address := range sortedKeys(all) {
+		fmt.Fprintf(w, "lb_udp_dropped_total{listener=%q} %d\n", address, all[address].dropped)
+	}
+}
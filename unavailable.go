@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// built in 503 settings, used when the backend config leaves them at 0
+const (
+	// pause after a 503 without a Retry-After header
+	defaultUnavailablePause = time.Second
+	// longest pause a Retry-After header gets
+	defaultMaxRetryAfter = 30 * time.Second
+)
+
+// a backend answered 503, the request goes to another one instead
+var errBackendUnavailable = errors.New("backend answered 503 Service Unavailable")
+
+func (b *Backend) unavailableSettings() (pause, limit time.Duration) {
+	pause, limit = b.config.UnavailablePause, b.config.MaxRetryAfter
+	if pause == 0 {
+		pause = defaultUnavailablePause
+	}
+	if limit == 0 {
+		limit = defaultMaxRetryAfter
+	}
+	return
+}
+
+// how long the backend asks to be left alone: the seconds or the date of
+// Retry-After, capped at limit, or pause without one
+func retryAfter(value string, pause, limit time.Duration) time.Duration {
+	value = strings.TrimSpace(value)
+	d := pause
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		d = time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil {
+		d = time.Until(t)
+	}
+	if d > limit {
+		d = limit
+	}
+	return d
+}
+
+// the backend answered 503: it gets no new requests for a while, like in a
+// reset storm. The request is sent to another backend when it can be sent
+// twice, whole, and there is one to take it, else the 503 goes to the client.
+// Returns errBackendUnavailable for the error handler to move the request on.
+func (b *Backend) honorUnavailable(resp *http.Response) error {
+	pause, limit := b.unavailableSettings()
+	if pause < 0 {
+		// disabled
+		return nil
+	}
+	d := retryAfter(resp.Header.Get("Retry-After"), pause, limit)
+	if d > 0 {
+		until := time.Now().Add(d)
+		b.mux.Lock()
+		if until.After(b.pausedUntil) {
+			b.pausedUntil = until
+		}
+		b.mux.Unlock()
+		b.unavailable.Add(1)
+		debugw(requestFields(resp.Request, "backend", b.URL.String(), "status", resp.StatusCode, "pause_ms", d.Milliseconds()), "%s answered 503, pausing traffic for %s\n", b.URL, d.Round(time.Millisecond))
+	}
+
+	r := resp.Request
+	route := GetRouteFromContext(r)
+	if isHedge(r) || !route.idempotent(r) || !bodyReplayable(r) || GetAttemptsFromContext(r) >= route.MaxAttempts {
+		return nil
+	}
+	pool := activePools.Load().Get(route.Pool)
+	if pool == nil || !pool.hasOther(b) {
+		return nil
+	}
+	if !globalRetryBudget.Take(activePools.Load().retryBudget) {
+		return nil
+	}
+	return fmt.Errorf("%w, retry after %s", errBackendUnavailable, d.Round(time.Millisecond))
+}
+
+// check if another backend than b can take a request now
+func (s *ServerPool) hasOther(b *Backend) bool {
+	for _, other := range s.backends {
+		if other != b && other.Available() {
+			return true
+		}
+	}
+	return false
+}
+
+// send a request the backend answered 503 to the next backend, the retry
+// budget was already taken for it
+func (b *Backend) retryUnavailable(w http.ResponseWriter, r *http.Request) {
+	attempts := GetAttemptsFromContext(r)
+	b.retries.Add(1)
+	debugw(requestFields(r, "backend", b.URL.String()), "%s(%s)%s %s answered 503, attempting retry %d on another backend\n", r.RemoteAddr, r.URL.Path, logRequest(r), b.URL, attempts)
+	releasePeerSlot(r)
+	lb(w, r.WithContext(context.WithValue(r.Context(), Attempts, attempts+1)))
+}
+
+func writeUnavailableMetrics(w io.Writer) {
+	writeMetricHeader(w, "lb_backend_unavailable_total", "counter", "503 answers of the backend that paused traffic to it.")
+	for _, pool := range activePools.Load().All() {
+		for _, b := range pool.backends {
+			fmt.Fprintf(w, "lb_backend_unavailable_total{pool=%q,backend=%q} %d\n", pool.name, b.URL.String(), b.unavailable.Load())
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listen on an address, host:port or unix:/path/to.sock for a unix domain
+// socket. A socket gets the permissions mode, or the ones of the umask when
+// mode is 0.
+func listenAddress(address string, mode os.FileMode) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, "unix:")
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+	// a socket left behind by an earlier run, anything else at the path is
+	// left alone and makes the listen fail
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+func isUnixAddress(address string) bool {
+	return strings.HasPrefix(address, "unix:")
+}
+
+// the socket_mode of a listener, 0 when it has none
+func (l ListenerConfig) socketMode() os.FileMode {
+	mode, _ := parseSocketMode(l.SocketMode)
+	return mode
+}
+
+// permissions like "0660", octal
+func parseSocketMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode == 0 || mode > 0777 {
+		return 0, fmt.Errorf("socket_mode %q must be octal permissions like 0660", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+func (l ListenerConfig) validateSocket() error {
+	if !isUnixAddress(l.Address) {
+		if l.SocketMode != "" {
+			return fmt.Errorf("listener %s: socket_mode is for unix: addresses", l.Address)
+		}
+		return nil
+	}
+	if strings.TrimPrefix(l.Address, "unix:") == "" {
+		return fmt.Errorf("listener %s: no socket path", l.Address)
+	}
+	if _, err := parseSocketMode(l.SocketMode); err != nil {
+		return fmt.Errorf("listener %s: %w", l.Address, err)
+	}
+	if l.HTTP3 || l.RedirectHTTP != "" {
+		return fmt.Errorf("listener %s: http3 and redirect_http need a tcp port", l.Address)
+	}
+	return nil
+}
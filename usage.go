@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UsageConfig is the byte accounting per tenant, api key and route, for
+// charging the traffic back to whoever sent it
+type UsageConfig struct {
+	// request header naming the tenant, and the one with the api key. Keys
+	// are counted by a hash, the key itself is never stored.
+	TenantHeader string `yaml:"tenant_header,omitempty"`
+	KeyHeader    string `yaml:"key_header,omitempty"`
+	// most tenant, key and route combinations counted, more are counted
+	// under the tenant "other"
+	MaxEntries int `yaml:"max_entries"`
+
+	// every interval the usage of the interval is appended to file (csv, or
+	// a json object per line when it ends in .json or .jsonl) and posted to
+	// url as json, both are optional
+	Interval time.Duration `yaml:"interval"`
+	File     string        `yaml:"file,omitempty"`
+	URL      string        `yaml:"url,omitempty"`
+	// bearer token for url, can be a secret reference
+	Token string `yaml:"token,omitempty"`
+}
+
+func defaultUsageConfig() UsageConfig {
+	return UsageConfig{MaxEntries: 10000, Interval: time.Minute}
+}
+
+func (u UsageConfig) Validate() error {
+	if u.TenantHeader != "" && !validHeaderName(u.TenantHeader) {
+		return fmt.Errorf("usage: tenant_header %q is not a valid header name", u.TenantHeader)
+	}
+	if u.KeyHeader != "" && !validHeaderName(u.KeyHeader) {
+		return fmt.Errorf("usage: key_header %q is not a valid header name", u.KeyHeader)
+	}
+	if u.MaxEntries < 1 {
+		return fmt.Errorf("usage: max_entries must be at least 1")
+	}
+	if u.Interval < time.Second {
+		return fmt.Errorf("usage: interval must be at least 1s")
+	}
+	if u.URL != "" && !strings.HasPrefix(u.URL, "http://") && !strings.HasPrefix(u.URL, "https://") {
+		return fmt.Errorf("usage: url must be http or https")
+	}
+	return nil
+}
+
+type usageKey struct {
+	Tenant string `json:"tenant"`
+	Key    string `json:"key"`
+	Route  string `json:"route"`
+}
+
+type usageCounters struct {
+	requests, bytesIn, bytesOut atomic.Uint64
+}
+
+type usageJSON struct {
+	usageKey
+	Requests uint64 `json:"requests"`
+	// request and response bodies, headers are not counted
+	BytesIn  uint64 `json:"bytes_in"`
+	BytesOut uint64 `json:"bytes_out"`
+}
+
+// usage since the start, outside of the pools so it survives a reload
+var (
+	usage        sync.Map
+	usageEntries atomic.Int64
+)
+
+// the tenant and the key id of a request, "-" when it has none
+func (u UsageConfig) identify(r *http.Request) (string, string) {
+	tenant, key := "-", "-"
+	if u.TenantHeader != "" {
+		if v := r.Header.Get(u.TenantHeader); v != "" {
+			tenant = v
+		}
+	}
+	if u.KeyHeader != "" {
+		if v := r.Header.Get(u.KeyHeader); v != "" {
+			sum := sha256.Sum256([]byte(v))
+			key = hex.EncodeToString(sum[:6])
+		}
+	}
+	return tenant, key
+}
+
+func countUsage(u UsageConfig, k usageKey, in, out int64) {
+	c, ok := usage.Load(k)
+	if !ok {
+		if usageEntries.Load() >= int64(u.MaxEntries) {
+			k = usageKey{Tenant: "other", Key: "-", Route: "-"}
+		}
+		var loaded bool
+		if c, loaded = usage.LoadOrStore(k, new(usageCounters)); !loaded {
+			usageEntries.Add(1)
+		}
+	}
+	counters := c.(*usageCounters)
+	counters.requests.Add(1)
+	counters.bytesIn.Add(uint64(in))
+	counters.bytesOut.Add(uint64(out))
+}
+
+// the usage since the start, sorted by tenant, key and route
+func usageTotals() []usageJSON {
+	var list []usageJSON
+	usage.Range(func(k, v interface{}) bool {
+		c := v.(*usageCounters)
+		list = append(list, usageJSON{
+			usageKey: k.(usageKey),
+			Requests: c.requests.Load(),
+			BytesIn:  c.bytesIn.Load(),
+			BytesOut: c.bytesOut.Load(),
+		})
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i].usageKey, list[j].usageKey
+		if a.Tenant != b.Tenant {
+			return a.Tenant < b.Tenant
+		}
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		return a.Route < b.Route
+	})
+	return list
+}
+
+// countingBody counts the bytes of the request body the backend gets
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// GET /admin/usage, ?format=csv for a spreadsheet
+func handleUsage(w http.ResponseWriter, req *http.Request) {
+	list := usageTotals()
+	if req.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		writeUsageCSV(w, list, time.Time{}, true)
+		return
+	}
+	if list == nil {
+		list = []usageJSON{}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// the csv rows of a usage list, prefixed with at when it is set
+func writeUsageCSV(w io.Writer, list []usageJSON, at time.Time, header bool) error {
+	cw := csv.NewWriter(w)
+	if header {
+		row := []string{"tenant", "key", "route", "requests", "bytes_in", "bytes_out"}
+		if !at.IsZero() {
+			row = append([]string{"time"}, row...)
+		}
+		cw.Write(row)
+	}
+	for _, u := range list {
+		row := []string{u.Tenant, u.Key, u.Route,
+			strconv.FormatUint(u.Requests, 10), strconv.FormatUint(u.BytesIn, 10), strconv.FormatUint(u.BytesOut, 10)}
+		if !at.IsZero() {
+			row = append([]string{at.UTC().Format(time.RFC3339)}, row...)
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// the usage of one interval
+type usageReport struct {
+	Start time.Time   `json:"start"`
+	End   time.Time   `json:"end"`
+	Usage []usageJSON `json:"usage"`
+}
+
+// what changed between two totals, entries without requests are left out
+func usageDelta(prev map[usageKey]usageJSON, list []usageJSON) []usageJSON {
+	var delta []usageJSON
+	for _, u := range list {
+		p := prev[u.usageKey]
+		if u.Requests == p.Requests {
+			continue
+		}
+		delta = append(delta, usageJSON{
+			usageKey: u.usageKey,
+			Requests: u.Requests - p.Requests,
+			BytesIn:  u.BytesIn - p.BytesIn,
+			BytesOut: u.BytesOut - p.BytesOut,
+		})
+	}
+	return delta
+}
+
+// every interval write the usage of the interval to the file and the url of
+// the config. A report that couldnt be delivered is part of the next one, so
+// nothing is lost while the receiver is down.
+func exportUsage(r *reloader) {
+	sent := map[string]map[usageKey]usageJSON{"file": {}, "url": {}}
+	start := map[string]time.Time{"file": time.Now(), "url": time.Now()}
+	for {
+		u := r.Current().Usage
+		time.Sleep(u.Interval)
+		u = r.Current().Usage
+		now := time.Now()
+		list := usageTotals()
+
+		if u.File != "" {
+			if delta := usageDelta(sent["file"], list); len(delta) > 0 {
+				if err := appendUsageFile(u.File, usageReport{start["file"], now, delta}); err != nil {
+					warnf("Writing the usage to %s failed: %s\n", u.File, err)
+				} else {
+					sent["file"], start["file"] = usageIndex(list), now
+				}
+			}
+		}
+		if u.URL != "" {
+			if delta := usageDelta(sent["url"], list); len(delta) > 0 {
+				if err := postUsage(u, usageReport{start["url"], now, delta}); err != nil {
+					warnf("Posting the usage to %s failed: %s\n", redactURL(u.URL), err)
+				} else {
+					sent["url"], start["url"] = usageIndex(list), now
+				}
+			}
+		}
+	}
+}
+
+func usageIndex(list []usageJSON) map[usageKey]usageJSON {
+	m := make(map[usageKey]usageJSON, len(list))
+	for _, u := range list {
+		m[u.usageKey] = u
+	}
+	return m
+}
+
+func appendUsageFile(path string, report usageReport) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if strings.HasSuffix(path, ".json") || strings.HasSuffix(path, ".jsonl") {
+		return json.NewEncoder(f).Encode(report)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return writeUsageCSV(f, report.Usage, report.End, info.Size() == 0)
+}
+
+func postUsage(u UsageConfig, report usageReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), u.Interval)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if u.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+u.Token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// lb validate -config lb.yaml
+// check the config without starting the listener, exits non zero on errors
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to the yaml config file")
+	resolve := fs.Bool("resolve", true, "Check that backend hostnames resolve")
+	fs.Parse(args)
+
+	if *configPath == "" {
+		fmt.Fprintln(os.Stderr, "validate: -config is required")
+		return 2
+	}
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	errs := 0
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", *configPath, err)
+		errs++
+	}
+
+	if *resolve {
+		activeResolver.Store(newDNSResolver(cfg.Resolver))
+		for name, pc := range cfg.effectivePools() {
+			for _, bc := range cfg.poolBackends(pc) {
+				u, err := parseBackendURL(bc.URL)
+				if err != nil {
+					// already reported by Validate
+					continue
+				}
+				if bc.EgressProxy != "" {
+					// the name may only be resolvable on the other side of the proxy
+					continue
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				_, err = lookupIPAddr(ctx, u.Hostname())
+				cancel()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s: pool %s: backend %s: %s\n", *configPath, name, u, err)
+					errs++
+				}
+			}
+		}
+	}
+
+	if errs > 0 {
+		return 1
+	}
+	backends := 0
+	pools := cfg.effectivePools()
+	for _, pc := range pools {
+		backends += len(pc.Backends)
+	}
+	fmt.Printf("%s: ok (%d pools, %d backends)\n", *configPath, len(pools), backends)
+	return 0
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WatchdogConfig watches the load balancer itself. A problem that lasts
+// escalates through the steps of the policy, e.g. log right away, call a
+// webhook after 30s, fail the readiness check after a minute and exit after
+// five so the supervisor restarts the process.
+type WatchdogConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	// a check running this much later than due means the process stalled
+	// (gc pauses, cpu starvation, a stuck scheduler)
+	StallThreshold time.Duration `yaml:"stall_threshold"`
+	MaxGoroutines  int           `yaml:"max_goroutines"`
+	// gets a json POST for the webhook action
+	Webhook string         `yaml:"webhook,omitempty"`
+	Policy  []WatchdogStep `yaml:"policy"`
+}
+
+// WatchdogStep is an action taken once a problem has lasted After
+type WatchdogStep struct {
+	// log, webhook, unready or exit
+	Action string        `yaml:"action"`
+	After  time.Duration `yaml:"after"`
+}
+
+var watchdogActions = map[string]bool{"log": true, "webhook": true, "unready": true, "exit": true}
+
+func defaultWatchdogConfig() WatchdogConfig {
+	return WatchdogConfig{
+		Interval:       time.Second,
+		StallThreshold: 2 * time.Second,
+		MaxGoroutines:  10000,
+		Policy:         []WatchdogStep{{Action: "log"}},
+	}
+}
+
+func (c *Config) validateWatchdog() error {
+	w := c.Watchdog
+	if w.Interval <= 0 || w.StallThreshold <= 0 {
+		return fmt.Errorf("watchdog: interval and stall_threshold must be positive")
+	}
+	if w.MaxGoroutines < 1 {
+		return fmt.Errorf("watchdog: max_goroutines must be at least 1")
+	}
+	for _, step := range w.Policy {
+		if !watchdogActions[step.Action] {
+			return fmt.Errorf("watchdog: unknown action %q", step.Action)
+		}
+		if step.After < 0 {
+			return fmt.Errorf("watchdog: %s: after must not be negative", step.Action)
+		}
+		if step.Action == "webhook" && w.Webhook == "" {
+			return fmt.Errorf("watchdog: the webhook action needs webhook")
+		}
+		if step.Action == "unready" && !c.Admin.Enabled {
+			return fmt.Errorf("watchdog: the unready action needs the admin api")
+		}
+	}
+	return nil
+}
+
+// not ready while the watchdog says so, see GET /admin/ready
+var watchdogUnready atomic.Bool
+
+// watchdog state, guarded by mu
+type watchdog struct {
+	mu sync.Mutex
+	// kind (stall, goroutines, listeners) -> what was seen
+	problems map[string]watchdogProblem
+	// actions already taken since the problems started
+	taken map[string]bool
+}
+
+type watchdogProblem struct {
+	detail string
+	since  time.Time
+}
+
+var selfWatchdog = &watchdog{taken: make(map[string]bool)}
+
+// check the process every interval, runs for the lifetime of the process
+// and does nothing while the watchdog is disabled
+func watchProcess(r *reloader) {
+	last := time.Now()
+	for {
+		cfg := r.Current()
+		time.Sleep(cfg.Watchdog.Interval)
+		now := time.Now()
+		late := now.Sub(last) - cfg.Watchdog.Interval
+		last = now
+		if !cfg.Watchdog.Enabled {
+			selfWatchdog.clear()
+			continue
+		}
+
+		found := make(map[string]string)
+		if late > cfg.Watchdog.StallThreshold {
+			found["stall"] = fmt.Sprintf("stalled for %s", late.Round(time.Millisecond))
+		}
+		if n := runtime.NumGoroutine(); n > cfg.Watchdog.MaxGoroutines {
+			found["goroutines"] = fmt.Sprintf("%d goroutines (max %d)", n, cfg.Watchdog.MaxGoroutines)
+		}
+		if err := listenersReachable(cfg, cfg.Watchdog.Interval); err != nil {
+			found["listeners"] = err.Error()
+		}
+		selfWatchdog.update(cfg.Watchdog, found, now)
+	}
+}
+
+// dial every listener, an error when none of them accepts connections
+func listenersReachable(cfg *Config, timeout time.Duration) error {
+	var errs []string
+	listeners := cfg.effectiveListeners()
+	for _, l := range listeners {
+		network, addr := "unix", strings.TrimPrefix(l.Address, "unix:")
+		if !isUnixAddress(l.Address) {
+			host, port, err := net.SplitHostPort(l.Address)
+			if err != nil {
+				continue
+			}
+			if host == "" || host == "0.0.0.0" || host == "::" {
+				host = "localhost"
+			}
+			network, addr = "tcp", net.JoinHostPort(host, port)
+		}
+		conn, err := net.DialTimeout(network, addr, timeout)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		conn.Close()
+	}
+	if len(listeners) > 0 && len(errs) == len(listeners) {
+		return fmt.Errorf("no listener accepts connections: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (wd *watchdog) update(cfg WatchdogConfig, found map[string]string, now time.Time) {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+
+	if len(found) == 0 {
+		if len(wd.problems) > 0 {
+			infof("Watchdog: recovered\n")
+		}
+		wd.clear0()
+		return
+	}
+	current := make(map[string]watchdogProblem)
+	for kind, detail := range found {
+		since := now
+		if old, ok := wd.problems[kind]; ok {
+			since = old.since
+		}
+		current[kind] = watchdogProblem{detail: detail, since: since}
+	}
+	wd.problems = current
+
+	// escalate on the oldest problem
+	oldest := now
+	var details []string
+	for _, p := range current {
+		if p.since.Before(oldest) {
+			oldest = p.since
+		}
+		details = append(details, p.detail)
+	}
+	sort.Strings(details)
+	lasted := now.Sub(oldest)
+	for _, step := range cfg.Policy {
+		if wd.taken[step.Action] || lasted < step.After {
+			continue
+		}
+		wd.taken[step.Action] = true
+		wd.act(cfg, step.Action, details, oldest)
+	}
+}
+
+func (wd *watchdog) act(cfg WatchdogConfig, action string, problems []string, since time.Time) {
+	switch action {
+	case "log":
+		warnf("Watchdog: %s\n", strings.Join(problems, ", "))
+	case "webhook":
+		go postWatchdogWebhook(cfg.Webhook, problems, since)
+	case "unready":
+		warnf("Watchdog: reporting not ready: %s\n", strings.Join(problems, ", "))
+		watchdogUnready.Store(true)
+	case "exit":
+		errorf("Watchdog: exiting for a restart: %s\n", strings.Join(problems, ", "))
+		os.Exit(3)
+	}
+}
+
+func postWatchdogWebhook(url string, problems []string, since time.Time) {
+	hostname, _ := os.Hostname()
+	body, _ := json.Marshal(map[string]interface{}{
+		"host":     hostname,
+		"problems": problems,
+		"since":    since,
+	})
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		warnf("Watchdog: webhook failed: %s\n", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		warnf("Watchdog: webhook answered %s\n", resp.Status)
+	}
+}
+
+func (wd *watchdog) clear() {
+	wd.mu.Lock()
+	wd.clear0()
+	wd.mu.Unlock()
+}
+
+// called with mu held
+func (wd *watchdog) clear0() {
+	wd.problems = make(map[string]watchdogProblem)
+	wd.taken = make(map[string]bool)
+	watchdogUnready.Store(false)
+}
+
+// GET /admin/ready, 503 while the watchdog takes the process out
+func handleReady(w http.ResponseWriter, req *http.Request) {
+	if watchdogUnready.Load() {
+		writeError(w, http.StatusServiceUnavailable, "not ready")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+// GET /admin/watchdog, the problems seen and the actions taken for them
+func handleWatchdog(w http.ResponseWriter, req *http.Request) {
+	selfWatchdog.mu.Lock()
+	defer selfWatchdog.mu.Unlock()
+	type problemJSON struct {
+		Problem string    `json:"problem"`
+		Since   time.Time `json:"since"`
+	}
+	problems := []problemJSON{}
+	for _, p := range selfWatchdog.problems {
+		problems = append(problems, problemJSON{p.detail, p.since})
+	}
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Problem < problems[j].Problem })
+	taken := []string{}
+	for action := range selfWatchdog.taken {
+		taken = append(taken, action)
+	}
+	sort.Strings(taken)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"problems": problems,
+		"actions":  taken,
+		"ready":    !watchdogUnready.Load(),
+	})
+}
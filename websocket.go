@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// a backend switched the protocols of a request (101), from now on the
+// proxy copies bytes both ways over the connection to that backend until
+// one side closes it. Count the connection on the backend while it is open.
+func (b *Backend) trackUpgrade(resp *http.Response) {
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		// the proxy answers 502 for this itself
+		return
+	}
+	b.websockets.Add(1)
+	b.websocketsTotal.Add(1)
+	debugw(requestFields(resp.Request, "backend", b.URL.String(), "status", resp.StatusCode), "%s%s websocket %s opened\n", b.URL, logRequest(resp.Request), resp.Request.URL.Path)
+	resp.Body = &upgradedConn{ReadWriteCloser: conn, backend: b, path: resp.Request.URL.Path, opened: time.Now()}
+}
+
+// upgradedConn is the connection to the backend of a websocket, the proxy
+// closes it when either side is done
+type upgradedConn struct {
+	io.ReadWriteCloser
+	backend *Backend
+	path    string
+	opened  time.Time
+	once    sync.Once
+}
+
+func (c *upgradedConn) Close() error {
+	c.once.Do(func() {
+		c.backend.websockets.Add(-1)
+		took := time.Since(c.opened)
+		debugw([]any{"backend", c.backend.URL.String(), "path", c.path, "duration_ms", took.Milliseconds()}, "%s websocket %s closed after %s\n", c.backend.URL, c.path, took.Round(time.Millisecond))
+	})
+	return c.ReadWriteCloser.Close()
+}
+
+func writeWebSocketMetrics(w io.Writer) {
+	writeMetricHeader(w, "lb_backend_websockets", "gauge", "Websocket connections open to the backend.")
+	for _, pool := range activePools.Load().All() {
+		for _, b := range pool.backends {
+			fmt.Fprintf(w, "lb_backend_websockets{pool=%q,backend=%q} %d\n", pool.name, b.URL.String(), b.websockets.Load())
+		}
+	}
+	writeMetricHeader(w, "lb_backend_websockets_total", "counter", "Websocket connections opened to the backend.")
+	for _, pool := range activePools.Load().All() {
+		for _, b := range pool.backends {
+			fmt.Fprintf(w, "lb_backend_websockets_total{pool=%q,backend=%q} %d\n", pool.name, b.URL.String(), b.websocketsTotal.Load())
+		}
+	}
+}